@@ -3,7 +3,10 @@ package main
 import (
 	"context"
 	"log"
+	"net/http"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/christopherjohns/chatsphere/internal/server"
@@ -28,9 +31,163 @@ func main() {
 		opts = append(opts, server.WithRedis(rdb))
 	}
 
+	if adminKey := os.Getenv("ADMIN_KEY"); adminKey != "" {
+		opts = append(opts, server.WithAdminKey(adminKey))
+	}
+
+	if webhookURL := os.Getenv("WEBHOOK_URL"); webhookURL != "" {
+		opts = append(opts, server.WithWebhook(webhookURL))
+	}
+
+	if baseURL := os.Getenv("PUBLIC_BASE_URL"); baseURL != "" {
+		opts = append(opts, server.WithPublicBaseURL(baseURL))
+	}
+
+	if os.Getenv("BATCH_WRITES") == "1" {
+		opts = append(opts, server.WithBatching())
+	}
+
+	if os.Getenv("DISABLE_EDITING") == "1" {
+		opts = append(opts, server.WithoutEditing())
+	}
+
+	if os.Getenv("STRICT_PROTOCOL") == "1" {
+		opts = append(opts, server.WithStrictProtocol())
+	}
+
+	if os.Getenv("EVICT_DUPLICATE_SESSIONS") == "1" {
+		opts = append(opts, server.WithEvictDuplicateSessions())
+	}
+
+	if os.Getenv("DISABLE_ATTACHMENTS") == "1" {
+		opts = append(opts, server.WithoutAttachments())
+	}
+
+	if v := os.Getenv("IDLE_TIMEOUT"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			log.Fatalf("Invalid IDLE_TIMEOUT %q: must be a duration such as 5m", v)
+		}
+		opts = append(opts, server.WithIdleTimeout(d))
+	}
+
+	if v := os.Getenv("LEAVE_GRACE"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			log.Fatalf("Invalid LEAVE_GRACE %q: must be a duration such as 5s", v)
+		}
+		opts = append(opts, server.WithLeaveGrace(d))
+	}
+
+	if v := os.Getenv("CLOCK_OFFSET"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			log.Fatalf("Invalid CLOCK_OFFSET %q: must be a duration such as 1.5s or -200ms", v)
+		}
+		opts = append(opts, server.WithClockOffset(d))
+	}
+
+	if v := os.Getenv("MAX_CONNS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			log.Fatalf("Invalid MAX_CONNS %q: must be a non-negative integer", v)
+		}
+		opts = append(opts, server.WithMaxConns(n))
+	}
+
+	if v := os.Getenv("REAP_INTERVAL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			log.Fatalf("Invalid REAP_INTERVAL %q: must be a positive duration such as 30s", v)
+		}
+		opts = append(opts, server.WithReapInterval(d))
+	}
+
+	if v := os.Getenv("MAX_ROOMS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			log.Fatalf("Invalid MAX_ROOMS %q: must be a non-negative integer", v)
+		}
+		opts = append(opts, server.WithMaxRooms(n))
+	}
+
+	if v := os.Getenv("MAX_ROOMS_PER_USER"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			log.Fatalf("Invalid MAX_ROOMS_PER_USER %q: must be a non-negative integer", v)
+		}
+		opts = append(opts, server.WithMaxRoomsPerUser(n))
+	}
+
+	domain, sameSite := os.Getenv("COOKIE_DOMAIN"), os.Getenv("COOKIE_SAMESITE")
+	maxAge, secure := os.Getenv("COOKIE_MAX_AGE"), os.Getenv("COOKIE_SECURE")
+	if domain != "" || sameSite != "" || maxAge != "" || secure != "" {
+		mode := http.SameSiteLaxMode
+		switch strings.ToLower(sameSite) {
+		case "", "lax":
+		case "strict":
+			mode = http.SameSiteStrictMode
+		case "none":
+			mode = http.SameSiteNoneMode
+		default:
+			log.Fatalf("Invalid COOKIE_SAMESITE %q: must be lax, strict or none", sameSite)
+		}
+		age := 86400
+		if maxAge != "" {
+			n, err := strconv.Atoi(maxAge)
+			if err != nil || n < 0 {
+				log.Fatalf("Invalid COOKIE_MAX_AGE %q: must be a non-negative number of seconds", maxAge)
+			}
+			age = n
+		}
+		opts = append(opts, server.WithCookieOptions(domain, mode, age, secure == "1"))
+	}
+
+	if v := os.Getenv("ARCHIVE_TTL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			log.Fatalf("Invalid ARCHIVE_TTL %q: must be a duration such as 720h", v)
+		}
+		opts = append(opts, server.WithArchive(d))
+	}
+
+	if v := os.Getenv("ROOM_FLOOD_LIMIT"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			log.Fatalf("Invalid ROOM_FLOOD_LIMIT %q: must be a non-negative integer", v)
+		}
+		opts = append(opts, server.WithRoomFloodLimit(n, time.Second))
+	}
+
+	if v := os.Getenv("RENAME_BROADCAST_LIMIT"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			log.Fatalf("Invalid RENAME_BROADCAST_LIMIT %q: must be a non-negative integer", v)
+		}
+		opts = append(opts, server.WithRenameBroadcastLimit(n, time.Minute))
+	}
+
+	if os.Getenv("LINK_PREVIEWS") == "1" {
+		opts = append(opts, server.WithLinkPreviews(
+			splitList(os.Getenv("LINK_PREVIEW_ALLOW")),
+			splitList(os.Getenv("LINK_PREVIEW_DENY")),
+		))
+	}
+
 	srv := server.New(addr, opts...)
 	log.Printf("Starting ChatSphere server on %s", addr)
 	if err := srv.Run(); err != nil {
 		log.Fatalf("Server error: %v", err)
 	}
 }
+
+// splitList splits a comma-separated environment value, dropping empty items.
+func splitList(v string) []string {
+	var items []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -4,12 +4,14 @@ go 1.25.6
 
 require gopkg.in/yaml.v3 v3.0.1
 
-require nhooyr.io/websocket v1.8.17
+require (
+	github.com/alicebob/miniredis/v2 v2.36.1
+	github.com/redis/go-redis/v9 v9.17.3
+	nhooyr.io/websocket v1.8.17
+)
 
 require (
-	github.com/alicebob/miniredis/v2 v2.36.1 // indirect
 	github.com/cespare/xxhash/v2 v2.3.0 // indirect
 	github.com/dgryski/go-rendezvous v0.0.0-20200823014737-9f7001d12a5f // indirect
-	github.com/redis/go-redis/v9 v9.17.3 // indirect
 	github.com/yuin/gopher-lua v1.1.1 // indirect
 )
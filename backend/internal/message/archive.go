@@ -0,0 +1,77 @@
+package message
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// archiveKey returns the Redis key for a room's archived transcript.
+func archiveKey(roomID string) string {
+	return "room:" + roomID + ":archive"
+}
+
+// Transcript is the final message history of a room, saved when it expires.
+type Transcript struct {
+	RoomID     string     `json:"room_id"`
+	ArchivedAt time.Time  `json:"archived_at"`
+	Messages   []*Message `json:"messages"`
+}
+
+// Archive keeps transcripts of expired rooms in Redis, each under its own
+// key that expires after ttl.
+type Archive struct {
+	client redis.Cmdable
+	ttl    time.Duration
+}
+
+// NewArchive creates an Archive that retains transcripts for ttl.
+func NewArchive(client redis.Cmdable, ttl time.Duration) *Archive {
+	return &Archive{
+		client: client,
+		ttl:    ttl,
+	}
+}
+
+// Save stores msgs as the room's transcript, replacing any earlier one.
+func (a *Archive) Save(roomID string, msgs []*Message) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	data, err := json.Marshal(Transcript{
+		RoomID:     roomID,
+		ArchivedAt: time.Now(),
+		Messages:   msgs,
+	})
+	if err != nil {
+		log.Printf("redis: failed to marshal transcript: %v", err)
+		return
+	}
+	if err := a.client.Set(ctx, archiveKey(roomID), data, a.ttl).Err(); err != nil {
+		log.Printf("redis: failed to archive room %s: %v", roomID, err)
+	}
+}
+
+// Load returns the room's archived transcript, or nil if there is none.
+func (a *Archive) Load(roomID string) *Transcript {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	data, err := a.client.Get(ctx, archiveKey(roomID)).Bytes()
+	if err != nil {
+		if !errors.Is(err, redis.Nil) {
+			log.Printf("redis: failed to read transcript: %v", err)
+		}
+		return nil
+	}
+	var t Transcript
+	if err := json.Unmarshal(data, &t); err != nil {
+		log.Printf("redis: failed to unmarshal transcript: %v", err)
+		return nil
+	}
+	return &t
+}
@@ -6,33 +6,97 @@ import "time"
 type Type string
 
 const (
-	TypeChat   Type = "chat"
-	TypeSystem Type = "system"
-	TypeTyping Type = "typing"
+	TypeChat        Type = "chat"
+	TypeSystem      Type = "system"
+	TypeTyping      Type = "typing"
+	TypeTypingStop  Type = "typing_stop"
+	TypeAttachment  Type = "attachment"
+	TypeLinkPreview Type = "link_preview"
+	TypeReconnect   Type = "reconnect"
+	TypeBatch       Type = "batch"
 )
 
 // Action describes what triggered a system message.
 type Action string
 
 const (
-	ActionJoin        Action = "join"
-	ActionRejoin      Action = "rejoin"
-	ActionLeave       Action = "leave"
-	ActionKick        Action = "kick"
-	ActionBan         Action = "ban"
-	ActionMute        Action = "mute"
-	ActionExpiration  Action = "expiration"
-	ActionSetUsername Action = "set_username"
+	ActionJoin         Action = "join"
+	ActionRejoin       Action = "rejoin"
+	ActionLeave        Action = "leave"
+	ActionTimeout      Action = "timeout"
+	ActionKick         Action = "kick"
+	ActionBan          Action = "ban"
+	ActionMute         Action = "mute"
+	ActionExpiration   Action = "expiration"
+	ActionSetUsername  Action = "set_username"
+	ActionAnnouncement Action = "announcement"
+	ActionSlowMode     Action = "slow_mode"
+	ActionTopic        Action = "topic"
+	ActionReadOnly     Action = "read_only"
+	ActionMod          Action = "mod"
+	ActionKnock        Action = "knock"
 )
 
+// Format tells clients how to render a chat message's content. The server
+// only checks that it is one it knows; rendering is up to the client.
+type Format string
+
+const (
+	FormatPlain   Format = "plain"
+	FormatCode    Format = "code"
+	FormatSpoiler Format = "spoiler"
+)
+
+// Valid reports whether f is a known format. The empty format means plain.
+func (f Format) Valid() bool {
+	switch f {
+	case "", FormatPlain, FormatCode, FormatSpoiler:
+		return true
+	}
+	return false
+}
+
+// Audience says who in a room may see a chat message.
+type Audience string
+
+const (
+	AudienceAll  Audience = "all"
+	AudienceMods Audience = "mods" // only the host and moderators
+)
+
+// Valid reports whether a is a known audience. The empty audience means all.
+func (a Audience) Valid() bool {
+	switch a {
+	case "", AudienceAll, AudienceMods:
+		return true
+	}
+	return false
+}
+
 // Message represents a chat message.
 type Message struct {
-	ID        string    `json:"id"`
-	RoomID    string    `json:"room_id"`
-	UserID    string    `json:"user_id,omitempty"`
-	Username  string    `json:"username,omitempty"`
-	Content   string    `json:"content"`
-	Type      Type      `json:"type"`
-	Action    Action    `json:"action,omitempty"`
-	CreatedAt time.Time `json:"created_at"`
+	ID         string      `json:"id"`
+	RoomID     string      `json:"room_id"`
+	UserID     string      `json:"user_id,omitempty"`
+	Username   string      `json:"username,omitempty"`
+	Color      string      `json:"color,omitempty"`
+	Bot        bool        `json:"bot,omitempty"`
+	Content    string      `json:"content"`
+	Format     Format      `json:"format,omitempty"`
+	Audience   Audience    `json:"audience,omitempty"`
+	Type       Type        `json:"type"`
+	Action     Action      `json:"action,omitempty"`
+	Seq        int64       `json:"seq,omitempty"`
+	Attachment *Attachment `json:"attachment,omitempty"`
+	CreatedAt  time.Time   `json:"created_at"`
+	EditedAt   *time.Time  `json:"edited_at,omitempty"`
+}
+
+// Attachment describes a file uploaded alongside a message. The bytes are
+// held by the server under ID and fetched separately.
+type Attachment struct {
+	ID   string `json:"id"`
+	Name string `json:"name,omitempty"`
+	MIME string `json:"mime"`
+	Size int    `json:"size"`
 }
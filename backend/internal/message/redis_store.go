@@ -4,6 +4,7 @@ import (
 	"context"
 	"encoding/json"
 	"log"
+	"sync"
 	"time"
 
 	"github.com/redis/go-redis/v9"
@@ -18,6 +19,9 @@ func redisKey(roomID string) string {
 type RedisStore struct {
 	client  redis.Cmdable
 	maxSize int64
+
+	mu     sync.RWMutex
+	limits map[string]roomLimit // kept per process, like the rooms themselves
 }
 
 // NewRedisStore creates a RedisStore that retains up to maxSize messages per room.
@@ -25,11 +29,49 @@ func NewRedisStore(client redis.Cmdable, maxSize int) *RedisStore {
 	return &RedisStore{
 		client:  client,
 		maxSize: int64(maxSize),
+		limits:  make(map[string]roomLimit),
+	}
+}
+
+// capacity returns the most messages the room may hold and whether new
+// messages are refused rather than evicting old ones at that point.
+func (s *RedisStore) capacity(roomID string) (max int64, reject bool) {
+	s.mu.RLock()
+	l, ok := s.limits[roomID]
+	s.mu.RUnlock()
+	if !ok {
+		return s.maxSize, false
+	}
+	return min(int64(l.max), s.maxSize), l.policy == OverflowRejectNew
+}
+
+// SetRoomLimit caps the messages stored for a room at max, below the
+// store's own size, with policy deciding what happens once it is reached.
+// A max of 0 removes the cap.
+func (s *RedisStore) SetRoomLimit(roomID string, max int, policy OverflowPolicy) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if max <= 0 {
+		delete(s.limits, roomID)
+		return
 	}
+	s.limits[roomID] = roomLimit{max: max, policy: policy}
+}
+
+// Full reports whether a reject-new room holds as many messages as it may.
+func (s *RedisStore) Full(roomID string) bool {
+	max, reject := s.capacity(roomID)
+	return reject && int64(s.Count(roomID)) >= max
 }
 
 // Append adds a message to the room's list in Redis, trimming to maxSize.
+// In a reject-new room that is already full the message is not stored.
 func (s *RedisStore) Append(msg *Message) {
+	max, reject := s.capacity(msg.RoomID)
+	if reject && s.Full(msg.RoomID) {
+		return
+	}
+
 	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
 	defer cancel()
 
@@ -42,7 +84,7 @@ func (s *RedisStore) Append(msg *Message) {
 	key := redisKey(msg.RoomID)
 	pipe := s.client.Pipeline()
 	pipe.RPush(ctx, key, data)
-	pipe.LTrim(ctx, key, -s.maxSize, -1)
+	pipe.LTrim(ctx, key, -max, -1)
 	if _, err := pipe.Exec(ctx); err != nil {
 		log.Printf("redis: failed to append message: %v", err)
 	}
@@ -121,6 +163,18 @@ func (s *RedisStore) Before(roomID, beforeID string, n int) []*Message {
 	return nil
 }
 
+// BeforeSeq returns up to n messages whose sequence number is below seq,
+// oldest first.
+func (s *RedisStore) BeforeSeq(roomID string, seq int64, n int) []*Message {
+	return beforeSeq(s.loadAll(roomID), seq, n)
+}
+
+// AfterSeq returns all messages whose sequence number is above seq,
+// oldest first.
+func (s *RedisStore) AfterSeq(roomID string, seq int64) []*Message {
+	return afterSeq(s.loadAll(roomID), seq)
+}
+
 // Recent returns the last n messages for a room.
 func (s *RedisStore) Recent(roomID string, n int) []*Message {
 	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
@@ -147,7 +201,127 @@ func (s *RedisStore) Recent(roomID string, n int) []*Message {
 	return msgs
 }
 
-// DeleteRoom removes all stored messages for a room.
+// Search returns messages in a room whose content contains query
+// (case-insensitive), most recent first. A limit of zero or less returns
+// every match.
+func (s *RedisStore) Search(roomID, query string, limit int) []*Message {
+	return searchMessages(s.loadAll(roomID), query, limit)
+}
+
+// Range returns up to limit messages in a room created at or after since
+// and before until, oldest first. A zero since or until leaves that end of
+// the range open. A limit of zero or less returns every match.
+func (s *RedisStore) Range(roomID string, since, until time.Time, limit int) []*Message {
+	return rangeMessages(s.loadAll(roomID), since, until, limit)
+}
+
+// loadAll returns every stored message for a room, oldest first.
+func (s *RedisStore) loadAll(roomID string) []*Message {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	vals, err := s.client.LRange(ctx, redisKey(roomID), 0, -1).Result()
+	if err != nil {
+		log.Printf("redis: failed to read messages: %v", err)
+		return nil
+	}
+
+	msgs := make([]*Message, 0, len(vals))
+	for _, v := range vals {
+		var m Message
+		if err := json.Unmarshal([]byte(v), &m); err != nil {
+			continue
+		}
+		msgs = append(msgs, &m)
+	}
+	return msgs
+}
+
+// replaceScript swaps the first list element equal to ARGV[1] for ARGV[2].
+// Matching on the raw value rather than an index keeps the swap correct
+// when a concurrent Append trims the list between read and write.
+var replaceScript = redis.NewScript(`
+local vals = redis.call('LRANGE', KEYS[1], 0, -1)
+for i, v in ipairs(vals) do
+	if v == ARGV[1] then
+		redis.call('LSET', KEYS[1], i - 1, ARGV[2])
+		return 1
+	end
+end
+return 0
+`)
+
+// Edit replaces the content of a chat message authored by userID and
+// stamps it with editedAt. It returns the updated message, or nil if no
+// matching message was found.
+func (s *RedisStore) Edit(roomID, msgID, userID, content string, editedAt time.Time) *Message {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	key := redisKey(roomID)
+	vals, err := s.client.LRange(ctx, key, 0, -1).Result()
+	if err != nil {
+		log.Printf("redis: failed to read messages: %v", err)
+		return nil
+	}
+
+	for _, v := range vals {
+		var m Message
+		if err := json.Unmarshal([]byte(v), &m); err != nil || m.ID != msgID {
+			continue
+		}
+		if !editable(&m, userID) {
+			return nil
+		}
+		m.Content = content
+		m.EditedAt = &editedAt
+		data, err := json.Marshal(&m)
+		if err != nil {
+			log.Printf("redis: failed to marshal message: %v", err)
+			return nil
+		}
+		n, err := replaceScript.Run(ctx, s.client, []string{key}, v, data).Int()
+		if err != nil {
+			log.Printf("redis: failed to edit message: %v", err)
+			return nil
+		}
+		if n == 0 {
+			// Trimmed or edited concurrently.
+			return nil
+		}
+		return &m
+	}
+	return nil
+}
+
+// Delete removes one message from a room's list, freeing its slot. It
+// reports whether the message was found.
+func (s *RedisStore) Delete(roomID, msgID string) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	key := redisKey(roomID)
+	vals, err := s.client.LRange(ctx, key, 0, -1).Result()
+	if err != nil {
+		log.Printf("redis: failed to read messages: %v", err)
+		return false
+	}
+	for _, v := range vals {
+		var m Message
+		if err := json.Unmarshal([]byte(v), &m); err != nil || m.ID != msgID {
+			continue
+		}
+		n, err := s.client.LRem(ctx, key, 1, v).Result()
+		if err != nil {
+			log.Printf("redis: failed to delete message: %v", err)
+			return false
+		}
+		return n > 0
+	}
+	return false
+}
+
+// DeleteRoom removes all stored messages for a room, and its limit.
 func (s *RedisStore) DeleteRoom(roomID string) {
 	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
 	defer cancel()
@@ -155,6 +329,9 @@ func (s *RedisStore) DeleteRoom(roomID string) {
 	if err := s.client.Del(ctx, redisKey(roomID)).Err(); err != nil {
 		log.Printf("redis: failed to delete room messages: %v", err)
 	}
+	s.mu.Lock()
+	delete(s.limits, roomID)
+	s.mu.Unlock()
 }
 
 // Count returns the number of stored messages for a room.
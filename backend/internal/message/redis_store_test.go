@@ -288,3 +288,118 @@ func TestRedisStoreImplementsInterface(t *testing.T) {
 	s, _ := newTestRedisStore(t, 100)
 	var _ MessageStore = s
 }
+
+func TestRedisStoreRoomLimit(t *testing.T) {
+	s, _ := newTestRedisStore(t, 100)
+	s.SetRoomLimit("drop", 2, OverflowDropOldest)
+	s.SetRoomLimit("reject", 2, OverflowRejectNew)
+
+	for i := 0; i < 4; i++ {
+		s.Append(redisMsg(fmt.Sprintf("%d", i), "drop", "hi"))
+		s.Append(redisMsg(fmt.Sprintf("%d", i), "reject", "hi"))
+	}
+	if got := ids(s.Recent("drop", 10)); fmt.Sprint(got) != "[2 3]" {
+		t.Errorf("drop-oldest: expected the newest two, got %v", got)
+	}
+	if got := ids(s.Recent("reject", 10)); fmt.Sprint(got) != "[0 1]" || !s.Full("reject") {
+		t.Errorf("reject-new: expected the first two and a full room, got %v", got)
+	}
+
+	if !s.Delete("reject", "0") || s.Full("reject") {
+		t.Fatal("expected Delete to free a slot")
+	}
+	s.Append(redisMsg("4", "reject", "hi"))
+	if got := ids(s.Recent("reject", 10)); fmt.Sprint(got) != "[1 4]" {
+		t.Errorf("expected the new message in the freed slot, got %v", got)
+	}
+}
+
+func TestRedisStoreSearch(t *testing.T) {
+	s, _ := newTestRedisStore(t, 100)
+	s.Append(redisMsg("1", "room1", "check https://example.com"))
+	s.Append(redisMsg("2", "room1", "unrelated"))
+	s.Append(redisMsg("3", "room1", "Example two"))
+
+	result := s.Search("room1", "example", 0)
+	if len(result) != 2 {
+		t.Fatalf("expected 2 matches, got %d", len(result))
+	}
+	if result[0].ID != "3" || result[1].ID != "1" {
+		t.Errorf("expected most recent first [3, 1], got [%s, %s]", result[0].ID, result[1].ID)
+	}
+}
+
+func TestRedisStoreEdit(t *testing.T) {
+	s, _ := newTestRedisStore(t, 100)
+	m := redisMsg("1", "room1", "helo")
+	m.UserID = "alice"
+	s.Append(m)
+	s.Append(redisMsg("2", "room1", "world"))
+
+	at := time.Now()
+	if got := s.Edit("room1", "1", "bob", "hijacked", at); got != nil {
+		t.Fatal("expected edit by another user to fail")
+	}
+
+	got := s.Edit("room1", "1", "alice", "hello", at)
+	if got == nil || got.Content != "hello" || got.EditedAt == nil {
+		t.Fatalf("unexpected edit result: %+v", got)
+	}
+
+	recent := s.Recent("room1", 2)
+	if len(recent) != 2 {
+		t.Fatalf("expected 2 messages, got %d", len(recent))
+	}
+	if recent[0].Content != "hello" || recent[0].EditedAt == nil {
+		t.Errorf("expected stored message to be edited, got %+v", recent[0])
+	}
+	if recent[1].Content != "world" {
+		t.Errorf("expected other messages untouched, got %q", recent[1].Content)
+	}
+}
+
+func TestRedisStoreRange(t *testing.T) {
+	s, _ := newTestRedisStore(t, 100)
+	base := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < 5; i++ {
+		m := redisMsg(string(rune('a'+i)), "room1", "hi")
+		m.CreatedAt = base.Add(time.Duration(i) * time.Minute)
+		s.Append(m)
+	}
+
+	got := s.Range("room1", base.Add(time.Minute), base.Add(3*time.Minute), 0)
+	if len(got) != 2 || got[0].ID != "b" || got[1].ID != "c" {
+		t.Fatalf("expected messages b and c, got %v", ids(got))
+	}
+	if got := s.Range("room2", time.Time{}, time.Time{}, 0); len(got) != 0 {
+		t.Errorf("expected no messages for an empty room, got %v", ids(got))
+	}
+}
+
+func TestRedisStoreBeforeSeq(t *testing.T) {
+	s, _ := newTestRedisStore(t, 100)
+	for i := 0; i < 5; i++ {
+		m := redisMsg(string(rune('a'+i)), "room1", "hi")
+		m.Seq = int64(i + 1)
+		s.Append(m)
+	}
+
+	got := s.BeforeSeq("room1", 4, 2)
+	if len(got) != 2 || got[0].ID != "b" || got[1].ID != "c" {
+		t.Fatalf("expected messages b and c, got %v", ids(got))
+	}
+}
+
+func TestRedisStoreAfterSeq(t *testing.T) {
+	s, _ := newTestRedisStore(t, 100)
+	for i := 0; i < 5; i++ {
+		m := redisMsg(string(rune('a'+i)), "room1", "hi")
+		m.Seq = int64(i + 1)
+		s.Append(m)
+	}
+
+	got := s.AfterSeq("room1", 3)
+	if len(got) != 2 || got[0].ID != "d" || got[1].ID != "e" {
+		t.Fatalf("expected messages d and e, got %v", ids(got))
+	}
+}
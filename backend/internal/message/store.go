@@ -1,44 +1,163 @@
 package message
 
-import "sync"
+import (
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
 
 // MessageStore is the interface for message persistence backends.
 type MessageStore interface {
 	Append(msg *Message)
 	After(roomID, afterID string) []*Message
 	Before(roomID, beforeID string, n int) []*Message
+	BeforeSeq(roomID string, seq int64, n int) []*Message
+	AfterSeq(roomID string, seq int64) []*Message
 	Recent(roomID string, n int) []*Message
+	Search(roomID, query string, limit int) []*Message
+	Range(roomID string, since, until time.Time, limit int) []*Message
+	Edit(roomID, msgID, userID, content string, editedAt time.Time) *Message
+	Delete(roomID, msgID string) bool
 	DeleteRoom(roomID string)
 	Count(roomID string) int
+	SetRoomLimit(roomID string, max int, policy OverflowPolicy)
+	Full(roomID string) bool
+}
+
+// OverflowPolicy decides what happens when a room with a message cap
+// reaches it.
+type OverflowPolicy string
+
+const (
+	// OverflowDropOldest evicts the oldest message to make room for each
+	// new one, as every room does at the store's size limit.
+	OverflowDropOldest OverflowPolicy = "drop-oldest"
+
+	// OverflowRejectNew keeps what is stored and refuses new messages
+	// once the room is full, for rooms whose history must stay complete.
+	OverflowRejectNew OverflowPolicy = "reject-new"
+)
+
+// Valid reports whether p is a known policy. The zero value means
+// OverflowDropOldest.
+func (p OverflowPolicy) Valid() bool {
+	return p == "" || p == OverflowDropOldest || p == OverflowRejectNew
+}
+
+// roomLimit is a per-room message cap set with SetRoomLimit.
+type roomLimit struct {
+	max    int
+	policy OverflowPolicy
 }
 
 // Store keeps recent messages per room in memory for backfill on reconnect.
 type Store struct {
-	mu      sync.RWMutex
-	rooms   map[string][]*Message
-	maxSize int
+	mu        sync.RWMutex
+	rooms     map[string][]*Message
+	maxSize   int
+	maxSystem int // 0 = system messages share maxSize with chat
+	limits    map[string]roomLimit
+}
+
+// StoreOption configures a Store.
+type StoreOption func(*Store)
+
+// WithMaxSystem keeps at most n system messages per room, dropping the
+// oldest system message when a new one goes over. A burst of joins and
+// leaves then cannot push chat out of the history. Zero, the default,
+// applies no separate limit.
+func WithMaxSystem(n int) StoreOption {
+	return func(s *Store) {
+		s.maxSystem = n
+	}
 }
 
 // NewStore creates a message store that retains up to maxSize messages per room.
-func NewStore(maxSize int) *Store {
-	return &Store{
+func NewStore(maxSize int, opts ...StoreOption) *Store {
+	s := &Store{
 		rooms:   make(map[string][]*Message),
 		maxSize: maxSize,
+		limits:  make(map[string]roomLimit),
+	}
+	for _, opt := range opts {
+		opt(s)
 	}
+	return s
 }
 
-// Append adds a message to the room's history.
+// Append adds a message to the room's history. In a reject-new room that
+// is already full the message is not stored.
 func (s *Store) Append(msg *Message) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	msgs := s.rooms[msg.RoomID]
+	max, reject := s.capacity(msg.RoomID)
+	if reject && len(msgs) >= max {
+		return
+	}
 	msgs = append(msgs, msg)
-	if len(msgs) > s.maxSize {
-		msgs = msgs[len(msgs)-s.maxSize:]
+	// A reject-new room never evicts, not even system messages.
+	if msg.Type == TypeSystem && s.maxSystem > 0 && !reject {
+		msgs = capSystem(msgs, s.maxSystem)
+	}
+	if len(msgs) > max {
+		msgs = msgs[len(msgs)-max:]
 	}
 	s.rooms[msg.RoomID] = msgs
 }
 
+// SetRoomLimit caps the messages stored for a room at max, below the
+// store's own size, with policy deciding what happens once it is reached.
+// A max of 0 removes the cap.
+func (s *Store) SetRoomLimit(roomID string, max int, policy OverflowPolicy) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if max <= 0 {
+		delete(s.limits, roomID)
+		return
+	}
+	s.limits[roomID] = roomLimit{max: max, policy: policy}
+}
+
+// Full reports whether a reject-new room holds as many messages as it may.
+func (s *Store) Full(roomID string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	max, reject := s.capacity(roomID)
+	return reject && len(s.rooms[roomID]) >= max
+}
+
+// capacity returns the most messages the room may hold and whether new
+// messages are refused rather than evicting old ones at that point. Must
+// be called with s.mu held.
+func (s *Store) capacity(roomID string) (max int, reject bool) {
+	l, ok := s.limits[roomID]
+	if !ok {
+		return s.maxSize, false
+	}
+	return min(l.max, s.maxSize), l.policy == OverflowRejectNew
+}
+
+// capSystem removes the oldest system message from msgs if it holds more
+// than max of them. It is called after each system append, so at most one
+// message is ever over.
+func capSystem(msgs []*Message, max int) []*Message {
+	n, oldest := 0, -1
+	for i, m := range msgs {
+		if m.Type == TypeSystem {
+			if oldest < 0 {
+				oldest = i
+			}
+			n++
+		}
+	}
+	if n <= max {
+		return msgs
+	}
+	return slices.Delete(msgs, oldest, oldest+1)
+}
+
 // After returns all messages in a room that were stored after the message
 // with the given ID. If afterID is empty, no messages are returned.
 func (s *Store) After(roomID, afterID string) []*Message {
@@ -86,6 +205,51 @@ func (s *Store) Before(roomID, beforeID string, n int) []*Message {
 	return nil
 }
 
+// BeforeSeq returns up to n messages whose sequence number is below seq,
+// oldest first.
+func (s *Store) BeforeSeq(roomID string, seq int64, n int) []*Message {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return beforeSeq(s.rooms[roomID], seq, n)
+}
+
+// beforeSeq returns the last n messages in msgs with a sequence number
+// below seq. Messages without a sequence number are skipped.
+func beforeSeq(msgs []*Message, seq int64, n int) []*Message {
+	end := len(msgs)
+	for end > 0 && msgs[end-1].Seq >= seq {
+		end--
+	}
+	var result []*Message
+	for i := end - 1; i >= 0 && len(result) < n; i-- {
+		if msgs[i].Seq > 0 {
+			result = append(result, msgs[i])
+		}
+	}
+	slices.Reverse(result)
+	return result
+}
+
+// AfterSeq returns all messages whose sequence number is above seq,
+// oldest first. Unlike After it still works when the message carrying seq
+// has been removed from the room's history.
+func (s *Store) AfterSeq(roomID string, seq int64) []*Message {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return afterSeq(s.rooms[roomID], seq)
+}
+
+// afterSeq returns the messages in msgs with a sequence number above seq.
+func afterSeq(msgs []*Message, seq int64) []*Message {
+	var result []*Message
+	for _, m := range msgs {
+		if m.Seq > seq {
+			result = append(result, m)
+		}
+	}
+	return result
+}
+
 // Recent returns the last n messages for a room. If fewer than n
 // messages exist, all messages are returned.
 func (s *Store) Recent(roomID string, n int) []*Message {
@@ -106,11 +270,109 @@ func (s *Store) Recent(roomID string, n int) []*Message {
 	return result
 }
 
-// DeleteRoom removes all stored messages for a room.
+// Search returns messages in a room whose content contains query
+// (case-insensitive), most recent first. A limit of zero or less returns
+// every match.
+func (s *Store) Search(roomID, query string, limit int) []*Message {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return searchMessages(s.rooms[roomID], query, limit)
+}
+
+// searchMessages scans msgs from newest to oldest for case-insensitive
+// substring matches of query.
+func searchMessages(msgs []*Message, query string, limit int) []*Message {
+	needle := strings.ToLower(query)
+	var result []*Message
+	for i := len(msgs) - 1; i >= 0; i-- {
+		if strings.Contains(strings.ToLower(msgs[i].Content), needle) {
+			result = append(result, msgs[i])
+			if limit > 0 && len(result) >= limit {
+				break
+			}
+		}
+	}
+	return result
+}
+
+// Range returns up to limit messages in a room created at or after since
+// and before until, oldest first. A zero since or until leaves that end of
+// the range open. A limit of zero or less returns every match.
+func (s *Store) Range(roomID string, since, until time.Time, limit int) []*Message {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return rangeMessages(s.rooms[roomID], since, until, limit)
+}
+
+// rangeMessages scans msgs from oldest to newest for those created within
+// [since, until).
+func rangeMessages(msgs []*Message, since, until time.Time, limit int) []*Message {
+	var result []*Message
+	for _, m := range msgs {
+		if !since.IsZero() && m.CreatedAt.Before(since) {
+			continue
+		}
+		if !until.IsZero() && !m.CreatedAt.Before(until) {
+			continue
+		}
+		result = append(result, m)
+		if limit > 0 && len(result) >= limit {
+			break
+		}
+	}
+	return result
+}
+
+// Edit replaces the content of a chat message authored by userID and
+// stamps it with editedAt. The stored message is swapped for an updated
+// copy so callers holding the old pointer never observe the change. It
+// returns the updated message, or nil if no matching message was found.
+func (s *Store) Edit(roomID, msgID, userID, content string, editedAt time.Time) *Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	msgs := s.rooms[roomID]
+	for i, m := range msgs {
+		if m.ID != msgID {
+			continue
+		}
+		if !editable(m, userID) {
+			return nil
+		}
+		updated := *m
+		updated.Content = content
+		updated.EditedAt = &editedAt
+		msgs[i] = &updated
+		return &updated
+	}
+	return nil
+}
+
+// editable reports whether userID may edit m.
+func editable(m *Message, userID string) bool {
+	return m.Type == TypeChat && m.UserID != "" && m.UserID == userID
+}
+
+// Delete removes one message from a room's history, freeing its slot. It
+// reports whether the message was found.
+func (s *Store) Delete(roomID, msgID string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	msgs := s.rooms[roomID]
+	i := slices.IndexFunc(msgs, func(m *Message) bool { return m.ID == msgID })
+	if i < 0 {
+		return false
+	}
+	s.rooms[roomID] = slices.Delete(msgs, i, i+1)
+	return true
+}
+
+// DeleteRoom removes all stored messages for a room, and its limit.
 func (s *Store) DeleteRoom(roomID string) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	delete(s.rooms, roomID)
+	delete(s.limits, roomID)
 }
 
 // Count returns the number of stored messages for a room.
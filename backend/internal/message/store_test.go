@@ -52,6 +52,55 @@ func TestStoreMaxSize(t *testing.T) {
 	}
 }
 
+func TestStoreMaxSystem(t *testing.T) {
+	s := NewStore(20, WithMaxSystem(5))
+
+	// Five chat messages, each buried under a flurry of joins and leaves.
+	for i := 0; i < 5; i++ {
+		s.Append(msg(fmt.Sprintf("chat-%d", i), "room1", fmt.Sprintf("chat %d", i)))
+		for j := 0; j < 10; j++ {
+			sys := msg(fmt.Sprintf("sys-%d-%d", i, j), "room1", "someone joined the room")
+			sys.Type = TypeSystem
+			s.Append(sys)
+		}
+	}
+
+	recent := s.Recent("room1", 20)
+	if len(recent) != 10 {
+		t.Fatalf("expected 5 chat + 5 system messages, got %d", len(recent))
+	}
+	var chats []string
+	for _, m := range recent {
+		if m.Type == TypeChat {
+			chats = append(chats, m.ID)
+		}
+	}
+	if fmt.Sprint(chats) != "[chat-0 chat-1 chat-2 chat-3 chat-4]" {
+		t.Errorf("expected every chat message kept in order, got %v", chats)
+	}
+	// The system messages kept are the newest ones.
+	if last := recent[len(recent)-1]; last.ID != "sys-4-9" {
+		t.Errorf("expected newest system message last, got %s", last.ID)
+	}
+	if first := recent[5]; first.ID != "sys-4-5" {
+		t.Errorf("expected oldest kept system message sys-4-5, got %s", first.ID)
+	}
+
+	// Without the option the same traffic pushes most chat out.
+	plain := NewStore(20)
+	for i := 0; i < 5; i++ {
+		plain.Append(msg(fmt.Sprintf("chat-%d", i), "room1", "chat"))
+		for j := 0; j < 10; j++ {
+			sys := msg(fmt.Sprintf("sys-%d-%d", i, j), "room1", "someone joined the room")
+			sys.Type = TypeSystem
+			plain.Append(sys)
+		}
+	}
+	if n := len(plain.Range("room1", time.Time{}, time.Time{}, 0)); n != 20 {
+		t.Fatalf("expected 20 messages, got %d", n)
+	}
+}
+
 func TestStoreAfterEmptyID(t *testing.T) {
 	s := NewStore(100)
 	s.Append(msg("1", "room1", "hello"))
@@ -278,3 +327,173 @@ func TestStoreAfterReturnsCopy(t *testing.T) {
 		t.Errorf("store was mutated: expected ID '2', got %q", check[0].ID)
 	}
 }
+
+func TestStoreSearch(t *testing.T) {
+	s := NewStore(100)
+	s.Append(msg("1", "room1", "check https://example.com"))
+	s.Append(msg("2", "room1", "unrelated"))
+	s.Append(msg("3", "room1", "Example two"))
+	s.Append(msg("4", "room2", "example elsewhere"))
+
+	result := s.Search("room1", "EXAMPLE", 10)
+	if len(result) != 2 {
+		t.Fatalf("expected 2 matches, got %d", len(result))
+	}
+	if result[0].ID != "3" || result[1].ID != "1" {
+		t.Errorf("expected most recent first [3, 1], got [%s, %s]", result[0].ID, result[1].ID)
+	}
+
+	if result := s.Search("room1", "example", 1); len(result) != 1 || result[0].ID != "3" {
+		t.Errorf("expected limit to keep only the newest match, got %v", result)
+	}
+	if result := s.Search("room1", "missing", 10); len(result) != 0 {
+		t.Errorf("expected no matches, got %d", len(result))
+	}
+}
+
+func TestStoreEdit(t *testing.T) {
+	s := NewStore(100)
+	m := msg("1", "room1", "helo")
+	m.UserID = "alice"
+	s.Append(m)
+	s.Append(msg("2", "room1", "world"))
+
+	at := time.Now()
+	if got := s.Edit("room1", "1", "bob", "hijacked", at); got != nil {
+		t.Fatal("expected edit by another user to fail")
+	}
+	if got := s.Edit("room1", "missing", "alice", "x", at); got != nil {
+		t.Fatal("expected edit of unknown message to fail")
+	}
+
+	got := s.Edit("room1", "1", "alice", "hello", at)
+	if got == nil || got.Content != "hello" || got.EditedAt == nil || !got.EditedAt.Equal(at) {
+		t.Fatalf("unexpected edit result: %+v", got)
+	}
+	if m.Content != "helo" || m.EditedAt != nil {
+		t.Error("expected the original pointer to be left untouched")
+	}
+	if recent := s.Recent("room1", 2); recent[0].Content != "hello" {
+		t.Errorf("expected stored content to be updated, got %q", recent[0].Content)
+	}
+}
+
+func TestStoreRange(t *testing.T) {
+	s := NewStore(100)
+	base := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < 5; i++ {
+		m := msg(fmt.Sprintf("%d", i), "room1", "hi")
+		m.CreatedAt = base.Add(time.Duration(i) * time.Minute)
+		s.Append(m)
+	}
+
+	got := s.Range("room1", base.Add(time.Minute), base.Add(3*time.Minute), 0)
+	if len(got) != 2 || got[0].ID != "1" || got[1].ID != "2" {
+		t.Fatalf("expected messages 1 and 2, got %v", ids(got))
+	}
+	if got := s.Range("room1", base.Add(2*time.Minute), time.Time{}, 2); len(got) != 2 || got[0].ID != "2" {
+		t.Errorf("expected open-ended range capped at 2 from message 2, got %v", ids(got))
+	}
+	if got := s.Range("room1", time.Time{}, base, 0); len(got) != 0 {
+		t.Errorf("expected empty range before the first message, got %v", ids(got))
+	}
+}
+
+func TestStoreBeforeSeq(t *testing.T) {
+	s := NewStore(100)
+	for i := 1; i <= 5; i++ {
+		m := msg(fmt.Sprintf("%d", i), "room1", "hi")
+		m.Seq = int64(i)
+		s.Append(m)
+	}
+
+	got := s.BeforeSeq("room1", 4, 2)
+	if len(got) != 2 || got[0].ID != "2" || got[1].ID != "3" {
+		t.Fatalf("expected messages 2 and 3, got %v", ids(got))
+	}
+	if got := s.BeforeSeq("room1", 3, 10); len(got) != 2 || got[0].ID != "1" {
+		t.Errorf("expected messages 1 and 2, got %v", ids(got))
+	}
+	if got := s.BeforeSeq("room1", 1, 10); len(got) != 0 {
+		t.Errorf("expected nothing before the first message, got %v", ids(got))
+	}
+}
+
+func TestStoreAfterSeq(t *testing.T) {
+	s := NewStore(100, WithMaxSystem(1))
+	for i := 1; i <= 4; i++ {
+		m := msg(fmt.Sprintf("%d", i), "room1", "hi")
+		m.Seq = int64(i)
+		if i == 2 || i == 3 {
+			m.Type = TypeSystem
+		}
+		s.Append(m)
+	}
+
+	// Message 2 was capped out of the middle, so After can no longer find
+	// it but AfterSeq still picks up where it left off.
+	if got := s.After("room1", "2"); got != nil {
+		t.Fatalf("expected the capped message to be gone, got %v", ids(got))
+	}
+	got := s.AfterSeq("room1", 2)
+	if len(got) != 2 || got[0].ID != "3" || got[1].ID != "4" {
+		t.Fatalf("expected messages 3 and 4, got %v", ids(got))
+	}
+	if got := s.AfterSeq("room1", 4); len(got) != 0 {
+		t.Errorf("expected nothing after the last message, got %v", ids(got))
+	}
+}
+
+func TestStoreRoomLimit(t *testing.T) {
+	s := NewStore(100)
+	s.SetRoomLimit("drop", 3, OverflowDropOldest)
+	s.SetRoomLimit("reject", 3, OverflowRejectNew)
+
+	for i := 0; i < 5; i++ {
+		s.Append(msg(fmt.Sprintf("%d", i), "drop", "hi"))
+		s.Append(msg(fmt.Sprintf("%d", i), "reject", "hi"))
+	}
+
+	if got := ids(s.Recent("drop", 10)); fmt.Sprint(got) != "[2 3 4]" {
+		t.Errorf("drop-oldest: expected the newest three, got %v", got)
+	}
+	if s.Full("drop") {
+		t.Error("a drop-oldest room is never full")
+	}
+	if got := ids(s.Recent("reject", 10)); fmt.Sprint(got) != "[0 1 2]" {
+		t.Errorf("reject-new: expected the first three, got %v", got)
+	}
+	if !s.Full("reject") {
+		t.Error("expected the reject-new room to be full")
+	}
+
+	if !s.Delete("reject", "1") {
+		t.Fatal("expected Delete to find message 1")
+	}
+	if s.Delete("reject", "1") {
+		t.Error("expected a second Delete to find nothing")
+	}
+	if s.Full("reject") {
+		t.Error("expected a slot to be free after the delete")
+	}
+	s.Append(msg("5", "reject", "hi"))
+	if got := ids(s.Recent("reject", 10)); fmt.Sprint(got) != "[0 2 5]" {
+		t.Errorf("expected the new message in the freed slot, got %v", got)
+	}
+
+	s.DeleteRoom("reject")
+	for i := 0; i < 5; i++ {
+		s.Append(msg(fmt.Sprintf("%d", i), "reject", "hi"))
+	}
+	if s.Count("reject") != 5 {
+		t.Errorf("expected DeleteRoom to clear the limit, got %d messages", s.Count("reject"))
+	}
+}
+
+func ids(msgs []*Message) []string {
+	out := make([]string, len(msgs))
+	for i, m := range msgs {
+		out[i] = m.ID
+	}
+	return out
+}
@@ -5,23 +5,32 @@ import (
 	"time"
 )
 
-// IPLimiter tracks request counts per IP within a sliding window.
+// IPLimiter tracks request counts per IP within a sliding window. It keeps
+// a log of request timestamps rather than a per-window counter, so there is
+// no burst at window boundaries.
 type IPLimiter struct {
-	mu      sync.Mutex
-	entries map[string][]time.Time
-	max     int
-	window  time.Duration
+	mu        sync.Mutex
+	entries   map[string][]time.Time
+	max       int
+	window    time.Duration
+	lastSweep time.Time
 }
 
 // NewIPLimiter creates an IPLimiter allowing max requests per window.
 func NewIPLimiter(max int, window time.Duration) *IPLimiter {
 	return &IPLimiter{
-		entries: make(map[string][]time.Time),
-		max:     max,
-		window:  window,
+		entries:   make(map[string][]time.Time),
+		max:       max,
+		window:    window,
+		lastSweep: time.Now(),
 	}
 }
 
+// Limit returns the configured maximum number of requests per window.
+func (l *IPLimiter) Limit() (max int, window time.Duration) {
+	return l.max, l.window
+}
+
 // Allow returns true if the IP has not exceeded the rate limit.
 // If allowed, the request is recorded.
 func (l *IPLimiter) Allow(ip string) bool {
@@ -31,6 +40,13 @@ func (l *IPLimiter) Allow(ip string) bool {
 	now := time.Now()
 	cutoff := now.Add(-l.window)
 
+	// Drop idle keys at most once per window so the map doesn't keep an
+	// entry for every key ever seen.
+	if now.Sub(l.lastSweep) >= l.window {
+		l.sweep(cutoff)
+		l.lastSweep = now
+	}
+
 	timestamps := l.entries[ip]
 	// Remove expired entries
 	valid := timestamps[:0]
@@ -48,3 +64,64 @@ func (l *IPLimiter) Allow(ip string) bool {
 	l.entries[ip] = append(valid, now)
 	return true
 }
+
+// Sweep removes keys whose requests have all left the window.
+func (l *IPLimiter) Sweep() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.sweep(time.Now().Add(-l.window))
+}
+
+// sweep drops keys with no request after cutoff. Must be called with l.mu held.
+func (l *IPLimiter) sweep(cutoff time.Time) {
+	for key, timestamps := range l.entries {
+		if len(timestamps) == 0 || !timestamps[len(timestamps)-1].After(cutoff) {
+			delete(l.entries, key)
+		}
+	}
+}
+
+// Len returns the number of keys currently tracked.
+func (l *IPLimiter) Len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.entries)
+}
+
+// Remaining returns how many more requests the key may make right now.
+func (l *IPLimiter) Remaining(key string) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	n := l.max - len(l.valid(key, time.Now()))
+	if n < 0 {
+		return 0
+	}
+	return n
+}
+
+// Reset returns when the key's oldest recorded request leaves the window,
+// freeing a slot. It returns the current time if the key has no requests
+// in the window.
+func (l *IPLimiter) Reset(key string) time.Time {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	valid := l.valid(key, now)
+	if len(valid) == 0 {
+		return now
+	}
+	return valid[0].Add(l.window)
+}
+
+// valid returns the key's timestamps still inside the window at now.
+// Must be called with l.mu held.
+func (l *IPLimiter) valid(key string, now time.Time) []time.Time {
+	cutoff := now.Add(-l.window)
+	timestamps := l.entries[key]
+	for i, t := range timestamps {
+		if t.After(cutoff) {
+			return timestamps[i:]
+		}
+	}
+	return nil
+}
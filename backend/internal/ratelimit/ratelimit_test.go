@@ -56,3 +56,91 @@ func TestExpiredEntriesPruned(t *testing.T) {
 		t.Fatal("should be allowed after window expires")
 	}
 }
+
+func TestNoBurstAcrossWindowBoundary(t *testing.T) {
+	const n = 5
+	window := 200 * time.Millisecond
+	l := NewIPLimiter(n, window)
+
+	// Open the window with one request, then burst n near its end and n
+	// again just after it. A fixed window would reset at the boundary and
+	// allow close to 2n in that short span; a sliding window must not.
+	l.Allow("1.2.3.4")
+	time.Sleep(150 * time.Millisecond)
+
+	allowed := 0
+	for i := 0; i < n; i++ {
+		if l.Allow("1.2.3.4") {
+			allowed++
+		}
+	}
+	time.Sleep(70 * time.Millisecond) // past the first window's end
+	for i := 0; i < n; i++ {
+		if l.Allow("1.2.3.4") {
+			allowed++
+		}
+	}
+
+	// Only the opening request has aged out, freeing a single slot.
+	if allowed != n {
+		t.Errorf("expected %d requests allowed across the boundary, got %d", n, allowed)
+	}
+}
+
+func TestRemainingAndReset(t *testing.T) {
+	l := NewIPLimiter(3, time.Hour)
+
+	if got := l.Remaining("1.2.3.4"); got != 3 {
+		t.Errorf("expected 3 remaining for unseen key, got %d", got)
+	}
+	before := time.Now()
+	if reset := l.Reset("1.2.3.4"); reset.Before(before) || reset.After(time.Now()) {
+		t.Errorf("expected reset of now for unseen key, got %s", reset)
+	}
+
+	l.Allow("1.2.3.4")
+	l.Allow("1.2.3.4")
+	if got := l.Remaining("1.2.3.4"); got != 1 {
+		t.Errorf("expected 1 remaining, got %d", got)
+	}
+	// The first request frees its slot one window after it was made.
+	if reset := l.Reset("1.2.3.4"); reset.Before(before.Add(time.Hour)) || reset.After(time.Now().Add(time.Hour)) {
+		t.Errorf("expected reset one hour after first request, got %s", reset)
+	}
+
+	l.Allow("1.2.3.4")
+	l.Allow("1.2.3.4") // denied, not recorded
+	if got := l.Remaining("1.2.3.4"); got != 0 {
+		t.Errorf("expected 0 remaining, got %d", got)
+	}
+}
+
+func TestSweepRemovesExpiredKeys(t *testing.T) {
+	l := NewIPLimiter(2, 50*time.Millisecond)
+
+	l.Allow("1.1.1.1")
+	l.Allow("2.2.2.2")
+	if got := l.Len(); got != 2 {
+		t.Fatalf("expected 2 keys, got %d", got)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	l.Sweep()
+	if got := l.Len(); got != 0 {
+		t.Errorf("expected expired keys to be swept, got %d", got)
+	}
+}
+
+func TestAllowSweepsLazily(t *testing.T) {
+	l := NewIPLimiter(2, 50*time.Millisecond)
+
+	l.Allow("1.1.1.1")
+	l.Allow("2.2.2.2")
+	time.Sleep(60 * time.Millisecond)
+
+	// A request after a full window has passed evicts the idle keys.
+	l.Allow("3.3.3.3")
+	if got := l.Len(); got != 1 {
+		t.Errorf("expected only the new key to remain, got %d", got)
+	}
+}
@@ -0,0 +1,112 @@
+package room
+
+import (
+	"errors"
+	"time"
+)
+
+// inviteCodeLength is the number of characters in an invite code. It
+// differs from codeLength so the two kinds of code can't be confused.
+const inviteCodeLength = 8
+
+// maxInvites caps the live invites one room may have at once.
+const maxInvites = 20
+
+var (
+	// ErrInviteNotFound is returned by RedeemInvite for a code no room has.
+	ErrInviteNotFound = errors.New("invite not found")
+
+	// ErrInviteExpired is returned by RedeemInvite for an invite that has
+	// expired or been used up.
+	ErrInviteExpired = errors.New("invite expired or used up")
+)
+
+// Invite is a code that leads to a private room alongside its permanent
+// code, until it expires or runs out of uses. Unlike the permanent code,
+// redeeming it does not reveal the room's code.
+type Invite struct {
+	Code      string     `json:"code"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"` // nil = never
+	MaxUses   int        `json:"max_uses,omitempty"`   // 0 = unlimited
+	Uses      int        `json:"uses"`
+}
+
+// spent reports whether the invite can no longer be used at now.
+func (inv *Invite) spent(now time.Time) bool {
+	return (inv.ExpiresAt != nil && !now.Before(*inv.ExpiresAt)) ||
+		(inv.MaxUses > 0 && inv.Uses >= inv.MaxUses)
+}
+
+// NormalizeInviteCode is NormalizeCode for invite codes.
+func NormalizeInviteCode(s string) (string, bool) {
+	return normalizeCode(s, inviteCodeLength)
+}
+
+// CreateInvite adds an invite to the room that expires after ttl and may
+// be used maxUses times. A zero ttl or maxUses means no limit of that
+// kind. It returns nil if the room already has maxInvites live invites.
+func (r *Room) CreateInvite(ttl time.Duration, maxUses int) *Invite {
+	now := r.now()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for code, inv := range r.invites {
+		if inv.spent(now) {
+			delete(r.invites, code)
+		}
+	}
+	if len(r.invites) >= maxInvites {
+		return nil
+	}
+	if r.invites == nil {
+		r.invites = make(map[string]*Invite)
+	}
+	inv := &Invite{Code: generateCodeOfLength(inviteCodeLength), MaxUses: maxUses}
+	if ttl > 0 {
+		expires := now.Add(ttl)
+		inv.ExpiresAt = &expires
+	}
+	r.invites[inv.Code] = inv
+	out := *inv
+	return &out
+}
+
+// redeemInvite counts one use of the room's invite with the given code.
+func (r *Room) redeemInvite(code string) error {
+	now := r.now()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	inv, ok := r.invites[code]
+	if !ok {
+		return ErrInviteNotFound
+	}
+	if inv.spent(now) {
+		return ErrInviteExpired
+	}
+	inv.Uses++
+	return nil
+}
+
+// RedeemInvite returns the private room an invite code belongs to and
+// counts one use of the invite. The code is normalized first; see
+// NormalizeInviteCode. It returns ErrInviteNotFound for an unknown code
+// and ErrInviteExpired for an invite that has expired or been used up.
+func (m *Manager) RedeemInvite(code string) (*Room, error) {
+	code, ok := NormalizeInviteCode(code)
+	if !ok {
+		return nil, ErrInviteNotFound
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for _, r := range m.rooms {
+		if r.Public {
+			continue
+		}
+		if err := r.redeemInvite(code); !errors.Is(err, ErrInviteNotFound) {
+			if err != nil {
+				return nil, err
+			}
+			return r, nil
+		}
+	}
+	return nil, ErrInviteNotFound
+}
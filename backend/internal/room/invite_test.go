@@ -0,0 +1,64 @@
+package room
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRoomInvites(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)}
+	m := NewManager(WithNowFunc(clock.Now))
+	r, _ := m.Create("secret", "", "user1", 10, false)
+
+	once := r.CreateInvite(0, 1)
+	hour := r.CreateInvite(time.Hour, 0)
+	if len(once.Code) != inviteCodeLength || once.Code == r.Code {
+		t.Fatalf("expected a distinct %d-character invite code, got %q", inviteCodeLength, once.Code)
+	}
+
+	if got, err := m.RedeemInvite(once.Code); err != nil || got != r {
+		t.Fatalf("expected the single-use invite to redeem, got %v, %v", got, err)
+	}
+	if _, err := m.RedeemInvite(once.Code); !errors.Is(err, ErrInviteExpired) {
+		t.Errorf("expected a used-up invite to be refused, got %v", err)
+	}
+
+	clock.Advance(59 * time.Minute)
+	for i := 0; i < 3; i++ {
+		if _, err := m.RedeemInvite(hour.Code); err != nil {
+			t.Fatalf("use %d: expected the unlimited invite to redeem, got %v", i, err)
+		}
+	}
+	clock.Advance(time.Minute)
+	if _, err := m.RedeemInvite(hour.Code); !errors.Is(err, ErrInviteExpired) {
+		t.Errorf("expected an expired invite to be refused, got %v", err)
+	}
+
+	if _, err := m.RedeemInvite("ZZZZZZZZ"); !errors.Is(err, ErrInviteNotFound) {
+		t.Errorf("expected an unknown invite to be not found, got %v", err)
+	}
+	if m.GetByCode(r.Code) != r {
+		t.Error("expected the permanent code to keep working")
+	}
+}
+
+func TestRoomInvitesLimit(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)}
+	m := NewManager(WithNowFunc(clock.Now))
+	r, _ := m.Create("secret", "", "user1", 10, false)
+
+	for i := 0; i < maxInvites; i++ {
+		if r.CreateInvite(time.Minute, 0) == nil {
+			t.Fatalf("invite %d: expected to be created", i)
+		}
+	}
+	if r.CreateInvite(time.Minute, 0) != nil {
+		t.Fatal("expected no more invites once the room has the most it may")
+	}
+	// Spent invites make way for new ones.
+	clock.Advance(time.Minute)
+	if r.CreateInvite(time.Minute, 0) == nil {
+		t.Error("expected expired invites to be pruned")
+	}
+}
@@ -3,9 +3,16 @@ package room
 import (
 	"crypto/rand"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"sort"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
+
+	"github.com/christopherjohns/chatsphere/internal/message"
+	"github.com/christopherjohns/chatsphere/internal/ratelimit"
 )
 
 // Room represents a chat room.
@@ -18,31 +25,155 @@ type Room struct {
 	Code        string    `json:"code,omitempty"`
 	CreatorID   string    `json:"creator_id"`
 	CreatedAt   time.Time `json:"created_at"`
+	Ephemeral   bool      `json:"ephemeral,omitempty"` // keep no history; set before users join
 	activeUsers atomic.Int32
-	ActiveUsers int `json:"active_users"`
+	counter     func(roomID string) int // live client count; see Manager.SetClientCounter
+	now         func() time.Time        // the owning Manager's clock
+
+	// ChatRateLimit messages per ChatRateWindowSeconds override the
+	// server-wide chat rate limit when set (see SetChatRateLimit).
+	ChatRateLimit         int `json:"chat_rate_limit,omitempty"`
+	ChatRateWindowSeconds int `json:"chat_rate_window_seconds,omitempty"`
+	chatLimiter           *ratelimit.IPLimiter
+
+	// MessageCap limits the messages stored for the room, with
+	// OverflowPolicy deciding what happens once it is reached. Zero means
+	// the store's own limit.
+	MessageCap     int                    `json:"message_cap,omitempty"`
+	OverflowPolicy message.OverflowPolicy `json:"overflow_policy,omitempty"`
+
+	peakUsers    atomic.Int32
+	messageCount atomic.Int64
 
 	mu             sync.Mutex
+	topic          string
 	lastMessageAt  time.Time
 	lastUserLeftAt time.Time
 	msgWarnSent    bool
 	emptyWarnSent  bool
+	invites        map[string]*Invite // by code; see CreateInvite
+}
+
+// Info is the JSON form of a Room, taken at a single moment.
+type Info struct {
+	ID                    string    `json:"id"`
+	Name                  string    `json:"name"`
+	Description           string    `json:"description,omitempty"`
+	Capacity              int       `json:"capacity"`
+	Public                bool      `json:"public"`
+	Code                  string    `json:"code,omitempty"`
+	CreatorID             string    `json:"creator_id"`
+	CreatedAt             time.Time `json:"created_at"`
+	Ephemeral             bool      `json:"ephemeral,omitempty"`
+	ActiveUsers           int       `json:"active_users"`
+	ChatRateLimit         int       `json:"chat_rate_limit,omitempty"`
+	ChatRateWindowSeconds int       `json:"chat_rate_window_seconds,omitempty"`
+
+	MessageCap     int                    `json:"message_cap,omitempty"`
+	OverflowPolicy message.OverflowPolicy `json:"overflow_policy,omitempty"`
+}
+
+// Info returns the room's current state, with its live active user count.
+func (r *Room) Info() Info {
+	return Info{
+		ID:                    r.ID,
+		Name:                  r.Name,
+		Description:           r.Description,
+		Capacity:              r.Capacity,
+		Public:                r.Public,
+		Code:                  r.Code,
+		CreatorID:             r.CreatorID,
+		CreatedAt:             r.CreatedAt,
+		Ephemeral:             r.Ephemeral,
+		ActiveUsers:           r.ActiveUsers(),
+		ChatRateLimit:         r.ChatRateLimit,
+		ChatRateWindowSeconds: r.ChatRateWindowSeconds,
+		MessageCap:            r.MessageCap,
+		OverflowPolicy:        r.OverflowPolicy,
+	}
 }
 
-// AddActiveUsers atomically adjusts the active user count and syncs it
-// to the exported field for JSON serialization.
+// MarshalJSON encodes the room as its Info, so the active user count is
+// read when the room is serialized rather than from a stored copy.
+func (r *Room) MarshalJSON() ([]byte, error) {
+	return json.Marshal(r.Info())
+}
+
+// ActiveUsers returns the number of users connected to the room. With a
+// client counter installed it asks the counter; otherwise it returns the
+// count kept by AddActiveUsers.
+func (r *Room) ActiveUsers() int {
+	if r.counter != nil {
+		return r.counter(r.ID)
+	}
+	return int(r.activeUsers.Load())
+}
+
+// AddActiveUsers adjusts the room's own tally of connected users, used
+// for the peak and for the count when no client counter is installed.
 func (r *Room) AddActiveUsers(delta int) {
-	r.ActiveUsers = int(r.activeUsers.Add(int32(delta)))
+	n := r.activeUsers.Add(int32(delta))
+	for {
+		peak := r.peakUsers.Load()
+		if n <= peak || r.peakUsers.CompareAndSwap(peak, n) {
+			break
+		}
+	}
+}
+
+// PeakUsers returns the highest concurrent user count the room has reached.
+func (r *Room) PeakUsers() int {
+	return int(r.peakUsers.Load())
+}
+
+// IncMessageCount records that a message was broadcast in the room.
+func (r *Room) IncMessageCount() {
+	r.messageCount.Add(1)
+}
+
+// MessageCount returns the number of messages broadcast since creation.
+func (r *Room) MessageCount() int64 {
+	return r.messageCount.Load()
+}
+
+// SetChatRateLimit overrides the chat rate limit for this room, allowing
+// n messages per window per user. Call it before users join.
+func (r *Room) SetChatRateLimit(n int, window time.Duration) {
+	r.ChatRateLimit = n
+	r.ChatRateWindowSeconds = int(window.Seconds())
+	r.chatLimiter = ratelimit.NewIPLimiter(n, window)
+}
+
+// ChatLimiter returns the room's chat rate limiter, or nil if the room
+// uses the server-wide limit.
+func (r *Room) ChatLimiter() *ratelimit.IPLimiter {
+	return r.chatLimiter
 }
 
 // IsFull returns true if the room has reached its capacity.
 func (r *Room) IsFull() bool {
-	return int(r.activeUsers.Load()) >= r.Capacity
+	return r.ActiveUsers() >= r.Capacity
+}
+
+// Topic returns the room's current topic banner, or "" if none is set.
+// Unlike Description, the topic can be changed by the host at any time.
+func (r *Room) Topic() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.topic
+}
+
+// SetTopic replaces the room's topic banner. An empty topic clears it.
+func (r *Room) SetTopic(topic string) {
+	r.mu.Lock()
+	r.topic = topic
+	r.mu.Unlock()
 }
 
 // TouchMessage records that a message was sent in this room.
 func (r *Room) TouchMessage() {
 	r.mu.Lock()
-	r.lastMessageAt = time.Now()
+	r.lastMessageAt = r.now()
 	r.msgWarnSent = false
 	r.mu.Unlock()
 }
@@ -50,7 +181,7 @@ func (r *Room) TouchMessage() {
 // TouchUserLeft records that a user left and the room became empty.
 func (r *Room) TouchUserLeft() {
 	r.mu.Lock()
-	r.lastUserLeftAt = time.Now()
+	r.lastUserLeftAt = r.now()
 	r.mu.Unlock()
 }
 
@@ -71,37 +202,74 @@ const (
 	WarnEmpty                      // Room will expire because it is empty.
 )
 
+// String returns the reason's name as used in the admin API.
+func (w WarningReason) String() string {
+	switch w {
+	case WarnMsgInactive:
+		return "inactive"
+	case WarnEmpty:
+		return "empty"
+	}
+	return "none"
+}
+
 // NeedsWarning reports whether the room is approaching expiration and a
 // warning should be sent. It returns the reason and the time remaining
 // until expiration. Each warning is sent at most once; the flag resets
-// when activity resumes (new message or user join).
+// when activity resumes (new message or user join). Call it only when
+// about to send the warning; use WarningStatus just to look.
 func (r *Room) NeedsWarning(msgTTL, msgWarn, emptyTTL, emptyWarn time.Duration, now time.Time) (WarningReason, time.Duration) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
-	// Check empty-room warning first (shorter TTL, more urgent).
-	if !r.lastUserLeftAt.IsZero() && !r.emptyWarnSent {
-		elapsed := now.Sub(r.lastUserLeftAt)
-		remaining := emptyTTL - elapsed
-		if remaining <= emptyWarn && remaining > 0 {
-			r.emptyWarnSent = true
-			return WarnEmpty, remaining
-		}
+	// The empty-room warning comes first (shorter TTL, more urgent).
+	empty, inactive := r.warningWindows(msgTTL, msgWarn, emptyTTL, emptyWarn, now)
+	if empty > 0 && !r.emptyWarnSent {
+		r.emptyWarnSent = true
+		return WarnEmpty, empty
 	}
-
-	// Check message inactivity warning.
-	if !r.lastMessageAt.IsZero() && !r.msgWarnSent {
-		elapsed := now.Sub(r.lastMessageAt)
-		remaining := msgTTL - elapsed
-		if remaining <= msgWarn && remaining > 0 {
-			r.msgWarnSent = true
-			return WarnMsgInactive, remaining
-		}
+	if inactive > 0 && !r.msgWarnSent {
+		r.msgWarnSent = true
+		return WarnMsgInactive, inactive
 	}
+	return WarnNone, 0
+}
+
+// WarningStatus reports the warning window the room is in, if any, and the
+// time remaining until expiration, like NeedsWarning but without marking
+// the warning sent. It returns the warning for as long as the room stays
+// in the window.
+func (r *Room) WarningStatus(msgTTL, msgWarn, emptyTTL, emptyWarn time.Duration, now time.Time) (WarningReason, time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
 
+	empty, inactive := r.warningWindows(msgTTL, msgWarn, emptyTTL, emptyWarn, now)
+	if empty > 0 {
+		return WarnEmpty, empty
+	}
+	if inactive > 0 {
+		return WarnMsgInactive, inactive
+	}
 	return WarnNone, 0
 }
 
+// warningWindows returns the time left until expiration in each warning
+// window the room is in, or 0 for a window it is not in. Must be called
+// with r.mu held.
+func (r *Room) warningWindows(msgTTL, msgWarn, emptyTTL, emptyWarn time.Duration, now time.Time) (empty, inactive time.Duration) {
+	if !r.lastUserLeftAt.IsZero() {
+		if remaining := emptyTTL - now.Sub(r.lastUserLeftAt); remaining <= emptyWarn && remaining > 0 {
+			empty = remaining
+		}
+	}
+	if !r.lastMessageAt.IsZero() {
+		if remaining := msgTTL - now.Sub(r.lastMessageAt); remaining <= msgWarn && remaining > 0 {
+			inactive = remaining
+		}
+	}
+	return empty, inactive
+}
+
 // Expired reports whether the room should be reaped based on inactivity.
 // A room expires if:
 //   - No messages have been sent for msgTTL, OR
@@ -132,17 +300,50 @@ func generateID() string {
 	return hex.EncodeToString(b)
 }
 
+// codeLength is the number of characters in a private room code.
+const codeLength = 6
+
+// codeCharset is the alphabet private room codes are drawn from.
+const codeCharset = "ABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+
+// NormalizeCode puts a user-entered room code in canonical form: trimmed
+// and upper-cased. It returns false if the result isn't codeLength
+// letters and digits. Every lookup by code goes through it, so a code
+// works the same wherever it is typed.
+func NormalizeCode(s string) (string, bool) {
+	return normalizeCode(s, codeLength)
+}
+
+// normalizeCode is NormalizeCode for a code of n characters.
+func normalizeCode(s string, n int) (string, bool) {
+	code := strings.ToUpper(strings.TrimSpace(s))
+	if len(code) != n {
+		return "", false
+	}
+	for i := 0; i < len(code); i++ {
+		if strings.IndexByte(codeCharset, code[i]) < 0 {
+			return "", false
+		}
+	}
+	return code, true
+}
+
 // generateCode returns a 6-character alphanumeric code for private rooms.
-// Uses rejection sampling to avoid modulo bias.
 func generateCode() string {
-	const charset = "ABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+	return generateCodeOfLength(codeLength)
+}
+
+// generateCodeOfLength returns an alphanumeric code of n characters.
+// Uses rejection sampling to avoid modulo bias.
+func generateCodeOfLength(n int) string {
+	const charset = codeCharset
 	const maxUnbiased = 252 // largest multiple of 36 that fits in a byte (36*7=252)
-	code := make([]byte, 6)
+	code := make([]byte, n)
 	buf := make([]byte, 12) // over-allocate to reduce Read calls
-	for i := 0; i < 6; {
+	for i := 0; i < n; {
 		rand.Read(buf)
 		for _, b := range buf {
-			if i >= 6 {
+			if i >= n {
 				break
 			}
 			if b < maxUnbiased {
@@ -183,12 +384,73 @@ type Manager struct {
 	emptyWarn time.Duration
 	onExpire func(roomID string)
 	onWarn   func(roomID string, reason WarningReason, remaining time.Duration)
+	counter  func(roomID string) int
+	maxRooms int
+	reaping  bool
+	maxOwned int
+	owned    map[string]int // creatorID → rooms they currently own
+	nowFunc  func() time.Time
 }
 
-// NewManager creates a new room Manager.
-func NewManager() *Manager {
-	return &Manager{
-		rooms: make(map[string]*Room),
+// ErrTooManyRooms is returned by Create when the manager already holds its
+// maximum number of rooms.
+var ErrTooManyRooms = errors.New("too many rooms")
+
+// ErrTooManyOwnedRooms is returned by Create when the creator already owns
+// the most rooms one creator may have at once.
+var ErrTooManyOwnedRooms = errors.New("too many rooms owned by creator")
+
+// ManagerOption configures a Manager.
+type ManagerOption func(*Manager)
+
+// WithMaxRooms caps the number of rooms that can exist at once. A value of
+// 0 means unlimited (default).
+func WithMaxRooms(n int) ManagerOption {
+	return func(m *Manager) {
+		m.maxRooms = n
+	}
+}
+
+// WithMaxOwnedRooms caps how many rooms one creator may own at once. Rooms
+// created without a creator ID are not counted. A value of 0 means
+// unlimited (default).
+func WithMaxOwnedRooms(n int) ManagerOption {
+	return func(m *Manager) {
+		m.maxOwned = n
+	}
+}
+
+// WithNowFunc replaces the clock the manager and its rooms read activity
+// and expiration times from. Tests use it to move time forward without
+// sleeping. Defaults to time.Now.
+func WithNowFunc(now func() time.Time) ManagerOption {
+	return func(m *Manager) {
+		m.nowFunc = now
+	}
+}
+
+// NewManager creates a new room Manager with optional configuration.
+func NewManager(opts ...ManagerOption) *Manager {
+	m := &Manager{
+		rooms:   make(map[string]*Room),
+		owned:   make(map[string]int),
+		nowFunc: time.Now,
+	}
+	for _, opt := range opts {
+		opt(m)
+	}
+	return m
+}
+
+// SetClientCounter makes rooms report fn(roomID) as their active user
+// count, so the count always agrees with whoever owns the connections
+// instead of being tracked separately. Call it before creating rooms.
+func (m *Manager) SetClientCounter(fn func(roomID string) int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.counter = fn
+	for _, r := range m.rooms {
+		r.counter = fn
 	}
 }
 
@@ -198,26 +460,39 @@ type ExpirationConfig struct {
 	EmptyTTL time.Duration // How long empty before expiring.
 	MsgWarn  time.Duration // Warning window before message-inactivity expiration.
 	EmptyWarn time.Duration // Warning window before empty-room expiration.
+	ReapInterval time.Duration // How often to reap and check for warnings; 0 means EmptyTTL/2, at least 1s.
 	OnExpire func(roomID string)
 	OnWarn   func(roomID string, reason WarningReason, remaining time.Duration)
 }
 
+// ErrInvalidReapInterval is returned by StartExpiration when the configured
+// reap interval is negative.
+var ErrInvalidReapInterval = errors.New("reap interval must be positive")
+
 // StartExpiration begins a background goroutine that reaps expired rooms.
-func (m *Manager) StartExpiration(cfg ExpirationConfig) {
+func (m *Manager) StartExpiration(cfg ExpirationConfig) error {
+	interval := cfg.ReapInterval
+	if interval < 0 {
+		return ErrInvalidReapInterval
+	}
+	if interval == 0 {
+		interval = cfg.EmptyTTL / 2
+		if interval < time.Second {
+			interval = time.Second
+		}
+	}
 	m.msgTTL = cfg.MsgTTL
 	m.emptyTTL = cfg.EmptyTTL
 	m.msgWarn = cfg.MsgWarn
 	m.emptyWarn = cfg.EmptyWarn
 	m.onExpire = cfg.OnExpire
 	m.onWarn = cfg.OnWarn
-	go m.reapLoop()
+	m.reaping = true
+	go m.reapLoop(interval)
+	return nil
 }
 
-func (m *Manager) reapLoop() {
-	interval := m.emptyTTL / 2
-	if interval < time.Second {
-		interval = time.Second
-	}
+func (m *Manager) reapLoop(interval time.Duration) {
 	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
 	for range ticker.C {
@@ -232,7 +507,7 @@ type roomWarning struct {
 }
 
 func (m *Manager) reap() {
-	now := time.Now()
+	now := m.nowFunc()
 	m.mu.RLock()
 	var expired []string
 	var warnings []roomWarning
@@ -241,6 +516,10 @@ func (m *Manager) reap() {
 			expired = append(expired, id)
 			continue
 		}
+		// Only mark a warning sent when there is a hook to send it.
+		if m.onWarn == nil {
+			continue
+		}
 		if reason, remaining := r.NeedsWarning(m.msgTTL, m.msgWarn, m.emptyTTL, m.emptyWarn, now); reason != WarnNone {
 			warnings = append(warnings, roomWarning{id, reason, remaining})
 		}
@@ -248,9 +527,7 @@ func (m *Manager) reap() {
 	m.mu.RUnlock()
 
 	for _, w := range warnings {
-		if m.onWarn != nil {
-			m.onWarn(w.id, w.reason, w.remaining)
-		}
+		m.onWarn(w.id, w.reason, w.remaining)
 	}
 
 	for _, id := range expired {
@@ -261,9 +538,43 @@ func (m *Manager) reap() {
 	}
 }
 
-// Create adds a new room and returns it.
-func (m *Manager) Create(name, description, creatorID string, capacity int, public bool) *Room {
-	now := time.Now()
+// ExpiringRoom is a room in a warning window, as listed by Expiring.
+type ExpiringRoom struct {
+	Room      *Room
+	Reason    WarningReason
+	Remaining time.Duration
+}
+
+// Expiring lists the rooms currently in a warning window, soonest to
+// expire first. It uses WarningStatus, so looking never keeps a room's
+// warning from being sent. It returns nil before StartExpiration.
+func (m *Manager) Expiring() []ExpiringRoom {
+	if !m.reaping {
+		return nil
+	}
+	now := m.nowFunc()
+	m.mu.RLock()
+	var out []ExpiringRoom
+	for _, r := range m.rooms {
+		if reason, remaining := r.WarningStatus(m.msgTTL, m.msgWarn, m.emptyTTL, m.emptyWarn, now); reason != WarnNone {
+			out = append(out, ExpiringRoom{Room: r, Reason: reason, Remaining: remaining})
+		}
+	}
+	m.mu.RUnlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].Remaining < out[j].Remaining })
+	return out
+}
+
+// Create adds a new room and returns it. If the manager is at its room
+// cap, or the creator at theirs, it first reaps any rooms that have
+// already expired, and returns ErrTooManyRooms or ErrTooManyOwnedRooms if
+// that frees nothing.
+func (m *Manager) Create(name, description, creatorID string, capacity int, public bool) (*Room, error) {
+	if (m.atCapacity() || m.ownsMax(creatorID)) && m.reaping {
+		m.reap()
+	}
+
+	now := m.nowFunc()
 	r := &Room{
 		ID:            generateID(),
 		Name:          name,
@@ -275,13 +586,43 @@ func (m *Manager) Create(name, description, creatorID string, capacity int, publ
 		lastMessageAt: now,
 	}
 	m.mu.Lock()
+	if m.maxRooms > 0 && len(m.rooms) >= m.maxRooms {
+		m.mu.Unlock()
+		return nil, ErrTooManyRooms
+	}
+	if creatorID != "" && m.maxOwned > 0 && m.owned[creatorID] >= m.maxOwned {
+		m.mu.Unlock()
+		return nil, ErrTooManyOwnedRooms
+	}
+	if creatorID != "" {
+		m.owned[creatorID]++
+	}
+	r.counter = m.counter
+	r.now = m.nowFunc
 	if !public {
 		r.Code = m.uniqueCode()
 	}
 	m.rooms[r.ID] = r
 	m.mu.Unlock()
 
-	return r
+	return r, nil
+}
+
+// atCapacity reports whether the manager holds its maximum number of rooms.
+func (m *Manager) atCapacity() bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.maxRooms > 0 && len(m.rooms) >= m.maxRooms
+}
+
+// ownsMax reports whether creatorID owns as many rooms as one creator may.
+func (m *Manager) ownsMax(creatorID string) bool {
+	if creatorID == "" {
+		return false
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.maxOwned > 0 && m.owned[creatorID] >= m.maxOwned
 }
 
 // Get returns a room by ID, or nil if not found.
@@ -291,8 +632,13 @@ func (m *Manager) Get(id string) *Room {
 	return m.rooms[id]
 }
 
-// GetByCode returns a private room matching the given code, or nil if not found.
+// GetByCode returns a private room matching the given code, or nil if not
+// found. The code is normalized first; see NormalizeCode.
 func (m *Manager) GetByCode(code string) *Room {
+	code, ok := NormalizeCode(code)
+	if !ok {
+		return nil
+	}
 	m.mu.RLock()
 	defer m.mu.RUnlock()
 	for _, r := range m.rooms {
@@ -305,24 +651,43 @@ func (m *Manager) GetByCode(code string) *Room {
 
 // List returns all public rooms sorted by active user count (descending).
 func (m *Manager) List() []*Room {
-	m.mu.RLock()
-	defer m.mu.RUnlock()
+	return m.list(false)
+}
+
+// ListAvailable is like List but leaves out rooms that are full, so a
+// directory only offers rooms that can still be joined.
+func (m *Manager) ListAvailable() []*Room {
+	return m.list(true)
+}
 
+func (m *Manager) list(availableOnly bool) []*Room {
+	m.mu.RLock()
 	result := make([]*Room, 0)
 	for _, r := range m.rooms {
 		if r.Public {
 			result = append(result, r)
 		}
 	}
+	m.mu.RUnlock()
 
-	// Sort by active users descending.
-	for i := 0; i < len(result); i++ {
-		for j := i + 1; j < len(result); j++ {
-			if result[j].ActiveUsers > result[i].ActiveUsers {
-				result[i], result[j] = result[j], result[i]
+	// Counts are read once, outside the lock, since the counter may take
+	// locks of its own.
+	counts := make(map[*Room]int, len(result))
+	for _, r := range result {
+		counts[r] = r.ActiveUsers()
+	}
+	if availableOnly {
+		open := result[:0]
+		for _, r := range result {
+			if counts[r] < r.Capacity {
+				open = append(open, r)
 			}
 		}
+		result = open
 	}
+	sort.SliceStable(result, func(i, j int) bool {
+		return counts[result[i]] > counts[result[j]]
+	})
 
 	return result
 }
@@ -330,6 +695,11 @@ func (m *Manager) List() []*Room {
 // Delete removes a room by ID.
 func (m *Manager) Delete(id string) {
 	m.mu.Lock()
+	if r, ok := m.rooms[id]; ok && r.CreatorID != "" {
+		if m.owned[r.CreatorID]--; m.owned[r.CreatorID] <= 0 {
+			delete(m.owned, r.CreatorID)
+		}
+	}
 	delete(m.rooms, id)
 	m.mu.Unlock()
 }
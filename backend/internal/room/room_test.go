@@ -1,6 +1,9 @@
 package room
 
 import (
+	"encoding/json"
+	"errors"
+	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
@@ -8,7 +11,7 @@ import (
 
 func TestManagerCreateAndGet(t *testing.T) {
 	m := NewManager()
-	r := m.Create("test-room", "A test room", "user1", 50, true)
+	r, _ := m.Create("test-room", "A test room", "user1", 50, true)
 
 	if r.Name != "test-room" {
 		t.Errorf("expected name 'test-room', got %q", r.Name)
@@ -37,7 +40,7 @@ func TestManagerCreateAndGet(t *testing.T) {
 
 func TestManagerCreatePrivateRoom(t *testing.T) {
 	m := NewManager()
-	r := m.Create("secret", "", "user1", 10, false)
+	r, _ := m.Create("secret", "", "user1", 10, false)
 
 	if r.Public {
 		t.Error("expected room to be private")
@@ -73,32 +76,32 @@ func TestManagerListReturnsOnlyPublicRooms(t *testing.T) {
 
 func TestManagerListSortedByActiveUsers(t *testing.T) {
 	m := NewManager()
-	r1 := m.Create("low", "", "user1", 50, true)
-	r2 := m.Create("high", "", "user1", 50, true)
-	r3 := m.Create("mid", "", "user1", 50, true)
+	r1, _ := m.Create("low", "", "user1", 50, true)
+	r2, _ := m.Create("high", "", "user1", 50, true)
+	r3, _ := m.Create("mid", "", "user1", 50, true)
 
-	r1.ActiveUsers = 1
-	r2.ActiveUsers = 10
-	r3.ActiveUsers = 5
+	r1.AddActiveUsers(1)
+	r2.AddActiveUsers(10)
+	r3.AddActiveUsers(5)
 
 	rooms := m.List()
 	if len(rooms) != 3 {
 		t.Fatalf("expected 3 rooms, got %d", len(rooms))
 	}
-	if rooms[0].ActiveUsers != 10 {
-		t.Errorf("expected first room to have 10 active users, got %d", rooms[0].ActiveUsers)
+	if rooms[0].ActiveUsers() != 10 {
+		t.Errorf("expected first room to have 10 active users, got %d", rooms[0].ActiveUsers())
 	}
-	if rooms[1].ActiveUsers != 5 {
-		t.Errorf("expected second room to have 5 active users, got %d", rooms[1].ActiveUsers)
+	if rooms[1].ActiveUsers() != 5 {
+		t.Errorf("expected second room to have 5 active users, got %d", rooms[1].ActiveUsers())
 	}
-	if rooms[2].ActiveUsers != 1 {
-		t.Errorf("expected third room to have 1 active user, got %d", rooms[2].ActiveUsers)
+	if rooms[2].ActiveUsers() != 1 {
+		t.Errorf("expected third room to have 1 active user, got %d", rooms[2].ActiveUsers())
 	}
 }
 
 func TestManagerDelete(t *testing.T) {
 	m := NewManager()
-	r := m.Create("to-delete", "", "user1", 50, true)
+	r, _ := m.Create("to-delete", "", "user1", 50, true)
 
 	m.Delete(r.ID)
 	if m.Get(r.ID) != nil {
@@ -108,7 +111,7 @@ func TestManagerDelete(t *testing.T) {
 
 func TestManagerGetByCode(t *testing.T) {
 	m := NewManager()
-	priv := m.Create("secret", "", "user1", 10, false)
+	priv, _ := m.Create("secret", "", "user1", 10, false)
 	m.Create("public", "", "user1", 50, true)
 
 	got := m.GetByCode(priv.Code)
@@ -133,7 +136,7 @@ func TestManagerUniqueCodeNoDuplicates(t *testing.T) {
 	m := NewManager()
 	seen := make(map[string]bool)
 	for i := 0; i < 50; i++ {
-		r := m.Create("room", "", "user1", 10, false)
+		r, _ := m.Create("room", "", "user1", 10, false)
 		if seen[r.Code] {
 			t.Fatalf("duplicate code %q generated", r.Code)
 		}
@@ -190,7 +193,7 @@ func TestGenerateCodeDistribution(t *testing.T) {
 
 func TestRoomExpiredByMessageInactivity(t *testing.T) {
 	m := NewManager()
-	r := m.Create("test", "", "user1", 50, true)
+	r, _ := m.Create("test", "", "user1", 50, true)
 
 	msgTTL := 2 * time.Hour
 	emptyTTL := 15 * time.Minute
@@ -212,7 +215,7 @@ func TestRoomExpiredByMessageInactivity(t *testing.T) {
 
 func TestRoomExpiredByEmptyRoom(t *testing.T) {
 	m := NewManager()
-	r := m.Create("test", "", "user1", 50, true)
+	r, _ := m.Create("test", "", "user1", 50, true)
 
 	msgTTL := 2 * time.Hour
 	emptyTTL := 15 * time.Minute
@@ -237,7 +240,7 @@ func TestRoomExpiredByEmptyRoom(t *testing.T) {
 
 func TestRoomNotExpiredWhenUsersPresent(t *testing.T) {
 	m := NewManager()
-	r := m.Create("test", "", "user1", 50, true)
+	r, _ := m.Create("test", "", "user1", 50, true)
 
 	msgTTL := 2 * time.Hour
 	emptyTTL := 15 * time.Minute
@@ -256,7 +259,7 @@ func TestRoomNotExpiredWhenUsersPresent(t *testing.T) {
 
 func TestRoomTouchMessageResetsExpiration(t *testing.T) {
 	m := NewManager()
-	r := m.Create("test", "", "user1", 50, true)
+	r, _ := m.Create("test", "", "user1", 50, true)
 
 	msgTTL := 2 * time.Hour
 	emptyTTL := 15 * time.Minute
@@ -280,8 +283,8 @@ func TestRoomTouchMessageResetsExpiration(t *testing.T) {
 
 func TestManagerReapExpiresRooms(t *testing.T) {
 	m := NewManager()
-	r1 := m.Create("active", "", "user1", 50, true)
-	r2 := m.Create("stale", "", "user1", 50, true)
+	r1, _ := m.Create("active", "", "user1", 50, true)
+	r2, _ := m.Create("stale", "", "user1", 50, true)
 
 	m.msgTTL = 2 * time.Hour
 	m.emptyTTL = 15 * time.Minute
@@ -309,9 +312,83 @@ func TestManagerReapExpiresRooms(t *testing.T) {
 	}
 }
 
+// fakeClock is a manually advanced clock for WithNowFunc.
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	c.mu.Unlock()
+}
+
+func TestManagerReapFakeClock(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)}
+	m := NewManager(WithNowFunc(clock.Now))
+	quiet, _ := m.Create("quiet", "", "user1", 50, true)
+	empty, _ := m.Create("empty", "", "user1", 50, true)
+
+	var warned []WarningReason
+	var expired []string
+	m.StartExpiration(ExpirationConfig{
+		MsgTTL:    2 * time.Hour,
+		EmptyTTL:  15 * time.Minute,
+		MsgWarn:   5 * time.Minute,
+		EmptyWarn: 2 * time.Minute,
+		OnExpire:  func(roomID string) { expired = append(expired, roomID) },
+		OnWarn: func(roomID string, reason WarningReason, remaining time.Duration) {
+			warned = append(warned, reason)
+		},
+	})
+
+	if !quiet.CreatedAt.Equal(clock.Now()) {
+		t.Errorf("expected CreatedAt from the fake clock, got %v", quiet.CreatedAt)
+	}
+
+	// The empty room's last user leaves; it warns two minutes before expiring.
+	empty.TouchUserLeft()
+	clock.Advance(13*time.Minute + 30*time.Second)
+	m.reap()
+	if len(warned) != 1 || warned[0] != WarnEmpty {
+		t.Fatalf("expected one WarnEmpty, got %v", warned)
+	}
+
+	clock.Advance(time.Minute)
+	empty.TouchMessage() // activity does not save an empty room
+	clock.Advance(time.Minute)
+	m.reap()
+	if m.Get(empty.ID) != nil {
+		t.Error("empty room should be reaped 15 minutes after its last user left")
+	}
+
+	// The quiet room has had no messages since creation.
+	clock.Advance(2*time.Hour - 15*time.Minute - 30*time.Second - time.Second)
+	m.reap()
+	if m.Get(quiet.ID) == nil {
+		t.Fatal("quiet room should survive until its message TTL")
+	}
+	clock.Advance(time.Second)
+	m.reap()
+	if m.Get(quiet.ID) != nil {
+		t.Error("quiet room should be reaped once its message TTL has passed")
+	}
+
+	if len(expired) != 2 || expired[0] != empty.ID || expired[1] != quiet.ID {
+		t.Errorf("expected empty then quiet to expire, got %v", expired)
+	}
+}
+
 func TestManagerReapEmptyRoom(t *testing.T) {
 	m := NewManager()
-	r := m.Create("empty", "", "user1", 50, true)
+	r, _ := m.Create("empty", "", "user1", 50, true)
 
 	m.msgTTL = 2 * time.Hour
 	m.emptyTTL = 15 * time.Minute
@@ -338,7 +415,7 @@ func TestManagerReapEmptyRoom(t *testing.T) {
 
 func TestManagerReapKeepsRecentEmptyRoom(t *testing.T) {
 	m := NewManager()
-	r := m.Create("just-emptied", "", "user1", 50, true)
+	r, _ := m.Create("just-emptied", "", "user1", 50, true)
 
 	m.msgTTL = 2 * time.Hour
 	m.emptyTTL = 15 * time.Minute
@@ -357,7 +434,7 @@ func TestManagerReapKeepsRecentEmptyRoom(t *testing.T) {
 
 func TestManagerStartExpirationReapsOverTime(t *testing.T) {
 	m := NewManager()
-	r := m.Create("stale", "", "user1", 50, true)
+	r, _ := m.Create("stale", "", "user1", 50, true)
 	roomID := r.ID
 
 	// Set lastMessageAt far in the past so it's clearly expired.
@@ -390,10 +467,48 @@ func TestManagerStartExpirationReapsOverTime(t *testing.T) {
 	}
 }
 
+func TestManagerReapInterval(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)}
+	m := NewManager(WithNowFunc(clock.Now))
+	r, _ := m.Create("test", "", "user1", 50, true)
+
+	if err := m.StartExpiration(ExpirationConfig{ReapInterval: -time.Second}); err != ErrInvalidReapInterval {
+		t.Fatalf("expected ErrInvalidReapInterval, got %v", err)
+	}
+
+	// Put the room in its warning window. With TTLs this long the default
+	// interval would be half an hour; the configured one checks far sooner.
+	r.TouchUserLeft()
+	clock.Advance(55 * time.Minute)
+	warned := make(chan WarningReason, 1)
+	err := m.StartExpiration(ExpirationConfig{
+		MsgTTL:       24 * time.Hour,
+		EmptyTTL:     time.Hour,
+		MsgWarn:      10 * time.Minute,
+		EmptyWarn:    10 * time.Minute,
+		ReapInterval: 20 * time.Millisecond,
+		OnWarn: func(roomID string, reason WarningReason, remaining time.Duration) {
+			warned <- reason
+		},
+	})
+	if err != nil {
+		t.Fatalf("StartExpiration: %v", err)
+	}
+
+	select {
+	case reason := <-warned:
+		if reason != WarnEmpty {
+			t.Errorf("expected WarnEmpty, got %v", reason)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected a warning within a second at a 20ms reap interval")
+	}
+}
+
 func TestCreateRoomInitializesLastMessageAt(t *testing.T) {
 	m := NewManager()
 	before := time.Now()
-	r := m.Create("test", "", "user1", 50, true)
+	r, _ := m.Create("test", "", "user1", 50, true)
 
 	r.mu.Lock()
 	lastMsg := r.lastMessageAt
@@ -406,7 +521,7 @@ func TestCreateRoomInitializesLastMessageAt(t *testing.T) {
 
 func TestNeedsWarningMessageInactivity(t *testing.T) {
 	m := NewManager()
-	r := m.Create("test", "", "user1", 50, true)
+	r, _ := m.Create("test", "", "user1", 50, true)
 
 	msgTTL := 2 * time.Hour
 	msgWarn := 5 * time.Minute
@@ -435,7 +550,7 @@ func TestNeedsWarningMessageInactivity(t *testing.T) {
 
 func TestNeedsWarningEmptyRoom(t *testing.T) {
 	m := NewManager()
-	r := m.Create("test", "", "user1", 50, true)
+	r, _ := m.Create("test", "", "user1", 50, true)
 
 	msgTTL := 2 * time.Hour
 	msgWarn := 5 * time.Minute
@@ -458,7 +573,7 @@ func TestNeedsWarningEmptyRoom(t *testing.T) {
 
 func TestNeedsWarningOnlySentOnce(t *testing.T) {
 	m := NewManager()
-	r := m.Create("test", "", "user1", 50, true)
+	r, _ := m.Create("test", "", "user1", 50, true)
 
 	msgTTL := 2 * time.Hour
 	msgWarn := 5 * time.Minute
@@ -483,9 +598,57 @@ func TestNeedsWarningOnlySentOnce(t *testing.T) {
 	}
 }
 
+func TestWarningStatusRepeatable(t *testing.T) {
+	m := NewManager()
+	r, _ := m.Create("test", "", "user1", 50, true)
+
+	msgTTL := 2 * time.Hour
+	msgWarn := 5 * time.Minute
+	emptyTTL := 15 * time.Minute
+	emptyWarn := 2 * time.Minute
+
+	now := time.Now()
+	r.mu.Lock()
+	r.lastMessageAt = now.Add(-1*time.Hour - 56*time.Minute)
+	r.mu.Unlock()
+
+	for i := 0; i < 3; i++ {
+		reason, remaining := r.WarningStatus(msgTTL, msgWarn, emptyTTL, emptyWarn, now)
+		if reason != WarnMsgInactive || remaining != 4*time.Minute {
+			t.Fatalf("call %d: expected WarnMsgInactive with 4m left, got %v %v", i, reason, remaining)
+		}
+	}
+
+	// Looking left the warning to be sent once, as usual.
+	if reason, _ := r.NeedsWarning(msgTTL, msgWarn, emptyTTL, emptyWarn, now); reason != WarnMsgInactive {
+		t.Fatalf("expected NeedsWarning to warn, got %v", reason)
+	}
+	if reason, _ := r.NeedsWarning(msgTTL, msgWarn, emptyTTL, emptyWarn, now); reason != WarnNone {
+		t.Errorf("expected NeedsWarning not to warn twice, got %v", reason)
+	}
+	if reason, _ := r.WarningStatus(msgTTL, msgWarn, emptyTTL, emptyWarn, now); reason != WarnMsgInactive {
+		t.Errorf("expected WarningStatus to keep reporting after the warning was sent, got %v", reason)
+	}
+}
+
+func TestManagerReapWithoutHookKeepsWarning(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)}
+	m := NewManager(WithNowFunc(clock.Now))
+	m.msgTTL, m.msgWarn = 2*time.Hour, 5*time.Minute
+	m.emptyTTL, m.emptyWarn = 15*time.Minute, 2*time.Minute
+	r, _ := m.Create("test", "", "user1", 50, true)
+
+	clock.Advance(time.Hour + 56*time.Minute)
+	m.reap() // no OnWarn hook: nothing to send the warning with
+
+	if reason, _ := r.NeedsWarning(m.msgTTL, m.msgWarn, m.emptyTTL, m.emptyWarn, clock.Now()); reason != WarnMsgInactive {
+		t.Errorf("expected the warning still to be due, got %v", reason)
+	}
+}
+
 func TestNeedsWarningResetOnActivity(t *testing.T) {
 	m := NewManager()
-	r := m.Create("test", "", "user1", 50, true)
+	r, _ := m.Create("test", "", "user1", 50, true)
 
 	msgTTL := 2 * time.Hour
 	msgWarn := 5 * time.Minute
@@ -518,7 +681,7 @@ func TestNeedsWarningResetOnActivity(t *testing.T) {
 
 func TestNeedsWarningEmptyResetOnJoin(t *testing.T) {
 	m := NewManager()
-	r := m.Create("test", "", "user1", 50, true)
+	r, _ := m.Create("test", "", "user1", 50, true)
 
 	msgTTL := 2 * time.Hour
 	msgWarn := 5 * time.Minute
@@ -551,7 +714,7 @@ func TestNeedsWarningEmptyResetOnJoin(t *testing.T) {
 
 func TestNeedsWarningNotInWindow(t *testing.T) {
 	m := NewManager()
-	r := m.Create("test", "", "user1", 50, true)
+	r, _ := m.Create("test", "", "user1", 50, true)
 
 	msgTTL := 2 * time.Hour
 	msgWarn := 5 * time.Minute
@@ -571,7 +734,7 @@ func TestNeedsWarningNotInWindow(t *testing.T) {
 
 func TestManagerReapSendsWarnings(t *testing.T) {
 	m := NewManager()
-	r := m.Create("approaching", "", "user1", 50, true)
+	r, _ := m.Create("approaching", "", "user1", 50, true)
 
 	m.msgTTL = 2 * time.Hour
 	m.emptyTTL = 15 * time.Minute
@@ -601,9 +764,9 @@ func TestManagerReapSendsWarnings(t *testing.T) {
 
 func TestManagerReapWarnsBeforeExpiring(t *testing.T) {
 	m := NewManager()
-	active := m.Create("active", "", "user1", 50, true)
-	approaching := m.Create("approaching", "", "user1", 50, true)
-	stale := m.Create("stale", "", "user1", 50, true)
+	active, _ := m.Create("active", "", "user1", 50, true)
+	approaching, _ := m.Create("approaching", "", "user1", 50, true)
+	stale, _ := m.Create("stale", "", "user1", 50, true)
 
 	m.msgTTL = 2 * time.Hour
 	m.emptyTTL = 15 * time.Minute
@@ -646,3 +809,164 @@ func TestManagerReapWarnsBeforeExpiring(t *testing.T) {
 		t.Errorf("expected expiration for stale room, got %v", expired)
 	}
 }
+
+func TestRoomPeakUsersHighWaterMark(t *testing.T) {
+	m := NewManager()
+	r, _ := m.Create("Room", "", "creator", 10, true)
+
+	r.AddActiveUsers(1)
+	r.AddActiveUsers(1)
+	r.AddActiveUsers(1)
+	r.AddActiveUsers(-1)
+	r.AddActiveUsers(-1)
+	if r.PeakUsers() != 3 {
+		t.Errorf("expected peak 3 after dropping to 1, got %d", r.PeakUsers())
+	}
+
+	r.AddActiveUsers(1)
+	if r.PeakUsers() != 3 {
+		t.Errorf("expected peak to stay 3 below the mark, got %d", r.PeakUsers())
+	}
+
+	r.AddActiveUsers(1)
+	r.AddActiveUsers(1)
+	if r.PeakUsers() != 4 {
+		t.Errorf("expected peak 4 after exceeding the mark, got %d", r.PeakUsers())
+	}
+}
+
+func TestRoomMessageCount(t *testing.T) {
+	m := NewManager()
+	r, _ := m.Create("Room", "", "creator", 10, true)
+	for i := 0; i < 3; i++ {
+		r.IncMessageCount()
+	}
+	if r.MessageCount() != 3 {
+		t.Errorf("expected 3 messages, got %d", r.MessageCount())
+	}
+}
+
+func TestManagerClientCounter(t *testing.T) {
+	m := NewManager()
+	before, _ := m.Create("before", "", "user1", 2, true)
+	counts := map[string]int{}
+	m.SetClientCounter(func(roomID string) int { return counts[roomID] })
+	after, _ := m.Create("after", "", "user1", 2, true)
+
+	// The counter decides the count, whatever the tally says.
+	before.AddActiveUsers(5)
+	counts[after.ID] = 2
+	if before.ActiveUsers() != 0 {
+		t.Errorf("expected counter to override deltas, got %d", before.ActiveUsers())
+	}
+	if !after.IsFull() {
+		t.Error("expected room to be full by the counter's count")
+	}
+
+	rooms := m.List()
+	if rooms[0] != after {
+		t.Errorf("expected %q first, got %q", after.Name, rooms[0].Name)
+	}
+	data, _ := json.Marshal(after)
+	var info Info
+	json.Unmarshal(data, &info)
+	if info.ActiveUsers != 2 {
+		t.Errorf("expected active_users 2 in JSON, got %d", info.ActiveUsers)
+	}
+}
+
+func TestManagerMaxOwnedRooms(t *testing.T) {
+	m := NewManager(WithMaxOwnedRooms(2))
+
+	first, _ := m.Create("first", "", "user1", 10, true)
+	m.Create("second", "", "user1", 10, true)
+	if r, err := m.Create("third", "", "user1", 10, true); !errors.Is(err, ErrTooManyOwnedRooms) || r != nil {
+		t.Fatalf("expected ErrTooManyOwnedRooms, got %v, %v", r, err)
+	}
+
+	// Other creators, and rooms with no creator, are unaffected.
+	if _, err := m.Create("other", "", "user2", 10, true); err != nil {
+		t.Errorf("expected user2 to create a room, got %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := m.Create("anon", "", "", 10, true); err != nil {
+			t.Errorf("expected creator-less room to be allowed, got %v", err)
+		}
+	}
+
+	m.Delete(first.ID)
+	if _, err := m.Create("third", "", "user1", 10, true); err != nil {
+		t.Errorf("expected create to succeed after a room was deleted, got %v", err)
+	}
+}
+
+func TestManagerMaxRooms(t *testing.T) {
+	m := NewManager(WithMaxRooms(2))
+	m.msgTTL = 2 * time.Hour
+	m.emptyTTL = 15 * time.Minute
+	m.reaping = true
+	var expired []string
+	m.onExpire = func(roomID string) {
+		expired = append(expired, roomID)
+	}
+
+	first, err := m.Create("first", "", "user1", 10, true)
+	if err != nil {
+		t.Fatalf("create first: %v", err)
+	}
+	if _, err := m.Create("second", "", "user1", 10, true); err != nil {
+		t.Fatalf("create second: %v", err)
+	}
+
+	r, err := m.Create("third", "", "user1", 10, true)
+	if !errors.Is(err, ErrTooManyRooms) || r != nil {
+		t.Fatalf("expected ErrTooManyRooms at the cap, got %v, %v", r, err)
+	}
+	if len(expired) != 0 {
+		t.Errorf("no room was due to expire, got %v", expired)
+	}
+
+	// Once a room is past its TTL, creating reaps it to make space.
+	first.mu.Lock()
+	first.lastMessageAt = time.Now().Add(-3 * time.Hour)
+	first.mu.Unlock()
+
+	r, err = m.Create("third", "", "user1", 10, true)
+	if err != nil {
+		t.Fatalf("expected create to succeed after a room expired, got %v", err)
+	}
+	if m.Get(r.ID) == nil {
+		t.Error("new room should be stored")
+	}
+	if m.Get(first.ID) != nil {
+		t.Error("expired room should have been reaped")
+	}
+	if len(expired) != 1 || expired[0] != first.ID {
+		t.Errorf("expected expiration for the first room, got %v", expired)
+	}
+}
+
+func TestNormalizeCode(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+		ok   bool
+	}{
+		{"ABC123", "ABC123", true},
+		{"abc123", "ABC123", true},
+		{"aBc123", "ABC123", true},
+		{"  abc123\n", "ABC123", true},
+		{"ABC12", "", false},
+		{"ABC1234", "", false},
+		{"ABC-12", "", false},
+		{"ABC 12", "", false},
+		{"ÄBC123", "", false},
+		{"", "", false},
+	}
+	for _, tt := range tests {
+		got, ok := NormalizeCode(tt.in)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("NormalizeCode(%q) = %q, %v; want %q, %v", tt.in, got, ok, tt.want, tt.ok)
+		}
+	}
+}
@@ -1,11 +1,15 @@
 package server
 
 import (
-	"crypto/rand"
-	"encoding/hex"
+	"crypto/subtle"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"log"
+	"math"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
 	"time"
 
@@ -13,6 +17,7 @@ import (
 	"github.com/christopherjohns/chatsphere/internal/ratelimit"
 	"github.com/christopherjohns/chatsphere/internal/room"
 	"github.com/christopherjohns/chatsphere/internal/user"
+	"github.com/christopherjohns/chatsphere/internal/webhook"
 	"github.com/christopherjohns/chatsphere/internal/ws"
 	"github.com/redis/go-redis/v9"
 )
@@ -27,8 +32,42 @@ type Server struct {
 	rooms        *room.Manager
 	hub          *ws.Hub
 	createLimit  *ratelimit.IPLimiter
+	botLimit     *ratelimit.IPLimiter
+	chatLimit    *ratelimit.IPLimiter
+	floodLimit   int
+	floodWindow  time.Duration
+	renameLimit  int
+	renameWindow time.Duration
+	connOpts     []ws.ConnManagerOption
+	roomOpts     []room.ManagerOption
+	leaveGrace   time.Duration
+	messages     message.MessageStore
+	archiveTTL   time.Duration
+	archive      *message.Archive
+	baseURL      string
 	redisClient  redis.Cmdable
 	userSessions *user.SessionStore
+	adminKey     string
+	webhook      *webhook.Relay
+	unfurler     *ws.Unfurler
+	noEditing    bool
+	noAttach     bool
+	wsHandler    *ws.Handler
+	clockOffset  time.Duration
+	maxPerUser   int
+	cookie       cookieOptions
+	strict       bool
+	evictDupes   bool
+	reapInterval time.Duration
+}
+
+// cookieOptions are the attributes of the session cookie; see
+// WithCookieOptions.
+type cookieOptions struct {
+	domain   string
+	sameSite http.SameSite
+	maxAge   int
+	secure   bool
 }
 
 // Option configures the server.
@@ -41,36 +80,248 @@ func WithRedis(client redis.Cmdable) Option {
 	}
 }
 
+// WithAdminKey enables the /api/admin endpoints, which require the key in
+// the X-Admin-Key header. Admin endpoints are disabled when no key is set.
+func WithAdminKey(key string) Option {
+	return func(s *Server) {
+		s.adminKey = key
+	}
+}
+
+// WithChatRateLimit sets the default chat rate limit to n messages per
+// window per user. Rooms may override it at creation.
+func WithChatRateLimit(n int, window time.Duration) Option {
+	return func(s *Server) {
+		s.chatLimit = ratelimit.NewIPLimiter(n, window)
+	}
+}
+
+// WithArchive saves the transcript of each expired room to Redis, where it
+// is kept for ttl and can be fetched from the admin API. It has no effect
+// without WithRedis.
+func WithArchive(ttl time.Duration) Option {
+	return func(s *Server) {
+		s.archiveTTL = ttl
+	}
+}
+
+// WithPublicBaseURL sets the origin used to build the join links returned
+// with rooms, e.g. "https://chat.example.com". Without it links point at
+// the host the request was made to.
+func WithPublicBaseURL(base string) Option {
+	return func(s *Server) {
+		s.baseURL = strings.TrimRight(base, "/")
+	}
+}
+
+// WithBatching lets each connection coalesce queued messages into a single
+// "batch" frame. Clients must unpack batch frames, so it is off by default.
+func WithBatching() Option {
+	return func(s *Server) {
+		s.connOpts = append(s.connOpts, ws.WithBatching(true))
+	}
+}
+
+// WithoutEditing turns off message editing and reports it in the server's
+// capabilities.
+func WithoutEditing() Option {
+	return func(s *Server) {
+		s.noEditing = true
+	}
+}
+
+// WithStrictProtocol answers WebSocket envelopes of unknown type with an
+// unknown_type error instead of ignoring them.
+func WithStrictProtocol() Option {
+	return func(s *Server) {
+		s.strict = true
+	}
+}
+
+// WithEvictDuplicateSessions lets a join for a session that is still
+// connected, e.g. from a second tab, take it over and close the older
+// connection, instead of being refused.
+func WithEvictDuplicateSessions() Option {
+	return func(s *Server) {
+		s.evictDupes = true
+	}
+}
+
+// WithoutAttachments turns off attachment uploads and reports it in the
+// server's capabilities.
+func WithoutAttachments() Option {
+	return func(s *Server) {
+		s.noAttach = true
+	}
+}
+
+// WithIdleTimeout closes WebSocket connections that have sent nothing for d.
+func WithIdleTimeout(d time.Duration) Option {
+	return func(s *Server) {
+		s.connOpts = append(s.connOpts, ws.WithIdleTimeout(d))
+	}
+}
+
+// WithLeaveGrace holds back "left" messages for dropped connections for d,
+// so users who reconnect within it come and go without any announcement.
+func WithLeaveGrace(d time.Duration) Option {
+	return func(s *Server) {
+		s.leaveGrace = d
+	}
+}
+
+// WithClockOffset shifts every timestamp sent to clients by d, for hosts
+// whose system clock is known to be off.
+func WithClockOffset(d time.Duration) Option {
+	return func(s *Server) {
+		s.clockOffset = d
+	}
+}
+
+// WithReapInterval makes the server check for expired rooms and send
+// expiry warnings every d instead of every half of the empty-room TTL.
+func WithReapInterval(d time.Duration) Option {
+	return func(s *Server) {
+		s.reapInterval = d
+	}
+}
+
+// WithMaxConns limits the server to n concurrent WebSocket connections.
+func WithMaxConns(n int) Option {
+	return func(s *Server) {
+		s.connOpts = append(s.connOpts, ws.WithMaxConns(n))
+	}
+}
+
+// WithMaxRooms caps the number of rooms that can exist at once across all
+// creators. Once it is reached, room creation fails until a room expires.
+func WithMaxRooms(n int) Option {
+	return func(s *Server) {
+		s.roomOpts = append(s.roomOpts, room.WithMaxRooms(n))
+	}
+}
+
+// defaultMaxRoomsPerUser is how many rooms one session-cookie user may own
+// at once unless WithMaxRoomsPerUser says otherwise.
+const defaultMaxRoomsPerUser = 5
+
+// WithMaxRoomsPerUser caps how many rooms one user, identified by their
+// session cookie, may own at once. 0 means unlimited.
+func WithMaxRoomsPerUser(n int) Option {
+	return func(s *Server) {
+		s.maxPerUser = n
+	}
+}
+
+// WithCookieOptions sets the attributes of the session cookie, for
+// deployments that share it across subdomains or embed the app cross-site.
+// maxAge is in seconds; 0 makes it a browser-session cookie. SameSite=None
+// is only honoured by browsers on secure cookies, so it forces secure.
+func WithCookieOptions(domain string, sameSite http.SameSite, maxAge int, secure bool) Option {
+	return func(s *Server) {
+		if sameSite == http.SameSiteNoneMode && !secure {
+			log.Printf("server: SameSite=None session cookies must be Secure; setting Secure")
+			secure = true
+		}
+		s.cookie = cookieOptions{domain: domain, sameSite: sameSite, maxAge: maxAge, secure: secure}
+	}
+}
+
+// WithRoomFloodLimit caps each room at n messages per window across all
+// users. A room that goes over is put in slow mode for a while.
+func WithRoomFloodLimit(n int, window time.Duration) Option {
+	return func(s *Server) {
+		s.floodLimit = n
+		s.floodWindow = window
+	}
+}
+
+// WithRenameBroadcastLimit announces at most n username changes per
+// window in each room. Further renames only update the presence roster.
+func WithRenameBroadcastLimit(n int, window time.Duration) Option {
+	return func(s *Server) {
+		s.renameLimit = n
+		s.renameWindow = window
+	}
+}
+
+// WithLinkPreviews enables link previews for URLs posted in chat. If allow
+// is non-empty only those hosts are fetched; hosts in deny never are.
+// Private and loopback addresses are always refused.
+func WithLinkPreviews(allow, deny []string) Option {
+	return func(s *Server) {
+		s.unfurler = ws.NewUnfurler(allow, deny)
+	}
+}
+
+// WithWebhook relays moderation and audit events (joins, leaves, kicks,
+// bans, mutes, and posted messages) to url as batched JSON POSTs.
+func WithWebhook(url string) Option {
+	return func(s *Server) {
+		s.webhook = webhook.New(url)
+	}
+}
+
 // New creates a new Server listening on addr. An optional Redis client can be
 // provided for message persistence; pass nil to use in-memory storage.
 func New(addr string, opts ...Option) *Server {
-	rm := room.NewManager()
 	s := &Server{
 		addr:         addr,
 		mux:          http.NewServeMux(),
-		rooms:        rm,
 		createLimit:  ratelimit.NewIPLimiter(3, time.Hour),
+		botLimit:     ratelimit.NewIPLimiter(10, 10*time.Second),
 		userSessions: user.NewSessionStore(),
+		maxPerUser:   defaultMaxRoomsPerUser,
+		cookie:       cookieOptions{sameSite: http.SameSiteLaxMode, maxAge: 86400}, // 24 hours
 	}
 	for _, opt := range opts {
 		opt(s)
 	}
-	s.hub = ws.NewHub(func(roomID string, delta int) {
+	rm := room.NewManager(append(s.roomOpts, room.WithMaxOwnedRooms(s.maxPerUser))...)
+	s.rooms = rm
+	if s.archiveTTL > 0 {
+		if s.redisClient != nil {
+			s.archive = message.NewArchive(s.redisClient, s.archiveTTL)
+		} else {
+			log.Printf("server: room archival needs Redis; expired rooms will not be archived")
+		}
+	}
+	// The hub owns the connections, so room listings count its clients
+	// rather than keeping a tally of their own.
+	rm.SetClientCounter(func(roomID string) int {
+		return s.hub.ClientCount(roomID)
+	})
+	s.hub = ws.NewHubWithConnManager(func(roomID string, delta int) {
 		if r := rm.Get(roomID); r != nil {
 			r.AddActiveUsers(delta)
 			if delta > 0 {
 				r.ClearUserLeft()
-			} else if r.ActiveUsers <= 0 {
+			} else if r.ActiveUsers() <= 0 {
 				r.TouchUserLeft()
 			}
 		}
 		s.hub.BroadcastPresence(roomID)
+	}, ws.NewConnManager(s.connOpts...))
+	s.hub.SetClockOffset(s.clockOffset)
+	s.hub.SetEphemeralLookup(func(roomID string) bool {
+		r := rm.Get(roomID)
+		return r != nil && r.Ephemeral
 	})
 	s.hub.SetOnBroadcast(func(roomID string) {
 		if r := rm.Get(roomID); r != nil {
 			r.TouchMessage()
+			r.IncMessageCount()
 		}
 	})
+	s.hub.SetFloodGuard(s.floodLimit, s.floodWindow)
+	if s.redisClient != nil {
+		s.hub.SetModerationStore(ws.NewRedisModerationStore(s.redisClient))
+	}
+	if s.webhook != nil {
+		s.hub.SetEventSink(func(e ws.Event) {
+			s.webhook.Enqueue(e)
+		})
+	}
 	s.routes()
 	return s
 }
@@ -83,19 +334,30 @@ func (s *Server) Run() error {
 func (s *Server) routes() {
 	s.mux.HandleFunc("GET /health", s.handleHealth)
 	s.mux.HandleFunc("GET /api/session", s.handleSession)
+	s.mux.HandleFunc("DELETE /api/session", s.handleDeleteSession)
+	s.mux.HandleFunc("GET /api/capabilities", s.handleCapabilities)
 	s.mux.HandleFunc("GET /api/rooms", s.handleListRooms)
 	s.mux.HandleFunc("GET /api/rooms/code/{code}", s.handleGetRoomByCode)
 	s.mux.HandleFunc("GET /api/rooms/{id}", s.handleGetRoom)
+	s.mux.HandleFunc("GET /api/rooms/{id}/{resource}", s.handleRoomResource)
+	s.mux.HandleFunc("GET /api/room-users", s.handleBulkRoomUsers)
 	s.mux.HandleFunc("GET /api/room-users/{id}", s.handleRoomUsers)
+	s.mux.HandleFunc("GET /api/attachments/{id}", s.handleAttachment)
 	s.mux.HandleFunc("POST /api/rooms", s.handleCreateRoom)
+	s.mux.HandleFunc("POST /api/rooms/{id}/messages", s.requireAdmin(s.handleBotMessage))
+	s.mux.HandleFunc("POST /api/rooms/{id}/invites", s.handleCreateInvite)
+	s.mux.HandleFunc("POST /api/admin/announce", s.requireAdmin(s.handleAnnounce))
+	s.mux.HandleFunc("GET /api/admin/archive/{id}", s.requireAdmin(s.handleArchive))
+	s.mux.HandleFunc("GET /api/admin/rooms/expiring", s.requireAdmin(s.handleExpiringRooms))
 
 	sessions := ws.NewSessionStore(2 * time.Minute)
 	var messages message.MessageStore
 	if s.redisClient != nil {
-		messages = message.NewRedisStore(s.redisClient, 200)
+		messages = message.NewRedisStore(s.redisClient, messageStoreSize)
 	} else {
-		messages = message.NewStore(200)
+		messages = message.NewStore(messageStoreSize, message.WithMaxSystem(50))
 	}
+	s.messages = messages
 	s.hub.SetMessageStore(messages)
 	s.hub.SetSessionStore(sessions)
 	wsHandler := ws.NewHandler(s.hub, func(roomID string) string {
@@ -103,23 +365,62 @@ func (s *Server) routes() {
 		if r == nil {
 			return "room not found"
 		}
-		if r.IsFull() {
-			return "room is full"
-		}
 		return ""
 	}, sessions, messages)
 	wsHandler.SetUserSessions(s.userSessions, sessionCookieName)
+	wsHandler.SetLeaveGrace(s.leaveGrace)
+	wsHandler.SetEditingEnabled(!s.noEditing)
+	wsHandler.SetStrictProtocol(s.strict)
+	wsHandler.SetEvictDuplicateSessions(s.evictDupes)
+	wsHandler.SetRenameBroadcastLimit(s.renameLimit, s.renameWindow)
+	wsHandler.SetAttachmentsEnabled(!s.noAttach)
+	if s.chatLimit != nil {
+		wsHandler.SetChatLimiter(s.chatLimit)
+	}
+	if s.unfurler != nil {
+		wsHandler.SetUnfurler(s.unfurler)
+	}
+	wsHandler.SetRoomCodeResolver(func(code string) string {
+		if r := s.rooms.GetByCode(code); r != nil {
+			return r.ID
+		}
+		return ""
+	})
+	wsHandler.SetRoomCapacity(func(roomID string) int {
+		if r := s.rooms.Get(roomID); r != nil {
+			return r.Capacity
+		}
+		return 0
+	})
+	wsHandler.SetRoomTopic(func(roomID string) string {
+		if r := s.rooms.Get(roomID); r != nil {
+			return r.Topic()
+		}
+		return ""
+	}, func(roomID, topic string) {
+		if r := s.rooms.Get(roomID); r != nil {
+			r.SetTopic(topic)
+		}
+	})
+	wsHandler.SetRoomChatLimiter(func(roomID string) *ratelimit.IPLimiter {
+		if r := s.rooms.Get(roomID); r != nil {
+			return r.ChatLimiter()
+		}
+		return nil
+	})
+	s.wsHandler = wsHandler
 	s.mux.Handle("GET /ws", wsHandler)
 
-	s.rooms.StartExpiration(room.ExpirationConfig{
+	s.hub.StartRoomSweep()
+	s.hub.StartAttachmentSweep()
+
+	err := s.rooms.StartExpiration(room.ExpirationConfig{
 		MsgTTL:   2 * time.Hour,
 		EmptyTTL: 15 * time.Minute,
 		MsgWarn:  5 * time.Minute,
 		EmptyWarn: 2 * time.Minute,
-		OnExpire: func(roomID string) {
-			s.hub.DisconnectRoom(roomID)
-			messages.DeleteRoom(roomID)
-		},
+		ReapInterval: s.reapInterval,
+		OnExpire: s.expireRoom,
 		OnWarn: func(roomID string, reason room.WarningReason, remaining time.Duration) {
 			mins := int(remaining.Minutes())
 			if mins < 1 {
@@ -132,18 +433,37 @@ func (s *Server) routes() {
 			case room.WarnEmpty:
 				content = fmt.Sprintf("This room will expire in %d minutes because it is empty", mins)
 			}
-			b := make([]byte, 16)
-			rand.Read(b)
 			s.hub.Broadcast(roomID, &message.Message{
-				ID:        hex.EncodeToString(b),
-				RoomID:    roomID,
-				Content:   content,
-				Type:      message.TypeSystem,
-				Action:    message.ActionExpiration,
-				CreatedAt: time.Now(),
+				RoomID:  roomID,
+				Content: content,
+				Type:    message.TypeSystem,
+				Action:  message.ActionExpiration,
 			})
 		},
 	})
+	if err != nil {
+		log.Printf("server: %v; rooms will not expire", err)
+	}
+}
+
+// messageStoreSize is the number of messages the store retains per room.
+// A room's message_cap may only lower it.
+const messageStoreSize = 200
+
+// archiveMaxMessages bounds the transcript saved for an expired room; it
+// matches the number of messages the store retains per room.
+const archiveMaxMessages = messageStoreSize
+
+// expireRoom disconnects an expired room's clients and deletes its
+// messages, saving them to the archive first when archival is enabled.
+func (s *Server) expireRoom(roomID string) {
+	s.hub.DisconnectRoom(roomID)
+	if s.archive != nil {
+		if msgs := s.messages.Recent(roomID, archiveMaxMessages); len(msgs) > 0 {
+			s.archive.Save(roomID, msgs)
+		}
+	}
+	s.messages.DeleteRoom(roomID)
 }
 
 func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
@@ -164,28 +484,114 @@ func (s *Server) handleSession(w http.ResponseWriter, r *http.Request) {
 	}
 
 	sess := s.userSessions.Create()
-	http.SetCookie(w, &http.Cookie{
+	http.SetCookie(w, s.sessionCookie(sess.Token, s.cookie.maxAge))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sess)
+}
+
+// handleDeleteSession forgets the caller: it deletes their anonymous
+// session, disconnects them from every room and clears the cookie. The
+// next GET /api/session starts over with a new identity.
+func (s *Server) handleDeleteSession(w http.ResponseWriter, r *http.Request) {
+	if cookie, err := r.Cookie(sessionCookieName); err == nil {
+		if sess := s.userSessions.Delete(cookie.Value); sess != nil {
+			s.hub.DisconnectUser(sess.UserID, "session deleted")
+		}
+	}
+	http.SetCookie(w, s.sessionCookie("", -1))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// sessionCookie builds the session cookie with the configured attributes.
+// Clearing it needs the same domain and path it was set with.
+func (s *Server) sessionCookie(token string, maxAge int) *http.Cookie {
+	return &http.Cookie{
 		Name:     sessionCookieName,
-		Value:    sess.Token,
+		Value:    token,
 		Path:     "/",
+		Domain:   s.cookie.domain,
 		HttpOnly: true,
-		SameSite: http.SameSiteLaxMode,
-		MaxAge:   86400, // 24 hours
-	})
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(sess)
+		Secure:   s.cookie.secure,
+		SameSite: s.cookie.sameSite,
+		MaxAge:   maxAge,
+	}
+}
+
+// sessionUserID returns the user ID behind the request's session cookie,
+// or "" if it carries no valid one.
+func (s *Server) sessionUserID(r *http.Request) string {
+	cookie, err := r.Cookie(sessionCookieName)
+	if err != nil {
+		return ""
+	}
+	if sess := s.userSessions.Get(cookie.Value); sess != nil {
+		return sess.UserID
+	}
+	return ""
+}
+
+// roomResponse is a room as returned by the create and get endpoints, with
+// its current topic and links that open it in the client. CodeURL is only
+// set for private rooms.
+type roomResponse struct {
+	room.Info
+	Topic   string `json:"topic,omitempty"`
+	JoinURL string `json:"join_url"`
+	CodeURL string `json:"code_url,omitempty"`
+}
+
+// roomLinks wraps rm with its join links.
+func (s *Server) roomLinks(r *http.Request, rm *room.Room) roomResponse {
+	base := s.linkBase(r)
+	resp := roomResponse{
+		Info:    rm.Info(),
+		Topic:   rm.Topic(),
+		JoinURL: base + "/?room=" + url.QueryEscape(rm.ID),
+	}
+	if !rm.Public && rm.Code != "" {
+		resp.CodeURL = base + "/?code=" + url.QueryEscape(rm.Code)
+	}
+	return resp
+}
+
+// linkBase returns the origin links are built on: the configured public
+// base URL, or else the request's own.
+func (s *Server) linkBase(r *http.Request) string {
+	if s.baseURL != "" {
+		return s.baseURL
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
 }
 
 func (s *Server) handleListRooms(w http.ResponseWriter, r *http.Request) {
-	rooms := s.rooms.List()
+	var rooms []*room.Room
+	if r.URL.Query().Get("available") == "true" {
+		rooms = s.rooms.ListAvailable()
+	} else {
+		rooms = s.rooms.List()
+	}
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(rooms)
 }
 
+// handleCapabilities reports the features and limits this server supports.
+func (s *Server) handleCapabilities(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.wsHandler.Capabilities())
+}
+
 func (s *Server) handleGetRoomByCode(w http.ResponseWriter, r *http.Request) {
-	code := strings.ToUpper(strings.TrimSpace(r.PathValue("code")))
-	if len(code) != 6 {
-		http.Error(w, `{"error":"code must be 6 characters"}`, http.StatusBadRequest)
+	code, ok := room.NormalizeCode(r.PathValue("code"))
+	if !ok {
+		if invite, ok := room.NormalizeInviteCode(r.PathValue("code")); ok {
+			s.redeemInvite(w, r, invite)
+			return
+		}
+		http.Error(w, `{"error":"code must be 6 letters or digits, or an 8-character invite"}`, http.StatusBadRequest)
 		return
 	}
 
@@ -196,7 +602,91 @@ func (s *Server) handleGetRoomByCode(w http.ResponseWriter, r *http.Request) {
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(rm)
+	json.NewEncoder(w).Encode(s.roomLinks(r, rm))
+}
+
+// redeemInvite answers GET /api/rooms/code/{code} for an invite code,
+// counting one use of it. The response leaves out the room's permanent
+// code, which the invite's holder was not given.
+func (s *Server) redeemInvite(w http.ResponseWriter, r *http.Request, code string) {
+	rm, err := s.rooms.RedeemInvite(code)
+	if errors.Is(err, room.ErrInviteExpired) {
+		http.Error(w, `{"error":"invite has expired or been used up"}`, http.StatusGone)
+		return
+	}
+	if err != nil {
+		http.Error(w, `{"error":"room not found"}`, http.StatusNotFound)
+		return
+	}
+
+	resp := s.roomLinks(r, rm)
+	resp.Code = ""
+	resp.CodeURL = ""
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// maxInviteTTL bounds how long an invite may stay valid.
+const maxInviteTTL = 7 * 24 * time.Hour
+
+type createInviteRequest struct {
+	TTLSeconds int `json:"ttl_seconds"` // 0 = until the room expires
+	MaxUses    int `json:"max_uses"`    // 0 = unlimited
+}
+
+// inviteResponse is an invite with the link that redeems it.
+type inviteResponse struct {
+	*room.Invite
+	InviteURL string `json:"invite_url"`
+}
+
+// handleCreateInvite lets the owner of a private room, identified by
+// their session cookie, create an invite to it.
+func (s *Server) handleCreateInvite(w http.ResponseWriter, r *http.Request) {
+	rm := s.rooms.Get(r.PathValue("id"))
+	if rm == nil {
+		http.Error(w, `{"error":"room not found"}`, http.StatusNotFound)
+		return
+	}
+	if userID := s.sessionUserID(r); userID == "" || userID != rm.CreatorID {
+		http.Error(w, `{"error":"only the room's creator can create invites"}`, http.StatusForbidden)
+		return
+	}
+	if rm.Public {
+		http.Error(w, `{"error":"public rooms need no invite"}`, http.StatusBadRequest)
+		return
+	}
+
+	var req createInviteRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, `{"error":"invalid JSON body"}`, http.StatusBadRequest)
+			return
+		}
+	}
+	// Check the seconds before converting, so a huge value can't overflow
+	// into a small or negative duration.
+	maxTTLSeconds := int(maxInviteTTL / time.Second)
+	if req.TTLSeconds < 0 || req.TTLSeconds > maxTTLSeconds {
+		fieldError(w, "ttl_seconds", fmt.Sprintf("ttl_seconds must be between 0 and %d", maxTTLSeconds))
+		return
+	}
+	ttl := time.Duration(req.TTLSeconds) * time.Second
+	if req.MaxUses < 0 || req.MaxUses > 1000 {
+		fieldError(w, "max_uses", "max_uses must be between 0 and 1000")
+		return
+	}
+
+	inv := rm.CreateInvite(ttl, req.MaxUses)
+	if inv == nil {
+		http.Error(w, `{"error":"this room has too many active invites"}`, http.StatusTooManyRequests)
+		return
+	}
+	// The invite link goes through the code lookup like a room code does.
+	resp := inviteResponse{Invite: inv, InviteURL: s.linkBase(r) + "/?code=" + url.QueryEscape(inv.Code)}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(resp)
 }
 
 func (s *Server) handleGetRoom(w http.ResponseWriter, r *http.Request) {
@@ -207,8 +697,114 @@ func (s *Server) handleGetRoom(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Only the creator gets the permanent code back: anyone else may know
+	// the ID from a one-use or expiring invite.
+	resp := s.roomLinks(r, rm)
+	if userID := s.sessionUserID(r); userID == "" || userID != rm.CreatorID {
+		resp.Code = ""
+		resp.CodeURL = ""
+	}
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(rm)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// handleRoomResource dispatches GET /api/rooms/{id}/{resource}. A single
+// wildcard route is used because a literal "/stats" suffix would conflict
+// with the /api/rooms/code/{code} pattern.
+func (s *Server) handleRoomResource(w http.ResponseWriter, r *http.Request) {
+	switch r.PathValue("resource") {
+	case "stats":
+		s.handleRoomStats(w, r)
+	case "stream":
+		s.handleRoomStream(w, r)
+	default:
+		http.Error(w, `{"error":"not found"}`, http.StatusNotFound)
+	}
+}
+
+// roomStats is the response body for GET /api/rooms/{id}/stats.
+type roomStats struct {
+	RoomID        string `json:"room_id"`
+	CurrentUsers  int    `json:"current_users"`
+	PeakUsers     int    `json:"peak_users"`
+	TotalMessages int64  `json:"total_messages"`
+	AgeSeconds    int64  `json:"age_seconds"`
+}
+
+func (s *Server) handleRoomStats(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	rm := s.rooms.Get(id)
+	if rm == nil {
+		http.Error(w, `{"error":"room not found"}`, http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(roomStats{
+		RoomID:        rm.ID,
+		CurrentUsers:  s.hub.ClientCount(id),
+		PeakUsers:     rm.PeakUsers(),
+		TotalMessages: rm.MessageCount(),
+		AgeSeconds:    int64(time.Since(rm.CreatedAt).Seconds()),
+	})
+}
+
+// streamHeartbeat is how often an idle room stream sends an SSE comment,
+// so proxies don't time the connection out.
+const streamHeartbeat = 15 * time.Second
+
+// handleRoomStream serves GET /api/rooms/{id}/stream: a read-only
+// Server-Sent Events feed of the room's broadcasts for clients that can't
+// open a WebSocket. Each event's data is one envelope, as it would arrive
+// over the socket. Posting goes through the REST API instead.
+func (s *Server) handleRoomStream(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if s.rooms.Get(id) == nil {
+		http.Error(w, `{"error":"room not found"}`, http.StatusNotFound)
+		return
+	}
+	// Knock-only rooms and banned addresses don't get a way around the door.
+	if s.hub.KnockRequired(id) || s.hub.IsBannedIP(id, clientIP(r)) {
+		http.Error(w, `{"error":"forbidden"}`, http.StatusForbidden)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, `{"error":"streaming unsupported"}`, http.StatusInternalServerError)
+		return
+	}
+
+	events, remove := s.hub.AddReadOnly(id)
+	defer remove()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	fmt.Fprint(w, ": connected\n\n")
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(streamHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case data, ok := <-events:
+			if !ok {
+				// The room expired.
+				return
+			}
+			if _, err := fmt.Fprintf(w, "data: %s\n\n", data); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
 }
 
 type createRoomRequest struct {
@@ -216,6 +812,19 @@ type createRoomRequest struct {
 	Description string `json:"description"`
 	Capacity    int    `json:"capacity"`
 	Public      bool   `json:"public"`
+	Ephemeral   bool   `json:"ephemeral"`
+
+	// KnockRequired makes everyone but the host ask to join.
+	KnockRequired bool `json:"knock_required"`
+
+	// Optional per-room chat rate limit override.
+	ChatRateLimit         int `json:"chat_rate_limit"`
+	ChatRateWindowSeconds int `json:"chat_rate_window_seconds"`
+
+	// Optional cap on stored messages, below the store's own limit, and
+	// what to do once it is reached.
+	MessageCap     int                    `json:"message_cap"`
+	OverflowPolicy message.OverflowPolicy `json:"overflow_policy"`
 }
 
 func clientIP(r *http.Request) string {
@@ -234,8 +843,42 @@ func clientIP(r *http.Request) string {
 	return addr
 }
 
+// setRateLimitHeaders reports the limiter's state for key so clients can
+// back off: X-RateLimit-Remaining, X-RateLimit-Reset (Unix seconds), and on
+// a rejected request Retry-After (seconds).
+func setRateLimitHeaders(w http.ResponseWriter, l *ratelimit.IPLimiter, key string, limited bool) {
+	reset := l.Reset(key)
+	w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(l.Remaining(key)))
+	w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(reset.Unix(), 10))
+	if limited {
+		secs := int(math.Ceil(time.Until(reset).Seconds()))
+		if secs < 1 {
+			secs = 1
+		}
+		w.Header().Set("Retry-After", strconv.Itoa(secs))
+	}
+}
+
+// fieldErrorResponse is the body of a 400 caused by one invalid request
+// field. Error is kept alongside Field for clients that only read error.
+type fieldErrorResponse struct {
+	Field string `json:"field"`
+	Error string `json:"error"`
+}
+
+// fieldError rejects a request because of one invalid field, naming the
+// field so a form can show the message next to the right input.
+func fieldError(w http.ResponseWriter, field, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(fieldErrorResponse{Field: field, Error: msg})
+}
+
 func (s *Server) handleCreateRoom(w http.ResponseWriter, r *http.Request) {
-	if !s.createLimit.Allow(clientIP(r)) {
+	ip := clientIP(r)
+	allowed := s.createLimit.Allow(ip)
+	setRateLimitHeaders(w, s.createLimit, ip, !allowed)
+	if !allowed {
 		http.Error(w, `{"error":"rate limit exceeded, max 3 rooms per hour"}`, http.StatusTooManyRequests)
 		return
 	}
@@ -250,27 +893,74 @@ func (s *Server) handleCreateRoom(w http.ResponseWriter, r *http.Request) {
 	req.Description = strings.TrimSpace(req.Description)
 
 	if req.Name == "" {
-		http.Error(w, `{"error":"name is required"}`, http.StatusBadRequest)
+		fieldError(w, "name", "name is required")
 		return
 	}
 	if len(req.Name) > 100 {
-		http.Error(w, `{"error":"name must be 100 characters or less"}`, http.StatusBadRequest)
+		fieldError(w, "name", "name must be 100 characters or less")
 		return
 	}
 	if len(req.Description) > 500 {
-		http.Error(w, `{"error":"description must be 500 characters or less"}`, http.StatusBadRequest)
+		fieldError(w, "description", "description must be 500 characters or less")
 		return
 	}
 	if req.Capacity < 2 || req.Capacity > 100 {
-		http.Error(w, `{"error":"capacity must be between 2 and 100"}`, http.StatusBadRequest)
+		fieldError(w, "capacity", "capacity must be between 2 and 100")
 		return
 	}
 
-	room := s.rooms.Create(req.Name, req.Description, "", req.Capacity, req.Public)
+	if req.ChatRateLimit != 0 || req.ChatRateWindowSeconds != 0 {
+		if req.ChatRateLimit < 1 || req.ChatRateLimit > 100 {
+			fieldError(w, "chat_rate_limit", "chat_rate_limit must be between 1 and 100")
+			return
+		}
+		if req.ChatRateWindowSeconds < 1 || req.ChatRateWindowSeconds > 3600 {
+			fieldError(w, "chat_rate_window_seconds", "chat_rate_window_seconds must be between 1 and 3600")
+			return
+		}
+	}
+
+	if req.MessageCap < 0 || req.MessageCap > messageStoreSize {
+		fieldError(w, "message_cap", fmt.Sprintf("message_cap must be between 0 and %d", messageStoreSize))
+		return
+	}
+	if !req.OverflowPolicy.Valid() {
+		fieldError(w, "overflow_policy", `overflow_policy must be "drop-oldest" or "reject-new"`)
+		return
+	}
+	if req.OverflowPolicy != "" && req.MessageCap == 0 {
+		fieldError(w, "message_cap", "message_cap is required with overflow_policy")
+		return
+	}
+
+	rm, err := s.rooms.Create(req.Name, req.Description, s.sessionUserID(r), req.Capacity, req.Public)
+	if errors.Is(err, room.ErrTooManyOwnedRooms) {
+		http.Error(w, fmt.Sprintf(`{"error":"you already own %d rooms"}`, s.maxPerUser), http.StatusTooManyRequests)
+		return
+	}
+	if err != nil {
+		http.Error(w, `{"error":"too many rooms, try again later"}`, http.StatusServiceUnavailable)
+		return
+	}
+	rm.Ephemeral = req.Ephemeral
+	if req.KnockRequired {
+		s.hub.SetKnockRequired(rm.ID, true)
+	}
+	if req.ChatRateLimit > 0 {
+		rm.SetChatRateLimit(req.ChatRateLimit, time.Duration(req.ChatRateWindowSeconds)*time.Second)
+	}
+	if req.MessageCap > 0 {
+		rm.MessageCap = req.MessageCap
+		rm.OverflowPolicy = req.OverflowPolicy
+		if rm.OverflowPolicy == "" {
+			rm.OverflowPolicy = message.OverflowDropOldest
+		}
+		s.messages.SetRoomLimit(rm.ID, rm.MessageCap, rm.OverflowPolicy)
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
-	json.NewEncoder(w).Encode(room)
+	json.NewEncoder(w).Encode(s.roomLinks(r, rm))
 }
 
 func (s *Server) handleRoomUsers(w http.ResponseWriter, r *http.Request) {
@@ -281,8 +971,268 @@ func (s *Server) handleRoomUsers(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	users := s.hub.RoomUsers(id)
 	w.Header().Set("Content-Type", "application/json")
+	if wantsActivity(r) {
+		json.NewEncoder(w).Encode(s.roomUsersWithActivity(id, s.hub.ConnMgr().Clients()))
+		return
+	}
+	json.NewEncoder(w).Encode(s.hub.RoomUsers(id))
+}
+
+// roomUserActivity is a RoomUser with how long they have been connected and
+// how long since they last did anything, for moderators telling silent
+// lurkers apart from new arrivals.
+type roomUserActivity struct {
+	ws.RoomUser
+	ConnectedAt time.Time `json:"connected_at"`
+	IdleSeconds int64     `json:"idle_seconds"`
+}
+
+// wantsActivity reports whether a room-users request asked for connection
+// activity with ?activity=true. Without it the response keeps the plain
+// RoomUser shape.
+func wantsActivity(r *http.Request) bool {
+	return r.URL.Query().Get("activity") == "true"
+}
+
+// roomUsersWithActivity returns the room's users joined with their entries
+// in conns by user ID. A user connected more than once counts from their
+// oldest connection and is only as idle as their most active one.
+func (s *Server) roomUsersWithActivity(roomID string, conns []ws.ConnInfo) []roomUserActivity {
+	type activity struct {
+		connectedAt time.Time
+		idle        time.Duration
+	}
+	byUser := make(map[string]activity)
+	for _, c := range conns {
+		if c.RoomID != roomID {
+			continue
+		}
+		a, ok := byUser[c.UserID]
+		if !ok {
+			byUser[c.UserID] = activity{c.ConnectedAt, c.Idle}
+			continue
+		}
+		if c.ConnectedAt.Before(a.connectedAt) {
+			a.connectedAt = c.ConnectedAt
+		}
+		a.idle = min(a.idle, c.Idle)
+		byUser[c.UserID] = a
+	}
+
+	users := s.hub.RoomUsers(roomID)
+	out := make([]roomUserActivity, len(users))
+	for i, u := range users {
+		a := byUser[u.UserID]
+		out[i] = roomUserActivity{
+			RoomUser:    u,
+			ConnectedAt: a.connectedAt,
+			IdleSeconds: int64(a.idle / time.Second),
+		}
+	}
+	return out
+}
+
+// maxBulkRoomUsers caps how many rooms one GET /api/room-users can ask about.
+const maxBulkRoomUsers = 50
+
+// handleBulkRoomUsers returns the users in several rooms at once, keyed by
+// room ID, for directories that show many rooms. Unknown rooms are left out.
+func (s *Server) handleBulkRoomUsers(w http.ResponseWriter, r *http.Request) {
+	var ids []string
+	for _, id := range strings.Split(r.URL.Query().Get("ids"), ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 {
+		http.Error(w, `{"error":"ids is required"}`, http.StatusBadRequest)
+		return
+	}
+	if len(ids) > maxBulkRoomUsers {
+		http.Error(w, fmt.Sprintf(`{"error":"at most %d ids per request"}`, maxBulkRoomUsers), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if wantsActivity(r) {
+		conns := s.hub.ConnMgr().Clients()
+		users := make(map[string][]roomUserActivity, len(ids))
+		for _, id := range ids {
+			if s.rooms.Get(id) != nil {
+				users[id] = s.roomUsersWithActivity(id, conns)
+			}
+		}
+		json.NewEncoder(w).Encode(users)
+		return
+	}
+	users := make(map[string][]ws.RoomUser, len(ids))
+	for _, id := range ids {
+		if s.rooms.Get(id) != nil {
+			users[id] = s.hub.RoomUsers(id)
+		}
+	}
 	json.NewEncoder(w).Encode(users)
 }
 
+// handleAttachment serves the bytes of an uploaded chat attachment.
+func (s *Server) handleAttachment(w http.ResponseWriter, r *http.Request) {
+	data, mime, ok := s.hub.Attachment(r.PathValue("id"))
+	if !ok {
+		http.Error(w, `{"error":"attachment not found"}`, http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", mime)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Write(data)
+}
+
+// requireAdmin wraps a handler so it only runs when the request carries the
+// configured admin key.
+func (s *Server) requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.adminKey == "" {
+			http.Error(w, `{"error":"admin API disabled"}`, http.StatusForbidden)
+			return
+		}
+		key := r.Header.Get("X-Admin-Key")
+		if subtle.ConstantTimeCompare([]byte(key), []byte(s.adminKey)) != 1 {
+			http.Error(w, `{"error":"unauthorized"}`, http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// handleArchive returns the saved transcript of an expired room.
+func (s *Server) handleArchive(w http.ResponseWriter, r *http.Request) {
+	if s.archive == nil {
+		http.Error(w, `{"error":"archive disabled"}`, http.StatusNotFound)
+		return
+	}
+	t := s.archive.Load(r.PathValue("id"))
+	if t == nil {
+		http.Error(w, `{"error":"transcript not found"}`, http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(t)
+}
+
+// expiringRoom is one entry of GET /api/admin/rooms/expiring.
+type expiringRoom struct {
+	ID               string `json:"id"`
+	Name             string `json:"name"`
+	Reason           string `json:"reason"`
+	RemainingSeconds int    `json:"remaining_seconds"`
+}
+
+// handleExpiringRooms lists the rooms that are about to expire, with why
+// and how long they have left. It only looks: rooms listed here still get
+// their warning over WebSocket.
+func (s *Server) handleExpiringRooms(w http.ResponseWriter, r *http.Request) {
+	out := []expiringRoom{}
+	for _, e := range s.rooms.Expiring() {
+		out = append(out, expiringRoom{
+			ID:               e.Room.ID,
+			Name:             e.Room.Name,
+			Reason:           e.Reason.String(),
+			RemainingSeconds: int(e.Remaining.Seconds()),
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
+
+type announceRequest struct {
+	Content string `json:"content"`
+	Persist bool   `json:"persist"`
+}
+
+// handleAnnounce broadcasts a system announcement to every active room.
+func (s *Server) handleAnnounce(w http.ResponseWriter, r *http.Request) {
+	var req announceRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"error":"invalid JSON body"}`, http.StatusBadRequest)
+		return
+	}
+	req.Content = strings.TrimSpace(req.Content)
+	if req.Content == "" {
+		http.Error(w, `{"error":"content is required"}`, http.StatusBadRequest)
+		return
+	}
+	if len(req.Content) > 2000 {
+		http.Error(w, `{"error":"content must be 2000 characters or less"}`, http.StatusBadRequest)
+		return
+	}
+
+	n := s.hub.Announce(&message.Message{
+		Content: req.Content,
+		Type:    message.TypeSystem,
+		Action:  message.ActionAnnouncement,
+	}, req.Persist)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"rooms": n})
+}
+
+type botMessageRequest struct {
+	Username string `json:"username"`
+	Content  string `json:"content"`
+}
+
+// handleBotMessage posts a chat message into a room on behalf of an external
+// system. Requests are rate limited per key, like chat is per user.
+func (s *Server) handleBotMessage(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if s.rooms.Get(id) == nil {
+		http.Error(w, `{"error":"room not found"}`, http.StatusNotFound)
+		return
+	}
+	key := r.Header.Get("X-Admin-Key")
+	allowed := s.botLimit.Allow(key)
+	setRateLimitHeaders(w, s.botLimit, key, !allowed)
+	if !allowed {
+		http.Error(w, `{"error":"rate limit exceeded: max 10 messages per 10 seconds"}`, http.StatusTooManyRequests)
+		return
+	}
+
+	var req botMessageRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"error":"invalid JSON body"}`, http.StatusBadRequest)
+		return
+	}
+	req.Username = strings.TrimSpace(req.Username)
+	req.Content = strings.TrimSpace(req.Content)
+	if req.Username == "" {
+		req.Username = "bot"
+	}
+	if len(req.Username) > 30 {
+		http.Error(w, `{"error":"username must be 30 characters or less"}`, http.StatusBadRequest)
+		return
+	}
+	if req.Content == "" {
+		http.Error(w, `{"error":"content is required"}`, http.StatusBadRequest)
+		return
+	}
+	if len(req.Content) > 2000 {
+		http.Error(w, `{"error":"content must be 2000 characters or less"}`, http.StatusBadRequest)
+		return
+	}
+
+	msg := &message.Message{
+		RoomID:   id,
+		Username: req.Username,
+		Content:  req.Content,
+		Type:     message.TypeChat,
+		Bot:      true,
+	}
+	if s.hub.HistoryFull(id) || !s.hub.Broadcast(id, msg) {
+		http.Error(w, `{"error":"this room has reached its message limit","code":"history_full"}`, http.StatusConflict)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(msg)
+}
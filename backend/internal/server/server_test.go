@@ -1,14 +1,26 @@
 package server
 
 import (
+	"bufio"
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/alicebob/miniredis/v2"
+	"github.com/christopherjohns/chatsphere/internal/message"
+	"github.com/christopherjohns/chatsphere/internal/room"
 	"github.com/christopherjohns/chatsphere/internal/ws"
+	"github.com/redis/go-redis/v9"
+	"nhooyr.io/websocket"
 )
 
 func TestHealthEndpoint(t *testing.T) {
@@ -76,13 +88,14 @@ func TestListRoomsWithData(t *testing.T) {
 
 func TestListRoomsSortedByActiveUsers(t *testing.T) {
 	srv := New(":0")
-	r1 := srv.rooms.Create("Low Activity", "", "user1", 50, true)
-	r2 := srv.rooms.Create("High Activity", "", "user1", 50, true)
-	r3 := srv.rooms.Create("Mid Activity", "", "user1", 50, true)
+	r1, _ := srv.rooms.Create("Low Activity", "", "user1", 50, true)
+	r2, _ := srv.rooms.Create("High Activity", "", "user1", 50, true)
+	r3, _ := srv.rooms.Create("Mid Activity", "", "user1", 50, true)
 
-	r1.AddActiveUsers(2)
-	r2.AddActiveUsers(15)
-	r3.AddActiveUsers(7)
+	counts := fakeClientCounts(srv)
+	counts[r1.ID] = 2
+	counts[r2.ID] = 15
+	counts[r3.ID] = 7
 
 	req := httptest.NewRequest(http.MethodGet, "/api/rooms", nil)
 	w := httptest.NewRecorder()
@@ -121,11 +134,55 @@ func TestListRoomsSortedByActiveUsers(t *testing.T) {
 	}
 }
 
+func TestListRoomsAvailable(t *testing.T) {
+	srv := New(":0")
+	small, _ := srv.rooms.Create("Small", "", "user1", 2, true)
+	big, _ := srv.rooms.Create("Big", "", "user1", 50, true)
+
+	counts := fakeClientCounts(srv)
+	counts[small.ID] = 2
+	counts[big.ID] = 1
+
+	list := func(query string) []string {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, "/api/rooms"+query, nil)
+		w := httptest.NewRecorder()
+		srv.mux.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", w.Code)
+		}
+		var rooms []map[string]interface{}
+		if err := json.NewDecoder(w.Body).Decode(&rooms); err != nil {
+			t.Fatalf("failed to decode response: %v", err)
+		}
+		var names []string
+		for _, r := range rooms {
+			names = append(names, r["name"].(string))
+		}
+		return names
+	}
+
+	// The full room is hidden from the available list only.
+	if got := list("?available=true"); !slices.Equal(got, []string{"Big"}) {
+		t.Errorf("expected only Big to be available, got %v", got)
+	}
+	if got := list(""); !slices.Equal(got, []string{"Small", "Big"}) {
+		t.Errorf("expected both rooms in full list, got %v", got)
+	}
+
+	// Once someone leaves it is offered again, still sorted by activity.
+	counts[small.ID] = 1
+	counts[big.ID] = 3
+	if got := list("?available=true"); !slices.Equal(got, []string{"Big", "Small"}) {
+		t.Errorf("expected both rooms available, got %v", got)
+	}
+}
+
 func TestListRoomsExcludesPrivateRooms(t *testing.T) {
 	srv := New(":0")
 	srv.rooms.Create("Public Room", "", "user1", 50, true)
-	priv := srv.rooms.Create("Private Room", "", "user1", 10, false)
-	priv.AddActiveUsers(100) // High activity, but should still be excluded
+	priv, _ := srv.rooms.Create("Private Room", "", "user1", 10, false)
+	fakeClientCounts(srv)[priv.ID] = 100 // High activity, but should still be excluded
 
 	req := httptest.NewRequest(http.MethodGet, "/api/rooms", nil)
 	w := httptest.NewRecorder()
@@ -144,8 +201,8 @@ func TestListRoomsExcludesPrivateRooms(t *testing.T) {
 
 func TestListRoomsResponseFields(t *testing.T) {
 	srv := New(":0")
-	r := srv.rooms.Create("Test Room", "A description", "user1", 50, true)
-	r.AddActiveUsers(3)
+	r, _ := srv.rooms.Create("Test Room", "A description", "user1", 50, true)
+	fakeClientCounts(srv)[r.ID] = 3
 
 	req := httptest.NewRequest(http.MethodGet, "/api/rooms", nil)
 	w := httptest.NewRecorder()
@@ -179,6 +236,14 @@ func TestListRoomsResponseFields(t *testing.T) {
 	}
 }
 
+// fakeClientCounts replaces the hub as the source of room active user
+// counts with the returned map.
+func fakeClientCounts(srv *Server) map[string]int {
+	counts := make(map[string]int)
+	srv.rooms.SetClientCounter(func(roomID string) int { return counts[roomID] })
+	return counts
+}
+
 func postJSON(srv *Server, body string) *httptest.ResponseRecorder {
 	return postJSONFrom(srv, body, "")
 }
@@ -249,6 +314,61 @@ func TestCreateRoomPrivate(t *testing.T) {
 	}
 }
 
+func TestCreateRoomJoinURLs(t *testing.T) {
+	srv := New(":0", WithPublicBaseURL("https://chat.example.com/"))
+
+	var public map[string]any
+	json.NewDecoder(postJSON(srv, `{"name":"Open","capacity":10,"public":true}`).Body).Decode(&public)
+	if want := "https://chat.example.com/?room=" + public["id"].(string); public["join_url"] != want {
+		t.Errorf("expected join_url %q, got %v", want, public["join_url"])
+	}
+	if public["code_url"] != nil {
+		t.Errorf("expected no code_url for public room, got %v", public["code_url"])
+	}
+
+	owner := srv.userSessions.Create()
+	req := httptest.NewRequest(http.MethodPost, "/api/rooms", strings.NewReader(`{"name":"Secret","capacity":10,"public":false}`))
+	req.AddCookie(&http.Cookie{Name: sessionCookieName, Value: owner.Token})
+	w := httptest.NewRecorder()
+	srv.mux.ServeHTTP(w, req)
+	var private map[string]any
+	json.NewDecoder(w.Body).Decode(&private)
+	if want := "https://chat.example.com/?code=" + private["code"].(string); private["code_url"] != want {
+		t.Errorf("expected code_url %q, got %v", want, private["code_url"])
+	}
+
+	// The creator fetching the room gets the same links back...
+	req = httptest.NewRequest(http.MethodGet, "/api/rooms/"+private["id"].(string), nil)
+	req.AddCookie(&http.Cookie{Name: sessionCookieName, Value: owner.Token})
+	w = httptest.NewRecorder()
+	srv.mux.ServeHTTP(w, req)
+	var fetched map[string]any
+	json.NewDecoder(w.Body).Decode(&fetched)
+	if fetched["code_url"] != private["code_url"] || fetched["join_url"] != private["join_url"] {
+		t.Errorf("expected get to return the create links, got %v / %v", fetched["join_url"], fetched["code_url"])
+	}
+
+	// ...while anyone else only gets the join link.
+	req = httptest.NewRequest(http.MethodGet, "/api/rooms/"+private["id"].(string), nil)
+	w = httptest.NewRecorder()
+	srv.mux.ServeHTTP(w, req)
+	fetched = nil
+	json.NewDecoder(w.Body).Decode(&fetched)
+	if fetched["code"] != nil || fetched["code_url"] != nil || fetched["join_url"] != private["join_url"] {
+		t.Errorf("expected only the join link for a stranger, got %v", fetched)
+	}
+}
+
+func TestCreateRoomJoinURLDefaultsToRequestHost(t *testing.T) {
+	srv := New(":0")
+
+	var room map[string]any
+	json.NewDecoder(postJSON(srv, `{"name":"Open","capacity":10,"public":true}`).Body).Decode(&room)
+	if want := "http://example.com/?room=" + room["id"].(string); room["join_url"] != want {
+		t.Errorf("expected join_url %q, got %v", want, room["join_url"])
+	}
+}
+
 func TestCreateRoomAppearsInList(t *testing.T) {
 	srv := New(":0")
 
@@ -313,8 +433,8 @@ func TestGetRoomByIDNotFound(t *testing.T) {
 
 func TestGetRoomByIDIncludesActiveUsers(t *testing.T) {
 	srv := New(":0")
-	r := srv.rooms.Create("Active Room", "", "user1", 50, true)
-	r.AddActiveUsers(5)
+	r, _ := srv.rooms.Create("Active Room", "", "user1", 50, true)
+	fakeClientCounts(srv)[r.ID] = 5
 
 	req := httptest.NewRequest(http.MethodGet, "/api/rooms/"+r.ID, nil)
 	w := httptest.NewRecorder()
@@ -331,6 +451,66 @@ func TestGetRoomByIDIncludesActiveUsers(t *testing.T) {
 	}
 }
 
+func TestGetRoomByIDIncludesTopic(t *testing.T) {
+	srv := New(":0")
+	r, _ := srv.rooms.Create("Topic Room", "Set at creation", "user1", 50, true)
+	r.SetTopic("Release party at 5pm")
+
+	req := httptest.NewRequest(http.MethodGet, "/api/rooms/"+r.ID, nil)
+	w := httptest.NewRecorder()
+	srv.mux.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+
+	var room map[string]interface{}
+	json.NewDecoder(w.Body).Decode(&room)
+	if room["topic"] != "Release party at 5pm" {
+		t.Errorf("expected topic 'Release party at 5pm', got %v", room["topic"])
+	}
+	if room["description"] != "Set at creation" {
+		t.Errorf("expected description unchanged, got %v", room["description"])
+	}
+}
+
+func TestCapabilities(t *testing.T) {
+	get := func(srv *Server) ws.Capabilities {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, "/api/capabilities", nil)
+		w := httptest.NewRecorder()
+		srv.mux.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d", w.Code)
+		}
+		var caps ws.Capabilities
+		if err := json.NewDecoder(w.Body).Decode(&caps); err != nil {
+			t.Fatalf("decode error: %v", err)
+		}
+		return caps
+	}
+
+	caps := get(New(":0"))
+	if !caps.EditingEnabled || !caps.AttachmentsEnabled {
+		t.Errorf("expected editing and attachments on by default, got %+v", caps)
+	}
+	if caps.ReactionsEnabled {
+		t.Error("reactions are not supported")
+	}
+	if caps.MaxMessageLength != 2000 || caps.HistoryLimit != 50 {
+		t.Errorf("unexpected limits: %+v", caps)
+	}
+
+	caps = get(New(":0", WithoutEditing()))
+	if caps.EditingEnabled || !caps.AttachmentsEnabled {
+		t.Errorf("expected only editing off, got %+v", caps)
+	}
+	caps = get(New(":0", WithoutAttachments()))
+	if !caps.EditingEnabled || caps.AttachmentsEnabled {
+		t.Errorf("expected only attachments off, got %+v", caps)
+	}
+}
+
 func TestGetRoomByCode(t *testing.T) {
 	srv := New(":0")
 
@@ -354,6 +534,79 @@ func TestGetRoomByCode(t *testing.T) {
 	}
 }
 
+func TestRoomInvites(t *testing.T) {
+	srv := New(":0")
+	owner := srv.userSessions.Create()
+	do := func(method, path, body, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		if token != "" {
+			req.AddCookie(&http.Cookie{Name: sessionCookieName, Value: token})
+		}
+		w := httptest.NewRecorder()
+		srv.mux.ServeHTTP(w, req)
+		return w
+	}
+
+	var created map[string]any
+	json.NewDecoder(do(http.MethodPost, "/api/rooms", `{"name":"Secret","capacity":10}`, owner.Token).Body).Decode(&created)
+	roomID, code := created["id"].(string), created["code"].(string)
+
+	if w := do(http.MethodPost, "/api/rooms/"+roomID+"/invites", `{}`, srv.userSessions.Create().Token); w.Code != http.StatusForbidden {
+		t.Fatalf("expected 403 for someone else's room, got %d", w.Code)
+	}
+	// 9223372037 seconds overflows a time.Duration into a negative one.
+	for _, ttl := range []string{"604801", "9223372037", "-1"} {
+		w := do(http.MethodPost, "/api/rooms/"+roomID+"/invites", `{"ttl_seconds":`+ttl+`}`, owner.Token)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("ttl_seconds %s: expected 400, got %d", ttl, w.Code)
+		}
+	}
+	w := do(http.MethodPost, "/api/rooms/"+roomID+"/invites", `{"max_uses":1}`, owner.Token)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", w.Code, w.Body.String())
+	}
+	var invite map[string]any
+	json.NewDecoder(w.Body).Decode(&invite)
+	inviteCode := invite["code"].(string)
+	if invite["invite_url"] != "http://example.com/?code="+inviteCode {
+		t.Errorf("unexpected invite_url %v", invite["invite_url"])
+	}
+
+	w = do(http.MethodGet, "/api/rooms/code/"+inviteCode, "", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected the invite to resolve, got %d", w.Code)
+	}
+	var resolved map[string]any
+	json.NewDecoder(w.Body).Decode(&resolved)
+	if resolved["id"] != roomID {
+		t.Errorf("expected room %s, got %v", roomID, resolved["id"])
+	}
+	if _, ok := resolved["code"]; ok {
+		t.Error("expected the permanent code to be withheld from invite holders")
+	}
+	// Following the invite's join link doesn't reveal it either.
+	var byID map[string]any
+	json.NewDecoder(do(http.MethodGet, "/api/rooms/"+roomID, "", "").Body).Decode(&byID)
+	if byID["code"] != nil || byID["code_url"] != nil {
+		t.Errorf("expected the permanent code to be withheld by room ID, got %v / %v", byID["code"], byID["code_url"])
+	}
+	if w := do(http.MethodGet, "/api/rooms/code/"+inviteCode, "", ""); w.Code != http.StatusGone {
+		t.Errorf("expected 410 for a used-up invite, got %d", w.Code)
+	}
+
+	expired := srv.rooms.Get(roomID).CreateInvite(time.Nanosecond, 0)
+	time.Sleep(time.Millisecond)
+	if w := do(http.MethodGet, "/api/rooms/code/"+expired.Code, "", ""); w.Code != http.StatusGone {
+		t.Errorf("expected 410 for an expired invite, got %d", w.Code)
+	}
+	if w := do(http.MethodGet, "/api/rooms/code/ZZZZZZZZ", "", ""); w.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for an unknown invite, got %d", w.Code)
+	}
+	if w := do(http.MethodGet, "/api/rooms/code/"+code, "", ""); w.Code != http.StatusOK {
+		t.Errorf("expected the permanent code to still resolve, got %d", w.Code)
+	}
+}
+
 func TestGetRoomByCodeNotFound(t *testing.T) {
 	srv := New(":0")
 
@@ -396,6 +649,227 @@ func TestGetRoomByCodeCaseInsensitive(t *testing.T) {
 	}
 }
 
+func TestRoomCodeResolvesAlikeOverRESTAndJoin(t *testing.T) {
+	srv := New(":0")
+	ts := httptest.NewServer(srv.mux)
+	defer ts.Close()
+
+	w := postJSON(srv, `{"name":"Secret","capacity":10,"public":false}`)
+	var created map[string]any
+	json.NewDecoder(w.Body).Decode(&created)
+	code := created["code"].(string)
+	mixed := strings.ToLower(code[:3]) + code[3:]
+
+	tests := []struct {
+		name  string
+		input string
+		found bool
+	}{
+		{"canonical", code, true},
+		{"lowercase", strings.ToLower(code), true},
+		{"mixed case", mixed, true},
+		{"padded", "  " + strings.ToLower(code) + "\t", true},
+		{"invalid character", code[:5] + "-", false},
+		{"too short", code[:5], false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/api/rooms/code/"+url.PathEscape(tt.input), nil)
+			w := httptest.NewRecorder()
+			srv.mux.ServeHTTP(w, req)
+			if got := w.Code == http.StatusOK; got != tt.found {
+				t.Errorf("REST lookup: expected found=%v, got status %d", tt.found, w.Code)
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			conn, _, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(ts.URL, "http")+"/ws", nil)
+			if err != nil {
+				t.Fatalf("dial error: %v", err)
+			}
+			defer conn.Close(websocket.StatusNormalClosure, "")
+			payload, _ := json.Marshal(ws.JoinPayload{Code: tt.input, Username: "alice"})
+			env, _ := json.Marshal(ws.Envelope{Type: "join", Payload: payload})
+			if err := conn.Write(ctx, websocket.MessageText, env); err != nil {
+				t.Fatalf("write join error: %v", err)
+			}
+			_, data, err := conn.Read(ctx)
+			if !tt.found {
+				if err == nil {
+					t.Fatalf("join: expected the connection closed, got %s", data)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("join: expected a session, got %v", err)
+			}
+			var got ws.Envelope
+			json.Unmarshal(data, &got)
+			if got.Type != "session" {
+				t.Fatalf("join: expected session, got %s", got.Type)
+			}
+			// The joined envelope ends the handshake; skip history first.
+			for got.Type != "joined" {
+				_, data, err = conn.Read(ctx)
+				if err != nil {
+					t.Fatalf("join: read error: %v", err)
+				}
+				json.Unmarshal(data, &got)
+			}
+			var joined ws.JoinedPayload
+			json.Unmarshal(got.Payload, &joined)
+			if joined.RoomID != created["id"] {
+				t.Errorf("join: expected room %v, got %s", created["id"], joined.RoomID)
+			}
+		})
+	}
+}
+
+func TestCreateRoomEphemeral(t *testing.T) {
+	srv := New(":0")
+
+	w := postJSON(srv, `{"name":"Support","capacity":2,"public":false,"ephemeral":true}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d", w.Code)
+	}
+	var room map[string]any
+	json.NewDecoder(w.Body).Decode(&room)
+	if room["ephemeral"] != true {
+		t.Errorf("expected ephemeral true, got %v", room["ephemeral"])
+	}
+	id := room["id"].(string)
+	if !srv.hub.IsEphemeral(id) {
+		t.Error("expected the hub to treat the room as ephemeral")
+	}
+
+	srv.hub.Broadcast(id, &message.Message{ID: "m1", RoomID: id, Content: "private", Type: message.TypeChat})
+	if n := srv.messages.Count(id); n != 0 {
+		t.Errorf("expected nothing stored for an ephemeral room, got %d", n)
+	}
+
+	other := createRoomID(t, srv)
+	if srv.hub.IsEphemeral(other) {
+		t.Error("rooms are not ephemeral by default")
+	}
+}
+
+func TestCreateRoomMaxRooms(t *testing.T) {
+	srv := New(":0", WithMaxRooms(2))
+	body := `{"name":"Room","capacity":10,"public":true}`
+
+	// Spread across addresses so the per-IP limit never applies.
+	var ids []string
+	for i := 1; i <= 2; i++ {
+		w := postJSONFrom(srv, body, fmt.Sprintf("10.0.0.%d:1234", i))
+		if w.Code != http.StatusCreated {
+			t.Fatalf("room %d: expected 201, got %d", i, w.Code)
+		}
+		var room map[string]any
+		json.NewDecoder(w.Body).Decode(&room)
+		ids = append(ids, room["id"].(string))
+	}
+
+	w := postJSONFrom(srv, body, "10.0.0.3:1234")
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503 at the room cap, got %d", w.Code)
+	}
+	if !strings.Contains(w.Body.String(), "too many rooms") {
+		t.Errorf("expected a too many rooms error, got %s", w.Body.String())
+	}
+
+	// Room expiry deletes through the manager, freeing a slot.
+	srv.rooms.Delete(ids[0])
+	if w := postJSONFrom(srv, body, "10.0.0.3:1234"); w.Code != http.StatusCreated {
+		t.Fatalf("expected 201 after a room expired, got %d", w.Code)
+	}
+}
+
+func TestCreateRoomMaxPerUser(t *testing.T) {
+	srv := New(":0", WithMaxRoomsPerUser(2))
+	sess := srv.userSessions.Create()
+	body := `{"name":"Room","capacity":10,"public":true}`
+
+	post := func(remoteAddr string, withCookie bool) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/api/rooms", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.RemoteAddr = remoteAddr
+		if withCookie {
+			req.AddCookie(&http.Cookie{Name: sessionCookieName, Value: sess.Token})
+		}
+		w := httptest.NewRecorder()
+		srv.mux.ServeHTTP(w, req)
+		return w
+	}
+
+	var ids []string
+	for i := 1; i <= 2; i++ {
+		w := post(fmt.Sprintf("10.0.0.%d:1234", i), true)
+		if w.Code != http.StatusCreated {
+			t.Fatalf("room %d: expected 201, got %d", i, w.Code)
+		}
+		var room map[string]any
+		json.NewDecoder(w.Body).Decode(&room)
+		ids = append(ids, room["id"].(string))
+	}
+
+	w := post("10.0.0.3:1234", true)
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected 429 past the per-user cap, got %d", w.Code)
+	}
+	if !strings.Contains(w.Body.String(), "you already own 2 rooms") {
+		t.Errorf("expected an owned rooms error, got %s", w.Body.String())
+	}
+
+	// Requests without a session are not counted against anyone.
+	if w := post("10.0.0.4:1234", false); w.Code != http.StatusCreated {
+		t.Fatalf("expected 201 without a session cookie, got %d", w.Code)
+	}
+
+	srv.rooms.Delete(ids[0])
+	if w := post("10.0.0.5:1234", true); w.Code != http.StatusCreated {
+		t.Fatalf("expected 201 after a room expired, got %d", w.Code)
+	}
+}
+
+func TestCreateRoomFieldErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		body  string
+		field string
+		error string
+	}{
+		{"missing name", `{"name":"","capacity":10}`, "name", "name is required"},
+		{"long name", `{"name":"` + strings.Repeat("a", 101) + `","capacity":10}`, "name", "name must be 100 characters or less"},
+		{"long description", `{"name":"Room","description":"` + strings.Repeat("a", 501) + `","capacity":10}`, "description", "description must be 500 characters or less"},
+		{"capacity too low", `{"name":"Room","capacity":1}`, "capacity", "capacity must be between 2 and 100"},
+		{"capacity too high", `{"name":"Room","capacity":101}`, "capacity", "capacity must be between 2 and 100"},
+		{"chat rate limit", `{"name":"Room","capacity":10,"chat_rate_limit":0,"chat_rate_window_seconds":10}`, "chat_rate_limit", "chat_rate_limit must be between 1 and 100"},
+		{"chat rate window", `{"name":"Room","capacity":10,"chat_rate_limit":5}`, "chat_rate_window_seconds", "chat_rate_window_seconds must be between 1 and 3600"},
+		{"message cap too high", `{"name":"Room","capacity":10,"message_cap":201}`, "message_cap", "message_cap must be between 0 and 200"},
+		{"unknown overflow policy", `{"name":"Room","capacity":10,"message_cap":50,"overflow_policy":"wrap"}`, "overflow_policy", `overflow_policy must be "drop-oldest" or "reject-new"`},
+		{"overflow policy without cap", `{"name":"Room","capacity":10,"overflow_policy":"reject-new"}`, "message_cap", "message_cap is required with overflow_policy"},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := New(":0")
+			w := postJSONFrom(srv, tt.body, fmt.Sprintf("10.0.1.%d:1234", i))
+			if w.Code != http.StatusBadRequest {
+				t.Fatalf("expected 400, got %d", w.Code)
+			}
+			if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+				t.Errorf("expected application/json, got %q", ct)
+			}
+			var body map[string]string
+			if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+				t.Fatalf("decode error: %v", err)
+			}
+			if body["field"] != tt.field || body["error"] != tt.error {
+				t.Errorf("expected field %q error %q, got %v", tt.field, tt.error, body)
+			}
+		})
+	}
+}
+
 func TestCreateRoomMissingName(t *testing.T) {
 	srv := New(":0")
 
@@ -517,6 +991,42 @@ func TestCreateRoomRateLimitEnforced(t *testing.T) {
 	}
 }
 
+func TestCreateRoomRateLimitHeaders(t *testing.T) {
+	srv := New(":0")
+	ip := "10.0.0.1:12345"
+	body := `{"name":"Room","capacity":10,"public":true}`
+
+	var w *httptest.ResponseRecorder
+	for i := 0; i < 3; i++ {
+		w = postJSONFrom(srv, body, ip)
+		if got, want := w.Header().Get("X-RateLimit-Remaining"), strconv.Itoa(2-i); got != want {
+			t.Errorf("request %d: expected X-RateLimit-Remaining %s, got %q", i+1, want, got)
+		}
+	}
+	reset, err := strconv.ParseInt(w.Header().Get("X-RateLimit-Reset"), 10, 64)
+	if err != nil {
+		t.Fatalf("invalid X-RateLimit-Reset: %v", err)
+	}
+	if until := time.Until(time.Unix(reset, 0)); until < 59*time.Minute || until > time.Hour {
+		t.Errorf("expected reset about an hour out, got %s", until)
+	}
+
+	w = postJSONFrom(srv, body, ip)
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected 429, got %d", w.Code)
+	}
+	retry, err := strconv.Atoi(w.Header().Get("Retry-After"))
+	if err != nil {
+		t.Fatalf("invalid Retry-After: %v", err)
+	}
+	if retry < 3500 || retry > 3600 {
+		t.Errorf("expected Retry-After close to 3600 seconds, got %d", retry)
+	}
+	if got := w.Header().Get("X-RateLimit-Remaining"); got != "0" {
+		t.Errorf("expected X-RateLimit-Remaining 0 on 429, got %q", got)
+	}
+}
+
 func TestCreateRoomRateLimitPerIP(t *testing.T) {
 	srv := New(":0")
 	body := `{"name":"Room","capacity":10,"public":true}`
@@ -574,6 +1084,29 @@ func TestSessionEndpointCreatesSession(t *testing.T) {
 	}
 }
 
+func TestSessionCookieOptions(t *testing.T) {
+	srv := New(":0", WithCookieOptions("chat.example.com", http.SameSiteNoneMode, 3600, false))
+
+	req := httptest.NewRequest(http.MethodGet, "/api/session", nil)
+	w := httptest.NewRecorder()
+	srv.mux.ServeHTTP(w, req)
+
+	header := w.Header().Get("Set-Cookie")
+	for _, want := range []string{"Domain=chat.example.com", "Max-Age=3600", "HttpOnly", "Secure", "SameSite=None"} {
+		if !strings.Contains(header, want) {
+			t.Errorf("expected %s in Set-Cookie, got %q", want, header)
+		}
+	}
+
+	// Clearing the cookie must match the domain it was set with.
+	req = httptest.NewRequest(http.MethodDelete, "/api/session", nil)
+	w = httptest.NewRecorder()
+	srv.mux.ServeHTTP(w, req)
+	if header := w.Header().Get("Set-Cookie"); !strings.Contains(header, "Domain=chat.example.com") || !strings.Contains(header, "Max-Age=0") {
+		t.Errorf("expected the cleared cookie to keep its domain, got %q", header)
+	}
+}
+
 func TestSessionEndpointReturnsSameSession(t *testing.T) {
 	srv := New(":0")
 
@@ -626,6 +1159,65 @@ func TestSessionEndpointInvalidCookieCreatesNew(t *testing.T) {
 	}
 }
 
+func TestDeleteSession(t *testing.T) {
+	srv := New(":0")
+	ts := httptest.NewServer(srv.mux)
+	defer ts.Close()
+	roomID := createRoomID(t, srv)
+	sess := srv.userSessions.Create()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, _, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(ts.URL, "http")+"/ws", &websocket.DialOptions{
+		HTTPHeader: http.Header{"Cookie": {sessionCookieName + "=" + sess.Token}},
+	})
+	if err != nil {
+		t.Fatalf("dial error: %v", err)
+	}
+	defer conn.Close(websocket.StatusNormalClosure, "")
+	payload, _ := json.Marshal(ws.JoinPayload{RoomID: roomID, Username: "alice"})
+	env, _ := json.Marshal(ws.Envelope{Type: "join", Payload: payload})
+	if err := conn.Write(ctx, websocket.MessageText, env); err != nil {
+		t.Fatalf("write join error: %v", err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for srv.hub.ClientCount(roomID) < 1 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	req := httptest.NewRequest(http.MethodDelete, "/api/session", nil)
+	req.AddCookie(&http.Cookie{Name: sessionCookieName, Value: sess.Token})
+	w := httptest.NewRecorder()
+	srv.mux.ServeHTTP(w, req)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d", w.Code)
+	}
+	if c := w.Result().Cookies(); len(c) != 1 || c[0].Name != sessionCookieName || c[0].MaxAge >= 0 {
+		t.Errorf("expected the session cookie to be cleared, got %+v", c)
+	}
+
+	// The live connection is closed.
+	for {
+		if _, _, err := conn.Read(ctx); err != nil {
+			break
+		}
+	}
+	if n := srv.hub.ClientCount(roomID); n != 0 {
+		t.Errorf("expected alice disconnected, %d clients left", n)
+	}
+
+	// The old cookie no longer resolves; a new identity is handed out.
+	req = httptest.NewRequest(http.MethodGet, "/api/session", nil)
+	req.AddCookie(&http.Cookie{Name: sessionCookieName, Value: sess.Token})
+	w = httptest.NewRecorder()
+	srv.mux.ServeHTTP(w, req)
+	var body map[string]any
+	json.NewDecoder(w.Body).Decode(&body)
+	if body["token"] == sess.Token || body["user_id"] == sess.UserID {
+		t.Errorf("expected a new session, got %v", body)
+	}
+}
+
 func TestCreateRoomRateLimitXForwardedFor(t *testing.T) {
 	srv := New(":0")
 	body := `{"name":"Room","capacity":10,"public":true}`
@@ -665,7 +1257,7 @@ func TestRoomUsersEndpointNotFound(t *testing.T) {
 
 func TestRoomUsersEndpointEmpty(t *testing.T) {
 	srv := New(":0")
-	rm := srv.rooms.Create("Test Room", "", "creator", 10, true)
+	rm, _ := srv.rooms.Create("Test Room", "", "creator", 10, true)
 
 	req := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/api/room-users/%s", rm.ID), nil)
 	w := httptest.NewRecorder()
@@ -683,3 +1275,636 @@ func TestRoomUsersEndpointEmpty(t *testing.T) {
 		t.Errorf("expected 0 users, got %d", len(users))
 	}
 }
+
+func TestBulkRoomUsers(t *testing.T) {
+	srv := New(":0")
+	ts := httptest.NewServer(srv.mux)
+	defer ts.Close()
+	room1 := createRoomID(t, srv)
+	room2 := createRoomID(t, srv)
+
+	alice := dialRoom(t, ts, room1, "alice")
+	defer alice.Close(websocket.StatusNormalClosure, "")
+	bob := dialRoom(t, ts, room2, "bob")
+	defer bob.Close(websocket.StatusNormalClosure, "")
+	deadline := time.Now().Add(2 * time.Second)
+	for (srv.hub.ClientCount(room1) < 1 || srv.hub.ClientCount(room2) < 1) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/api/room-users?ids="+room1+",nonexistent,"+room2, nil)
+	w := httptest.NewRecorder()
+	srv.mux.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+
+	var users map[string][]ws.RoomUser
+	if err := json.NewDecoder(w.Body).Decode(&users); err != nil {
+		t.Fatalf("decode error: %v", err)
+	}
+	if len(users) != 2 {
+		t.Fatalf("expected 2 rooms, got %v", users)
+	}
+	if _, ok := users["nonexistent"]; ok {
+		t.Error("expected unknown room to be omitted")
+	}
+	if u := users[room1]; len(u) != 1 || u[0].Username != "alice" {
+		t.Errorf("expected alice in room1, got %+v", u)
+	}
+	if u := users[room2]; len(u) != 1 || u[0].Username != "bob" {
+		t.Errorf("expected bob in room2, got %+v", u)
+	}
+}
+
+func TestRoomUsersActivity(t *testing.T) {
+	srv := New(":0")
+	ts := httptest.NewServer(srv.mux)
+	defer ts.Close()
+	roomID := createRoomID(t, srv)
+
+	before := time.Now().Add(-time.Second)
+	alice := dialRoom(t, ts, roomID, "alice")
+	defer alice.Close(websocket.StatusNormalClosure, "")
+	deadline := time.Now().Add(2 * time.Second)
+	for srv.hub.ClientCount(roomID) < 1 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	get := func(path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		w := httptest.NewRecorder()
+		srv.mux.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("GET %s: expected 200, got %d", path, w.Code)
+		}
+		return w
+	}
+
+	// Without the flag the response keeps its usual shape.
+	if body := get("/api/room-users/" + roomID).Body.String(); strings.Contains(body, "connected_at") {
+		t.Errorf("expected no activity fields by default, got %s", body)
+	}
+
+	var users []roomUserActivity
+	json.NewDecoder(get("/api/room-users/" + roomID + "?activity=true").Body).Decode(&users)
+	if len(users) != 1 || users[0].Username != "alice" {
+		t.Fatalf("expected alice, got %+v", users)
+	}
+	if at := users[0].ConnectedAt; at.Before(before) || at.After(time.Now()) {
+		t.Errorf("expected a recent connected_at, got %v", at)
+	}
+	if users[0].IdleSeconds < 0 || users[0].IdleSeconds > 5 {
+		t.Errorf("expected alice to be barely idle, got %ds", users[0].IdleSeconds)
+	}
+
+	var bulk map[string][]roomUserActivity
+	json.NewDecoder(get("/api/room-users?activity=true&ids=" + roomID).Body).Decode(&bulk)
+	if u := bulk[roomID]; len(u) != 1 || u[0].ConnectedAt.IsZero() {
+		t.Errorf("expected alice with connected_at in the bulk response, got %+v", u)
+	}
+}
+
+func TestBulkRoomUsersLimits(t *testing.T) {
+	srv := New(":0")
+	ids := make([]string, maxBulkRoomUsers+1)
+	for i := range ids {
+		ids[i] = fmt.Sprintf("room%d", i)
+	}
+	for _, query := range []string{"", "?ids=", "?ids=" + strings.Join(ids, ",")} {
+		req := httptest.NewRequest(http.MethodGet, "/api/room-users"+query, nil)
+		w := httptest.NewRecorder()
+		srv.mux.ServeHTTP(w, req)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%q: expected 400, got %d", query, w.Code)
+		}
+	}
+}
+
+func TestAnnounceRequiresAdminKey(t *testing.T) {
+	body := `{"content":"maintenance in 10 minutes"}`
+
+	// Disabled when no key is configured.
+	srv := New(":0")
+	req := httptest.NewRequest(http.MethodPost, "/api/admin/announce", strings.NewReader(body))
+	w := httptest.NewRecorder()
+	srv.mux.ServeHTTP(w, req)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("expected 403 without admin key configured, got %d", w.Code)
+	}
+
+	srv = New(":0", WithAdminKey("secret"))
+	req = httptest.NewRequest(http.MethodPost, "/api/admin/announce", strings.NewReader(body))
+	req.Header.Set("X-Admin-Key", "wrong")
+	w = httptest.NewRecorder()
+	srv.mux.ServeHTTP(w, req)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 with wrong key, got %d", w.Code)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/api/admin/announce", strings.NewReader(body))
+	req.Header.Set("X-Admin-Key", "secret")
+	w = httptest.NewRecorder()
+	srv.mux.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200 with correct key, got %d", w.Code)
+	}
+	var resp map[string]int
+	json.NewDecoder(w.Body).Decode(&resp)
+	if resp["rooms"] != 0 {
+		t.Errorf("expected 0 rooms reached with no clients, got %d", resp["rooms"])
+	}
+}
+
+func TestAnnounceEmptyContent(t *testing.T) {
+	srv := New(":0", WithAdminKey("secret"))
+	req := httptest.NewRequest(http.MethodPost, "/api/admin/announce", strings.NewReader(`{"content":"  "}`))
+	req.Header.Set("X-Admin-Key", "secret")
+	w := httptest.NewRecorder()
+	srv.mux.ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for empty content, got %d", w.Code)
+	}
+}
+
+func TestAdminExpiringRooms(t *testing.T) {
+	var mu sync.Mutex
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	clock := func() time.Time {
+		mu.Lock()
+		defer mu.Unlock()
+		return now
+	}
+	srv := New(":0", WithAdminKey("secret"), func(s *Server) {
+		s.roomOpts = append(s.roomOpts, room.WithNowFunc(clock))
+	})
+	quiet := srv.rooms.Get(createRoomID(t, srv))
+	createRoomID(t, srv) // still busy, never listed
+
+	// Empty for 14 of its 15 minutes: inside the 2-minute warning window.
+	quiet.TouchUserLeft()
+	mu.Lock()
+	now = now.Add(14 * time.Minute)
+	mu.Unlock()
+
+	list := func() []expiringRoom {
+		req := httptest.NewRequest(http.MethodGet, "/api/admin/rooms/expiring", nil)
+		req.Header.Set("X-Admin-Key", "secret")
+		w := httptest.NewRecorder()
+		srv.mux.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d", w.Code)
+		}
+		var out []expiringRoom
+		json.NewDecoder(w.Body).Decode(&out)
+		return out
+	}
+	for i := 0; i < 2; i++ {
+		got := list()
+		if len(got) != 1 || got[0].ID != quiet.ID || got[0].Reason != "empty" || got[0].RemainingSeconds != 60 {
+			t.Fatalf("call %d: expected the empty room with 60s left, got %+v", i, got)
+		}
+	}
+
+	// Listing left the warning to be sent as usual.
+	if reason, _ := quiet.NeedsWarning(2*time.Hour, 5*time.Minute, 15*time.Minute, 2*time.Minute, clock()); reason != room.WarnEmpty {
+		t.Errorf("expected the WebSocket warning still to be due, got %v", reason)
+	}
+}
+
+func TestRoomStatsEndpoint(t *testing.T) {
+	srv := New(":0")
+	rm, _ := srv.rooms.Create("Stats Room", "", "creator", 10, true)
+	rm.AddActiveUsers(2)
+	rm.AddActiveUsers(-1)
+	srv.hub.Broadcast(rm.ID, &message.Message{ID: "m1", RoomID: rm.ID, Type: message.TypeChat})
+	srv.hub.Broadcast(rm.ID, &message.Message{ID: "m2", RoomID: rm.ID, Type: message.TypeChat})
+
+	req := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/api/rooms/%s/stats", rm.ID), nil)
+	w := httptest.NewRecorder()
+	srv.mux.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+
+	var stats map[string]interface{}
+	if err := json.NewDecoder(w.Body).Decode(&stats); err != nil {
+		t.Fatalf("decode error: %v", err)
+	}
+	if stats["peak_users"] != float64(2) {
+		t.Errorf("expected peak_users 2, got %v", stats["peak_users"])
+	}
+	if stats["total_messages"] != float64(2) {
+		t.Errorf("expected total_messages 2, got %v", stats["total_messages"])
+	}
+	if stats["current_users"] != float64(0) {
+		t.Errorf("expected current_users 0 (no hub clients), got %v", stats["current_users"])
+	}
+	if _, ok := stats["age_seconds"]; !ok {
+		t.Error("expected age_seconds field")
+	}
+}
+
+func TestRoomStatsEndpointNotFound(t *testing.T) {
+	srv := New(":0")
+
+	req := httptest.NewRequest(http.MethodGet, "/api/rooms/nonexistent/stats", nil)
+	w := httptest.NewRecorder()
+	srv.mux.ServeHTTP(w, req)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected 404, got %d", w.Code)
+	}
+}
+
+func TestRoomStream(t *testing.T) {
+	srv := New(":0")
+	rm, _ := srv.rooms.Create("Stream Room", "", "creator", 10, true)
+	ts := httptest.NewServer(srv.mux)
+	defer ts.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, ts.URL+"/api/rooms/"+rm.ID+"/stream", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("stream request error: %v", err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("expected text/event-stream, got %q", ct)
+	}
+
+	// The opening comment arrives once the subscriber is registered.
+	lines := bufio.NewScanner(resp.Body)
+	if !lines.Scan() || !strings.HasPrefix(lines.Text(), ":") {
+		t.Fatalf("expected an opening comment, got %q", lines.Text())
+	}
+	if n := srv.hub.ClientCount(rm.ID); n != 0 {
+		t.Errorf("stream subscriber should not count as a room client, got %d", n)
+	}
+
+	srv.hub.Broadcast(rm.ID, &message.Message{ID: "m1", RoomID: rm.ID, Username: "bob", Content: "live", Type: message.TypeChat})
+
+	var data string
+	for lines.Scan() {
+		if after, ok := strings.CutPrefix(lines.Text(), "data: "); ok {
+			data = after
+			break
+		}
+	}
+	var env ws.Envelope
+	if err := json.Unmarshal([]byte(data), &env); err != nil {
+		t.Fatalf("unmarshal event %q: %v", data, err)
+	}
+	var msg message.Message
+	json.Unmarshal(env.Payload, &msg)
+	if env.Type != "chat" || msg.Content != "live" {
+		t.Errorf("expected the chat broadcast, got %s %q", env.Type, msg.Content)
+	}
+}
+
+func TestRoomStreamNotFound(t *testing.T) {
+	srv := New(":0")
+
+	req := httptest.NewRequest(http.MethodGet, "/api/rooms/nonexistent/stream", nil)
+	w := httptest.NewRecorder()
+	srv.mux.ServeHTTP(w, req)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected 404, got %d", w.Code)
+	}
+}
+
+func TestBotMessage(t *testing.T) {
+	srv := New(":0", WithAdminKey("secret"))
+	rm, _ := srv.rooms.Create("Bot Room", "", "creator", 10, true)
+
+	body := `{"username":"ci","content":"  build passed  "}`
+	req := httptest.NewRequest(http.MethodPost, fmt.Sprintf("/api/rooms/%s/messages", rm.ID), strings.NewReader(body))
+	req.Header.Set("X-Admin-Key", "secret")
+	w := httptest.NewRecorder()
+	srv.mux.ServeHTTP(w, req)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", w.Code, w.Body.String())
+	}
+
+	var msg message.Message
+	if err := json.NewDecoder(w.Body).Decode(&msg); err != nil {
+		t.Fatalf("decode error: %v", err)
+	}
+	if !msg.Bot {
+		t.Error("expected bot flag to be set")
+	}
+	if msg.Type != message.TypeChat {
+		t.Errorf("expected type chat, got %q", msg.Type)
+	}
+	if msg.Username != "ci" || msg.Content != "build passed" {
+		t.Errorf("unexpected message: %+v", msg)
+	}
+	if msg.Seq != 1 {
+		t.Errorf("expected seq 1, got %d", msg.Seq)
+	}
+	if rm.MessageCount() != 1 {
+		t.Errorf("expected room message count 1, got %d", rm.MessageCount())
+	}
+}
+
+func TestBotMessageErrors(t *testing.T) {
+	srv := New(":0", WithAdminKey("secret"))
+	rm, _ := srv.rooms.Create("Bot Room", "", "creator", 10, true)
+
+	tests := []struct {
+		name   string
+		roomID string
+		key    string
+		body   string
+		want   int
+	}{
+		{"wrong key", rm.ID, "wrong", `{"content":"hi"}`, http.StatusUnauthorized},
+		{"unknown room", "nope", "secret", `{"content":"hi"}`, http.StatusNotFound},
+		{"empty content", rm.ID, "secret", `{"content":"   "}`, http.StatusBadRequest},
+		{"content too long", rm.ID, "secret", `{"content":"` + strings.Repeat("a", 2001) + `"}`, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, fmt.Sprintf("/api/rooms/%s/messages", tt.roomID), strings.NewReader(tt.body))
+			req.Header.Set("X-Admin-Key", tt.key)
+			w := httptest.NewRecorder()
+			srv.mux.ServeHTTP(w, req)
+			if w.Code != tt.want {
+				t.Errorf("expected %d, got %d", tt.want, w.Code)
+			}
+		})
+	}
+}
+
+func TestBotMessageRateLimited(t *testing.T) {
+	srv := New(":0", WithAdminKey("secret"))
+	rm, _ := srv.rooms.Create("Bot Room", "", "creator", 10, true)
+
+	var last int
+	for i := 0; i < 11; i++ {
+		req := httptest.NewRequest(http.MethodPost, fmt.Sprintf("/api/rooms/%s/messages", rm.ID), strings.NewReader(`{"content":"ping"}`))
+		req.Header.Set("X-Admin-Key", "secret")
+		w := httptest.NewRecorder()
+		srv.mux.ServeHTTP(w, req)
+		last = w.Code
+	}
+	if last != http.StatusTooManyRequests {
+		t.Errorf("expected 429 after 10 messages, got %d", last)
+	}
+}
+
+func TestCreateRoomChatRateLimit(t *testing.T) {
+	srv := New(":0", WithChatRateLimit(20, time.Minute))
+
+	body := `{"name":"Support","capacity":10,"public":true,"chat_rate_limit":2,"chat_rate_window_seconds":30}`
+	req := httptest.NewRequest(http.MethodPost, "/api/rooms", strings.NewReader(body))
+	w := httptest.NewRecorder()
+	srv.mux.ServeHTTP(w, req)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", w.Code, w.Body.String())
+	}
+	var created map[string]interface{}
+	json.NewDecoder(w.Body).Decode(&created)
+	if created["chat_rate_limit"] != float64(2) || created["chat_rate_window_seconds"] != float64(30) {
+		t.Errorf("expected chat rate override in response, got %v", created)
+	}
+	rm := srv.rooms.Get(created["id"].(string))
+	if max, window := rm.ChatLimiter().Limit(); max != 2 || window != 30*time.Second {
+		t.Errorf("expected room limiter 2/30s, got %d/%s", max, window)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/api/rooms", strings.NewReader(`{"name":"Bad","capacity":10,"chat_rate_limit":5}`))
+	req.RemoteAddr = "10.0.0.2:1234"
+	w = httptest.NewRecorder()
+	srv.mux.ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for override without window, got %d", w.Code)
+	}
+}
+
+func TestCreateRoomMessageCap(t *testing.T) {
+	srv := New(":0", WithAdminKey("secret"))
+
+	w := postJSON(srv, `{"name":"Minutes","capacity":10,"message_cap":2,"overflow_policy":"reject-new"}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", w.Code, w.Body.String())
+	}
+	var created map[string]interface{}
+	json.NewDecoder(w.Body).Decode(&created)
+	if created["message_cap"] != float64(2) || created["overflow_policy"] != "reject-new" {
+		t.Errorf("expected the cap in the response, got %v", created)
+	}
+	roomID := created["id"].(string)
+	for i := 0; i < 3; i++ {
+		srv.messages.Append(&message.Message{ID: fmt.Sprint(i), RoomID: roomID, Type: message.TypeChat})
+	}
+	if !srv.messages.Full(roomID) || srv.messages.Count(roomID) != 2 {
+		t.Errorf("expected the store to stop at 2 messages, got %d", srv.messages.Count(roomID))
+	}
+
+	// Bots are refused too, rather than told a dropped message was posted.
+	req := httptest.NewRequest(http.MethodPost, "/api/rooms/"+roomID+"/messages", strings.NewReader(`{"content":"ping"}`))
+	req.Header.Set("X-Admin-Key", "secret")
+	w = httptest.NewRecorder()
+	srv.mux.ServeHTTP(w, req)
+	if w.Code != http.StatusConflict || !strings.Contains(w.Body.String(), "history_full") {
+		t.Errorf("expected 409 history_full, got %d: %s", w.Code, w.Body.String())
+	}
+
+	w = postJSONFrom(srv, `{"name":"Lobby","capacity":10,"message_cap":2}`, "10.0.0.2:1234")
+	json.NewDecoder(w.Body).Decode(&created)
+	if created["overflow_policy"] != "drop-oldest" {
+		t.Errorf("expected drop-oldest by default, got %v", created["overflow_policy"])
+	}
+}
+
+func TestCreateRoomKnockRequired(t *testing.T) {
+	srv := New(":0")
+
+	w := postJSON(srv, `{"name":"Office hours","capacity":10,"knock_required":true}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", w.Code, w.Body.String())
+	}
+	var created map[string]interface{}
+	json.NewDecoder(w.Body).Decode(&created)
+	if !srv.hub.KnockRequired(created["id"].(string)) {
+		t.Error("expected the new room to require knocking")
+	}
+}
+
+func TestAttachmentNotFound(t *testing.T) {
+	srv := New(":0")
+	req := httptest.NewRequest(http.MethodGet, "/api/attachments/missing", nil)
+	w := httptest.NewRecorder()
+	srv.mux.ServeHTTP(w, req)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected 404, got %d", w.Code)
+	}
+}
+
+// createRoomID creates a public room and returns its ID.
+func createRoomID(t *testing.T, srv *Server) string {
+	t.Helper()
+	w := postJSON(srv, `{"name":"Room","capacity":10,"public":true}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create room: expected 201, got %d", w.Code)
+	}
+	var room map[string]any
+	json.NewDecoder(w.Body).Decode(&room)
+	return room["id"].(string)
+}
+
+// dialRoom opens a WebSocket to the server and sends a join for roomID.
+func dialRoom(t *testing.T, ts *httptest.Server, roomID, username string) *websocket.Conn {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, _, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(ts.URL, "http")+"/ws", nil)
+	if err != nil {
+		t.Fatalf("dial error: %v", err)
+	}
+	payload, _ := json.Marshal(ws.JoinPayload{RoomID: roomID, Username: username})
+	env, _ := json.Marshal(ws.Envelope{Type: "join", Payload: payload})
+	if err := conn.Write(ctx, websocket.MessageText, env); err != nil {
+		t.Fatalf("write join error: %v", err)
+	}
+	return conn
+}
+
+func TestIdleTimeoutReapsConnection(t *testing.T) {
+	srv := New(":0", WithIdleTimeout(200*time.Millisecond))
+	ts := httptest.NewServer(srv.mux)
+	defer ts.Close()
+
+	conn := dialRoom(t, ts, createRoomID(t, srv), "alice")
+	defer conn.Close(websocket.StatusNormalClosure, "")
+
+	// Sit idle; the server should close the connection on its own.
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	for {
+		_, _, err := conn.Read(ctx)
+		if err == nil {
+			continue
+		}
+		if websocket.CloseStatus(err) != websocket.StatusPolicyViolation {
+			t.Fatalf("expected idle timeout close, got %v", err)
+		}
+		return
+	}
+}
+
+func TestRoomActiveUsersMatchesHub(t *testing.T) {
+	srv := New(":0")
+	ts := httptest.NewServer(srv.mux)
+	defer ts.Close()
+	roomID := createRoomID(t, srv)
+
+	activeUsers := func() int {
+		req := httptest.NewRequest(http.MethodGet, "/api/rooms/"+roomID, nil)
+		w := httptest.NewRecorder()
+		srv.mux.ServeHTTP(w, req)
+		var room map[string]any
+		json.NewDecoder(w.Body).Decode(&room)
+		return int(room["active_users"].(float64))
+	}
+	waitForCount := func(want int) {
+		t.Helper()
+		deadline := time.Now().Add(2 * time.Second)
+		for srv.hub.ClientCount(roomID) != want {
+			if time.Now().After(deadline) {
+				t.Fatalf("expected %d hub clients, got %d", want, srv.hub.ClientCount(roomID))
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if got := activeUsers(); got != want {
+			t.Fatalf("expected active_users %d to match the hub, got %d", want, got)
+		}
+	}
+
+	// alice joins first so she is the host.
+	alice := dialRoom(t, ts, roomID, "alice")
+	defer alice.Close(websocket.StatusNormalClosure, "")
+	waitForCount(1)
+	bob := dialRoom(t, ts, roomID, "bob")
+	defer bob.Close(websocket.StatusNormalClosure, "")
+	carol := dialRoom(t, ts, roomID, "carol")
+	defer carol.Close(websocket.StatusNormalClosure, "")
+	waitForCount(3)
+
+	payload, _ := json.Marshal(ws.KickPayload{Username: "carol"})
+	env, _ := json.Marshal(ws.Envelope{Type: "kick", Payload: payload})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := alice.Write(ctx, websocket.MessageText, env); err != nil {
+		t.Fatalf("write kick error: %v", err)
+	}
+	waitForCount(2)
+
+	// Disconnecting the room drops its clients without per-client leave
+	// callbacks; the count must still follow the hub.
+	srv.hub.DisconnectRoom(roomID)
+	waitForCount(0)
+}
+
+func TestExpireRoomArchivesTranscript(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	srv := New(":0", WithRedis(client), WithArchive(time.Hour), WithAdminKey("secret"))
+	roomID := createRoomID(t, srv)
+	srv.hub.Broadcast(roomID, &message.Message{ID: "m1", RoomID: roomID, Content: "hello", Type: message.TypeChat, CreatedAt: time.Now()})
+	srv.hub.Broadcast(roomID, &message.Message{ID: "m2", RoomID: roomID, Content: "bye", Type: message.TypeChat, CreatedAt: time.Now()})
+
+	srv.expireRoom(roomID)
+
+	if n := srv.messages.Count(roomID); n != 0 {
+		t.Errorf("expected messages deleted, got %d", n)
+	}
+	if ttl := mr.TTL("room:" + roomID + ":archive"); ttl != time.Hour {
+		t.Errorf("expected archive TTL 1h, got %v", ttl)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/api/admin/archive/"+roomID, nil)
+	req.Header.Set("X-Admin-Key", "secret")
+	w := httptest.NewRecorder()
+	srv.mux.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	var transcript message.Transcript
+	if err := json.NewDecoder(w.Body).Decode(&transcript); err != nil {
+		t.Fatalf("decode error: %v", err)
+	}
+	if transcript.RoomID != roomID {
+		t.Errorf("expected room_id %s, got %s", roomID, transcript.RoomID)
+	}
+	if len(transcript.Messages) != 2 || transcript.Messages[0].ID != "m1" || transcript.Messages[1].ID != "m2" {
+		t.Errorf("expected messages m1, m2, got %+v", transcript.Messages)
+	}
+}
+
+func TestExpireRoomWithoutArchive(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	srv := New(":0", WithRedis(client), WithAdminKey("secret"))
+	roomID := createRoomID(t, srv)
+	srv.hub.Broadcast(roomID, &message.Message{ID: "m1", RoomID: roomID, Content: "hello", Type: message.TypeChat, CreatedAt: time.Now()})
+
+	srv.expireRoom(roomID)
+
+	if n := srv.messages.Count(roomID); n != 0 {
+		t.Errorf("expected messages deleted, got %d", n)
+	}
+	if mr.Exists("room:" + roomID + ":archive") {
+		t.Error("expected no archive without WithArchive")
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/api/admin/archive/"+roomID, nil)
+	req.Header.Set("X-Admin-Key", "secret")
+	w := httptest.NewRecorder()
+	srv.mux.ServeHTTP(w, req)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected 404, got %d", w.Code)
+	}
+}
@@ -20,12 +20,14 @@ type AnonymousSession struct {
 type SessionStore struct {
 	mu       sync.Mutex
 	sessions map[string]*AnonymousSession
+	lastRead map[string]map[string]int64 // userID → roomID → last read seq
 }
 
 // NewSessionStore creates a new anonymous session store.
 func NewSessionStore() *SessionStore {
 	return &SessionStore{
 		sessions: make(map[string]*AnonymousSession),
+		lastRead: make(map[string]map[string]int64),
 	}
 }
 
@@ -49,6 +51,21 @@ func (s *SessionStore) Get(token string) *AnonymousSession {
 	return s.sessions[token]
 }
 
+// Delete removes the session for token along with the read positions of
+// the user behind it, so nothing about them is kept. It returns the deleted
+// session, or nil if token was unknown.
+func (s *SessionStore) Delete(token string) *AnonymousSession {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sess := s.sessions[token]
+	if sess == nil {
+		return nil
+	}
+	delete(s.sessions, token)
+	delete(s.lastRead, sess.UserID)
+	return sess
+}
+
 // Count returns the number of sessions.
 func (s *SessionStore) Count() int {
 	s.mu.Lock()
@@ -56,6 +73,31 @@ func (s *SessionStore) Count() int {
 	return len(s.sessions)
 }
 
+// SetLastRead records seq as the highest message the user has read in a
+// room. The position only moves forward, so a stale device cannot undo
+// reads made on another.
+func (s *SessionStore) SetLastRead(userID, roomID string, seq int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rooms := s.lastRead[userID]
+	if rooms == nil {
+		rooms = make(map[string]int64)
+		s.lastRead[userID] = rooms
+	}
+	if seq > rooms[roomID] {
+		rooms[roomID] = seq
+	}
+}
+
+// GetLastRead returns the user's read position in a room, and false if
+// none has been recorded.
+func (s *SessionStore) GetLastRead(userID, roomID string) (int64, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	seq, ok := s.lastRead[userID][roomID]
+	return seq, ok
+}
+
 func generateToken() string {
 	b := make([]byte, 16)
 	rand.Read(b)
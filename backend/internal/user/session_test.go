@@ -38,6 +38,25 @@ func TestSessionStoreGetNotFound(t *testing.T) {
 	}
 }
 
+func TestSessionStoreDelete(t *testing.T) {
+	store := NewSessionStore()
+
+	sess := store.Create()
+	store.SetLastRead(sess.UserID, "room1", 5)
+	if got := store.Delete(sess.Token); got == nil || got.UserID != sess.UserID {
+		t.Fatalf("expected the deleted session back, got %+v", got)
+	}
+	if store.Get(sess.Token) != nil {
+		t.Error("expected the session to be gone")
+	}
+	if _, ok := store.GetLastRead(sess.UserID, "room1"); ok {
+		t.Error("expected the user's read positions to be gone")
+	}
+	if store.Delete(sess.Token) != nil {
+		t.Error("expected deleting twice to return nil")
+	}
+}
+
 func TestSessionStoreCount(t *testing.T) {
 	store := NewSessionStore()
 
@@ -64,3 +83,22 @@ func TestSessionStoreUniqueTokens(t *testing.T) {
 		t.Error("expected unique user IDs")
 	}
 }
+
+func TestSessionStoreLastRead(t *testing.T) {
+	store := NewSessionStore()
+	if _, ok := store.GetLastRead("u1", "room1"); ok {
+		t.Fatal("expected no read position before SetLastRead")
+	}
+
+	store.SetLastRead("u1", "room1", 10)
+	store.SetLastRead("u1", "room1", 4) // moving backwards is ignored
+	if seq, ok := store.GetLastRead("u1", "room1"); !ok || seq != 10 {
+		t.Errorf("expected read position 10, got %d (ok=%v)", seq, ok)
+	}
+	if _, ok := store.GetLastRead("u1", "room2"); ok {
+		t.Error("expected read positions to be per room")
+	}
+	if _, ok := store.GetLastRead("u2", "room1"); ok {
+		t.Error("expected read positions to be per user")
+	}
+}
@@ -0,0 +1,112 @@
+package webhook
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	queueSize     = 1024
+	maxBatchSize  = 50
+	flushInterval = time.Second
+	postTimeout   = 10 * time.Second
+)
+
+// Relay delivers events to a webhook URL in the background. Events are
+// queued without blocking and POSTed in batches as {"events": [...]}.
+// Delivery failures are logged and the batch is dropped.
+type Relay struct {
+	url    string
+	client *http.Client
+	queue  chan any
+	done   chan struct{}
+	once   sync.Once
+}
+
+// New creates a Relay that posts to url and starts its delivery loop.
+func New(url string) *Relay {
+	r := &Relay{
+		url:    url,
+		client: &http.Client{Timeout: postTimeout},
+		queue:  make(chan any, queueSize),
+		done:   make(chan struct{}),
+	}
+	go r.loop()
+	return r
+}
+
+// Enqueue queues an event for delivery. It never blocks; if the queue is
+// full the event is dropped and false is returned.
+func (r *Relay) Enqueue(event any) bool {
+	select {
+	case r.queue <- event:
+		return true
+	default:
+		log.Printf("webhook: queue full, dropping event")
+		return false
+	}
+}
+
+// Close stops accepting events, flushes anything still queued, and waits
+// for delivery to finish.
+func (r *Relay) Close() {
+	r.once.Do(func() { close(r.queue) })
+	<-r.done
+}
+
+func (r *Relay) loop() {
+	defer close(r.done)
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+
+	var batch []any
+	for {
+		select {
+		case ev, ok := <-r.queue:
+			if !ok {
+				r.flush(batch)
+				return
+			}
+			batch = append(batch, ev)
+			if len(batch) >= maxBatchSize {
+				r.flush(batch)
+				batch = nil
+			}
+		case <-ticker.C:
+			r.flush(batch)
+			batch = nil
+		}
+	}
+}
+
+func (r *Relay) flush(batch []any) {
+	if len(batch) == 0 {
+		return
+	}
+	if err := r.post(batch); err != nil {
+		log.Printf("webhook: failed to deliver %d events: %v", len(batch), err)
+	}
+}
+
+func (r *Relay) post(batch []any) error {
+	body, err := json.Marshal(struct {
+		Events []any `json:"events"`
+	}{batch})
+	if err != nil {
+		return err
+	}
+	resp, err := r.client.Post(r.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package webhook
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+type testEvent struct {
+	Type string `json:"type"`
+}
+
+func TestRelayDeliversBatch(t *testing.T) {
+	var mu sync.Mutex
+	var got []testEvent
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ct := r.Header.Get("Content-Type"); ct != "application/json" {
+			t.Errorf("expected application/json, got %q", ct)
+		}
+		var body struct {
+			Events []testEvent `json:"events"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Errorf("decode error: %v", err)
+		}
+		mu.Lock()
+		got = append(got, body.Events...)
+		mu.Unlock()
+	}))
+	defer ts.Close()
+
+	r := New(ts.URL)
+	r.Enqueue(testEvent{Type: "join"})
+	r.Enqueue(testEvent{Type: "kick"})
+	r.Close()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(got) != 2 {
+		t.Fatalf("expected 2 events delivered, got %d", len(got))
+	}
+	if got[0].Type != "join" || got[1].Type != "kick" {
+		t.Errorf("unexpected events: %+v", got)
+	}
+}
+
+func TestRelayFailureLoggedAndNonFatal(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	var mu sync.Mutex
+	calls := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		calls++
+		mu.Unlock()
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer ts.Close()
+
+	r := New(ts.URL)
+	if !r.Enqueue(testEvent{Type: "ban"}) {
+		t.Fatal("expected enqueue to succeed")
+	}
+	r.Close()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if calls != 1 {
+		t.Errorf("expected 1 delivery attempt, got %d", calls)
+	}
+	if !strings.Contains(buf.String(), "webhook: failed to deliver 1 events") {
+		t.Errorf("expected failure to be logged, got %q", buf.String())
+	}
+}
@@ -0,0 +1,306 @@
+package ws
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/christopherjohns/chatsphere/internal/message"
+)
+
+const (
+	// maxAttachmentSize is the largest attachment a client may upload.
+	// Uploads arrive as binary frames, each bounded by maxFrameSize, so
+	// larger files span several frames.
+	maxAttachmentSize = 512 << 10
+
+	// maxAttachmentNameLength is the maximum attachment file name length.
+	maxAttachmentNameLength = 100
+
+	// attachmentTTL is how long uploaded bytes are kept for download.
+	attachmentTTL = 30 * time.Minute
+
+	// maxStoredAttachmentBytes bounds the bytes held across every room.
+	// Past it the oldest attachments are dropped early.
+	maxStoredAttachmentBytes = 64 << 20
+
+	// maxRoomAttachments bounds how many attachments one room may hold.
+	// Past it the room's oldest attachment is dropped early.
+	maxRoomAttachments = 50
+
+	// attachmentSweepInterval is how often StartAttachmentSweep drops
+	// expired attachments.
+	attachmentSweepInterval = time.Minute
+)
+
+// allowedAttachmentTypes are the MIME types clients may upload.
+var allowedAttachmentTypes = map[string]bool{
+	"image/png":  true,
+	"image/jpeg": true,
+	"image/gif":  true,
+	"image/webp": true,
+}
+
+// AttachBeginPayload is sent by the client before the binary frames that
+// carry an attachment's bytes.
+type AttachBeginPayload struct {
+	Name string `json:"name"`
+	MIME string `json:"mime"`
+	Size int    `json:"size"`
+}
+
+// pendingUpload accumulates binary frames announced by attach_begin. It is
+// only touched by the client's own read loop.
+type pendingUpload struct {
+	name string
+	mime string
+	size int
+	data []byte
+}
+
+// storedAttachment is an uploaded file held in memory for download.
+type storedAttachment struct {
+	roomID    string
+	mime      string
+	data      []byte
+	expiresAt time.Time
+}
+
+// attachmentStore holds uploaded attachment bytes transiently, within a
+// total byte budget and a per-room count.
+type attachmentStore struct {
+	mu       sync.Mutex
+	items    map[string]*storedAttachment
+	order    []string // IDs oldest first; may hold IDs already removed
+	perRoom  map[string]int
+	bytes    int
+	ttl      time.Duration
+	maxBytes int
+	maxRoom  int
+}
+
+func newAttachmentStore(ttl time.Duration) *attachmentStore {
+	return &attachmentStore{
+		items:    make(map[string]*storedAttachment),
+		perRoom:  make(map[string]int),
+		ttl:      ttl,
+		maxBytes: maxStoredAttachmentBytes,
+		maxRoom:  maxRoomAttachments,
+	}
+}
+
+// put stores data under id, first dropping the room's oldest attachment if
+// the room is at its limit, then the oldest overall until data fits the
+// byte budget.
+func (s *attachmentStore) put(id, roomID, mime string, data []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.perRoom[roomID] >= s.maxRoom {
+		for _, k := range s.order {
+			if a, ok := s.items[k]; ok && a.roomID == roomID {
+				s.removeLocked(k)
+				break
+			}
+		}
+	}
+	for len(s.order) > 0 && s.bytes+len(data) > s.maxBytes {
+		s.removeLocked(s.order[0])
+		s.order = s.order[1:]
+	}
+	s.items[id] = &storedAttachment{roomID: roomID, mime: mime, data: data, expiresAt: time.Now().Add(s.ttl)}
+	s.order = append(s.order, id)
+	s.perRoom[roomID]++
+	s.bytes += len(data)
+}
+
+// removeLocked drops id from the store, leaving its place in s.order to be
+// skipped or compacted later. Must be called with s.mu held.
+func (s *attachmentStore) removeLocked(id string) {
+	a, ok := s.items[id]
+	if !ok {
+		return
+	}
+	delete(s.items, id)
+	s.bytes -= len(a.data)
+	if s.perRoom[a.roomID]--; s.perRoom[a.roomID] <= 0 {
+		delete(s.perRoom, a.roomID)
+	}
+}
+
+// sweep drops expired attachments and compacts the eviction order.
+func (s *attachmentStore) sweep() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	live := s.order[:0]
+	for _, id := range s.order {
+		a, ok := s.items[id]
+		if !ok {
+			continue
+		}
+		if now.After(a.expiresAt) {
+			s.removeLocked(id)
+			continue
+		}
+		live = append(live, id)
+	}
+	clear(s.order[len(live):])
+	s.order = live
+}
+
+func (s *attachmentStore) get(id string) (*storedAttachment, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	a, ok := s.items[id]
+	if !ok || time.Now().After(a.expiresAt) {
+		return nil, false
+	}
+	return a, true
+}
+
+// remove drops a single attachment, such as one whose message the room
+// refused.
+func (s *attachmentStore) remove(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.removeLocked(id)
+}
+
+// deleteRoom drops every attachment uploaded to the room.
+func (s *attachmentStore) deleteRoom(roomID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for k, a := range s.items {
+		if a.roomID == roomID {
+			s.removeLocked(k)
+		}
+	}
+}
+
+// StartAttachmentSweep begins a background goroutine that drops expired
+// attachments every attachmentSweepInterval. Lookups already ignore them;
+// the sweep frees their memory.
+func (h *Hub) StartAttachmentSweep() {
+	go func() {
+		ticker := time.NewTicker(attachmentSweepInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			h.attachments.sweep()
+		}
+	}()
+}
+
+// Attachment returns the bytes and MIME type of an uploaded attachment.
+// ok is false if the ID is unknown or has expired.
+func (h *Hub) Attachment(id string) (data []byte, mime string, ok bool) {
+	a, ok := h.attachments.get(id)
+	if !ok {
+		return nil, "", false
+	}
+	return a.data, a.mime, true
+}
+
+// handleAttachBegin validates an attach_begin envelope and readies the
+// client to receive the attachment's binary frames.
+func (h *Handler) handleAttachBegin(ctx context.Context, client *Client, payload json.RawMessage) {
+	if h.attachmentsDisabled {
+		h.sendError(ctx, client, ErrorCodeUnsupported, "attachments are not enabled")
+		return
+	}
+	var p AttachBeginPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		h.sendError(ctx, client, ErrorCodeInvalidPayload, "invalid attach_begin payload")
+		return
+	}
+	p.Name = strings.TrimSpace(p.Name)
+	if h.hub.IsMuted(client.roomID, client.userID) {
+		h.sendError(ctx, client, ErrorCodeMuted, "you are muted in this room")
+		return
+	}
+	if !client.isCreator && !h.hub.IsMod(client.roomID, client.userID) && h.hub.ReadOnly(client.roomID) {
+		h.sendError(ctx, client, ErrorCodeReadOnly, readOnlyError)
+		return
+	}
+	if h.hub.HistoryFull(client.roomID) {
+		h.sendError(ctx, client, ErrorCodeHistoryFull, historyFullError)
+		return
+	}
+	if !allowedAttachmentTypes[p.MIME] {
+		h.sendError(ctx, client, ErrorCodeInvalidPayload, "unsupported attachment type")
+		return
+	}
+	if p.Size <= 0 || p.Size > maxAttachmentSize {
+		h.sendError(ctx, client, ErrorCodeTooLong, "attachment must be between 1 byte and 512 KiB")
+		return
+	}
+	if len(p.Name) > maxAttachmentNameLength {
+		h.sendError(ctx, client, ErrorCodeTooLong, "attachment name must be 100 characters or less")
+		return
+	}
+	if limiter := h.chatLimiterFor(client.roomID); !limiter.Allow(client.userID) {
+		h.sendError(ctx, client, ErrorCodeRateLimited, "rate limit exceeded")
+		return
+	}
+	if !h.hub.allowRoomMessage(client.roomID, client.userID) {
+		h.sendError(ctx, client, ErrorCodeSlowMode, h.hub.slowModeError())
+		return
+	}
+	// A new begin abandons any unfinished upload.
+	client.upload = &pendingUpload{
+		name: p.Name,
+		mime: p.MIME,
+		size: p.Size,
+		data: make([]byte, 0, p.Size),
+	}
+}
+
+// handleAttachmentFrame appends a binary frame to the client's pending
+// upload and broadcasts the attachment once all announced bytes arrive.
+func (h *Handler) handleAttachmentFrame(ctx context.Context, client *Client, data []byte) {
+	up := client.upload
+	if up == nil {
+		h.sendError(ctx, client, ErrorCodeInvalidPayload, "binary frame without attach_begin")
+		return
+	}
+	if len(up.data)+len(data) > up.size {
+		client.upload = nil
+		h.sendError(ctx, client, ErrorCodeTooLong, "attachment exceeds announced size")
+		return
+	}
+	up.data = append(up.data, data...)
+	if len(up.data) < up.size {
+		return
+	}
+	client.upload = nil
+
+	// The declared type must match the content, since the bytes are served
+	// back with it.
+	if detected := http.DetectContentType(up.data); detected != up.mime {
+		h.sendError(ctx, client, ErrorCodeInvalidPayload, "attachment content does not match its type")
+		return
+	}
+
+	id := generateClientID()
+	h.hub.attachments.put(id, client.roomID, up.mime, up.data)
+	ok := h.hub.Broadcast(client.roomID, &message.Message{
+		RoomID:   client.roomID,
+		UserID:   client.userID,
+		Username: client.username,
+		Color:    client.color,
+		Content:  up.name,
+		Type:     message.TypeAttachment,
+		Attachment: &message.Attachment{
+			ID:   id,
+			Name: up.name,
+			MIME: up.mime,
+			Size: up.size,
+		},
+	})
+	if !ok {
+		h.hub.attachments.remove(id)
+		h.sendError(ctx, client, ErrorCodeHistoryFull, historyFullError)
+	}
+}
@@ -0,0 +1,52 @@
+package ws
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestAttachmentStoreLimits(t *testing.T) {
+	s := newAttachmentStore(time.Minute)
+	s.maxBytes = 10
+	s.maxRoom = 2
+
+	// The room limit drops the room's oldest attachment, not anyone else's.
+	s.put("a1", "a", "image/png", []byte("xx"))
+	s.put("b1", "b", "image/png", []byte("xx"))
+	s.put("a2", "a", "image/png", []byte("xx"))
+	s.put("a3", "a", "image/png", []byte("xx"))
+	if _, ok := s.get("a1"); ok {
+		t.Error("expected the room's oldest attachment to be dropped")
+	}
+	for _, id := range []string{"b1", "a2", "a3"} {
+		if _, ok := s.get(id); !ok {
+			t.Errorf("expected %s to be kept", id)
+		}
+	}
+
+	// The byte budget drops the oldest overall.
+	s.put("c1", "c", "image/png", []byte("xxxxxx"))
+	if _, ok := s.get("b1"); ok {
+		t.Error("expected the oldest attachment to be dropped for space")
+	}
+	if s.bytes > s.maxBytes {
+		t.Errorf("expected at most %d bytes, got %d", s.maxBytes, s.bytes)
+	}
+	if _, ok := s.get("c1"); !ok {
+		t.Error("expected the new attachment to be stored")
+	}
+}
+
+func TestAttachmentStoreSweep(t *testing.T) {
+	s := newAttachmentStore(time.Millisecond)
+	for i := 0; i < 3; i++ {
+		s.put(fmt.Sprint(i), "room1", "image/png", []byte("xx"))
+	}
+	s.remove("1")
+	time.Sleep(5 * time.Millisecond)
+	s.sweep()
+	if len(s.items) != 0 || len(s.order) != 0 || s.bytes != 0 || len(s.perRoom) != 0 {
+		t.Errorf("expected an empty store after the sweep, got %d items, %d ids, %d bytes", len(s.items), len(s.order), s.bytes)
+	}
+}
@@ -0,0 +1,113 @@
+package ws
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+const (
+	// maxBlocklistWords caps how many words a host may block in one room.
+	maxBlocklistWords = 100
+
+	// maxBlockedWordLength caps the length of each blocked word.
+	maxBlockedWordLength = 50
+)
+
+// BlocklistPayload is sent by the host to replace the room's blocked words.
+// An empty list clears it. The host's own messages are checked too only if
+// BlockHost is set.
+type BlocklistPayload struct {
+	Words     []string `json:"words"`
+	BlockHost bool     `json:"block_host,omitempty"`
+}
+
+// roomBlocklist is the set of words a host has blocked in one room.
+type roomBlocklist struct {
+	words     map[string]struct{} // lower-cased
+	blockHost bool
+}
+
+// blocklistWords splits s into the words a blocklist matches against:
+// runs of letters and digits, lower-cased.
+func blocklistWords(s string) []string {
+	return strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// SetBlocklist replaces the words blocked in a room. Matching is by whole
+// word and ignores case. An empty list clears the room's blocklist.
+func (h *Hub) SetBlocklist(roomID string, words []string, blockHost bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(words) == 0 {
+		delete(h.blocklists, roomID)
+		return
+	}
+	bl := &roomBlocklist{words: make(map[string]struct{}, len(words)), blockHost: blockHost}
+	for _, w := range words {
+		bl.words[strings.ToLower(w)] = struct{}{}
+	}
+	h.blocklists[roomID] = bl
+}
+
+// blocked reports whether content contains a word blocked in the room.
+// The host is exempt unless the blocklist says otherwise.
+func (h *Hub) blocked(roomID, content string, isHost bool) bool {
+	h.mu.RLock()
+	bl := h.blocklists[roomID]
+	h.mu.RUnlock()
+	if bl == nil || (isHost && !bl.blockHost) {
+		return false
+	}
+	for _, w := range blocklistWords(content) {
+		if _, ok := bl.words[w]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// blocklistError is the error given to a sender whose message contains a
+// blocked word.
+const blocklistError = "message contains a word blocked in this room"
+
+// handleSetBlocklist replaces the room's blocked words. The list itself is
+// not announced, so posting it would not spread the words it blocks.
+func (h *Handler) handleSetBlocklist(ctx context.Context, client *Client, payload json.RawMessage) {
+	if !client.isCreator {
+		h.sendError(ctx, client, ErrorCodeNotHost, "only the room host can change blocked words")
+		return
+	}
+	var p BlocklistPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		h.sendError(ctx, client, ErrorCodeInvalidPayload, "invalid set_blocklist payload")
+		return
+	}
+	if len(p.Words) > maxBlocklistWords {
+		h.sendError(ctx, client, ErrorCodeInvalidPayload,
+			fmt.Sprintf("a room can block at most %d words", maxBlocklistWords))
+		return
+	}
+	words := make([]string, 0, len(p.Words))
+	for _, w := range p.Words {
+		if len(w) > maxBlockedWordLength {
+			h.sendError(ctx, client, ErrorCodeTooLong,
+				fmt.Sprintf("blocked words must be %d characters or less", maxBlockedWordLength))
+			return
+		}
+		split := blocklistWords(w)
+		if len(split) == 0 {
+			continue
+		}
+		if len(split) > 1 {
+			h.sendError(ctx, client, ErrorCodeInvalidPayload, fmt.Sprintf("%q is not a single word", w))
+			return
+		}
+		words = append(words, split[0])
+	}
+	h.hub.SetBlocklist(client.roomID, words, p.BlockHost)
+}
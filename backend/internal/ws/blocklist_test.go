@@ -0,0 +1,100 @@
+package ws
+
+import (
+	"testing"
+
+	"nhooyr.io/websocket"
+)
+
+func TestHubBlocked(t *testing.T) {
+	hub := NewHub(nil)
+	hub.SetBlocklist("room1", []string{"darn"}, false)
+
+	tests := []struct {
+		content string
+		isHost  bool
+		want    bool
+	}{
+		{"darn it", false, true},
+		{"Well, DARN!", false, true},
+		{"darned thing", false, false}, // whole words only
+		{"darn it", true, false},       // the host is exempt
+	}
+	for _, tt := range tests {
+		if got := hub.blocked("room1", tt.content, tt.isHost); got != tt.want {
+			t.Errorf("blocked(%q, host=%v) = %v, want %v", tt.content, tt.isHost, got, tt.want)
+		}
+	}
+	if hub.blocked("room2", "darn", false) {
+		t.Error("blocklist should not apply to other rooms")
+	}
+
+	hub.SetBlocklist("room1", []string{"darn"}, true)
+	if !hub.blocked("room1", "darn", true) {
+		t.Error("expected the host to be blocked with blockHost set")
+	}
+
+	hub.DisconnectRoom("room1")
+	if hub.blocked("room1", "darn", false) {
+		t.Error("expected DisconnectRoom to clear the blocklist")
+	}
+}
+
+func TestHandlerBlocklist(t *testing.T) {
+	ts, hub, _ := newHandlerTestServer(t, nil)
+	defer ts.Close()
+
+	conn1 := dialAndJoin(t, ts.URL, "room1", "alice")
+	defer conn1.Close(websocket.StatusNormalClosure, "")
+	waitForClients(t, hub, "room1", 1)
+	drainSystemMessages(t, conn1, 1) // "alice joined"
+	conn2 := dialAndJoin(t, ts.URL, "room1", "bob")
+	defer conn2.Close(websocket.StatusNormalClosure, "")
+	waitForClients(t, hub, "room1", 2)
+	drainSystemMessages(t, conn1, 1) // "bob joined"
+	drainSystemMessages(t, conn2, 1)
+
+	// Only the host may set it.
+	sendEnvelope(t, conn2, "set_blocklist", BlocklistPayload{Words: []string{"darn"}})
+	if got := readError(t, conn2); got != "only the room host can change blocked words" {
+		t.Errorf("unexpected error %q", got)
+	}
+
+	// The host can still say a word it blocked. Bob seeing the host's chat
+	// also means the blocklist is in place.
+	sendEnvelope(t, conn1, "set_blocklist", BlocklistPayload{Words: []string{"Darn"}})
+	sendEnvelope(t, conn1, "chat", ChatPayload{Content: "darn it"})
+	if env, msg := readMessage(t, conn2); env.Type != "chat" || msg.Content != "darn it" {
+		t.Fatalf("expected the host's chat, got %q %q", env.Type, msg.Content)
+	}
+	drainSystemMessages(t, conn1, 1)
+
+	sendEnvelope(t, conn2, "chat", ChatPayload{Content: "DARN!"})
+	if got := readError(t, conn2); got != blocklistError {
+		t.Errorf("expected blocklist error, got %q", got)
+	}
+
+	// Blocking the host too.
+	sendEnvelope(t, conn1, "set_blocklist", BlocklistPayload{Words: []string{"darn"}, BlockHost: true})
+	sendEnvelope(t, conn1, "chat", ChatPayload{Content: "darn"})
+	if got := readError(t, conn1); got != blocklistError {
+		t.Errorf("expected blocklist error for the host, got %q", got)
+	}
+
+	// Phrases are refused rather than silently never matching.
+	sendEnvelope(t, conn1, "set_blocklist", BlocklistPayload{Words: []string{"oh no"}})
+	if got := readError(t, conn1); got != `"oh no" is not a single word` {
+		t.Errorf("unexpected error %q", got)
+	}
+
+	// An empty list clears it.
+	sendEnvelope(t, conn1, "set_blocklist", BlocklistPayload{})
+	sendEnvelope(t, conn1, "chat", ChatPayload{Content: "darn"})
+	if env, msg := readMessage(t, conn2); env.Type != "chat" || msg.Content != "darn" {
+		t.Fatalf("expected the host's chat after clearing, got %q %q", env.Type, msg.Content)
+	}
+	sendEnvelope(t, conn2, "chat", ChatPayload{Content: "darn"})
+	if env, msg := readMessage(t, conn2); env.Type != "chat" || msg.Content != "darn" {
+		t.Errorf("expected guest chat after clearing, got %q %q", env.Type, msg.Content)
+	}
+}
@@ -2,11 +2,14 @@ package ws
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"log"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/christopherjohns/chatsphere/internal/message"
 	"nhooyr.io/websocket"
 )
 
@@ -25,6 +28,69 @@ const (
 
 	// idleCheckInterval is how often the idle reaper runs.
 	idleCheckInterval = 30 * time.Second
+
+	// minIdleCheckInterval keeps the idle reaper from spinning, however
+	// short the idle timeout.
+	minIdleCheckInterval = time.Second
+
+	// reconnectBaseDelay is the shortest reconnect delay suggested to a
+	// client the server disconnects on its own.
+	reconnectBaseDelay = time.Second
+
+	// reconnectSpread is the window over which a shutdown staggers the
+	// suggested reconnect delays of its clients.
+	reconnectSpread = 10 * time.Second
+)
+
+// ReconnectPayload is sent before the server closes a connection on its own
+// (shutdown or capacity). Clients should wait AfterMs plus a random extra
+// delay of up to JitterMs before reconnecting, so they don't all return at
+// once.
+type ReconnectPayload struct {
+	AfterMs  int `json:"after_ms"`
+	JitterMs int `json:"jitter_ms"`
+}
+
+// reconnectHint returns the hint for the i-th of n clients being
+// disconnected together. Delays rise with i across reconnectSpread, and each
+// client's jitter covers its slot so the whole batch spreads out evenly.
+func reconnectHint(i, n int) ReconnectPayload {
+	if n < 1 {
+		n = 1
+	}
+	step := reconnectSpread / time.Duration(n)
+	return ReconnectPayload{
+		AfterMs:  int((reconnectBaseDelay + time.Duration(i)*step).Milliseconds()),
+		JitterMs: int(step.Milliseconds()),
+	}
+}
+
+// sendReconnectHint writes a reconnect envelope straight to the connection,
+// bypassing the send queue, which is already closed or was never opened.
+func sendReconnectHint(ctx context.Context, c *Client, hint ReconnectPayload) {
+	data, err := json.Marshal(hint)
+	if err != nil {
+		log.Printf("ws: failed to marshal reconnect hint: %v", err)
+		return
+	}
+	env, err := json.Marshal(Envelope{Type: string(message.TypeReconnect), Payload: data})
+	if err != nil {
+		log.Printf("ws: failed to marshal reconnect envelope: %v", err)
+		return
+	}
+	writeCtx, cancel := context.WithTimeout(ctx, writeTimeout)
+	defer cancel()
+	if err := c.conn.Write(writeCtx, websocket.MessageText, env); err != nil {
+		log.Printf("ws: failed to write reconnect hint to client %s: %v", c.userID, err)
+	}
+}
+
+var (
+	// errShuttingDown is returned by register once Shutdown has been called.
+	errShuttingDown = errors.New("server shutting down")
+
+	// errAtCapacity is returned by register when maxConns is reached.
+	errAtCapacity = errors.New("server at capacity")
 )
 
 // connEntry holds per-connection metadata alongside the cancel function.
@@ -37,6 +103,7 @@ type connEntry struct {
 // ConnStats holds point-in-time connection statistics.
 type ConnStats struct {
 	Active          int
+	Peak            int // most connections ever active at once
 	MaxConns        int
 	Rejected        int64
 	DroppedMessages int64
@@ -47,14 +114,16 @@ type ConnStats struct {
 // lifecycle management including graceful shutdown, per-client
 // buffered send channels, connection limits, and idle detection.
 type ConnManager struct {
-	mu       sync.Mutex
+	mu       sync.RWMutex
 	clients  map[*Client]*connEntry
 	closed   bool
 	maxConns int
 	idleTTL  time.Duration
 	stopIdle context.CancelFunc
+	batch    bool
 
 	// Atomic counters for stats.
+	peak            atomic.Int64
 	rejected        atomic.Int64
 	droppedMessages atomic.Int64
 	idleReaped      atomic.Int64
@@ -80,6 +149,16 @@ func WithIdleTimeout(d time.Duration) ConnManagerOption {
 	}
 }
 
+// WithBatching makes each write pump coalesce messages that queued up
+// while it was writing into a single "batch" frame whose payload is a JSON
+// array of the queued envelopes. Off by default, since clients must know to
+// split batch frames.
+func WithBatching(enabled bool) ConnManagerOption {
+	return func(cm *ConnManager) {
+		cm.batch = enabled
+	}
+}
+
 // NewConnManager creates a new connection manager with optional configuration.
 func NewConnManager(opts ...ConnManagerOption) *ConnManager {
 	cm := &ConnManager{
@@ -103,22 +182,34 @@ func NewConnManager(opts ...ConnManagerOption) *ConnManager {
 // shuts down. Callers should select on ctx.Done() in their read loop.
 // Returns a cancelled context if the manager is closed or at capacity.
 func (cm *ConnManager) Add(c *Client) context.Context {
+	ctx, err := cm.register(c)
+	switch {
+	case errors.Is(err, errShuttingDown):
+		c.conn.Close(websocket.StatusGoingAway, err.Error())
+	case errors.Is(err, errAtCapacity):
+		c.conn.Close(websocket.StatusTryAgainLater, err.Error())
+	}
+	return ctx
+}
+
+// register is Add without closing the connection on rejection, so the
+// caller can tell the client why before closing it. On error the returned
+// context is already cancelled.
+func (cm *ConnManager) register(c *Client) (context.Context, error) {
 	cm.mu.Lock()
 	defer cm.mu.Unlock()
 
 	if cm.closed {
-		c.conn.Close(websocket.StatusGoingAway, "server shutting down")
 		ctx, cancel := context.WithCancel(context.Background())
 		cancel()
-		return ctx
+		return ctx, errShuttingDown
 	}
 
 	if cm.maxConns > 0 && len(cm.clients) >= cm.maxConns {
 		cm.rejected.Add(1)
-		c.conn.Close(websocket.StatusTryAgainLater, "server at capacity")
 		ctx, cancel := context.WithCancel(context.Background())
 		cancel()
-		return ctx
+		return ctx, errAtCapacity
 	}
 
 	now := time.Now()
@@ -129,10 +220,13 @@ func (cm *ConnManager) Add(c *Client) context.Context {
 		connectedAt: now,
 		lastActive:  now,
 	}
+	if n := int64(len(cm.clients)); n > cm.peak.Load() {
+		cm.peak.Store(n)
+	}
 
 	go cm.writePump(ctx, c)
 
-	return ctx
+	return ctx, nil
 }
 
 // Remove stops a client's write pump and cleans it up.
@@ -141,19 +235,29 @@ func (cm *ConnManager) Remove(c *Client) {
 	entry, ok := cm.clients[c]
 	if ok {
 		delete(cm.clients, c)
+		// Close under the lock so Send never races with the close.
+		close(c.send)
 	}
 	cm.mu.Unlock()
 
 	if ok {
 		entry.cancel()
-		close(c.send)
 	}
 }
 
 // Send queues a message for delivery to the client. Returns false
 // if the client's buffer is full (slow consumer) or the client has
-// been removed.
+// been removed. Every close of a send channel happens under the write
+// lock together with removal from cm.clients, so a broadcast racing a
+// kick sees the client as removed rather than sending on a closed
+// channel. Sends only need the read lock, so broadcasts to many clients
+// don't serialize on one another; the channel send itself never blocks.
 func (cm *ConnManager) Send(c *Client, data []byte) bool {
+	cm.mu.RLock()
+	defer cm.mu.RUnlock()
+	if _, ok := cm.clients[c]; !ok {
+		return false
+	}
 	select {
 	case c.send <- data:
 		return true
@@ -165,7 +269,9 @@ func (cm *ConnManager) Send(c *Client, data []byte) bool {
 }
 
 // TouchActivity updates the last-active timestamp for a client.
-// Call this when a client sends a message to prevent idle reaping.
+// Call this when a client sends a message to prevent idle reaping. It
+// takes the write lock because it updates the entry that Clients reads
+// under the read lock.
 func (cm *ConnManager) TouchActivity(c *Client) {
 	cm.mu.Lock()
 	if entry, ok := cm.clients[c]; ok {
@@ -176,19 +282,20 @@ func (cm *ConnManager) TouchActivity(c *Client) {
 
 // Count returns the number of active connections.
 func (cm *ConnManager) Count() int {
-	cm.mu.Lock()
-	defer cm.mu.Unlock()
+	cm.mu.RLock()
+	defer cm.mu.RUnlock()
 	return len(cm.clients)
 }
 
 // Stats returns point-in-time connection statistics.
 func (cm *ConnManager) Stats() ConnStats {
-	cm.mu.Lock()
+	cm.mu.RLock()
 	active := len(cm.clients)
 	maxConns := cm.maxConns
-	cm.mu.Unlock()
+	cm.mu.RUnlock()
 	return ConnStats{
 		Active:          active,
+		Peak:            int(cm.peak.Load()),
 		MaxConns:        maxConns,
 		Rejected:        cm.rejected.Load(),
 		DroppedMessages: cm.droppedMessages.Load(),
@@ -208,8 +315,8 @@ type ConnInfo struct {
 
 // Clients returns metadata for all active connections.
 func (cm *ConnManager) Clients() []ConnInfo {
-	cm.mu.Lock()
-	defer cm.mu.Unlock()
+	cm.mu.RLock()
+	defer cm.mu.RUnlock()
 	now := time.Now()
 	result := make([]ConnInfo, 0, len(cm.clients))
 	for c, entry := range cm.clients {
@@ -233,6 +340,7 @@ func (cm *ConnManager) Shutdown() {
 	clients := make(map[*Client]*connEntry, len(cm.clients))
 	for c, entry := range cm.clients {
 		clients[c] = entry
+		close(c.send)
 	}
 	cm.clients = make(map[*Client]*connEntry)
 	cm.mu.Unlock()
@@ -241,16 +349,18 @@ func (cm *ConnManager) Shutdown() {
 		cm.stopIdle()
 	}
 
+	i := 0
 	for c, entry := range clients {
 		entry.cancel()
-		close(c.send)
+		sendReconnectHint(context.Background(), c, reconnectHint(i, len(clients)))
 		c.conn.Close(websocket.StatusGoingAway, "server shutting down")
+		i++
 	}
 }
 
 // idleReapLoop periodically checks for and closes idle connections.
 func (cm *ConnManager) idleReapLoop(ctx context.Context) {
-	ticker := time.NewTicker(idleCheckInterval)
+	ticker := time.NewTicker(idleInterval(cm.idleTTL))
 	defer ticker.Stop()
 	for {
 		select {
@@ -262,6 +372,13 @@ func (cm *ConnManager) idleReapLoop(ctx context.Context) {
 	}
 }
 
+// idleInterval returns how often to check for connections idle longer
+// than ttl. Short idle timeouts are checked more often so a connection is
+// never kept much past its deadline, down to minIdleCheckInterval.
+func idleInterval(ttl time.Duration) time.Duration {
+	return min(max(ttl/2, minIdleCheckInterval), idleCheckInterval)
+}
+
 // reapIdle closes connections that have been idle longer than idleTTL.
 func (cm *ConnManager) reapIdle() {
 	cm.mu.Lock()
@@ -277,12 +394,13 @@ func (cm *ConnManager) reapIdle() {
 	for _, c := range stale {
 		entries[c] = cm.clients[c]
 		delete(cm.clients, c)
+		close(c.send)
+		c.timedOut.Store(true)
 	}
 	cm.mu.Unlock()
 
 	for c, entry := range entries {
 		entry.cancel()
-		close(c.send)
 		c.conn.Close(websocket.StatusPolicyViolation, "idle timeout")
 		cm.idleReaped.Add(1)
 		log.Printf("ws: reaped idle connection for client %s", c.userID)
@@ -290,8 +408,9 @@ func (cm *ConnManager) reapIdle() {
 }
 
 // writePump drains the client's send channel, writing each message
-// to the WebSocket connection. It exits when ctx is cancelled or the
-// send channel is closed.
+// to the WebSocket connection. With batching on, messages already waiting
+// behind the first are written together as one batch frame. It exits when
+// ctx is cancelled or the send channel is closed.
 func (cm *ConnManager) writePump(ctx context.Context, c *Client) {
 	for {
 		select {
@@ -301,6 +420,10 @@ func (cm *ConnManager) writePump(ctx context.Context, c *Client) {
 			if !ok {
 				return
 			}
+			open := true
+			if cm.batch {
+				msg, open = drainBatch(c.send, msg)
+			}
 			writeCtx, cancel := context.WithTimeout(ctx, writeTimeout)
 			if err := c.conn.Write(writeCtx, websocket.MessageText, msg); err != nil {
 				cancel()
@@ -308,6 +431,44 @@ func (cm *ConnManager) writePump(ctx context.Context, c *Client) {
 				return
 			}
 			cancel()
+			if !open {
+				return
+			}
+		}
+	}
+}
+
+// drainBatch takes whatever is queued on send without blocking and, if
+// anything was, wraps first and the queued messages in a batch envelope.
+// The returned bool is false if send was found closed while draining.
+func drainBatch(send <-chan []byte, first []byte) ([]byte, bool) {
+	msgs := []json.RawMessage{first}
+	open := true
+drain:
+	for {
+		select {
+		case msg, ok := <-send:
+			if !ok {
+				open = false
+				break drain
+			}
+			msgs = append(msgs, msg)
+		default:
+			break drain
 		}
 	}
+	if len(msgs) == 1 {
+		return first, open
+	}
+	payload, err := json.Marshal(msgs)
+	if err != nil {
+		log.Printf("ws: failed to marshal batch: %v", err)
+		return first, open
+	}
+	data, err := json.Marshal(Envelope{Type: string(message.TypeBatch), Payload: payload})
+	if err != nil {
+		log.Printf("ws: failed to marshal batch envelope: %v", err)
+		return first, open
+	}
+	return data, open
 }
@@ -3,6 +3,7 @@ package ws
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"sync"
@@ -34,7 +35,7 @@ func newConnTestServer(t *testing.T, hub *Hub, roomID string) *httptest.Server {
 			roomID:   roomID,
 			hub:      hub,
 		}
-		connCtx := hub.addClient(client)
+		connCtx, _ := hub.addClient(client)
 		defer hub.removeClient(client)
 
 		// Read until closed or context cancelled.
@@ -193,6 +194,25 @@ func TestConnManagerSendBufferFull(t *testing.T) {
 	}
 }
 
+func TestConnManagerSendAfterRemove(t *testing.T) {
+	cm := NewConnManager()
+
+	client := &Client{userID: "removed"}
+	client.send = make(chan []byte, sendBufferSize)
+	now := time.Now()
+	_, cancel := context.WithCancel(context.Background())
+	cm.mu.Lock()
+	cm.clients[client] = &connEntry{cancel: cancel, connectedAt: now, lastActive: now}
+	cm.mu.Unlock()
+
+	cm.Remove(client)
+
+	// The send channel is now closed; Send must report failure, not panic.
+	if cm.Send(client, []byte("late")) {
+		t.Fatal("expected send to a removed client to fail")
+	}
+}
+
 func TestConnManagerConcurrentSend(t *testing.T) {
 	hub := NewHub(nil)
 
@@ -272,10 +292,19 @@ func TestConnManagerShutdown(t *testing.T) {
 		t.Fatalf("expected 0 connections after shutdown, got %d", hub.ConnMgr().Count())
 	}
 
-	// The WebSocket should be closed — reads should fail.
+	// The client is told when to reconnect, then the WebSocket is closed.
 	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
 	defer cancel()
-	_, _, err := conn.Read(ctx)
+	_, data, err := conn.Read(ctx)
+	if err != nil {
+		t.Fatalf("expected reconnect hint before close, got %v", err)
+	}
+	var env Envelope
+	json.Unmarshal(data, &env)
+	if env.Type != string(message.TypeReconnect) {
+		t.Fatalf("expected reconnect envelope, got %s", env.Type)
+	}
+	_, _, err = conn.Read(ctx)
 	if err == nil {
 		t.Fatal("expected read to fail after shutdown")
 	}
@@ -477,6 +506,70 @@ func TestConnManagerStats(t *testing.T) {
 	cm.Remove(client)
 }
 
+func TestConnManagerSendUnderReadLock(t *testing.T) {
+	cm := NewConnManager()
+	client := &Client{userID: "reader"}
+	client.send = make(chan []byte, sendBufferSize)
+
+	now := time.Now()
+	_, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cm.mu.Lock()
+	cm.clients[client] = &connEntry{cancel: cancel, connectedAt: now, lastActive: now}
+	cm.mu.Unlock()
+
+	// Another broadcast holding the read lock must not hold up this one.
+	cm.mu.RLock()
+	done := make(chan bool, 1)
+	go func() { done <- cm.Send(client, []byte("msg")) }()
+	select {
+	case ok := <-done:
+		if !ok {
+			t.Error("expected send to succeed")
+		}
+	case <-time.After(time.Second):
+		t.Error("expected send to proceed while another reader holds the lock")
+	}
+	cm.mu.RUnlock()
+
+	cm.Remove(client)
+	if cm.Send(client, []byte("msg")) {
+		t.Error("expected send to a removed client to fail")
+	}
+}
+
+func TestConnManagerPeak(t *testing.T) {
+	cm := NewConnManager()
+
+	// The write pumps never write here, so the clients need no connection.
+	clients := make([]*Client, 5)
+	for i := range clients {
+		clients[i] = &Client{userID: fmt.Sprintf("peak-%d", i)}
+		cm.Add(clients[i])
+	}
+	for _, c := range clients[:3] {
+		cm.Remove(c)
+	}
+
+	stats := cm.Stats()
+	if stats.Active != 2 {
+		t.Fatalf("expected 2 active, got %d", stats.Active)
+	}
+	if stats.Peak != 5 {
+		t.Errorf("expected peak 5, got %d", stats.Peak)
+	}
+
+	// Coming back up below the old high-water mark leaves it alone.
+	extra := &Client{userID: "peak-extra"}
+	cm.Add(extra)
+	if peak := cm.Stats().Peak; peak != 5 {
+		t.Errorf("expected peak to stay 5, got %d", peak)
+	}
+	for _, c := range append(clients[3:], extra) {
+		cm.Remove(c)
+	}
+}
+
 func TestConnManagerTouchActivity(t *testing.T) {
 	cm := NewConnManager()
 
@@ -605,6 +698,22 @@ func TestConnManagerIdleReap(t *testing.T) {
 	}
 }
 
+func TestIdleInterval(t *testing.T) {
+	tests := []struct {
+		ttl  time.Duration
+		want time.Duration
+	}{
+		{time.Hour, idleCheckInterval},
+		{10 * time.Second, 5 * time.Second},
+		{time.Nanosecond, minIdleCheckInterval}, // never a zero ticker
+	}
+	for _, tt := range tests {
+		if got := idleInterval(tt.ttl); got != tt.want {
+			t.Errorf("idleInterval(%v) = %v, want %v", tt.ttl, got, tt.want)
+		}
+	}
+}
+
 func TestConnManagerIdleReapSkipsActive(t *testing.T) {
 	cm := NewConnManager(WithIdleTimeout(1 * time.Hour))
 	defer cm.Shutdown()
@@ -661,3 +770,111 @@ func TestConnManagerDroppedMessageStats(t *testing.T) {
 		t.Fatalf("expected 3 dropped, got %d", stats.DroppedMessages)
 	}
 }
+
+func TestConnManagerBatching(t *testing.T) {
+	for _, batching := range []bool{true, false} {
+		t.Run(fmt.Sprintf("batching=%v", batching), func(t *testing.T) {
+			cm := NewConnManager(WithBatching(batching))
+
+			client := &Client{userID: "batched"}
+			ready := make(chan struct{})
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				conn, err := websocket.Accept(w, r, nil)
+				if err != nil {
+					return
+				}
+				client.conn = conn
+				close(ready)
+				for {
+					if _, _, err := conn.Read(r.Context()); err != nil {
+						return
+					}
+				}
+			}))
+			defer ts.Close()
+
+			conn := dialWS(t, ts.URL)
+			defer conn.Close(websocket.StatusNormalClosure, "")
+			<-ready
+
+			// Queue three broadcasts before the write pump runs, as if they
+			// arrived while it was busy with an earlier write.
+			client.send = make(chan []byte, sendBufferSize)
+			now := time.Now()
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			cm.mu.Lock()
+			cm.clients[client] = &connEntry{cancel: cancel, connectedAt: now, lastActive: now}
+			cm.mu.Unlock()
+			for i := 0; i < 3; i++ {
+				payload, err := json.Marshal(&message.Message{
+					ID:      fmt.Sprintf("msg-%d", i),
+					RoomID:  "room1",
+					Content: fmt.Sprintf("message %d", i),
+					Type:    message.TypeChat,
+				})
+				if err != nil {
+					t.Fatalf("marshal error: %v", err)
+				}
+				data, err := json.Marshal(Envelope{Type: string(message.TypeChat), Payload: payload})
+				if err != nil {
+					t.Fatalf("marshal envelope error: %v", err)
+				}
+				if !cm.Send(client, data) {
+					t.Fatalf("send %d failed", i)
+				}
+			}
+			go cm.writePump(ctx, client)
+
+			// Split frames the way a client would: a batch frame carries an
+			// array of envelopes, anything else is a single envelope.
+			var got []Envelope
+			frames := 0
+			readCtx, readCancel := context.WithTimeout(context.Background(), 2*time.Second)
+			defer readCancel()
+			for len(got) < 3 {
+				_, data, err := conn.Read(readCtx)
+				if err != nil {
+					t.Fatalf("read error after %d envelopes: %v", len(got), err)
+				}
+				frames++
+				var env Envelope
+				if err := json.Unmarshal(data, &env); err != nil {
+					t.Fatalf("unmarshal error: %v", err)
+				}
+				if env.Type != string(message.TypeBatch) {
+					got = append(got, env)
+					continue
+				}
+				var inner []Envelope
+				if err := json.Unmarshal(env.Payload, &inner); err != nil {
+					t.Fatalf("unmarshal batch error: %v", err)
+				}
+				got = append(got, inner...)
+			}
+
+			wantFrames := 3
+			if batching {
+				wantFrames = 1
+			}
+			if frames != wantFrames {
+				t.Errorf("expected %d frames, got %d", wantFrames, frames)
+			}
+			if len(got) != 3 {
+				t.Fatalf("expected 3 envelopes, got %d", len(got))
+			}
+			for i, env := range got {
+				var msg message.Message
+				if env.Type != "chat" {
+					t.Fatalf("envelope %d: expected type chat, got %q", i, env.Type)
+				}
+				if err := json.Unmarshal(env.Payload, &msg); err != nil {
+					t.Fatalf("unmarshal payload error: %v", err)
+				}
+				if want := fmt.Sprintf("msg-%d", i); msg.ID != want {
+					t.Errorf("envelope %d: expected %s, got %s", i, want, msg.ID)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,51 @@
+package ws
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// historyCursorTTL is how long a cursor returned by history_fetch stays
+// valid. Clients paging further back after that restart from before_id.
+const historyCursorTTL = 10 * time.Minute
+
+var errInvalidCursor = errors.New("invalid or expired cursor")
+
+// historyCursor is the decoded form of the opaque cursor handed to clients
+// for paging through history. It points just past the oldest message the
+// client has seen, by sequence number.
+type historyCursor struct {
+	RoomID  string `json:"r"`
+	Seq     int64  `json:"s"`
+	Expires int64  `json:"e"` // unix seconds
+}
+
+// encodeCursor returns an opaque cursor for fetching messages older than
+// seq in roomID.
+func encodeCursor(roomID string, seq int64, now time.Time) string {
+	data, _ := json.Marshal(historyCursor{
+		RoomID:  roomID,
+		Seq:     seq,
+		Expires: now.Add(historyCursorTTL).Unix(),
+	})
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// decodeCursor returns the sequence number held by cursor. It fails if the
+// cursor is malformed, has expired, or was issued for a different room.
+func decodeCursor(cursor, roomID string, now time.Time) (int64, error) {
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, errInvalidCursor
+	}
+	var c historyCursor
+	if err := json.Unmarshal(data, &c); err != nil {
+		return 0, errInvalidCursor
+	}
+	if c.RoomID != roomID || c.Seq <= 0 || now.Unix() > c.Expires {
+		return 0, errInvalidCursor
+	}
+	return c.Seq, nil
+}
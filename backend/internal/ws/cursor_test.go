@@ -0,0 +1,43 @@
+package ws
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCursorRoundTrip(t *testing.T) {
+	now := time.Now()
+	cursor := encodeCursor("room1", 42, now)
+
+	seq, err := decodeCursor(cursor, "room1", now)
+	if err != nil {
+		t.Fatalf("decode error: %v", err)
+	}
+	if seq != 42 {
+		t.Errorf("expected seq 42, got %d", seq)
+	}
+}
+
+func TestCursorRejected(t *testing.T) {
+	now := time.Now()
+	cursor := encodeCursor("room1", 42, now)
+
+	tests := []struct {
+		name   string
+		cursor string
+		roomID string
+		now    time.Time
+	}{
+		{"malformed", "not a cursor!", "room1", now},
+		{"not json", "aGVsbG8", "room1", now},
+		{"other room", cursor, "room2", now},
+		{"expired", cursor, "room1", now.Add(historyCursorTTL + time.Second)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := decodeCursor(tt.cursor, tt.roomID, tt.now); err != errInvalidCursor {
+				t.Errorf("expected errInvalidCursor, got %v", err)
+			}
+		})
+	}
+}
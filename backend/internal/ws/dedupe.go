@@ -0,0 +1,104 @@
+package ws
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/christopherjohns/chatsphere/internal/message"
+)
+
+const (
+	// dedupeCapacity is the maximum number of client message IDs remembered.
+	dedupeCapacity = 1024
+
+	// dedupeTTL is how long a client message ID is remembered for resend detection.
+	dedupeTTL = 2 * time.Minute
+
+	// maxClientMsgIDLength caps the size of client-supplied idempotency keys.
+	maxClientMsgIDLength = 64
+)
+
+// dedupeEntry is a remembered (userID, clientMsgID) pair and the server
+// message it produced.
+type dedupeEntry struct {
+	key       string
+	msg       *message.Message
+	expiresAt time.Time
+}
+
+// dedupeCache is a small LRU with TTL that maps client idempotency keys to
+// the server message already broadcast for them, so a resend after a
+// reconnect does not produce a duplicate.
+type dedupeCache struct {
+	mu       sync.Mutex
+	entries  map[string]*list.Element
+	order    *list.List // front = most recently used
+	capacity int
+	ttl      time.Duration
+}
+
+// newDedupeCache creates a cache holding up to capacity keys for ttl.
+func newDedupeCache(capacity int, ttl time.Duration) *dedupeCache {
+	return &dedupeCache{
+		entries:  make(map[string]*list.Element),
+		order:    list.New(),
+		capacity: capacity,
+		ttl:      ttl,
+	}
+}
+
+func dedupeKey(userID, clientMsgID string) string {
+	return userID + "\x00" + clientMsgID
+}
+
+// Get returns the message previously recorded for the key, or nil if the
+// key is unknown or has expired.
+func (d *dedupeCache) Get(userID, clientMsgID string) *message.Message {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	el, ok := d.entries[dedupeKey(userID, clientMsgID)]
+	if !ok {
+		return nil
+	}
+	entry := el.Value.(*dedupeEntry)
+	if time.Now().After(entry.expiresAt) {
+		d.order.Remove(el)
+		delete(d.entries, entry.key)
+		return nil
+	}
+	d.order.MoveToFront(el)
+	return entry.msg
+}
+
+// Add records the message produced for the key, evicting the least
+// recently used entry if the cache is full.
+func (d *dedupeCache) Add(userID, clientMsgID string, msg *message.Message) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	key := dedupeKey(userID, clientMsgID)
+	if el, ok := d.entries[key]; ok {
+		entry := el.Value.(*dedupeEntry)
+		entry.msg = msg
+		entry.expiresAt = time.Now().Add(d.ttl)
+		d.order.MoveToFront(el)
+		return
+	}
+	d.entries[key] = d.order.PushFront(&dedupeEntry{
+		key:       key,
+		msg:       msg,
+		expiresAt: time.Now().Add(d.ttl),
+	})
+	for d.order.Len() > d.capacity {
+		oldest := d.order.Back()
+		d.order.Remove(oldest)
+		delete(d.entries, oldest.Value.(*dedupeEntry).key)
+	}
+}
+
+// Len returns the number of remembered keys.
+func (d *dedupeCache) Len() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.order.Len()
+}
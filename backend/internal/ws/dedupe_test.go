@@ -0,0 +1,51 @@
+package ws
+
+import (
+	"testing"
+	"time"
+
+	"github.com/christopherjohns/chatsphere/internal/message"
+)
+
+func TestDedupeCacheGetAdd(t *testing.T) {
+	d := newDedupeCache(10, time.Minute)
+	if d.Get("u1", "m1") != nil {
+		t.Fatal("expected miss for unknown key")
+	}
+	msg := &message.Message{ID: "srv-1"}
+	d.Add("u1", "m1", msg)
+	if got := d.Get("u1", "m1"); got != msg {
+		t.Errorf("expected recorded message, got %+v", got)
+	}
+	// Keys are scoped per user.
+	if d.Get("u2", "m1") != nil {
+		t.Error("expected miss for the same client ID from another user")
+	}
+}
+
+func TestDedupeCacheTTL(t *testing.T) {
+	d := newDedupeCache(10, 20*time.Millisecond)
+	d.Add("u1", "m1", &message.Message{ID: "srv-1"})
+	time.Sleep(40 * time.Millisecond)
+	if d.Get("u1", "m1") != nil {
+		t.Error("expected expired entry to be a miss")
+	}
+	if d.Len() != 0 {
+		t.Errorf("expected expired entry to be evicted, len=%d", d.Len())
+	}
+}
+
+func TestDedupeCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	d := newDedupeCache(2, time.Minute)
+	d.Add("u1", "a", &message.Message{ID: "a"})
+	d.Add("u1", "b", &message.Message{ID: "b"})
+	d.Get("u1", "a") // a is now most recently used
+	d.Add("u1", "c", &message.Message{ID: "c"})
+
+	if d.Get("u1", "b") != nil {
+		t.Error("expected least recently used entry to be evicted")
+	}
+	if d.Get("u1", "a") == nil || d.Get("u1", "c") == nil {
+		t.Error("expected recent entries to be retained")
+	}
+}
@@ -0,0 +1,106 @@
+package ws
+
+import (
+	"log"
+	"time"
+)
+
+// EventType identifies a moderation or audit event emitted by the hub.
+type EventType string
+
+const (
+	EventJoin    EventType = "join"
+	EventLeave   EventType = "leave"
+	EventKick    EventType = "kick"
+	EventBan     EventType = "ban"
+	EventMute    EventType = "mute"
+	EventUnmute  EventType = "unmute"
+	EventMessage EventType = "message"
+	EventEdit    EventType = "edit"
+	EventDelete  EventType = "delete"
+)
+
+// Event is a structured record of something that happened in a room.
+// UserID/Username identify the subject; ActorID is the host who performed
+// a moderation action.
+type Event struct {
+	Type      EventType `json:"type"`
+	RoomID    string    `json:"room_id"`
+	UserID    string    `json:"user_id,omitempty"`
+	Username  string    `json:"username,omitempty"`
+	ActorID   string    `json:"actor_id,omitempty"`
+	MessageID string    `json:"message_id,omitempty"`
+	Content   string    `json:"content,omitempty"`
+	Time      time.Time `json:"time"`
+}
+
+// SetEventSink installs a callback that receives every emitted Event. The
+// sink is called synchronously, so it must not block.
+func (h *Hub) SetEventSink(fn func(Event)) {
+	h.eventSink = fn
+}
+
+// emit sends an event to the sink, if one is installed.
+func (h *Hub) emit(e Event) {
+	if h.eventSink == nil {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = h.Now()
+	}
+	h.eventSink(e)
+}
+
+// RoomEvent records one change to who is in a room: a join, a leave, or a
+// kick or ban that removed someone. Type is one of EventJoin, EventLeave,
+// EventKick or EventBan.
+type RoomEvent struct {
+	Type     EventType
+	UserID   string
+	Username string
+	Time     time.Time
+}
+
+// roomEventBuffer is how many room events may wait for a slow hook before
+// new ones are dropped.
+const roomEventBuffer = 256
+
+type queuedRoomEvent struct {
+	roomID string
+	event  RoomEvent
+}
+
+// SetRoomEventHook installs an in-process callback for room membership
+// changes, for live analytics such as peak users and churn. Unlike the
+// event sink it sees every connection come and go, including those
+// dropped by DisconnectRoom. fn runs on its own goroutine, in order, so
+// it never holds up the hub; if it falls behind, events are dropped. Call
+// it once, before serving.
+func (h *Hub) SetRoomEventHook(fn func(roomID string, event RoomEvent)) {
+	ch := make(chan queuedRoomEvent, roomEventBuffer)
+	h.roomEvents = ch
+	go func() {
+		for q := range ch {
+			fn(q.roomID, q.event)
+		}
+	}()
+}
+
+// roomEvent describes c for a room event. Must be called with h.mu held,
+// since renames change c.username under it.
+func (h *Hub) roomEvent(typ EventType, c *Client) RoomEvent {
+	return RoomEvent{Type: typ, UserID: c.userID, Username: c.username, Time: h.Now()}
+}
+
+// sendRoomEvent queues an event for the room event hook, if one is
+// installed, without blocking.
+func (h *Hub) sendRoomEvent(roomID string, e RoomEvent) {
+	if h.roomEvents == nil {
+		return
+	}
+	select {
+	case h.roomEvents <- queuedRoomEvent{roomID: roomID, event: e}:
+	default:
+		log.Printf("ws: room event hook is behind; dropping %s event for %s", e.Type, roomID)
+	}
+}
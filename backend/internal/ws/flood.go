@@ -0,0 +1,133 @@
+package ws
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/christopherjohns/chatsphere/internal/message"
+	"github.com/christopherjohns/chatsphere/internal/ratelimit"
+)
+
+const (
+	// slowModeInterval is the minimum gap between one user's messages
+	// while a room is in slow mode.
+	slowModeInterval = 5 * time.Second
+
+	// slowModeDuration is how long slow mode stays on once a flood trips it.
+	slowModeDuration = time.Minute
+)
+
+// floodGuard caps the total message rate of a room regardless of who is
+// sending. When a room goes over the cap it is put in slow mode, limiting
+// every user to one message per interval until the mode expires.
+type floodGuard struct {
+	rooms    *ratelimit.IPLimiter // keyed by roomID
+	interval time.Duration
+	duration time.Duration
+
+	mu   sync.Mutex
+	slow map[string]*slowMode // roomID → active slow mode
+}
+
+// slowMode is the per-room state while slow mode is on.
+type slowMode struct {
+	until time.Time
+	users *ratelimit.IPLimiter // keyed by userID
+}
+
+func newFloodGuard(n int, window time.Duration) *floodGuard {
+	return &floodGuard{
+		rooms:    ratelimit.NewIPLimiter(n, window),
+		interval: slowModeInterval,
+		duration: slowModeDuration,
+		slow:     make(map[string]*slowMode),
+	}
+}
+
+// allow records a message from userID in roomID. It returns false if the
+// message must be rejected, and engaged is true when this message is the
+// one that tripped the room into slow mode.
+func (f *floodGuard) allow(roomID, userID string) (ok, engaged bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	now := time.Now()
+	if sm := f.slow[roomID]; sm != nil {
+		if now.Before(sm.until) {
+			return sm.users.Allow(userID), false
+		}
+		delete(f.slow, roomID)
+	}
+
+	if f.rooms.Allow(roomID) {
+		return true, false
+	}
+	f.slow[roomID] = &slowMode{
+		until: now.Add(f.duration),
+		users: ratelimit.NewIPLimiter(1, f.interval),
+	}
+	return false, true
+}
+
+// slowInterval returns the per-user message interval if the room is in
+// slow mode, or zero.
+func (f *floodGuard) slowInterval(roomID string) time.Duration {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if sm := f.slow[roomID]; sm != nil && time.Now().Before(sm.until) {
+		return f.interval
+	}
+	return 0
+}
+
+// deleteRoom drops any slow mode state for a room.
+func (f *floodGuard) deleteRoom(roomID string) {
+	f.mu.Lock()
+	delete(f.slow, roomID)
+	f.mu.Unlock()
+}
+
+// SetFloodGuard caps each room at n messages per window across all users.
+// A room that exceeds the cap is switched to slow mode. A value of 0
+// disables the guard (the default).
+func (h *Hub) SetFloodGuard(n int, window time.Duration) {
+	if n <= 0 {
+		h.flood = nil
+		return
+	}
+	h.flood = newFloodGuard(n, window)
+}
+
+// SlowMode returns the minimum gap between one user's messages while the
+// room is in slow mode, or zero if it is not.
+func (h *Hub) SlowMode(roomID string) time.Duration {
+	if h.flood == nil {
+		return 0
+	}
+	return h.flood.slowInterval(roomID)
+}
+
+// allowRoomMessage applies the room-wide flood guard to a message from
+// userID. If the message trips the guard, the room is told slow mode is on.
+func (h *Hub) allowRoomMessage(roomID, userID string) bool {
+	if h.flood == nil {
+		return true
+	}
+	ok, engaged := h.flood.allow(roomID, userID)
+	if engaged {
+		h.Broadcast(roomID, &message.Message{
+			RoomID: roomID,
+			Content: fmt.Sprintf("Slow mode is on for %s: one message every %s",
+				formatDuration(h.flood.duration), formatDuration(h.flood.interval)),
+			Type:   message.TypeSystem,
+			Action: message.ActionSlowMode,
+		})
+	}
+	return ok
+}
+
+// slowModeError is the error sent to a user held back by the flood guard.
+func (h *Hub) slowModeError() string {
+	return fmt.Sprintf("slow mode is on: max 1 message per %s", formatDuration(h.flood.interval))
+}
@@ -0,0 +1,41 @@
+package ws
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFloodGuardEngagesAndExpires(t *testing.T) {
+	f := newFloodGuard(2, time.Minute)
+	f.duration = 50 * time.Millisecond
+
+	for _, user := range []string{"a", "b"} {
+		if ok, _ := f.allow("room1", user); !ok {
+			t.Fatalf("expected message from %s under the room cap", user)
+		}
+	}
+	ok, engaged := f.allow("room1", "c")
+	if ok || !engaged {
+		t.Fatalf("expected third message to trip slow mode, got ok=%v engaged=%v", ok, engaged)
+	}
+
+	// In slow mode each user gets one message per interval.
+	if ok, engaged := f.allow("room1", "a"); !ok || engaged {
+		t.Error("expected first slow-mode message from a to pass")
+	}
+	if ok, _ := f.allow("room1", "a"); ok {
+		t.Error("expected second slow-mode message from a to be held back")
+	}
+
+	// Other rooms are unaffected.
+	if ok, _ := f.allow("room2", "a"); !ok {
+		t.Error("expected room2 to be unaffected")
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	// Once slow mode lapses the room cap applies again; room1 is still
+	// over it within the window, so slow mode re-engages.
+	if ok, engaged := f.allow("room1", "a"); ok || !engaged {
+		t.Errorf("expected slow mode to re-engage while still over the cap, got ok=%v engaged=%v", ok, engaged)
+	}
+}
@@ -5,11 +5,19 @@ import (
 	"crypto/rand"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"hash/fnv"
+	"io"
 	"log"
+	"net"
 	"net/http"
+	"sort"
 	"strings"
+	"sync"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/christopherjohns/chatsphere/internal/message"
 	"github.com/christopherjohns/chatsphere/internal/ratelimit"
@@ -21,25 +29,106 @@ import (
 // to join. It returns an empty string on success or an error reason on failure.
 type RoomValidator func(roomID string) string
 
+// ContentFilter inspects chat content before it is broadcast. It returns the
+// text to broadcast (e.g. with words masked) or blocked=true to reject the
+// message outright.
+type ContentFilter func(content string) (filtered string, blocked bool)
+
+// IdentityResolver maps an upgrade request to a known user, e.g. by
+// checking a bearer token. It returns ok=false for anonymous requests,
+// which then fall back to the session cookie or a random ID.
+type IdentityResolver func(r *http.Request) (userID, displayName string, ok bool)
+
 // Handler handles WebSocket upgrade requests and client message loops.
 type Handler struct {
-	hub          *Hub
-	validateRoom RoomValidator
-	sessions     *SessionStore
-	messages     message.MessageStore
-	chatLimiter  *ratelimit.IPLimiter
-	userSessions *user.SessionStore
-	cookieName   string
+	hub           *Hub
+	validateRoom  RoomValidator
+	sessions      *SessionStore
+	messages      message.MessageStore
+	chatLimiter   *ratelimit.IPLimiter
+	roomLimiter   func(roomID string) *ratelimit.IPLimiter
+	roomCapacity  func(roomID string) int
+	resolveCode   func(code string) string
+	roomTopic     func(roomID string) string
+	setRoomTopic  func(roomID, topic string)
+	renameLimit   *ratelimit.IPLimiter
+	renameNotices *ratelimit.IPLimiter // keyed by roomID; nil announces every rename
+	recentSends   *dedupeCache
+	searchLimit   *ratelimit.IPLimiter
+	presenceLimit *ratelimit.IPLimiter
+	filter        ContentFilter
+	knockTimeout  time.Duration
+	unfurler      *Unfurler
+	userSessions  *user.SessionStore
+	cookieName    string
+	reserved      map[string]struct{} // lowercased usernames nobody may claim
+	anonNamer     func(userID string) string
+	identify      IdentityResolver
+
+	// Features a deployment can switch off; see Capabilities.
+	editingDisabled     bool
+	attachmentsDisabled bool
+
+	// evictDuplicates makes a join for an already connected session take
+	// over from the older connection instead of being refused.
+	evictDuplicates bool
+
+	// strict answers envelopes of unknown type with an error instead of
+	// ignoring them.
+	strict bool
+
+	// leaveGrace delays "left" announcements so a session that resumes
+	// within it reconnects silently. pendingLeaves holds the delayed
+	// announcements by session ID.
+	leaveGrace    time.Duration
+	leaveMu       sync.Mutex
+	pendingLeaves map[string]*time.Timer
+
+	// backfillLimit caps the messages replayed to a resumed session. When
+	// more than gapThreshold were missed, only the gapRecent newest are
+	// sent instead; a zero gapThreshold disables that.
+	backfillLimit int
+	gapThreshold  int
+	gapRecent     int
 }
 
-// NewHandler creates a new WebSocket Handler.
+// Subprotocol is the WebSocket subprotocol naming the envelope schema this
+// server speaks. A client that offers subprotocols must include it; one
+// that offers none is assumed to speak it.
+const Subprotocol = "chatsphere.v1"
+
+// anonPrefix is the username prefix given to users who join without a name.
+const anonPrefix = "anon-"
+
+// hostNameError is given to anyone else who tries to use the name of the
+// host or a moderator.
+const hostNameError = "username is in use by the room host or a moderator"
+
+// roomClosedReason is given to a session that tries to resume in a room
+// that has since been reaped.
+const roomClosedReason = "this room no longer exists"
+
+// defaultReservedUsernames are the names blocked unless overridden with
+// SetReservedUsernames.
+var defaultReservedUsernames = []string{"admin", "system", "moderator"}
+
+// NewHandler creates a new WebSocket Handler. sessions may be nil for a
+// minimal setup: every join then starts afresh and nothing can be resumed.
 func NewHandler(hub *Hub, validateRoom RoomValidator, sessions *SessionStore, messages message.MessageStore) *Handler {
 	return &Handler{
-		hub:          hub,
-		validateRoom: validateRoom,
-		sessions:     sessions,
-		messages:     messages,
-		chatLimiter:  ratelimit.NewIPLimiter(10, 10*time.Second),
+		hub:           hub,
+		validateRoom:  validateRoom,
+		sessions:      sessions,
+		messages:      messages,
+		chatLimiter:   ratelimit.NewIPLimiter(10, 10*time.Second),
+		renameLimit:   ratelimit.NewIPLimiter(3, time.Minute),
+		recentSends:   newDedupeCache(dedupeCapacity, dedupeTTL),
+		searchLimit:   ratelimit.NewIPLimiter(5, 10*time.Second),
+		presenceLimit: ratelimit.NewIPLimiter(5, 10*time.Second),
+		knockTimeout:  defaultKnockTimeout,
+		reserved:      reservedSet(defaultReservedUsernames),
+		pendingLeaves: make(map[string]*time.Timer),
+		backfillLimit: defaultBackfillLimit,
 	}
 }
 
@@ -50,15 +139,230 @@ func (h *Handler) SetUserSessions(store *user.SessionStore, cookieName string) {
 	h.cookieName = cookieName
 }
 
-// SetChatLimiter replaces the default chat rate limiter (for testing).
+// SetReservedUsernames replaces the list of usernames that clients may not
+// claim. Matching is case-insensitive.
+func (h *Handler) SetReservedUsernames(names []string) {
+	h.reserved = reservedSet(names)
+}
+
+func reservedSet(names []string) map[string]struct{} {
+	set := make(map[string]struct{}, len(names))
+	for _, n := range names {
+		set[strings.ToLower(strings.TrimSpace(n))] = struct{}{}
+	}
+	return set
+}
+
+// joinUsername returns the name a fresh join goes by: blank and reserved
+// names become an anonymous one. If the name may not be used it returns
+// the reason to close the connection with instead. A name vouched for by
+// the IdentityResolver is taken as is.
+func (h *Handler) joinUsername(client *Client, roomID, name string) (string, string) {
+	name = strings.TrimSpace(name)
+	if client.verified != "" {
+		return name, ""
+	}
+	if name == "" || h.isReservedUsername(name) {
+		name = h.anonName(client.userID)
+	}
+	if len(name) > maxUsernameLength {
+		return "", "username must be 30 characters or less"
+	}
+	if h.hub.impersonatesStaff(roomID, name, client.userID) {
+		return "", hostNameError
+	}
+	return name, ""
+}
+
+// isReservedUsername reports whether name is on the reserved list or
+// impersonates an anonymous user via the anon- prefix.
+func (h *Handler) isReservedUsername(name string) bool {
+	lower := strings.ToLower(name)
+	if strings.HasPrefix(lower, anonPrefix) {
+		return true
+	}
+	_, ok := h.reserved[lower]
+	return ok
+}
+
+// SetAnonNamer sets the function that names users who join without a
+// username. Names it returns that are empty, too long or reserved fall back
+// to the default anon- name. Passing nil restores the default.
+func (h *Handler) SetAnonNamer(fn func(userID string) string) {
+	h.anonNamer = fn
+}
+
+// SetIdentityResolver lets a deployment vouch for who is connecting, for
+// example from a JWT or OAuth session. A resolved user keeps the same user
+// ID on every connection and is always shown under the display name the
+// resolver returns, whatever name the join asks for. Requests the resolver
+// does not recognise stay anonymous.
+func (h *Handler) SetIdentityResolver(fn IdentityResolver) {
+	h.identify = fn
+}
+
+// anonName returns the username given to userID when it joins without one.
+func (h *Handler) anonName(userID string) string {
+	if h.anonNamer != nil {
+		name := strings.TrimSpace(h.anonNamer(userID))
+		if name != "" && len(name) <= maxUsernameLength && !h.isReservedUsername(name) {
+			return name
+		}
+	}
+	return anonPrefix + userID[:6]
+}
+
+// SetChatLimiter replaces the default chat rate limiter of 10 messages
+// per 10 seconds.
 func (h *Handler) SetChatLimiter(l *ratelimit.IPLimiter) {
 	h.chatLimiter = l
 }
 
+// SetRoomChatLimiter installs a lookup for per-room chat rate limiters.
+// Rooms for which fn returns nil use the handler-wide chat limiter.
+func (h *Handler) SetRoomChatLimiter(fn func(roomID string) *ratelimit.IPLimiter) {
+	h.roomLimiter = fn
+}
+
+// SetRoomCapacity installs a lookup for a room's capacity. Joins beyond it
+// are refused, except for the host and resumed sessions, and it is reported
+// to clients when they finish joining.
+func (h *Handler) SetRoomCapacity(fn func(roomID string) int) {
+	h.roomCapacity = fn
+}
+
+// SetRoomCodeResolver installs a lookup from a private room code to its
+// room ID, letting clients join with code in place of room_id. fn returns
+// "" for a code that matches no room.
+func (h *Handler) SetRoomCodeResolver(fn func(code string) string) {
+	h.resolveCode = fn
+}
+
+// SetRoomTopic installs accessors for a room's topic, which the host can
+// change with set_topic and which is reported to clients when they finish
+// joining. Without them set_topic is rejected.
+func (h *Handler) SetRoomTopic(get func(roomID string) string, set func(roomID, topic string)) {
+	h.roomTopic = get
+	h.setRoomTopic = set
+}
+
+// SetEditingEnabled turns message editing on or off. It is on by default.
+func (h *Handler) SetEditingEnabled(enabled bool) {
+	h.editingDisabled = !enabled
+}
+
+// SetAttachmentsEnabled turns attachment uploads on or off. They are on by
+// default.
+func (h *Handler) SetAttachmentsEnabled(enabled bool) {
+	h.attachmentsDisabled = !enabled
+}
+
+// Capabilities reports what this handler supports. It is sent in the
+// joined envelope and served over REST for clients that haven't joined.
+func (h *Handler) Capabilities() Capabilities {
+	return Capabilities{
+		MaxMessageLength:   maxMessageLength,
+		HistoryLimit:       historyLimit,
+		ReactionsEnabled:   false, // not implemented yet
+		EditingEnabled:     !h.editingDisabled && h.messages != nil,
+		AttachmentsEnabled: !h.attachmentsDisabled,
+	}
+}
+
+// SetEvictDuplicateSessions controls what happens when a join resumes a
+// session that is still connected, e.g. from a second tab. By default the
+// newcomer is refused; with evict set the older connection is closed and
+// the newcomer takes over the session.
+func (h *Handler) SetEvictDuplicateSessions(evict bool) {
+	h.evictDuplicates = evict
+}
+
+// SetStrictProtocol controls what happens to an envelope whose type the
+// server does not know. By default it is ignored, so older servers
+// tolerate newer clients; in strict mode the sender gets an unknown_type
+// error, which helps client developers catch typos.
+func (h *Handler) SetStrictProtocol(strict bool) {
+	h.strict = strict
+}
+
+// SetLeaveGrace delays the "left" message for a dropped connection by d.
+// If the session resumes within d, neither the leave nor the rejoin is
+// announced, so a flaky connection does not flood the room. Explicit
+// leaves and idle timeouts are still announced at once. Zero, the
+// default, announces every leave immediately.
+func (h *Handler) SetLeaveGrace(d time.Duration) {
+	h.leaveGrace = d
+}
+
+// SetBackfillLimit caps how many missed messages a resumed session is
+// replayed. Older ones are dropped and the backfill is flagged has_gap.
+// The default is 200.
+func (h *Handler) SetBackfillLimit(n int) {
+	h.backfillLimit = n
+}
+
+// SetBackfillGap skips the replay for sessions that missed more than
+// threshold messages, sending only the recent newest ones flagged has_gap,
+// so a client back from a long absence is not sent megabytes of history
+// it will never read. A zero threshold, the default, always replays up to
+// the backfill limit.
+func (h *Handler) SetBackfillGap(threshold, recent int) {
+	h.gapThreshold = threshold
+	h.gapRecent = recent
+}
+
+// chatLimiterFor returns the chat rate limiter that applies in a room.
+func (h *Handler) chatLimiterFor(roomID string) *ratelimit.IPLimiter {
+	if h.roomLimiter != nil {
+		if l := h.roomLimiter(roomID); l != nil {
+			return l
+		}
+	}
+	return h.chatLimiter
+}
+
+// SetRenameLimiter replaces the default username change rate limiter (for testing).
+func (h *Handler) SetRenameLimiter(l *ratelimit.IPLimiter) {
+	h.renameLimit = l
+}
+
+// SetRenameBroadcastLimit caps each room at n rename announcements per
+// window. Renames past the cap, such as a bot renaming guests in bulk,
+// still take effect but only update everyone's presence roster, with no
+// system message in the room's history. n <= 0 announces every rename.
+func (h *Handler) SetRenameBroadcastLimit(n int, window time.Duration) {
+	if n <= 0 {
+		h.renameNotices = nil
+		return
+	}
+	h.renameNotices = ratelimit.NewIPLimiter(n, window)
+}
+
+// SetKnockTimeout sets how long a knock waits for the host's decision.
+func (h *Handler) SetKnockTimeout(d time.Duration) {
+	h.knockTimeout = d
+}
+
+// SetContentFilter installs a filter applied to every chat message. A nil
+// filter (the default) passes content through unchanged.
+func (h *Handler) SetContentFilter(f ContentFilter) {
+	h.filter = f
+}
+
+// SetSearchLimiter replaces the default message search rate limiter (for testing).
+func (h *Handler) SetSearchLimiter(l *ratelimit.IPLimiter) {
+	h.searchLimit = l
+}
+
 // ServeHTTP upgrades the HTTP connection to a WebSocket and runs the
 // read loop for the client.
 func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !offersSubprotocol(r) {
+		http.Error(w, "unsupported subprotocol: this server speaks "+Subprotocol, http.StatusBadRequest)
+		return
+	}
 	conn, err := websocket.Accept(w, r, &websocket.AcceptOptions{
+		Subprotocols:       []string{Subprotocol},
 		InsecureSkipVerify: true, // Allow all origins in dev; tighten in production.
 	})
 	if err != nil {
@@ -66,21 +370,35 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	defer conn.Close(websocket.StatusNormalClosure, "")
+	// One byte of headroom lets readFrame spot an oversized message and
+	// explain it; the library's limit is only a backstop.
+	conn.SetReadLimit(maxFrameSize + 1)
 
 	userID := generateClientID()
-	if h.userSessions != nil && h.cookieName != "" {
+	persistent := false
+	verified := ""
+	resolved := false
+	if h.identify != nil {
+		if id, name, ok := h.identify(r); ok {
+			userID, verified, resolved = id, strings.TrimSpace(name), true
+		}
+	}
+	if !resolved && h.userSessions != nil && h.cookieName != "" {
 		if cookie, err := r.Cookie(h.cookieName); err == nil {
 			if sess := h.userSessions.Get(cookie.Value); sess != nil {
 				userID = sess.UserID
+				persistent = true
 			}
 		}
 	}
 
 	client := &Client{
-		conn:   conn,
-		userID: userID,
-		ip:     extractIP(r),
-		hub:    h.hub,
+		conn:       conn,
+		userID:     userID,
+		ip:         extractIP(r),
+		hub:        h.hub,
+		persistent: persistent,
+		verified:   verified,
 	}
 
 	// First message must be a "join" envelope.
@@ -88,49 +406,119 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	connCtx := h.hub.addClient(client)
+	name := client.username
+	connCtx, err := h.hub.addClient(client)
+	if err != nil {
+		if client.newHost {
+			h.hub.releaseHost(client.roomID, client.userID)
+		}
+		h.releaseSession(client)
+		h.rejectClient(r.Context(), client, err)
+		return
+	}
+	// A concurrent join may have taken the name since the session envelope
+	// went out; the joined envelope carries the one addClient settled on.
+	if client.username != name && client.prevName == "" && h.sessions != nil {
+		h.sessions.SetUsername(client.sessionID, client.username)
+	}
+	// Queued ahead of the join broadcast, so it lands after history or
+	// backfill and before any room traffic.
+	h.sendJoined(client)
+	if client.prevName != "" {
+		h.sessions.SetUsername(client.sessionID, client.username)
+		h.announceRename(client, client.prevName)
+	}
 	defer func() {
 		h.hub.removeClient(client)
-		h.sessions.MarkDisconnected(client.sessionID)
+		h.releaseSession(client)
 	}()
 
-	if client.resumed {
+	silent := client.resumed && h.cancelLeave(client.sessionID)
+	switch {
+	case silent:
+		// Back within the leave grace period: the room never heard it left.
+	case client.resumed:
 		h.hub.Broadcast(client.roomID, &message.Message{
-			ID:        generateClientID(),
-			RoomID:    client.roomID,
-			Username:  client.username,
-			Content:   client.username + " rejoined the room",
-			Type:      message.TypeSystem,
-			Action:    message.ActionRejoin,
-			CreatedAt: time.Now(),
+			RoomID:   client.roomID,
+			Username: client.username,
+			Color:    client.color,
+			Content:  client.username + " rejoined the room",
+			Type:     message.TypeSystem,
+			Action:   message.ActionRejoin,
 		})
-	} else {
+	default:
 		h.hub.Broadcast(client.roomID, &message.Message{
-			ID:        generateClientID(),
-			RoomID:    client.roomID,
-			Username:  client.username,
-			Content:   client.username + " joined the room",
-			Type:      message.TypeSystem,
-			Action:    message.ActionJoin,
-			CreatedAt: time.Now(),
+			RoomID:   client.roomID,
+			Username: client.username,
+			Color:    client.color,
+			Content:  client.username + " joined the room",
+			Type:     message.TypeSystem,
+			Action:   message.ActionJoin,
 		})
 	}
+	if !silent {
+		h.hub.emit(Event{Type: EventJoin, RoomID: client.roomID, UserID: client.userID, Username: client.username})
+	}
 
 	h.readLoop(r.Context(), connCtx, client)
 
 	// Broadcast a "left" message unless the user was kicked/banned
-	// (those actions already broadcast their own system message).
-	if !client.kicked {
-		h.hub.Broadcast(client.roomID, &message.Message{
-			ID:        generateClientID(),
-			RoomID:    client.roomID,
-			Username:  client.username,
-			Content:   client.username + " left the room",
-			Type:      message.TypeSystem,
-			Action:    message.ActionLeave,
-			CreatedAt: time.Now(),
+	// (those actions already broadcast their own system message). The
+	// leaving client never sees it, so its session pointer stays put.
+	if client.kicked {
+		return
+	}
+	timedOut := client.timedOut.Load()
+	announce := func() {
+		content, action := client.username+" left the room", message.ActionLeave
+		if timedOut {
+			content, action = client.username+" timed out", message.ActionTimeout
+		}
+		h.hub.BroadcastFrom(client.roomID, client, &message.Message{
+			RoomID:   client.roomID,
+			Username: client.username,
+			Color:    client.color,
+			Content:  content,
+			Type:     message.TypeSystem,
+			Action:   action,
 		})
+		h.hub.emit(Event{Type: EventLeave, RoomID: client.roomID, UserID: client.userID, Username: client.username})
+	}
+	if h.leaveGrace > 0 && client.sessionID != "" && !client.left && !timedOut {
+		h.deferLeave(client.sessionID, announce)
+		return
+	}
+	announce()
+}
+
+// deferLeave runs announce after the leave grace period unless the session
+// resumes first.
+func (h *Handler) deferLeave(sessionID string, announce func()) {
+	h.leaveMu.Lock()
+	defer h.leaveMu.Unlock()
+	var t *time.Timer
+	t = time.AfterFunc(h.leaveGrace, func() {
+		h.leaveMu.Lock()
+		if h.pendingLeaves[sessionID] == t {
+			delete(h.pendingLeaves, sessionID)
+		}
+		h.leaveMu.Unlock()
+		announce()
+	})
+	h.pendingLeaves[sessionID] = t
+}
+
+// cancelLeave drops the session's pending leave announcement. It reports
+// whether one was pending and will now never be sent.
+func (h *Handler) cancelLeave(sessionID string) bool {
+	h.leaveMu.Lock()
+	defer h.leaveMu.Unlock()
+	t, ok := h.pendingLeaves[sessionID]
+	if !ok {
+		return false
 	}
+	delete(h.pendingLeaves, sessionID)
+	return t.Stop()
 }
 
 // handleJoin reads the first message from the client and expects a "join"
@@ -151,8 +539,8 @@ func (h *Handler) handleJoin(ctx context.Context, client *Client) bool {
 		closeWithError(client.conn, "invalid JSON")
 		return false
 	}
-	if env.Type != "join" {
-		closeWithError(client.conn, "first message must be type 'join'")
+	if env.Type != "join" && env.Type != "knock" {
+		closeWithError(client.conn, "first message must be type 'join' or 'knock'")
 		return false
 	}
 
@@ -161,11 +549,28 @@ func (h *Handler) handleJoin(ctx context.Context, client *Client) bool {
 		closeWithError(client.conn, "invalid join payload")
 		return false
 	}
+	if payload.RoomID == "" && payload.Code != "" && h.resolveCode != nil {
+		payload.RoomID = h.resolveCode(payload.Code)
+		if payload.RoomID == "" {
+			closeWithError(client.conn, "room not found")
+			return false
+		}
+	}
 	if payload.RoomID == "" {
 		closeWithError(client.conn, "room_id is required")
 		return false
 	}
 
+	// A session whose room was reaped gets told so, rather than the room
+	// simply being missing or a fresh session starting in its place.
+	if payload.SessionID != "" {
+		if sess := h.session(payload.SessionID); sess != nil && sess.RoomClosed && sess.RoomID == payload.RoomID {
+			h.sendError(ctx, client, ErrorCodeRoomClosed, roomClosedReason)
+			closeWithError(client.conn, roomClosedReason)
+			return false
+		}
+	}
+
 	if h.validateRoom != nil {
 		if reason := h.validateRoom(payload.RoomID); reason != "" {
 			closeWithError(client.conn, reason)
@@ -175,9 +580,8 @@ func (h *Handler) handleJoin(ctx context.Context, client *Client) bool {
 
 	// Check if the user is banned or kicked from this room (by session).
 	if payload.SessionID != "" {
-		if sess := h.sessions.Get(payload.SessionID); sess != nil {
-			if h.hub.IsBanned(payload.RoomID, sess.UserID) {
-				closeWithError(client.conn, "you are banned from this room")
+		if sess := h.session(payload.SessionID); sess != nil {
+			if h.refuseBanned(client, payload.RoomID, sess.UserID, "") {
 				return false
 			}
 			if h.hub.IsKicked(payload.RoomID, sess.UserID) {
@@ -187,9 +591,9 @@ func (h *Handler) handleJoin(ctx context.Context, client *Client) bool {
 		}
 	}
 
-	// Also check ban/kick status by the connection's userID (from cookie).
-	if h.hub.IsBanned(payload.RoomID, client.userID) {
-		closeWithError(client.conn, "you are banned from this room")
+	// Also check ban/kick status by the connection's userID (from cookie)
+	// and its IP address.
+	if h.refuseBanned(client, payload.RoomID, client.userID, client.ip) {
 		return false
 	}
 	if h.hub.IsKicked(payload.RoomID, client.userID) {
@@ -197,42 +601,137 @@ func (h *Handler) handleJoin(ctx context.Context, client *Client) bool {
 		return false
 	}
 
-	// Check if the client's IP address is banned.
-	if h.hub.IsBannedIP(payload.RoomID, client.ip) {
-		closeWithError(client.conn, "you are banned from this room")
+	if h.roomFull(client, payload) {
+		closeWithError(client.conn, "room is full")
 		return false
 	}
 
+	// A join for a session that is still connected is a duplicate, e.g. a
+	// second tab. It is refused unless duplicates evict the older connection.
+	// A resolved identity goes by its verified name and may only resume
+	// its own sessions.
+	if client.verified != "" {
+		payload.Username = client.verified
+		if sess := h.session(payload.SessionID); sess != nil && sess.UserID != client.userID {
+			payload.SessionID = ""
+		}
+	}
+
+	resuming := false
+	if payload.SessionID != "" {
+		if sess := h.session(payload.SessionID); sess != nil && sess.RoomID == payload.RoomID {
+			if !h.evictDuplicates && h.sessions.Connected(sess.ID) {
+				closeWithError(client.conn, errSessionInUse.Error())
+				return false
+			}
+			resuming = true
+		}
+	}
+
+	// Knock-only rooms: anyone not yet admitted must knock and wait for the
+	// host. A resuming session was already let in on its first join.
+	if !resuming && h.hub.NeedsKnock(payload.RoomID, client.userID) {
+		if env.Type != "knock" {
+			closeWithError(client.conn, "this room requires knocking to join")
+			return false
+		}
+		// The host sees the name before deciding, so it gets the same
+		// checks as a join would.
+		name, reason := h.joinUsername(client, payload.RoomID, payload.Username)
+		if reason != "" {
+			closeWithError(client.conn, reason)
+			return false
+		}
+		if !h.awaitKnock(ctx, client, payload.RoomID, name) {
+			return false
+		}
+	}
+
 	// Attempt session resumption.
 	resumed := false
-	if payload.SessionID != "" {
-		if sess := h.sessions.Get(payload.SessionID); sess != nil && !sess.connected() && sess.RoomID == payload.RoomID {
+	if payload.SessionID != "" && h.sessions != nil {
+		sess, gen, err := h.sessions.Resume(payload.SessionID, payload.RoomID, h.evictDuplicates)
+		if err != nil {
+			// Another connection claimed the session since the check above.
+			closeWithError(client.conn, err.Error())
+			return false
+		}
+		if sess != nil {
 			client.userID = sess.UserID
 			client.username = sess.Username
+			client.status = sess.Status
 			client.sessionID = sess.ID
-			h.sessions.MarkConnected(sess.ID)
+			client.sessionGen = gen
 			resumed = true
 		}
 	}
 
 	if !resumed {
-		payload.Username = strings.TrimSpace(payload.Username)
-		if payload.Username == "" {
-			payload.Username = "anon-" + client.userID[:6]
-		}
-		if len(payload.Username) > maxUsernameLength {
-			closeWithError(client.conn, "username must be 30 characters or less")
+		name, reason := h.joinUsername(client, payload.RoomID, payload.Username)
+		if reason != "" {
+			closeWithError(client.conn, reason)
 			return false
 		}
 		client.roomID = payload.RoomID
-		client.username = payload.Username
-		sess := h.sessions.Create(client.userID, client.username, client.roomID)
-		client.sessionID = sess.ID
+		client.username = name
+		if h.sessions != nil {
+			sess := h.sessions.Create(client.userID, client.username, client.roomID)
+			client.sessionID = sess.ID
+			client.sessionGen = sess.gen
+			h.sessions.SetLastRead(sess.ID, h.initialLastRead(client))
+		}
 	} else {
 		client.roomID = payload.RoomID
+		if client.verified != "" && client.username != client.verified {
+			client.username = client.verified
+			h.sessions.SetUsername(client.sessionID, client.username)
+		}
+	}
+
+	// A resume may also pick a new name, keeping the identity and history
+	// pointer. It goes through the same checks and rate limit as a rename
+	// in the room; a reserved name is ignored, as on a fresh join, and so is
+	// one over the limit, leaving the session's name in place.
+	var renamedFrom string
+	if newName := strings.TrimSpace(payload.Username); resumed && client.verified == "" && newName != "" && newName != client.username {
+		// The session is already claimed, so give it back on refusal or
+		// it could never be resumed again.
+		if len(newName) > maxUsernameLength {
+			h.releaseSession(client)
+			closeWithError(client.conn, "username must be 30 characters or less")
+			return false
+		}
+		if h.hub.impersonatesStaff(client.roomID, newName, client.userID) {
+			h.releaseSession(client)
+			closeWithError(client.conn, hostNameError)
+			return false
+		}
+		if !h.isReservedUsername(newName) && h.renameLimit.Allow(client.userID) {
+			renamedFrom = client.username
+			client.username = newName
+		}
 	}
 
 	client.resumed = resumed
+	client.color = userColor(client.userID)
+
+	// A first pass so the session envelope usually has the final name;
+	// addClient settles it under the lock that inserts the client.
+	if name := h.hub.uniqueUsername(client.roomID, client.username, client); name != client.username {
+		client.username = name
+		if h.sessions != nil && renamedFrom == "" {
+			h.sessions.SetUsername(client.sessionID, name)
+		}
+	}
+	// The rename is stored and announced once addClient has let the client
+	// in, so a refused join leaves neither behind.
+	if renamedFrom != client.username {
+		client.prevName = renamedFrom
+	}
+
+	// Decide the host now, ahead of addClient, so the session envelope
+	// can tell the client whether it is the host.
+	client.isCreator, client.newHost = h.hub.claimHost(client.roomID, client.userID)
 
 	// Send session info back to client.
 	h.sendSessionInfo(ctx, client, resumed)
@@ -244,17 +743,40 @@ func (h *Handler) handleJoin(ctx context.Context, client *Client) bool {
 		h.sendHistory(ctx, client)
 	}
 
+	client.joined = true
 	return true
 }
 
+// rejectClient closes a connection the ConnManager refused after the join
+// handshake. At capacity the client first gets an error envelope so it can
+// tell a full server apart from a dropped connection. Either way it is told
+// how long to wait before trying again.
+func (h *Handler) rejectClient(ctx context.Context, client *Client, err error) {
+	if errors.Is(err, errAtCapacity) {
+		h.sendError(ctx, client, ErrorCodeAtCapacity, "server at capacity, retry shortly")
+		sendReconnectHint(ctx, client, reconnectHint(0, 1))
+		client.conn.Close(websocket.StatusTryAgainLater, err.Error())
+		return
+	}
+	if errors.Is(err, errSessionInUse) {
+		closeWithError(client.conn, err.Error())
+		return
+	}
+	sendReconnectHint(ctx, client, reconnectHint(0, 1))
+	client.conn.Close(websocket.StatusGoingAway, err.Error())
+}
+
 // sendSessionInfo writes the session envelope to the client.
 func (h *Handler) sendSessionInfo(ctx context.Context, client *Client, resumed bool) {
 	sp := SessionPayload{
 		SessionID: client.sessionID,
 		UserID:    client.userID,
 		Username:  client.username,
+		Color:     client.color,
 		Resumed:   resumed,
 		IsCreator: client.isCreator,
+		IsHost:    client.isCreator,
+		IsMod:     h.hub.IsMod(client.roomID, client.userID),
 	}
 	data, err := json.Marshal(sp)
 	if err != nil {
@@ -279,15 +801,153 @@ type BackfillPayload struct {
 	HasGap   bool               `json:"has_gap"`
 }
 
+// offersSubprotocol reports whether r either offers no subprotocols or
+// offers the one this server speaks. The websocket library just picks no
+// subprotocol when none match, so incompatible clients are refused here
+// before the upgrade.
+func offersSubprotocol(r *http.Request) bool {
+	offered := r.Header.Values("Sec-WebSocket-Protocol")
+	if len(offered) == 0 {
+		return true
+	}
+	for _, v := range offered {
+		for _, p := range strings.Split(v, ",") {
+			if strings.TrimSpace(p) == Subprotocol {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// sendJoined queues the joined envelope that ends the join handshake.
+func (h *Handler) sendJoined(client *Client) {
+	p := JoinedPayload{
+		RoomID:          client.roomID,
+		Username:        client.username,
+		SlowModeSeconds: int(h.hub.SlowMode(client.roomID) / time.Second),
+		KnockRequired:   h.hub.KnockRequired(client.roomID),
+		IsHost:          client.isCreator,
+		IsMod:           h.hub.IsMod(client.roomID, client.userID),
+		Muted:           h.hub.IsMuted(client.roomID, client.userID),
+		Unread:          h.unreadCount(client),
+		Capabilities:    h.Capabilities(),
+		ServerTime:      h.hub.Now().UnixMilli(),
+		Protocol:        Subprotocol,
+		ReadOnly:        h.hub.ReadOnly(client.roomID),
+	}
+	if h.roomCapacity != nil {
+		p.Capacity = h.roomCapacity(client.roomID)
+	}
+	if h.roomTopic != nil {
+		p.Topic = h.roomTopic(client.roomID)
+	}
+	data, err := json.Marshal(p)
+	if err != nil {
+		log.Printf("ws: failed to marshal joined payload: %v", err)
+		return
+	}
+	env, err := json.Marshal(Envelope{Type: "joined", Payload: data})
+	if err != nil {
+		log.Printf("ws: failed to marshal joined envelope: %v", err)
+		return
+	}
+	h.hub.ConnMgr().Send(client, env)
+}
+
+// initialLastRead returns the read position for a new session. A user
+// with a cookie-backed identity picks up where any earlier session in the
+// room left off; otherwise messages from before the join never count as
+// unread.
+func (h *Handler) initialLastRead(client *Client) int64 {
+	last := h.hub.LastSeq(client.roomID)
+	if client.persistent {
+		if seq, ok := h.userSessions.GetLastRead(client.userID, client.roomID); ok {
+			return min(seq, last)
+		}
+	}
+	return last
+}
+
+// refuseBanned closes the connection and returns true if userID, or ip if
+// non-empty, is banned from roomID. When the moderation store can't be
+// reached the join is refused with a retryable close instead, so an
+// outage never lets a banned user back in.
+func (h *Handler) refuseBanned(client *Client, roomID, userID, ip string) bool {
+	banned, err := h.hub.banStatus(roomID, userID, ip)
+	if err != nil {
+		log.Printf("ws: ban check for room %s failed, refusing join: %v", roomID, err)
+		client.conn.Close(websocket.StatusTryAgainLater, "moderation unavailable, retry shortly")
+		return true
+	}
+	if banned {
+		closeWithError(client.conn, "you are banned from this room")
+		return true
+	}
+	return false
+}
+
+// roomFull reports whether a join must be refused because the room is at
+// capacity. The host may always get in to moderate, and members resuming
+// a session in the room keep their place.
+func (h *Handler) roomFull(client *Client, payload JoinPayload) bool {
+	if h.roomCapacity == nil || !h.hub.IsAtCapacity(payload.RoomID, h.roomCapacity(payload.RoomID)) {
+		return false
+	}
+	if h.hub.IsHost(payload.RoomID, client.userID) {
+		return false
+	}
+	if payload.SessionID != "" {
+		if sess := h.session(payload.SessionID); sess != nil && sess.RoomID == payload.RoomID {
+			return false
+		}
+	}
+	return true
+}
+
+// session looks up a session by ID. It returns nil if there is no such
+// session, or no session store at all.
+func (h *Handler) session(id string) *Session {
+	if h.sessions == nil || id == "" {
+		return nil
+	}
+	return h.sessions.Get(id)
+}
+
+// releaseSession gives up the client's claim on its session, if it has one.
+func (h *Handler) releaseSession(client *Client) {
+	if h.sessions != nil {
+		h.sessions.Release(client.sessionID, client.sessionGen)
+	}
+}
+
+// unreadCount returns the number of stored chat messages after the
+// session's read position that the client may see. System messages such
+// as joins never count, nor do messages for moderators a guest can't read.
+func (h *Handler) unreadCount(client *Client) int {
+	sess := h.session(client.sessionID)
+	if sess == nil || h.messages == nil {
+		return 0
+	}
+	n := 0
+	msgs := h.hub.visibleTo(client, h.messages.Range(client.roomID, time.Time{}, time.Time{}, 0))
+	for _, m := range msgs {
+		if m.Seq > sess.LastReadSeq && m.Type == message.TypeChat {
+			n++
+		}
+	}
+	return n
+}
+
 // sendBackfill sends missed messages to a client that is resuming a session.
 // If the last message ID was evicted from the store, it falls back to recent
 // messages and sets has_gap to true so the client can show a gap indicator.
 func (h *Handler) sendBackfill(ctx context.Context, client *Client) {
-	if h.messages == nil {
+	if h.messages == nil || h.hub.IsEphemeral(client.roomID) {
 		return
 	}
 
-	sess := h.sessions.Get(client.sessionID)
+	sess := h.session(client.sessionID)
 	if sess == nil {
 		return
 	}
@@ -295,20 +955,37 @@ func (h *Handler) sendBackfill(ctx context.Context, client *Client) {
 	missed := h.messages.After(client.roomID, sess.LastMessageID)
 	hasGap := false
 
-	// If After() returned nil but the room has messages, the LastMessageID
-	// was evicted from the store. Fall back to recent messages.
-	if missed == nil && sess.LastMessageID != "" && h.messages.Count(client.roomID) > 0 {
-		missed = h.messages.Recent(client.roomID, backfillLimit)
+	// If After() returned nil, the LastMessageID is no longer in the store.
+	// It may have been a system message capped out of the middle of the
+	// history, so resume from its seq; the seq check below still flags a
+	// real gap. Without a seq, fall back to recent messages.
+	if missed == nil && sess.LastSeq > 0 {
+		missed = h.messages.AfterSeq(client.roomID, sess.LastSeq)
+	} else if missed == nil && sess.LastMessageID != "" && h.messages.Count(client.roomID) > 0 {
+		missed = h.messages.Recent(client.roomID, h.backfillLimit)
 		hasGap = true
 	}
+	missed = h.hub.visibleTo(client, missed)
 
 	if len(missed) == 0 {
 		return
 	}
 
-	// Cap the number of backfilled messages.
-	if len(missed) > backfillLimit {
-		missed = missed[len(missed)-backfillLimit:]
+	// Cap the number of backfilled messages, or send only the newest few
+	// if so many were missed that a replay is pointless.
+	keep := h.backfillLimit
+	if h.gapThreshold > 0 && len(missed) > h.gapThreshold {
+		keep = h.gapRecent
+	}
+	keep = max(keep, 1)
+	if len(missed) > keep {
+		missed = missed[len(missed)-keep:]
+		hasGap = true
+	}
+
+	// With sequence numbers, a gap is simply a jump past the last seq the
+	// session saw.
+	if sess.LastSeq > 0 && missed[0].Seq > sess.LastSeq+1 {
 		hasGap = true
 	}
 
@@ -337,14 +1014,18 @@ func (h *Handler) sendBackfill(ctx context.Context, client *Client) {
 
 	// Update last message ID to the last backfilled message.
 	last := missed[len(missed)-1]
-	h.sessions.SetLastMessageID(client.sessionID, last.ID)
+	h.sessions.SetLastDelivered(client.sessionID, last.ID, last.Seq)
 }
 
 // historyLimit is the number of recent messages to send on room join.
 const historyLimit = 50
 
-// backfillLimit caps how many missed messages to send on reconnect.
-const backfillLimit = 200
+// historyChunkSize caps how many messages go in each envelope of the join
+// history, so a full history never arrives as one oversized frame.
+const historyChunkSize = 20
+
+// defaultBackfillLimit caps how many missed messages to send on reconnect.
+const defaultBackfillLimit = 200
 
 // historyBatchDefault is the default number of older messages per batch.
 const historyBatchDefault = 50
@@ -352,19 +1033,38 @@ const historyBatchDefault = 50
 // historyBatchMax caps the number of older messages per batch.
 const historyBatchMax = 100
 
+// searchDefault is the default number of search results returned.
+const searchDefault = 20
+
+// searchMax caps the number of search results returned.
+const searchMax = 50
+
+// maxSearchQueryLength is the maximum allowed length for a search query.
+const maxSearchQueryLength = 100
+
 // sendHistory sends recent message history to a newly joined client.
 // An empty history envelope is always sent so clients can rely on
-// receiving it as part of the join handshake.
+// receiving it as part of the join handshake. The history envelope holds
+// only the newest historyChunkSize messages; older ones follow as
+// history_batch pages, newest first, exactly as if the client had fetched
+// them.
 func (h *Handler) sendHistory(ctx context.Context, client *Client) {
 	var recent []*message.Message
-	if h.messages != nil {
-		recent = h.messages.Recent(client.roomID, historyLimit)
+	if h.messages != nil && !h.hub.IsEphemeral(client.roomID) {
+		// Fetch one extra to detect if more messages exist.
+		recent = h.hub.visibleTo(client, h.messages.Recent(client.roomID, historyLimit+1))
+	}
+	hasMore := false
+	if len(recent) > historyLimit {
+		recent = recent[len(recent)-historyLimit:]
+		hasMore = true
 	}
 	if recent == nil {
 		recent = []*message.Message{}
 	}
 
-	data, err := json.Marshal(recent)
+	split := max(len(recent)-historyChunkSize, 0)
+	data, err := json.Marshal(recent[split:])
 	if err != nil {
 		log.Printf("ws: failed to marshal history: %v", err)
 		return
@@ -380,12 +1080,38 @@ func (h *Handler) sendHistory(ctx context.Context, client *Client) {
 	defer cancel()
 	if err := client.conn.Write(writeCtx, websocket.MessageText, env); err != nil {
 		log.Printf("ws: failed to write history: %v", err)
+		return
+	}
+
+	for end := split; end > 0; end -= historyChunkSize {
+		chunk := recent[max(end-historyChunkSize, 0):end]
+		payload := HistoryBatchPayload{
+			Messages: chunk,
+			HasMore:  end > historyChunkSize || hasMore,
+		}
+		if payload.HasMore && chunk[0].Seq > 0 {
+			payload.NextCursor = encodeCursor(client.roomID, chunk[0].Seq, time.Now())
+		}
+		data, err := json.Marshal(payload)
+		if err != nil {
+			log.Printf("ws: failed to marshal history batch: %v", err)
+			return
+		}
+		env, err := json.Marshal(Envelope{Type: "history_batch", Payload: data})
+		if err != nil {
+			log.Printf("ws: failed to marshal history batch envelope: %v", err)
+			return
+		}
+		if err := client.conn.Write(writeCtx, websocket.MessageText, env); err != nil {
+			log.Printf("ws: failed to write history batch: %v", err)
+			return
+		}
 	}
 }
 
 // sendHistoryBatch sends a batch of older messages to a client that requested them.
 func (h *Handler) sendHistoryBatch(ctx context.Context, client *Client, req HistoryFetchPayload) {
-	if h.messages == nil || req.BeforeID == "" {
+	if h.messages == nil || (req.Cursor == "" && req.BeforeID == "") {
 		return
 	}
 
@@ -398,7 +1124,18 @@ func (h *Handler) sendHistoryBatch(ctx context.Context, client *Client, req Hist
 	}
 
 	// Fetch one extra to detect if more messages exist.
-	msgs := h.messages.Before(client.roomID, req.BeforeID, limit+1)
+	var msgs []*message.Message
+	if req.Cursor != "" {
+		seq, err := decodeCursor(req.Cursor, client.roomID, time.Now())
+		if err != nil {
+			h.sendError(ctx, client, ErrorCodeInvalidPayload, err.Error())
+			return
+		}
+		msgs = h.messages.BeforeSeq(client.roomID, seq, limit+1)
+	} else {
+		msgs = h.messages.Before(client.roomID, req.BeforeID, limit+1)
+	}
+	msgs = h.hub.visibleTo(client, msgs)
 
 	hasMore := false
 	if len(msgs) > limit {
@@ -414,6 +1151,9 @@ func (h *Handler) sendHistoryBatch(ctx context.Context, client *Client, req Hist
 		Messages: msgs,
 		HasMore:  hasMore,
 	}
+	if hasMore && msgs[0].Seq > 0 {
+		payload.NextCursor = encodeCursor(client.roomID, msgs[0].Seq, time.Now())
+	}
 
 	data, err := json.Marshal(payload)
 	if err != nil {
@@ -434,26 +1174,260 @@ func (h *Handler) sendHistoryBatch(ctx context.Context, client *Client, req Hist
 	}
 }
 
-// readLoop reads messages from the client until the connection closes
-// or the connection manager cancels connCtx.
-func (h *Handler) readLoop(ctx context.Context, connCtx context.Context, client *Client) {
-	for {
-		select {
-		case <-connCtx.Done():
-			return
-		default:
-		}
+// sendHistoryRange sends the messages created within the requested time
+// range, oldest first. HasMore is set when the range holds more than the
+// batch limit; the client can continue from the last message's time.
+func (h *Handler) sendHistoryRange(ctx context.Context, client *Client, req HistoryRangePayload) {
+	if !req.SinceTime.IsZero() && !req.UntilTime.IsZero() && req.SinceTime.After(req.UntilTime) {
+		h.sendError(ctx, client, ErrorCodeInvalidPayload, "since_time must not be after until_time")
+		return
+	}
 
-		_, data, err := client.conn.Read(ctx)
-		if err != nil {
-			// Normal close or context cancelled.
-			return
-		}
+	limit := req.Limit
+	if limit <= 0 {
+		limit = historyBatchDefault
+	}
+	if limit > historyBatchMax {
+		limit = historyBatchMax
+	}
 
-		// Mark activity so idle reaping doesn't close active connections.
-		h.hub.ConnMgr().TouchActivity(client)
+	var msgs []*message.Message
+	if h.messages != nil {
+		// Fetch one extra to detect if more messages exist.
+		msgs = h.hub.visibleTo(client, h.messages.Range(client.roomID, req.SinceTime, req.UntilTime, limit+1))
+	}
 
-		var env Envelope
+	hasMore := false
+	if len(msgs) > limit {
+		msgs = msgs[:limit]
+		hasMore = true
+	}
+
+	if msgs == nil {
+		msgs = []*message.Message{}
+	}
+
+	data, err := json.Marshal(HistoryBatchPayload{Messages: msgs, HasMore: hasMore})
+	if err != nil {
+		log.Printf("ws: failed to marshal history range: %v", err)
+		return
+	}
+
+	env, err := json.Marshal(Envelope{Type: "history_range", Payload: data})
+	if err != nil {
+		log.Printf("ws: failed to marshal history range envelope: %v", err)
+		return
+	}
+
+	writeCtx, cancel := context.WithTimeout(ctx, writeTimeout)
+	defer cancel()
+	if err := client.conn.Write(writeCtx, websocket.MessageText, env); err != nil {
+		log.Printf("ws: failed to write history range: %v", err)
+	}
+}
+
+// handleEdit replaces the content of one of the client's own chat messages
+// in the store and tells the room. Only the current content is kept, so
+// history and backfill served afterwards already reflect the edit.
+func (h *Handler) handleEdit(ctx context.Context, client *Client, req EditPayload) {
+	if h.editingDisabled || h.messages == nil {
+		h.sendError(ctx, client, ErrorCodeUnsupported, "editing is not enabled")
+		return
+	}
+	if h.hub.IsMuted(client.roomID, client.userID) {
+		h.sendError(ctx, client, ErrorCodeMuted, "you are muted in this room")
+		return
+	}
+	content := strings.TrimSpace(req.Content)
+	if content == "" {
+		h.sendError(ctx, client, ErrorCodeContentRequired, "message content is required")
+		return
+	}
+	if len(content) > maxMessageLength {
+		h.sendError(ctx, client, ErrorCodeTooLong, "message exceeds maximum length of 2000 characters")
+		return
+	}
+	if h.filter != nil {
+		filtered, blocked := h.filter(content)
+		if blocked {
+			h.sendError(ctx, client, ErrorCodeBlocked, "message blocked by content filter")
+			return
+		}
+		content = filtered
+	}
+	if h.hub.blocked(client.roomID, content, client.isCreator) {
+		h.sendError(ctx, client, ErrorCodeBlocked, blocklistError)
+		return
+	}
+	if limiter := h.chatLimiterFor(client.roomID); !limiter.Allow(client.userID) {
+		max, window := limiter.Limit()
+		h.sendError(ctx, client, ErrorCodeRateLimited,
+			fmt.Sprintf("rate limit exceeded: max %d messages per %s", max, formatDuration(window)))
+		return
+	}
+
+	msg := h.messages.Edit(client.roomID, req.MessageID, client.userID, content, h.hub.Now())
+	if msg == nil {
+		h.sendError(ctx, client, ErrorCodeNotFound, "message not found or not editable")
+		return
+	}
+
+	data, err := json.Marshal(msg)
+	if err != nil {
+		log.Printf("ws: failed to marshal edited message: %v", err)
+		return
+	}
+	env, err := json.Marshal(Envelope{Type: "edit", Payload: data})
+	if err != nil {
+		log.Printf("ws: failed to marshal edit envelope: %v", err)
+		return
+	}
+	h.hub.sendToAudience(client.roomID, msg, env)
+	h.hub.emit(Event{
+		Type:      EventEdit,
+		RoomID:    client.roomID,
+		UserID:    client.userID,
+		Username:  client.username,
+		MessageID: msg.ID,
+		Content:   msg.Content,
+	})
+}
+
+// handleDelete removes a message from the room's history and tells the
+// room. It is host-only, and is how a host frees space in a room whose
+// history cap refuses new messages.
+func (h *Handler) handleDelete(ctx context.Context, client *Client, payload json.RawMessage) {
+	if !client.isCreator {
+		h.sendError(ctx, client, ErrorCodeNotHost, "only the room host can delete messages")
+		return
+	}
+	if h.messages == nil {
+		h.sendError(ctx, client, ErrorCodeUnsupported, "history is not enabled")
+		return
+	}
+	var p DeletePayload
+	if err := json.Unmarshal(payload, &p); err != nil || p.MessageID == "" {
+		h.sendError(ctx, client, ErrorCodeInvalidPayload, "invalid delete payload")
+		return
+	}
+	if !h.messages.Delete(client.roomID, p.MessageID) {
+		h.sendError(ctx, client, ErrorCodeNotFound, "message not found")
+		return
+	}
+
+	data, err := json.Marshal(p)
+	if err != nil {
+		log.Printf("ws: failed to marshal delete payload: %v", err)
+		return
+	}
+	env, err := json.Marshal(Envelope{Type: "delete", Payload: data})
+	if err != nil {
+		log.Printf("ws: failed to marshal delete envelope: %v", err)
+		return
+	}
+	h.hub.sendToRoom(client.roomID, env)
+	h.hub.emit(Event{
+		Type:      EventDelete,
+		RoomID:    client.roomID,
+		ActorID:   client.userID,
+		MessageID: p.MessageID,
+	})
+}
+
+// handleSearch replies with stored messages in the client's room matching
+// a case-insensitive substring query, most recent first.
+func (h *Handler) handleSearch(ctx context.Context, client *Client, req SearchPayload) {
+	query := strings.TrimSpace(req.Query)
+	if query == "" {
+		h.sendError(ctx, client, ErrorCodeContentRequired, "search query is required")
+		return
+	}
+	if len(query) > maxSearchQueryLength {
+		h.sendError(ctx, client, ErrorCodeTooLong, "search query must be 100 characters or less")
+		return
+	}
+	if !h.searchLimit.Allow(client.userID) {
+		h.sendError(ctx, client, ErrorCodeRateLimited, "rate limit exceeded: max 5 searches per 10 seconds")
+		return
+	}
+
+	limit := req.Limit
+	if limit <= 0 {
+		limit = searchDefault
+	}
+	if limit > searchMax {
+		limit = searchMax
+	}
+
+	var matches []*message.Message
+	if h.messages != nil {
+		for _, m := range h.hub.visibleTo(client, h.messages.Search(client.roomID, query, 0)) {
+			if m.Type != message.TypeChat && !req.IncludeSystem {
+				continue
+			}
+			matches = append(matches, m)
+			if len(matches) >= limit {
+				break
+			}
+		}
+	}
+	if matches == nil {
+		matches = []*message.Message{}
+	}
+
+	data, err := json.Marshal(SearchResultPayload{Query: query, Messages: matches})
+	if err != nil {
+		log.Printf("ws: failed to marshal search result: %v", err)
+		return
+	}
+	env, err := json.Marshal(Envelope{Type: "search_result", Payload: data})
+	if err != nil {
+		log.Printf("ws: failed to marshal search result envelope: %v", err)
+		return
+	}
+	writeCtx, cancel := context.WithTimeout(ctx, writeTimeout)
+	defer cancel()
+	if err := client.conn.Write(writeCtx, websocket.MessageText, env); err != nil {
+		log.Printf("ws: failed to write search result: %v", err)
+	}
+}
+
+// readLoop reads messages from the client until the connection closes
+// or the connection manager cancels connCtx.
+func (h *Handler) readLoop(ctx context.Context, connCtx context.Context, client *Client) {
+	for {
+		select {
+		case <-connCtx.Done():
+			return
+		default:
+		}
+
+		typ, data, err := readFrame(ctx, client.conn)
+		if errors.Is(err, errFrameTooLarge) {
+			h.sendError(ctx, client, ErrorCodeTooLong, err.Error())
+			client.conn.Close(websocket.StatusMessageTooBig, err.Error())
+			return
+		}
+		if err != nil {
+			// Normal close or context cancelled.
+			return
+		}
+
+		// Nothing is acted on for a client that isn't in a room yet.
+		if !client.joined {
+			h.sendError(ctx, client, ErrorCodeNotJoined, "first message must be type 'join'")
+			continue
+		}
+
+		// Mark activity so idle reaping doesn't close active connections.
+		h.hub.ConnMgr().TouchActivity(client)
+
+		if typ == websocket.MessageBinary {
+			h.handleAttachmentFrame(ctx, client, data)
+			continue
+		}
+
+		var env Envelope
 		if err := json.Unmarshal(data, &env); err != nil {
 			continue
 		}
@@ -464,109 +1438,369 @@ func (h *Handler) readLoop(ctx context.Context, connCtx context.Context, client
 			if err := json.Unmarshal(env.Payload, &payload); err != nil {
 				continue
 			}
+			if len(payload.ClientMsgID) > maxClientMsgIDLength {
+				h.sendError(ctx, client, ErrorCodeTooLong, "client_msg_id must be 64 characters or less")
+				continue
+			}
+			if payload.ClientMsgID != "" {
+				// A resend of a message we already broadcast: echo the
+				// original back to the sender instead of duplicating it.
+				if prev := h.recentSends.Get(client.userID, payload.ClientMsgID); prev != nil {
+					h.sendMessage(client, prev)
+					h.sendAck(client, payload.ClientMsgID, prev)
+					continue
+				}
+			}
 			if h.hub.IsMuted(client.roomID, client.userID) {
-				h.sendError(ctx, client, "you are muted in this room")
+				h.sendChatError(ctx, client, payload.ClientMsgID, ErrorCodeMuted, "you are muted in this room")
+				continue
+			}
+			if !client.isCreator && !h.hub.IsMod(client.roomID, client.userID) && h.hub.ReadOnly(client.roomID) {
+				h.sendChatError(ctx, client, payload.ClientMsgID, ErrorCodeReadOnly, readOnlyError)
+				continue
+			}
+			if h.hub.HistoryFull(client.roomID) {
+				h.sendChatError(ctx, client, payload.ClientMsgID, ErrorCodeHistoryFull, historyFullError)
+				continue
+			}
+			if !payload.Format.Valid() {
+				h.sendChatError(ctx, client, payload.ClientMsgID, ErrorCodeInvalidPayload, "format must be plain, code or spoiler")
+				continue
+			}
+			if !payload.Audience.Valid() {
+				h.sendChatError(ctx, client, payload.ClientMsgID, ErrorCodeInvalidPayload, "audience must be all or mods")
+				continue
+			}
+			if payload.Audience == message.AudienceAll {
+				payload.Audience = ""
+			}
+			if payload.Audience == message.AudienceMods && !client.isCreator && !h.hub.IsMod(client.roomID, client.userID) {
+				h.sendChatError(ctx, client, payload.ClientMsgID, ErrorCodeNotHost, "only the host and moderators can post to moderators")
 				continue
 			}
 			content := strings.TrimSpace(payload.Content)
 			if content == "" {
-				h.sendError(ctx, client, "message content is required")
+				h.sendChatError(ctx, client, payload.ClientMsgID, ErrorCodeContentRequired, "message content is required")
 				continue
 			}
 			if len(content) > maxMessageLength {
-				h.sendError(ctx, client, "message exceeds maximum length of 2000 characters")
+				h.sendChatError(ctx, client, payload.ClientMsgID, ErrorCodeTooLong, "message exceeds maximum length of 2000 characters")
+				continue
+			}
+			if h.filter != nil {
+				filtered, blocked := h.filter(content)
+				if blocked {
+					h.sendChatError(ctx, client, payload.ClientMsgID, ErrorCodeBlocked, "message blocked by content filter")
+					continue
+				}
+				content = filtered
+			}
+			if h.hub.blocked(client.roomID, content, client.isCreator) {
+				h.sendChatError(ctx, client, payload.ClientMsgID, ErrorCodeBlocked, blocklistError)
+				continue
+			}
+			if limiter := h.chatLimiterFor(client.roomID); !limiter.Allow(client.userID) {
+				max, window := limiter.Limit()
+				h.sendChatError(ctx, client, payload.ClientMsgID, ErrorCodeRateLimited,
+					fmt.Sprintf("rate limit exceeded: max %d messages per %s", max, formatDuration(window)))
 				continue
 			}
-			if !h.chatLimiter.Allow(client.userID) {
-				h.sendError(ctx, client, "rate limit exceeded: max 10 messages per 10 seconds")
+			if !h.hub.allowRoomMessage(client.roomID, client.userID) {
+				h.sendChatError(ctx, client, payload.ClientMsgID, ErrorCodeSlowMode, h.hub.slowModeError())
 				continue
 			}
-			h.hub.Broadcast(client.roomID, &message.Message{
-				ID:        generateClientID(),
+			msg := &message.Message{
+				RoomID:   client.roomID,
+				UserID:   client.userID,
+				Username: client.username,
+				Color:    client.color,
+				Content:  content,
+				Format:   payload.Format,
+				Audience: payload.Audience,
+				Type:     message.TypeChat,
+			}
+			// Clear the sender's typing indicator ahead of the message so
+			// peers never show it typing after its message has landed.
+			h.hub.StopTyping(client)
+			// The room may have filled up since the check above.
+			if !h.hub.Broadcast(client.roomID, msg) {
+				h.sendChatError(ctx, client, payload.ClientMsgID, ErrorCodeHistoryFull, historyFullError)
+				continue
+			}
+			if payload.ClientMsgID != "" {
+				h.recentSends.Add(client.userID, payload.ClientMsgID, msg)
+			}
+			// Links in a code block are text, not something to preview.
+			// Previews go to the whole room, so none for moderators' messages.
+			if h.unfurler != nil && msg.Format != message.FormatCode && msg.Audience == "" {
+				if link := firstURL(content); link != "" {
+					go h.sendLinkPreview(client.roomID, msg.ID, link)
+				}
+			}
+			h.hub.emit(Event{
+				Type:      EventMessage,
 				RoomID:    client.roomID,
 				UserID:    client.userID,
 				Username:  client.username,
-				Content:   content,
-				Type:      message.TypeChat,
-				CreatedAt: time.Now(),
+				MessageID: msg.ID,
+				Content:   msg.Content,
 			})
+			if payload.ClientMsgID != "" {
+				h.sendAck(client, payload.ClientMsgID, msg)
+			}
+		case "edit":
+			var payload EditPayload
+			if err := json.Unmarshal(env.Payload, &payload); err != nil {
+				continue
+			}
+			h.handleEdit(ctx, client, payload)
+		case "delete":
+			h.handleDelete(ctx, client, env.Payload)
 		case "kick":
 			h.handleKick(ctx, client, env.Payload)
+		case "kick_guests":
+			h.handleKickGuests(ctx, client)
 		case "ban":
 			h.handleBan(ctx, client, env.Payload)
 		case "mute":
 			h.handleMute(ctx, client, env.Payload)
+		case "set_topic":
+			h.handleSetTopic(ctx, client, env.Payload)
+		case "set_read_only":
+			h.handleSetReadOnly(ctx, client, env.Payload)
+		case "set_knock":
+			h.handleSetKnock(ctx, client, env.Payload)
+		case "set_blocklist":
+			h.handleSetBlocklist(ctx, client, env.Payload)
+		case "set_mod":
+			h.handleSetMod(ctx, client, env.Payload)
+		case "who":
+			h.handleWho(ctx, client)
 		case "history_fetch":
 			var payload HistoryFetchPayload
 			if err := json.Unmarshal(env.Payload, &payload); err != nil {
 				continue
 			}
 			h.sendHistoryBatch(ctx, client, payload)
+		case "history_range":
+			var payload HistoryRangePayload
+			if err := json.Unmarshal(env.Payload, &payload); err != nil {
+				h.sendError(ctx, client, ErrorCodeInvalidPayload, "invalid history_range payload")
+				continue
+			}
+			h.sendHistoryRange(ctx, client, payload)
+		case "search":
+			var payload SearchPayload
+			if err := json.Unmarshal(env.Payload, &payload); err != nil {
+				continue
+			}
+			h.handleSearch(ctx, client, payload)
+		case "presence_fetch":
+			h.handlePresenceFetch(ctx, client)
+		case "ping":
+			// The payload is optional; a bare ping still gets a pong.
+			var payload PingPayload
+			if len(env.Payload) > 0 && json.Unmarshal(env.Payload, &payload) != nil {
+				h.sendError(ctx, client, ErrorCodeInvalidPayload, "invalid ping payload")
+				continue
+			}
+			h.handlePing(ctx, client, payload)
+		case "admit":
+			h.handleKnockResponse(ctx, client, env.Payload, true)
+		case "deny":
+			h.handleKnockResponse(ctx, client, env.Payload, false)
 		case "set_username":
 			var payload SetUsernamePayload
 			if err := json.Unmarshal(env.Payload, &payload); err != nil {
 				continue
 			}
 			h.handleSetUsername(ctx, client, payload)
+		case "status":
+			var payload StatusPayload
+			if err := json.Unmarshal(env.Payload, &payload); err != nil {
+				continue
+			}
+			h.handleStatus(ctx, client, payload)
+		case "attach_begin":
+			h.handleAttachBegin(ctx, client, env.Payload)
 		case "typing":
-			h.hub.BroadcastEphemeral(client.roomID, client, &message.Message{
-				RoomID:   client.roomID,
-				UserID:   client.userID,
-				Username: client.username,
-				Type:     message.TypeTyping,
-			})
+			h.hub.BroadcastTyping(client)
+		case "mark_read":
+			var payload MarkReadPayload
+			if err := json.Unmarshal(env.Payload, &payload); err != nil || payload.Seq <= 0 {
+				h.sendError(ctx, client, ErrorCodeInvalidPayload, "invalid mark_read payload")
+				continue
+			}
+			// A client cannot mark messages read that do not exist yet.
+			seq := min(payload.Seq, h.hub.LastSeq(client.roomID))
+			if h.sessions != nil {
+				h.sessions.SetLastRead(client.sessionID, seq)
+			}
+			if client.persistent {
+				h.userSessions.SetLastRead(client.userID, client.roomID, seq)
+			}
 		case "leave":
+			var payload LeavePayload
+			if len(env.Payload) > 0 {
+				if err := json.Unmarshal(env.Payload, &payload); err != nil {
+					h.sendError(ctx, client, ErrorCodeInvalidPayload, "invalid leave payload")
+					continue
+				}
+			}
+			if payload.Forget && h.sessions != nil {
+				h.sessions.Delete(client.sessionID)
+			}
+			client.left = true
 			return
+		default:
+			if h.strict {
+				h.sendError(ctx, client, ErrorCodeUnknownType, fmt.Sprintf("unknown message type %q", env.Type))
+			}
 		}
 	}
 }
 
+// errFrameTooLarge is returned by readFrame for a message over maxFrameSize.
+var errFrameTooLarge = errors.New("message too large")
+
+// readFrame reads one message of at most maxFrameSize bytes.
+func readFrame(ctx context.Context, conn *websocket.Conn) (websocket.MessageType, []byte, error) {
+	typ, r, err := conn.Reader(ctx)
+	if err != nil {
+		return 0, nil, err
+	}
+	data, err := io.ReadAll(io.LimitReader(r, maxFrameSize+1))
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(data) > maxFrameSize {
+		return 0, nil, errFrameTooLarge
+	}
+	return typ, data, nil
+}
+
 // handleKick removes a user from the room.
 func (h *Handler) handleKick(ctx context.Context, client *Client, payload json.RawMessage) {
 	if !client.isCreator {
-		h.sendError(ctx, client, "only the room host can kick users")
+		h.sendError(ctx, client, ErrorCodeNotHost, "only the room host can kick users")
 		return
 	}
 	var p KickPayload
-	if err := json.Unmarshal(payload, &p); err != nil || p.UserID == "" {
-		h.sendError(ctx, client, "invalid kick payload")
+	if err := json.Unmarshal(payload, &p); err != nil || (p.UserID == "" && p.Username == "") {
+		h.sendError(ctx, client, ErrorCodeInvalidPayload, "invalid kick payload")
 		return
 	}
+	if p.UserID == "" {
+		var ok bool
+		if p.UserID, ok = h.resolveUsername(ctx, client, p.Username); !ok {
+			return
+		}
+	}
 	if p.UserID == client.userID {
-		h.sendError(ctx, client, "you cannot kick yourself")
+		h.sendError(ctx, client, ErrorCodeInvalidTarget, "you cannot kick yourself")
 		return
 	}
 	target := h.hub.FindClient(client.roomID, p.UserID)
 	if target == nil {
-		h.sendError(ctx, client, "user not found in room")
+		h.sendError(ctx, client, ErrorCodeNotFound, "user not found in room")
 		return
 	}
 	h.hub.Kick(client.roomID, p.UserID)
 	h.hub.Broadcast(client.roomID, &message.Message{
-		ID:        generateClientID(),
-		RoomID:    client.roomID,
-		Username:  target.username,
-		Content:   target.username + " was kicked from the room",
-		Type:      message.TypeSystem,
-		Action:    message.ActionKick,
-		CreatedAt: time.Now(),
+		RoomID:   client.roomID,
+		Username: target.username,
+		Content:  target.username + " was kicked from the room",
+		Type:     message.TypeSystem,
+		Action:   message.ActionKick,
 	})
-	h.hub.KickClient(target)
+	h.hub.emit(Event{Type: EventKick, RoomID: client.roomID, UserID: p.UserID, Username: target.username, ActorID: client.userID})
+	h.hub.KickClient(target, "you were kicked from the room")
+}
+
+// handleKickGuests removes every guest from the host's room: anyone still
+// using an anonymous name without a cookie-backed identity. Named users and
+// users with a cookie session stay. The room gets one summary message
+// rather than one per guest.
+func (h *Handler) handleKickGuests(ctx context.Context, client *Client) {
+	if !client.isCreator {
+		h.sendError(ctx, client, ErrorCodeNotHost, "only the room host can kick users")
+		return
+	}
+	guests := h.hub.guestsInRoom(client.roomID)
+	if len(guests) == 0 {
+		h.sendError(ctx, client, ErrorCodeNotFound, "no guests in room")
+		return
+	}
+	noun := "guests were"
+	if len(guests) == 1 {
+		noun = "guest was"
+	}
+	for _, g := range guests {
+		h.hub.Kick(client.roomID, g.userID)
+	}
+	h.hub.Broadcast(client.roomID, &message.Message{
+		RoomID:  client.roomID,
+		Content: fmt.Sprintf("%d %s removed from the room", len(guests), noun),
+		Type:    message.TypeSystem,
+		Action:  message.ActionKick,
+	})
+	for _, g := range guests {
+		h.hub.emit(Event{Type: EventKick, RoomID: client.roomID, UserID: g.userID, Username: g.username, ActorID: client.userID})
+		h.hub.KickClient(g, "guests were removed from the room")
+	}
+}
+
+// resolveUsername finds the user ID of the connected user in the client's
+// room whose name matches username, ignoring case. If no user or more than
+// one user matches, the client is sent an error and ok is false.
+func (h *Handler) resolveUsername(ctx context.Context, client *Client, username string) (userID string, ok bool) {
+	var matches []RoomUser
+	for _, u := range h.hub.RoomUsers(client.roomID) {
+		if strings.EqualFold(u.Username, username) {
+			matches = append(matches, u)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		h.sendError(ctx, client, ErrorCodeNotFound, "user not found in room")
+		return "", false
+	case 1:
+		return matches[0].UserID, true
+	}
+	candidates := make([]string, len(matches))
+	for i, u := range matches {
+		candidates[i] = fmt.Sprintf("%s (%s)", u.Username, u.UserID)
+	}
+	sort.Strings(candidates)
+	h.sendError(ctx, client, ErrorCodeAmbiguousUser, fmt.Sprintf("username %q matches multiple users: %s", username, strings.Join(candidates, ", ")))
+	return "", false
 }
 
 // handleBan bans a user from the room and kicks them if connected.
 func (h *Handler) handleBan(ctx context.Context, client *Client, payload json.RawMessage) {
 	if !client.isCreator {
-		h.sendError(ctx, client, "only the room host can ban users")
+		h.sendError(ctx, client, ErrorCodeNotHost, "only the room host can ban users")
 		return
 	}
 	var p BanPayload
-	if err := json.Unmarshal(payload, &p); err != nil || p.UserID == "" {
-		h.sendError(ctx, client, "invalid ban payload")
+	if err := json.Unmarshal(payload, &p); err != nil || (p.UserID == "" && p.Username == "" && p.CIDR == "") {
+		h.sendError(ctx, client, ErrorCodeInvalidPayload, "invalid ban payload")
+		return
+	}
+	if p.CIDR != "" && !h.banCIDR(ctx, client, p.CIDR) {
 		return
 	}
+	if p.UserID == "" && p.Username == "" {
+		return
+	}
+	if p.UserID == "" {
+		var ok bool
+		if p.UserID, ok = h.resolveUsername(ctx, client, p.Username); !ok {
+			return
+		}
+	}
 	if p.UserID == client.userID {
-		h.sendError(ctx, client, "you cannot ban yourself")
+		h.sendError(ctx, client, ErrorCodeInvalidTarget, "you cannot ban yourself")
 		return
 	}
 	target := h.hub.FindClient(client.roomID, p.UserID)
@@ -578,42 +1812,72 @@ func (h *Handler) handleBan(ctx context.Context, client *Client, payload json.Ra
 	}
 	h.hub.Ban(client.roomID, p.UserID, targetIP)
 	h.hub.Broadcast(client.roomID, &message.Message{
-		ID:        generateClientID(),
-		RoomID:    client.roomID,
-		Username:  targetName,
-		Content:   targetName + " was banned from the room",
-		Type:      message.TypeSystem,
-		Action:    message.ActionBan,
-		CreatedAt: time.Now(),
+		RoomID:   client.roomID,
+		Username: targetName,
+		Content:  targetName + " was banned from the room",
+		Type:     message.TypeSystem,
+		Action:   message.ActionBan,
 	})
+	h.hub.emit(Event{Type: EventBan, RoomID: client.roomID, UserID: p.UserID, Username: targetName, ActorID: client.userID})
 	if target != nil {
-		h.hub.KickClient(target)
+		h.hub.KickClient(target, "you are banned from this room")
+	}
+}
+
+// banCIDR bans an IP range from the client's room and disconnects anyone
+// connected from inside it. It returns false if the range was rejected.
+func (h *Handler) banCIDR(ctx context.Context, client *Client, cidr string) bool {
+	ipnet, err := parseBanCIDR(cidr)
+	if err != nil {
+		h.sendError(ctx, client, ErrorCodeInvalidPayload, err.Error())
+		return false
 	}
+	if inCIDRs(client.ip, []*net.IPNet{ipnet}) {
+		h.sendError(ctx, client, ErrorCodeInvalidTarget, "you cannot ban a range that includes your own address")
+		return false
+	}
+	h.hub.banCIDR(client.roomID, ipnet)
+	h.hub.Broadcast(client.roomID, &message.Message{
+		RoomID:  client.roomID,
+		Content: "An IP range was banned from the room",
+		Type:    message.TypeSystem,
+		Action:  message.ActionBan,
+	})
+	for _, target := range h.hub.clientsInCIDR(client.roomID, ipnet) {
+		h.hub.KickClient(target, "you are banned from this room")
+	}
+	return true
 }
 
 // handleMute toggles a user's mute status in the room.
 // If duration is provided (in seconds), the mute expires automatically.
 func (h *Handler) handleMute(ctx context.Context, client *Client, payload json.RawMessage) {
 	if !client.isCreator {
-		h.sendError(ctx, client, "only the room host can mute users")
+		h.sendError(ctx, client, ErrorCodeNotHost, "only the room host can mute users")
 		return
 	}
 	var p MutePayload
-	if err := json.Unmarshal(payload, &p); err != nil || p.UserID == "" {
-		h.sendError(ctx, client, "invalid mute payload")
+	if err := json.Unmarshal(payload, &p); err != nil || (p.UserID == "" && p.Username == "") {
+		h.sendError(ctx, client, ErrorCodeInvalidPayload, "invalid mute payload")
 		return
 	}
+	if p.UserID == "" {
+		var ok bool
+		if p.UserID, ok = h.resolveUsername(ctx, client, p.Username); !ok {
+			return
+		}
+	}
 	if p.Duration < 0 {
-		h.sendError(ctx, client, "duration must not be negative")
+		h.sendError(ctx, client, ErrorCodeInvalidPayload, "duration must not be negative")
 		return
 	}
 	if p.UserID == client.userID {
-		h.sendError(ctx, client, "you cannot mute yourself")
+		h.sendError(ctx, client, ErrorCodeInvalidTarget, "you cannot mute yourself")
 		return
 	}
 	target := h.hub.FindClient(client.roomID, p.UserID)
 	if target == nil {
-		h.sendError(ctx, client, "user not found in room")
+		h.sendError(ctx, client, ErrorCodeNotFound, "user not found in room")
 		return
 	}
 	duration := time.Duration(p.Duration) * time.Second
@@ -629,23 +1893,59 @@ func (h *Handler) handleMute(ctx context.Context, client *Client, payload json.R
 		content = target.username + " was unmuted"
 	}
 	h.hub.Broadcast(client.roomID, &message.Message{
-		ID:        generateClientID(),
-		RoomID:    client.roomID,
-		Username:  target.username,
-		Content:   content,
-		Type:      message.TypeSystem,
-		Action:    message.ActionMute,
-		CreatedAt: time.Now(),
+		RoomID:   client.roomID,
+		Username: target.username,
+		Content:  content,
+		Type:     message.TypeSystem,
+		Action:   message.ActionMute,
 	})
+	ev := Event{Type: EventMute, RoomID: client.roomID, UserID: p.UserID, Username: target.username, ActorID: client.userID}
+	if !muted {
+		ev.Type = EventUnmute
+	}
+	h.hub.emit(ev)
 
 	// Send mute status directly to the target user.
 	status := MuteStatusPayload{Muted: muted}
 	if muted && duration > 0 {
-		status.ExpiresAt = time.Now().Add(duration).Format(time.RFC3339)
+		status.ExpiresAt = h.hub.Now().Add(duration).Format(time.RFC3339)
 	}
 	h.sendMuteStatus(ctx, target, status)
 }
 
+// sendMessage queues a single message envelope to one client without
+// persisting or broadcasting it.
+func (h *Handler) sendMessage(client *Client, msg *message.Message) {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return
+	}
+	env, err := json.Marshal(Envelope{Type: string(msg.Type), Payload: data})
+	if err != nil {
+		return
+	}
+	h.hub.ConnMgr().Send(client, env)
+}
+
+// sendAck queues an ack envelope mapping a client message ID to the
+// server-assigned message. It is queued behind the broadcast copy so the
+// client always sees the message before its ack.
+func (h *Handler) sendAck(client *Client, clientMsgID string, msg *message.Message) {
+	data, err := json.Marshal(AckPayload{
+		ClientMsgID: clientMsgID,
+		MessageID:   msg.ID,
+		Seq:         msg.Seq,
+	})
+	if err != nil {
+		return
+	}
+	env, err := json.Marshal(Envelope{Type: "ack", Payload: data})
+	if err != nil {
+		return
+	}
+	h.hub.ConnMgr().Send(client, env)
+}
+
 // sendMuteStatus queues a mute_status envelope to the given client.
 func (h *Handler) sendMuteStatus(_ context.Context, client *Client, status MuteStatusPayload) {
 	data, err := json.Marshal(status)
@@ -695,40 +1995,229 @@ func formatDuration(d time.Duration) string {
 	return strings.Join(parts, " ")
 }
 
+// handleSetTopic lets the host change the room topic and tells the room.
+// The system message carries the new topic as its content, empty when the
+// topic was cleared.
+func (h *Handler) handleSetTopic(ctx context.Context, client *Client, payload json.RawMessage) {
+	if !client.isCreator {
+		h.sendError(ctx, client, ErrorCodeNotHost, "only the room host can set the topic")
+		return
+	}
+	if h.setRoomTopic == nil {
+		h.sendError(ctx, client, ErrorCodeUnsupported, "topics are not supported")
+		return
+	}
+	var p TopicPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		h.sendError(ctx, client, ErrorCodeInvalidPayload, "invalid set_topic payload")
+		return
+	}
+	topic := strings.TrimSpace(p.Topic)
+	if utf8.RuneCountInString(topic) > maxTopicLength {
+		h.sendError(ctx, client, ErrorCodeTooLong, "topic must be 200 characters or less")
+		return
+	}
+	if h.roomTopic != nil && h.roomTopic(client.roomID) == topic {
+		return
+	}
+
+	h.setRoomTopic(client.roomID, topic)
+	h.hub.Broadcast(client.roomID, &message.Message{
+		RoomID:   client.roomID,
+		UserID:   client.userID,
+		Username: client.username,
+		Color:    client.color,
+		Content:  topic,
+		Type:     message.TypeSystem,
+		Action:   message.ActionTopic,
+	})
+}
+
+// readOnlyError is the error given to guests who post in spectator mode.
+const readOnlyError = "only the host and moderators can post in this room"
+
+// historyFullError is the error given to senders in a reject-new room that
+// has reached its message cap.
+const historyFullError = "this room has reached its message limit"
+
+// handleSetReadOnly turns spectator mode on or off and tells the room.
+func (h *Handler) handleSetReadOnly(ctx context.Context, client *Client, payload json.RawMessage) {
+	if !client.isCreator {
+		h.sendError(ctx, client, ErrorCodeNotHost, "only the room host can change who may post")
+		return
+	}
+	var p ReadOnlyPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		h.sendError(ctx, client, ErrorCodeInvalidPayload, "invalid set_read_only payload")
+		return
+	}
+	if h.hub.ReadOnly(client.roomID) == p.Enabled {
+		return
+	}
+
+	h.hub.SetReadOnly(client.roomID, p.Enabled)
+	content := "Everyone can post again"
+	if p.Enabled {
+		content = "Only the host and moderators can post now"
+	}
+	h.hub.Broadcast(client.roomID, &message.Message{
+		RoomID:   client.roomID,
+		UserID:   client.userID,
+		Username: client.username,
+		Color:    client.color,
+		Content:  content,
+		Type:     message.TypeSystem,
+		Action:   message.ActionReadOnly,
+	})
+}
+
 // handleSetUsername updates a client's username in the current room.
 func (h *Handler) handleSetUsername(ctx context.Context, client *Client, payload SetUsernamePayload) {
+	if client.verified != "" {
+		h.sendError(ctx, client, ErrorCodeUnsupported, "your username comes from your account")
+		return
+	}
 	newName := strings.TrimSpace(payload.Username)
 	if newName == "" {
-		h.sendError(ctx, client, "username cannot be empty")
+		h.sendError(ctx, client, ErrorCodeContentRequired, "username cannot be empty")
 		return
 	}
 	if len(newName) > maxUsernameLength {
-		h.sendError(ctx, client, "username must be 30 characters or less")
+		h.sendError(ctx, client, ErrorCodeTooLong, "username must be 30 characters or less")
+		return
+	}
+	if h.isReservedUsername(newName) {
+		h.sendError(ctx, client, ErrorCodeUsernameReserved, "username is reserved")
 		return
 	}
+	if h.hub.impersonatesStaff(client.roomID, newName, client.userID) {
+		h.sendError(ctx, client, ErrorCodeUsernameReserved, hostNameError)
+		return
+	}
+	newName = h.hub.uniqueUsername(client.roomID, newName, client)
 	if newName == client.username {
 		return
 	}
+	if !h.renameLimit.Allow(client.userID) {
+		max, window := h.renameLimit.Limit()
+		h.sendError(ctx, client, ErrorCodeRateLimited,
+			fmt.Sprintf("username change limit exceeded: max %d changes per %s, try again later", max, formatDuration(window)))
+		return
+	}
 
 	oldName := client.username
-	client.username = newName
-	h.sessions.SetUsername(client.sessionID, newName)
+	h.hub.SetUsername(client, newName)
+	if h.sessions != nil {
+		h.sessions.SetUsername(client.sessionID, newName)
+	}
 
+	h.announceRename(client, oldName)
+}
+
+// announceRename tells the room client is now known by its current name
+// instead of oldName. Past the room's rename announcement cap it only
+// refreshes everyone's presence roster.
+func (h *Handler) announceRename(client *Client, oldName string) {
+	if h.renameNotices != nil && !h.renameNotices.Allow(client.roomID) {
+		h.hub.BroadcastPresence(client.roomID)
+		return
+	}
 	h.hub.Broadcast(client.roomID, &message.Message{
-		ID:        generateClientID(),
-		RoomID:    client.roomID,
-		UserID:    client.userID,
-		Username:  newName,
-		Content:   oldName + " is now known as " + newName,
-		Type:      message.TypeSystem,
-		Action:    message.ActionSetUsername,
-		CreatedAt: time.Now(),
+		RoomID:   client.roomID,
+		UserID:   client.userID,
+		Username: client.username,
+		Color:    client.color,
+		Content:  oldName + " is now known as " + client.username,
+		Type:     message.TypeSystem,
+		Action:   message.ActionSetUsername,
 	})
 }
 
+// handlePresenceFetch replies with the room's current roster so a client
+// that missed a presence broadcast can resync without reconnecting.
+func (h *Handler) handlePresenceFetch(ctx context.Context, client *Client) {
+	if !h.presenceLimit.Allow(client.userID) {
+		h.sendError(ctx, client, ErrorCodeRateLimited, "rate limit exceeded: max 5 presence requests per 10 seconds")
+		return
+	}
+
+	data, err := json.Marshal(PresencePayload{Users: h.hub.RoomUsers(client.roomID)})
+	if err != nil {
+		log.Printf("ws: failed to marshal presence payload: %v", err)
+		return
+	}
+	env, err := json.Marshal(Envelope{Type: "presence", Payload: data})
+	if err != nil {
+		log.Printf("ws: failed to marshal presence envelope: %v", err)
+		return
+	}
+	writeCtx, cancel := context.WithTimeout(ctx, writeTimeout)
+	defer cancel()
+	if err := client.conn.Write(writeCtx, websocket.MessageText, env); err != nil {
+		log.Printf("ws: failed to write presence: %v", err)
+	}
+}
+
+// handlePing answers an application-level ping right away, bypassing the
+// send queue so the measured round trip is not inflated by queued messages.
+func (h *Handler) handlePing(ctx context.Context, client *Client, payload PingPayload) {
+	data, err := json.Marshal(PongPayload{
+		ClientTime: payload.ClientTime,
+		ServerTime: h.hub.Now().UnixMilli(),
+	})
+	if err != nil {
+		log.Printf("ws: failed to marshal pong payload: %v", err)
+		return
+	}
+	env, err := json.Marshal(Envelope{Type: "pong", Payload: data})
+	if err != nil {
+		log.Printf("ws: failed to marshal pong envelope: %v", err)
+		return
+	}
+	writeCtx, cancel := context.WithTimeout(ctx, writeTimeout)
+	defer cancel()
+	if err := client.conn.Write(writeCtx, websocket.MessageText, env); err != nil {
+		log.Printf("ws: failed to write pong: %v", err)
+	}
+}
+
+// handleStatus updates a client's status message and refreshes presence.
+// Status is presence metadata only; it is never persisted as a chat message.
+func (h *Handler) handleStatus(ctx context.Context, client *Client, payload StatusPayload) {
+	status := strings.TrimSpace(payload.Message)
+	if utf8.RuneCountInString(status) > maxStatusLength {
+		h.sendError(ctx, client, ErrorCodeTooLong, "status must be 80 characters or less")
+		return
+	}
+	if strings.IndexFunc(status, unicode.IsControl) != -1 {
+		h.sendError(ctx, client, ErrorCodeInvalidPayload, "status must not contain control characters")
+		return
+	}
+	if status == client.status {
+		return
+	}
+
+	h.hub.SetStatus(client, status)
+	if h.sessions != nil {
+		h.sessions.SetStatus(client.sessionID, status)
+	}
+	h.hub.BroadcastPresence(client.roomID)
+}
+
 // sendError writes an error envelope to the client.
-func (h *Handler) sendError(ctx context.Context, client *Client, msg string) {
-	data, err := json.Marshal(ErrorPayload{Message: msg})
+func (h *Handler) sendError(ctx context.Context, client *Client, code ErrorCode, msg string) {
+	h.writeError(ctx, client, ErrorPayload{Code: code, Message: msg})
+}
+
+// sendChatError writes an error envelope for a rejected chat, echoing its
+// client message ID so the client can mark that pending message failed.
+func (h *Handler) sendChatError(ctx context.Context, client *Client, clientMsgID string, code ErrorCode, msg string) {
+	h.writeError(ctx, client, ErrorPayload{Code: code, Message: msg, ClientMsgID: clientMsgID})
+}
+
+// writeError writes an error payload to the client.
+func (h *Handler) writeError(ctx context.Context, client *Client, payload ErrorPayload) {
+	data, err := json.Marshal(payload)
 	if err != nil {
 		return
 	}
@@ -744,7 +2233,39 @@ func (h *Handler) sendError(ctx context.Context, client *Client, msg string) {
 }
 
 func closeWithError(conn *websocket.Conn, reason string) {
-	conn.Close(websocket.StatusPolicyViolation, reason)
+	conn.Close(websocket.StatusPolicyViolation, safeCloseReason(reason))
+}
+
+// maxCloseReasonBytes is the longest reason a close frame can carry: the
+// 125-byte control frame payload minus the 2-byte status code.
+const maxCloseReasonBytes = 123
+
+// safeCloseReason truncates s to fit in a close frame without splitting a
+// UTF-8 sequence.
+func safeCloseReason(s string) string {
+	if len(s) <= maxCloseReasonBytes {
+		return s
+	}
+	cut := maxCloseReasonBytes
+	for cut > 0 && !utf8.RuneStart(s[cut]) {
+		cut--
+	}
+	return s[:cut]
+}
+
+// avatarPalette is the set of avatar colors assigned to users.
+var avatarPalette = []string{
+	"#e11d48", "#db2777", "#c026d3", "#9333ea",
+	"#4f46e5", "#2563eb", "#0284c7", "#0d9488",
+	"#059669", "#65a30d", "#d97706", "#ea580c",
+}
+
+// userColor deterministically maps a user ID to an avatar color so the same
+// user renders with the same color across reconnects and devices.
+func userColor(userID string) string {
+	h := fnv.New32a()
+	h.Write([]byte(userID))
+	return avatarPalette[h.Sum32()%uint32(len(avatarPalette))]
 }
 
 func generateClientID() string {
@@ -1,18 +1,27 @@
 package ws
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"slices"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
+	"unicode/utf8"
 
+	"github.com/alicebob/miniredis/v2"
 	"github.com/christopherjohns/chatsphere/internal/message"
 	"github.com/christopherjohns/chatsphere/internal/ratelimit"
 	"github.com/christopherjohns/chatsphere/internal/user"
+	"github.com/redis/go-redis/v9"
 	"nhooyr.io/websocket"
 )
 
@@ -37,10 +46,29 @@ func dialAndJoin(t *testing.T, url, roomID, username string) *websocket.Conn {
 	if _, _, err := conn.Read(readCtx); err != nil {
 		t.Fatalf("read history response error: %v", err)
 	}
+	readJoined(t, conn)
 
 	return conn
 }
 
+// readJoined reads the joined envelope that ends the join handshake,
+// skipping any history_batch pages of the join history before it.
+func readJoined(t *testing.T, conn *websocket.Conn) JoinedPayload {
+	t.Helper()
+	env, _ := readMessage(t, conn)
+	for env.Type == "history_batch" {
+		env, _ = readMessage(t, conn)
+	}
+	if env.Type != "joined" {
+		t.Fatalf("expected joined envelope, got %s", env.Type)
+	}
+	var p JoinedPayload
+	if err := json.Unmarshal(env.Payload, &p); err != nil {
+		t.Fatalf("unmarshal joined payload error: %v", err)
+	}
+	return p
+}
+
 func TestHandlerJoinAndChat(t *testing.T) {
 	ts, hub, _ := newHandlerTestServer(t, nil)
 	defer ts.Close()
@@ -296,16 +324,21 @@ func TestHandlerSessionResumption(t *testing.T) {
 		t.Errorf("expected username 'alice' preserved, got %q", sp2.Username)
 	}
 
-	// No backfill expected here because alice was the only client and no
-	// messages were sent while she was disconnected. The "alice left" system
-	// message was sent while she was still in the hub, updating her LastMessageID.
-
 	// Wait for client to be registered.
 	deadline = time.Now().Add(2 * time.Second)
 	for hub.ClientCount("room1") == 0 && time.Now().Before(deadline) {
 		time.Sleep(10 * time.Millisecond)
 	}
 
+	// The backfill holds only "alice left": it was broadcast on alice's own
+	// disconnect path, so it never reached her and her LastMessageID stayed
+	// on "alice joined".
+	backfill := readBackfill(t, conn2)
+	readJoined(t, conn2)
+	if len(backfill.Messages) != 1 || backfill.Messages[0].Action != message.ActionLeave {
+		t.Fatalf("expected backfill of just alice's leave message, got %+v", backfill.Messages)
+	}
+
 	// A "rejoined" system message should be broadcast on session resumption.
 	readCtx1, readCancel1 := context.WithTimeout(context.Background(), 5*time.Second)
 	defer readCancel1()
@@ -353,6 +386,234 @@ func TestHandlerSessionResumption(t *testing.T) {
 	}
 }
 
+func TestHandlerSessionResumptionRename(t *testing.T) {
+	ts, hub, _ := newHandlerTestServer(t, nil)
+	defer ts.Close()
+
+	bob := dialAndJoin(t, ts.URL, "room1", "bob")
+	defer bob.Close(websocket.StatusNormalClosure, "")
+	waitForClients(t, hub, "room1", 1)
+	drainSystemMessages(t, bob, 1) // "bob joined"
+
+	conn1, sp1 := dialJoinAndReadSession(t, ts.URL, "room1", "alice", "")
+	waitForClients(t, hub, "room1", 2)
+	drainSystemMessages(t, conn1, 2) // history + "alice joined"
+	drainSystemMessages(t, bob, 1)
+	conn1.Close(websocket.StatusNormalClosure, "")
+	waitForClients(t, hub, "room1", 1)
+	drainSystemMessages(t, bob, 1) // "alice left"
+
+	conn2, sp2 := dialJoinAndReadSession(t, ts.URL, "room1", "alicia", sp1.SessionID)
+	defer conn2.Close(websocket.StatusNormalClosure, "")
+	if !sp2.Resumed || sp2.UserID != sp1.UserID {
+		t.Fatalf("expected alice's session to resume, got %+v", sp2)
+	}
+	if sp2.Username != "alicia" {
+		t.Errorf("expected the new username, got %q", sp2.Username)
+	}
+
+	// The rename is announced once the join succeeds, so the resuming
+	// client gets it live, right after the handshake.
+	readBackfill(t, conn2)
+	readJoined(t, conn2)
+	if _, msg := readMessage(t, conn2); msg.Action != message.ActionSetUsername {
+		t.Errorf("expected the rename after the handshake, got %+v", msg)
+	}
+
+	_, msg := readMessage(t, bob)
+	if msg.Action != message.ActionSetUsername || msg.Content != "alice is now known as alicia" || msg.UserID != sp1.UserID {
+		t.Errorf("expected the rename to be broadcast, got %+v", msg)
+	}
+	waitForClients(t, hub, "room1", 2)
+	for _, u := range hub.RoomUsers("room1") {
+		if u.UserID == sp1.UserID && u.Username != "alicia" {
+			t.Errorf("expected alicia in the roster, got %q", u.Username)
+		}
+	}
+}
+
+func TestHandlerSessionResumptionRenameRateLimited(t *testing.T) {
+	hub := NewHub(nil)
+	sessions := NewSessionStore(30 * time.Second)
+	messages := message.NewStore(200)
+	hub.SetMessageStore(messages)
+	hub.SetSessionStore(sessions)
+	handler := NewHandler(hub, nil, sessions, messages)
+	handler.SetRenameLimiter(ratelimit.NewIPLimiter(1, time.Minute))
+	ts := httptest.NewServer(handler)
+	defer ts.Close()
+
+	bob := dialAndJoin(t, ts.URL, "room1", "bob")
+	defer bob.Close(websocket.StatusNormalClosure, "")
+	waitForClients(t, hub, "room1", 1)
+
+	conn, sp := dialJoinAndReadSession(t, ts.URL, "room1", "alice", "")
+	waitForClients(t, hub, "room1", 2)
+	// Reconnecting under a new name each time only gets one rename past
+	// the limiter; after that the session keeps the name it has.
+	for _, tc := range []struct{ asked, want string }{
+		{"alicia", "alicia"},
+		{"ally", "alicia"},
+	} {
+		conn.Close(websocket.StatusNormalClosure, "")
+		waitForClients(t, hub, "room1", 1)
+		var got SessionPayload
+		conn, got = dialJoinAndReadSession(t, ts.URL, "room1", tc.asked, sp.SessionID)
+		if !got.Resumed || got.Username != tc.want {
+			t.Fatalf("resuming as %q: expected %q, got %q (resumed=%v)", tc.asked, tc.want, got.Username, got.Resumed)
+		}
+		waitForClients(t, hub, "room1", 2)
+	}
+	defer conn.Close(websocket.StatusNormalClosure, "")
+}
+
+func TestHandlerSessionResumptionRenameRefused(t *testing.T) {
+	ts, hub, _ := newHandlerTestServer(t, nil)
+	defer ts.Close()
+
+	bob := dialAndJoin(t, ts.URL, "room1", "bob")
+	defer bob.Close(websocket.StatusNormalClosure, "")
+	waitForClients(t, hub, "room1", 1)
+
+	conn, sp := dialJoinAndReadSession(t, ts.URL, "room1", "alice", "")
+	waitForClients(t, hub, "room1", 2)
+	conn.Close(websocket.StatusNormalClosure, "")
+	waitForClients(t, hub, "room1", 1)
+
+	// A resume under a name that is too long is refused...
+	refused := dialWS(t, ts.URL)
+	defer refused.Close(websocket.StatusNormalClosure, "")
+	sendEnvelope(t, refused, "join", JoinPayload{RoomID: "room1", Username: strings.Repeat("a", 40), SessionID: sp.SessionID})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, _, err := refused.Read(ctx); websocket.CloseStatus(err) != websocket.StatusPolicyViolation {
+		t.Fatalf("expected the resume to be refused, got %v", err)
+	}
+
+	// ...without leaving the session claimed, so a plain resume still works.
+	conn, got := dialJoinAndReadSession(t, ts.URL, "room1", "", sp.SessionID)
+	defer conn.Close(websocket.StatusNormalClosure, "")
+	if !got.Resumed || got.Username != "alice" {
+		t.Errorf("expected alice's session to resume, got %+v", got)
+	}
+}
+
+// stillOpen drains conn until the server sends a close frame or the
+// deadline passes, and reports whether the connection was still open.
+// Either way conn is closed afterwards: an expired read context makes the
+// websocket library close it.
+func stillOpen(conn *websocket.Conn) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	for {
+		if _, _, err := conn.Read(ctx); err != nil {
+			return websocket.CloseStatus(err) == -1
+		}
+	}
+}
+
+func TestHandlerConcurrentSessionResume(t *testing.T) {
+	for _, evict := range []bool{false, true} {
+		t.Run(fmt.Sprintf("evict=%v", evict), func(t *testing.T) {
+			hub := NewHub(nil)
+			sessions := NewSessionStore(30 * time.Second)
+			messages := message.NewStore(200)
+			hub.SetMessageStore(messages)
+			hub.SetSessionStore(sessions)
+			handler := NewHandler(hub, nil, sessions, messages)
+			handler.SetEvictDuplicateSessions(evict)
+			ts := httptest.NewServer(handler)
+			defer ts.Close()
+
+			conn, sp := dialJoinAndReadSession(t, ts.URL, "room1", "alice", "")
+			waitForClients(t, hub, "room1", 1)
+			conn.Close(websocket.StatusNormalClosure, "")
+			waitForClients(t, hub, "room1", 0)
+
+			// Two tabs resume the same session at once.
+			conns := []*websocket.Conn{dialWS(t, ts.URL), dialWS(t, ts.URL)}
+			payload, _ := json.Marshal(JoinPayload{RoomID: "room1", SessionID: sp.SessionID})
+			env, _ := json.Marshal(Envelope{Type: "join", Payload: payload})
+			var wg sync.WaitGroup
+			for _, c := range conns {
+				wg.Add(1)
+				go func(c *websocket.Conn) {
+					defer wg.Done()
+					ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+					defer cancel()
+					c.Write(ctx, websocket.MessageText, env)
+				}(c)
+			}
+			wg.Wait()
+
+			open := 0
+			for _, c := range conns {
+				if stillOpen(c) {
+					open++
+				}
+			}
+			if open != 1 {
+				t.Errorf("expected exactly one live connection, got %d", open)
+			}
+		})
+	}
+}
+
+func TestHandlerDuplicateSessionPolicy(t *testing.T) {
+	for _, evict := range []bool{false, true} {
+		t.Run(fmt.Sprintf("evict=%v", evict), func(t *testing.T) {
+			hub := NewHub(nil)
+			sessions := NewSessionStore(30 * time.Second)
+			messages := message.NewStore(200)
+			hub.SetMessageStore(messages)
+			hub.SetSessionStore(sessions)
+			handler := NewHandler(hub, nil, sessions, messages)
+			handler.SetEvictDuplicateSessions(evict)
+			var mu sync.Mutex
+			var leaves int
+			hub.SetEventSink(func(e Event) {
+				if e.Type == EventLeave {
+					mu.Lock()
+					leaves++
+					mu.Unlock()
+				}
+			})
+			ts := httptest.NewServer(handler)
+			defer ts.Close()
+
+			conn1, sp1 := dialJoinAndReadSession(t, ts.URL, "room1", "alice", "")
+			waitForClients(t, hub, "room1", 1)
+
+			conn2 := dialWS(t, ts.URL)
+			sendEnvelope(t, conn2, "join", JoinPayload{RoomID: "room1", SessionID: sp1.SessionID})
+
+			if evict {
+				if stillOpen(conn1) {
+					t.Error("expected the older connection to be evicted")
+				}
+				if !stillOpen(conn2) {
+					t.Error("expected the newcomer to take over the session")
+				}
+				// One leave for the evicted connection, one for conn2.
+				waitForClients(t, hub, "room1", 0)
+				mu.Lock()
+				if leaves != 2 {
+					t.Errorf("expected the eviction to be reported as a leave, got %d leaves", leaves)
+				}
+				mu.Unlock()
+			} else {
+				if stillOpen(conn2) {
+					t.Error("expected the duplicate connection to be refused")
+				}
+				if !stillOpen(conn1) {
+					t.Error("expected the original connection to stay open")
+				}
+			}
+			waitForClients(t, hub, "room1", 0)
+		})
+	}
+}
+
 func TestHandlerSessionResumptionWrongRoom(t *testing.T) {
 	ts, hub, _ := newHandlerTestServer(t, nil)
 	defer ts.Close()
@@ -504,19 +765,22 @@ func TestHandlerBackfillOnReconnect(t *testing.T) {
 		t.Error("expected has_gap to be false for normal backfill")
 	}
 
-	// Should contain: "msg1" + "msg2" + "msg3" (chat messages sent while alice was offline).
-	// Note: "alice left" is NOT included because it was broadcast while alice was still
-	// in the hub, which updated her LastMessageID past it.
-	if len(backfillPayload.Messages) != 3 {
-		t.Fatalf("expected 3 backfill messages, got %d", len(backfillPayload.Messages))
+	// Should contain "alice left" (never delivered to alice, so her
+	// LastMessageID stopped before it) + "msg1" + "msg2" + "msg3".
+	if len(backfillPayload.Messages) != 4 {
+		t.Fatalf("expected 4 backfill messages, got %d", len(backfillPayload.Messages))
+	}
+	if backfillPayload.Messages[0].Action != message.ActionLeave {
+		t.Errorf("backfill[0]: expected alice's leave message, got action %q", backfillPayload.Messages[0].Action)
 	}
 
 	for i, content := range []string{"msg1", "msg2", "msg3"} {
-		if backfillPayload.Messages[i].Content != content {
-			t.Errorf("backfill[%d]: expected content %q, got %q", i, content, backfillPayload.Messages[i].Content)
+		m := backfillPayload.Messages[i+1]
+		if m.Content != content {
+			t.Errorf("backfill[%d]: expected content %q, got %q", i+1, content, m.Content)
 		}
-		if backfillPayload.Messages[i].Type != message.TypeChat {
-			t.Errorf("backfill[%d]: expected type 'chat', got %q", i, backfillPayload.Messages[i].Type)
+		if m.Type != message.TypeChat {
+			t.Errorf("backfill[%d]: expected type 'chat', got %q", i+1, m.Type)
 		}
 	}
 }
@@ -637,6 +901,125 @@ func TestHandlerJoinRoomFull(t *testing.T) {
 	}
 }
 
+func TestHandlerFullRoomAdmitsHost(t *testing.T) {
+	hub := NewHub(nil)
+	sessions := NewSessionStore(30 * time.Second)
+	messages := message.NewStore(200)
+	hub.SetMessageStore(messages)
+	hub.SetSessionStore(sessions)
+	userSessions := user.NewSessionStore()
+	handler := NewHandler(hub, nil, sessions, messages)
+	handler.SetUserSessions(userSessions, "chatsphere_session")
+	handler.SetRoomCapacity(func(roomID string) int { return 2 })
+	handler.SetEvictDuplicateSessions(true)
+	ts := httptest.NewServer(handler)
+	defer ts.Close()
+
+	// alice creates the room by joining first, so she is its host.
+	hostSess := userSessions.Create()
+	host, _ := dialJoinAndReadSessionWithCookie(t, ts.URL, "room1", "alice", "chatsphere_session", hostSess.Token)
+	defer host.Close(websocket.StatusNormalClosure, "")
+	waitForClients(t, hub, "room1", 1)
+	bob, bobSP := dialJoinAndReadSession(t, ts.URL, "room1", "bob", "")
+	defer bob.Close(websocket.StatusNormalClosure, "")
+	waitForClients(t, hub, "room1", 2)
+
+	// A newcomer is turned away.
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	carol, _, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(ts.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("dial error: %v", err)
+	}
+	defer carol.Close(websocket.StatusNormalClosure, "")
+	sendEnvelope(t, carol, "join", JoinPayload{RoomID: "room1", Username: "carol"})
+	_, _, err = carol.Read(ctx)
+	var ce websocket.CloseError
+	if !errors.As(err, &ce) || ce.Reason != "room is full" {
+		t.Fatalf("expected carol to be refused with 'room is full', got %v", err)
+	}
+
+	// The host still gets in from a second tab, past capacity.
+	host2, _ := dialJoinAndReadSessionWithCookie(t, ts.URL, "room1", "alice", "chatsphere_session", hostSess.Token)
+	defer host2.Close(websocket.StatusNormalClosure, "")
+	waitForClients(t, hub, "room1", 3)
+
+	// A member resuming their session keeps their place.
+	bob2, sp := dialJoinAndReadSession(t, ts.URL, "room1", "", bobSP.SessionID)
+	defer bob2.Close(websocket.StatusNormalClosure, "")
+	if !sp.Resumed {
+		t.Error("expected bob's session to resume in the full room")
+	}
+}
+
+func TestHandlerChatBeforeJoin(t *testing.T) {
+	ts, hub, _ := newHandlerTestServer(t, nil)
+	defer ts.Close()
+
+	alice := dialAndJoin(t, ts.URL, "room1", "alice")
+	defer alice.Close(websocket.StatusNormalClosure, "")
+	waitForClients(t, hub, "room1", 1)
+	drainSystemMessages(t, alice, 1) // "alice joined"
+
+	// A chat sent as the first frame ends the connection.
+	eve := dialWS(t, ts.URL)
+	defer eve.Close(websocket.StatusNormalClosure, "")
+	sendEnvelope(t, eve, "chat", ChatPayload{Content: "sneaky"})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, _, err := eve.Read(ctx)
+	var ce websocket.CloseError
+	if !errors.As(err, &ce) || !strings.HasPrefix(ce.Reason, "first message must be type 'join'") {
+		t.Fatalf("expected close with 'first message must be type 'join'', got %v", err)
+	}
+
+	// Nothing reached the room: the next thing alice sees is bob joining.
+	bob := dialAndJoin(t, ts.URL, "room1", "bob")
+	defer bob.Close(websocket.StatusNormalClosure, "")
+	env, msg := readMessage(t, alice)
+	if env.Type != "system" || msg.Action != message.ActionJoin || msg.Username != "bob" {
+		t.Fatalf("expected bob's join, got %s %q", env.Type, msg.Content)
+	}
+}
+
+func TestHandlerReadLoopRequiresJoin(t *testing.T) {
+	hub := NewHub(nil)
+	sessions := NewSessionStore(30 * time.Second)
+	messages := message.NewStore(200)
+	h := NewHandler(hub, nil, sessions, messages)
+
+	// Drive the read loop with a client that never finished a join.
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close(websocket.StatusNormalClosure, "")
+		client := &Client{conn: conn, hub: hub}
+		h.readLoop(r.Context(), context.Background(), client)
+	}))
+	defer ts.Close()
+
+	conn := dialWS(t, ts.URL)
+	defer conn.Close(websocket.StatusNormalClosure, "")
+	sendEnvelope(t, conn, "chat", ChatPayload{Content: "hello"})
+
+	env, _ := readMessage(t, conn)
+	if env.Type != "error" {
+		t.Fatalf("expected error, got %s", env.Type)
+	}
+	var p ErrorPayload
+	if err := json.Unmarshal(env.Payload, &p); err != nil {
+		t.Fatalf("unmarshal error payload: %v", err)
+	}
+	if p.Code != ErrorCodeNotJoined {
+		t.Errorf("expected code %q, got %q", ErrorCodeNotJoined, p.Code)
+	}
+	if got := messages.Recent("", 10); len(got) != 0 {
+		t.Errorf("expected nothing stored, got %d messages", len(got))
+	}
+}
+
 func TestHandlerLeaveUpdatesClientCount(t *testing.T) {
 	ts, hub, _ := newHandlerTestServer(t, nil)
 	defer ts.Close()
@@ -1153,6 +1536,41 @@ func TestHandlerHistoryEmptyRoom(t *testing.T) {
 	}
 }
 
+// readJoinHistory reads the join history envelope and the history_batch
+// pages that follow it, returning each chunk in the order received and the
+// last page's has_more.
+func readJoinHistory(t *testing.T, conn *websocket.Conn) ([][]message.Message, bool) {
+	t.Helper()
+	env, _ := readMessage(t, conn)
+	if env.Type != "history" {
+		t.Fatalf("expected type 'history', got %q", env.Type)
+	}
+	var first []message.Message
+	if err := json.Unmarshal(env.Payload, &first); err != nil {
+		t.Fatalf("unmarshal history error: %v", err)
+	}
+	chunks := [][]message.Message{first}
+	hasMore := false
+	for {
+		env, _ := readMessage(t, conn)
+		if env.Type == "joined" {
+			return chunks, hasMore
+		}
+		if env.Type != "history_batch" {
+			t.Fatalf("expected history_batch or joined, got %q", env.Type)
+		}
+		var batch struct {
+			Messages []message.Message `json:"messages"`
+			HasMore  bool              `json:"has_more"`
+		}
+		if err := json.Unmarshal(env.Payload, &batch); err != nil {
+			t.Fatalf("unmarshal history batch error: %v", err)
+		}
+		chunks = append(chunks, batch.Messages)
+		hasMore = batch.HasMore
+	}
+}
+
 func TestHandlerHistoryLimit(t *testing.T) {
 	hub := NewHub(nil)
 	sessions := NewSessionStore(30 * time.Second)
@@ -1174,28 +1592,15 @@ func TestHandlerHistoryLimit(t *testing.T) {
 		})
 	}
 
-	// Join the room and read the history envelope.
 	conn, _ := dialJoinAndReadSession(t, ts.URL, "room1", "alice", "")
 	defer conn.Close(websocket.StatusNormalClosure, "")
 
-	readCtx, readCancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer readCancel()
-	_, data, err := conn.Read(readCtx)
-	if err != nil {
-		t.Fatalf("read error: %v", err)
-	}
-
-	var env Envelope
-	if err := json.Unmarshal(data, &env); err != nil {
-		t.Fatalf("unmarshal error: %v", err)
-	}
-	if env.Type != "history" {
-		t.Fatalf("expected type 'history', got %q", env.Type)
-	}
+	chunks, hasMore := readJoinHistory(t, conn)
 
+	// Chunks arrive newest first; put them back in order.
 	var historyMsgs []message.Message
-	if err := json.Unmarshal(env.Payload, &historyMsgs); err != nil {
-		t.Fatalf("unmarshal history error: %v", err)
+	for _, chunk := range chunks {
+		historyMsgs = append(chunk, historyMsgs...)
 	}
 
 	// Should receive exactly 50 messages (the limit), not all 60.
@@ -1210,6 +1615,118 @@ func TestHandlerHistoryLimit(t *testing.T) {
 	if historyMsgs[49].ID != "msg-59" {
 		t.Errorf("expected last history message ID 'msg-59', got %q", historyMsgs[49].ID)
 	}
+	if !hasMore {
+		t.Error("expected has_more with older messages beyond the limit")
+	}
+}
+
+func TestHandlerHistoryChunked(t *testing.T) {
+	hub := NewHub(nil)
+	sessions := NewSessionStore(30 * time.Second)
+	messages := message.NewStore(200)
+	hub.SetMessageStore(messages)
+	hub.SetSessionStore(sessions)
+	handler := NewHandler(hub, nil, sessions, messages)
+	ts := httptest.NewServer(handler)
+	defer ts.Close()
+
+	for i := 0; i < historyLimit; i++ {
+		messages.Append(&message.Message{
+			ID:        fmt.Sprintf("msg-%d", i),
+			RoomID:    "room1",
+			Content:   fmt.Sprintf("message %d", i),
+			Type:      message.TypeChat,
+			CreatedAt: time.Now(),
+		})
+	}
+
+	conn, _ := dialJoinAndReadSession(t, ts.URL, "room1", "alice", "")
+	defer conn.Close(websocket.StatusNormalClosure, "")
+
+	chunks, hasMore := readJoinHistory(t, conn)
+	var sizes []int
+	for _, chunk := range chunks {
+		sizes = append(sizes, len(chunk))
+	}
+	if !slices.Equal(sizes, []int{20, 20, 10}) {
+		t.Fatalf("expected chunks of 20, 20 and 10, got %v", sizes)
+	}
+	// The history envelope carries the newest messages.
+	if chunks[0][19].ID != "msg-49" || chunks[2][0].ID != "msg-0" {
+		t.Errorf("expected newest chunk first, got %q..%q", chunks[0][19].ID, chunks[2][0].ID)
+	}
+	if hasMore {
+		t.Error("expected no has_more when the whole room fit in the history")
+	}
+}
+
+func TestHandlerUnreadCountSkipsSystemMessages(t *testing.T) {
+	ts, hub, _ := newHandlerTestServer(t, nil)
+	defer ts.Close()
+
+	conn1 := dialAndJoin(t, ts.URL, "room1", "alice")
+	defer conn1.Close(websocket.StatusNormalClosure, "")
+	waitForClients(t, hub, "room1", 1)
+	drainSystemMessages(t, conn1, 1) // "alice joined"
+
+	sendEnvelope(t, conn1, "chat", ChatPayload{Content: "before bob"})
+	readMessage(t, conn1)
+
+	// History from before joining is not unread.
+	conn2, sp2 := dialJoinAndReadSession(t, ts.URL, "room1", "bob", "")
+	drainSystemMessages(t, conn2, 1) // history
+	if p := readJoined(t, conn2); p.Unread != 0 {
+		t.Errorf("expected 0 unread on first join, got %d", p.Unread)
+	}
+	waitForClients(t, hub, "room1", 2)
+	drainSystemMessages(t, conn1, 1) // "bob joined"
+	drainSystemMessages(t, conn2, 1) // "bob joined"
+
+	sendEnvelope(t, conn1, "chat", ChatPayload{Content: "one"})
+	readMessage(t, conn1)
+	_, one := readMessage(t, conn2)
+	sendEnvelope(t, conn2, "mark_read", MarkReadPayload{Seq: one.Seq})
+
+	sendEnvelope(t, conn1, "chat", ChatPayload{Content: "two"})
+	readMessage(t, conn1)
+	readMessage(t, conn2)
+
+	conn2.Close(websocket.StatusNormalClosure, "")
+	waitForClients(t, hub, "room1", 1)
+	drainSystemMessages(t, conn1, 1) // "bob left"
+
+	// A join and a chat while bob is away.
+	conn3 := dialAndJoin(t, ts.URL, "room1", "carol")
+	defer conn3.Close(websocket.StatusNormalClosure, "")
+	waitForClients(t, hub, "room1", 2)
+	drainSystemMessages(t, conn1, 1) // "carol joined"
+	sendEnvelope(t, conn1, "chat", ChatPayload{Content: "three"})
+	readMessage(t, conn1)
+
+	conn4, sp4 := dialJoinAndReadSession(t, ts.URL, "room1", "", sp2.SessionID)
+	defer conn4.Close(websocket.StatusNormalClosure, "")
+	if !sp4.Resumed {
+		t.Fatal("expected session to be resumed")
+	}
+	readBackfill(t, conn4)
+	if p := readJoined(t, conn4); p.Unread != 2 {
+		t.Errorf("expected 2 unread (two, three), got %d", p.Unread)
+	}
+}
+
+func TestHandlerMarkReadInvalid(t *testing.T) {
+	ts, hub, _ := newHandlerTestServer(t, nil)
+	defer ts.Close()
+
+	conn := dialAndJoin(t, ts.URL, "room1", "alice")
+	defer conn.Close(websocket.StatusNormalClosure, "")
+	waitForClients(t, hub, "room1", 1)
+	drainSystemMessages(t, conn, 1) // "alice joined"
+
+	sendEnvelope(t, conn, "mark_read", MarkReadPayload{Seq: 0})
+	if msg := readError(t, conn); msg != "invalid mark_read payload" {
+		t.Errorf("expected invalid mark_read payload, got %q", msg)
+	}
 }
 
 func TestHandlerBackfillGapOnEvictedMessage(t *testing.T) {
@@ -1384,21 +1901,63 @@ func TestHandlerBackfillNoGapOnNormalReconnect(t *testing.T) {
 	if backfillPayload.HasGap {
 		t.Error("expected has_gap=false for normal backfill within store capacity")
 	}
-	if len(backfillPayload.Messages) != 2 {
-		t.Errorf("expected 2 backfill messages, got %d", len(backfillPayload.Messages))
-	}
-}
-
-// drainSystemMessages reads and discards n messages from the connection.
-func drainSystemMessages(t *testing.T, conn *websocket.Conn, n int) {
-	t.Helper()
-	for i := 0; i < n; i++ {
-		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-		_, _, err := conn.Read(ctx)
-		cancel()
-		if err != nil {
-			t.Fatalf("drain message %d: %v", i, err)
-		}
+	if len(backfillPayload.Messages) != 3 { // "alice left" + 2 chats
+		t.Errorf("expected 3 backfill messages, got %d", len(backfillPayload.Messages))
+	}
+}
+
+func TestHandlerBackfillNoGapOnCappedSystemMessage(t *testing.T) {
+	hub := NewHub(nil)
+	sessions := NewSessionStore(30 * time.Second)
+	// Only one system message is kept, so "alice left" pushes out the
+	// "bob joined" message alice last saw.
+	messages := message.NewStore(200, message.WithMaxSystem(1))
+	hub.SetMessageStore(messages)
+	hub.SetSessionStore(sessions)
+	handler := NewHandler(hub, nil, sessions, messages)
+	ts := httptest.NewServer(handler)
+	defer ts.Close()
+
+	conn1, sp1 := dialJoinAndReadSession(t, ts.URL, "room1", "alice", "")
+	conn2 := dialAndJoin(t, ts.URL, "room1", "bob")
+	defer conn2.Close(websocket.StatusNormalClosure, "")
+	waitForClients(t, hub, "room1", 2)
+
+	drainSystemMessages(t, conn1, 3)
+	drainSystemMessages(t, conn2, 1)
+
+	conn1.Close(websocket.StatusNormalClosure, "")
+	waitForClients(t, hub, "room1", 1)
+	drainSystemMessages(t, conn2, 1) // "alice left"
+
+	sendEnvelope(t, conn2, "chat", ChatPayload{Content: "hello"})
+	drainSystemMessages(t, conn2, 1)
+
+	conn3, sp3 := dialJoinAndReadSession(t, ts.URL, "room1", "", sp1.SessionID)
+	defer conn3.Close(websocket.StatusNormalClosure, "")
+	if !sp3.Resumed {
+		t.Fatal("expected session to be resumed")
+	}
+
+	bp := readBackfill(t, conn3)
+	if bp.HasGap {
+		t.Error("expected has_gap=false when only a capped system message is missing")
+	}
+	if len(bp.Messages) != 2 || bp.Messages[1].Content != "hello" {
+		t.Errorf("expected \"alice left\" and the chat message, got %+v", bp.Messages)
+	}
+}
+
+// drainSystemMessages reads and discards n messages from the connection.
+func drainSystemMessages(t *testing.T, conn *websocket.Conn, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		_, _, err := conn.Read(ctx)
+		cancel()
+		if err != nil {
+			t.Fatalf("drain message %d: %v", i, err)
+		}
 	}
 }
 
@@ -1504,6 +2063,163 @@ func TestHandlerLeaveAllowsSessionResumption(t *testing.T) {
 	}
 }
 
+func TestHandlerSessionPayloadIsHost(t *testing.T) {
+	ts, hub, _ := newHandlerTestServer(t, nil)
+	defer ts.Close()
+
+	conn1, sp1 := dialJoinAndReadSession(t, ts.URL, "room1", "alice", "")
+	defer conn1.Close(websocket.StatusNormalClosure, "")
+	if !sp1.IsHost {
+		t.Error("expected the first joiner's session payload to have is_host")
+	}
+	waitForClients(t, hub, "room1", 1)
+
+	conn2, sp2 := dialJoinAndReadSession(t, ts.URL, "room1", "bob", "")
+	defer conn2.Close(websocket.StatusNormalClosure, "")
+	if sp2.IsHost {
+		t.Error("expected a later joiner not to be host")
+	}
+
+	// A resumed host is still told it is the host.
+	conn1.Close(websocket.StatusNormalClosure, "")
+	waitForClients(t, hub, "room1", 1)
+	conn3, sp3 := dialJoinAndReadSession(t, ts.URL, "room1", "", sp1.SessionID)
+	defer conn3.Close(websocket.StatusNormalClosure, "")
+	if !sp3.Resumed || !sp3.IsHost {
+		t.Errorf("expected resumed host session, got resumed=%v is_host=%v", sp3.Resumed, sp3.IsHost)
+	}
+}
+
+func TestHandlerLeaveGrace(t *testing.T) {
+	hub := NewHub(nil)
+	sessions := NewSessionStore(30 * time.Second)
+	messages := message.NewStore(200)
+	hub.SetMessageStore(messages)
+	hub.SetSessionStore(sessions)
+	handler := NewHandler(hub, nil, sessions, messages)
+	handler.SetLeaveGrace(300 * time.Millisecond)
+	ts := httptest.NewServer(handler)
+	defer ts.Close()
+
+	alice := dialAndJoin(t, ts.URL, "room1", "alice")
+	defer alice.Close(websocket.StatusNormalClosure, "")
+	waitForClients(t, hub, "room1", 1)
+	drainSystemMessages(t, alice, 1) // "alice joined"
+
+	bob, sp := dialJoinAndReadSession(t, ts.URL, "room1", "bob", "")
+	waitForClients(t, hub, "room1", 2)
+	drainSystemMessages(t, alice, 1) // "bob joined"
+
+	// bob drops and comes straight back: alice hears nothing of it.
+	bob.Close(websocket.StatusNormalClosure, "")
+	waitForClients(t, hub, "room1", 1)
+	bob, _ = dialJoinAndReadSession(t, ts.URL, "room1", "", sp.SessionID)
+	waitForClients(t, hub, "room1", 2)
+	sendEnvelope(t, alice, "chat", ChatPayload{Content: "still here?"})
+	if env, msg := readMessage(t, alice); env.Type != "chat" {
+		t.Fatalf("expected no leave or rejoin within the grace period, got %q %q", env.Type, msg.Content)
+	}
+
+	// This time bob stays away past the grace period.
+	bob.Close(websocket.StatusNormalClosure, "")
+	waitForClients(t, hub, "room1", 1)
+	if _, msg := readMessage(t, alice); msg.Action != message.ActionLeave {
+		t.Fatalf("expected a leave after the grace period, got %q %q", msg.Action, msg.Content)
+	}
+	bob, _ = dialJoinAndReadSession(t, ts.URL, "room1", "", sp.SessionID)
+	defer bob.Close(websocket.StatusNormalClosure, "")
+	if _, msg := readMessage(t, alice); msg.Action != message.ActionRejoin {
+		t.Fatalf("expected a rejoin after the grace period, got %q %q", msg.Action, msg.Content)
+	}
+}
+
+func TestHandlerLeaveForgetEndsSession(t *testing.T) {
+	ts, hub, sessions := newHandlerTestServer(t, nil)
+	defer ts.Close()
+
+	conn1 := dialAndJoin(t, ts.URL, "room1", "bob")
+	defer conn1.Close(websocket.StatusNormalClosure, "")
+	waitForClients(t, hub, "room1", 1)
+	drainSystemMessages(t, conn1, 1) // "bob joined"
+
+	conn2, sp2 := dialJoinAndReadSession(t, ts.URL, "room1", "alice", "")
+	drainSystemMessages(t, conn2, 1) // history
+	waitForClients(t, hub, "room1", 2)
+	drainSystemMessages(t, conn1, 1) // "alice joined"
+
+	sendEnvelope(t, conn2, "leave", LeavePayload{Forget: true})
+
+	// Others still see the normal leave message.
+	_, msg := readMessage(t, conn1)
+	if msg.Action != message.ActionLeave || msg.Username != "alice" {
+		t.Errorf("expected alice left message, got %q (%s)", msg.Content, msg.Action)
+	}
+	if s := sessions.Get(sp2.SessionID); s != nil {
+		t.Fatal("expected session to be deleted after forget-leave")
+	}
+
+	// Resuming falls back to a brand-new session.
+	conn3, sp3 := dialJoinAndReadSession(t, ts.URL, "room1", "alice", sp2.SessionID)
+	defer conn3.Close(websocket.StatusNormalClosure, "")
+	if sp3.Resumed {
+		t.Error("expected a new session, not a resumed one")
+	}
+	if sp3.SessionID == sp2.SessionID {
+		t.Error("expected a different session ID")
+	}
+}
+
+func TestHandlerLeaveInvalidPayload(t *testing.T) {
+	ts, hub, sessions := newHandlerTestServer(t, nil)
+	defer ts.Close()
+
+	conn, sp := dialJoinAndReadSession(t, ts.URL, "room1", "alice", "")
+	defer conn.Close(websocket.StatusNormalClosure, "")
+	readMessage(t, conn) // history
+	readJoined(t, conn)
+	waitForClients(t, hub, "room1", 1)
+	drainSystemMessages(t, conn, 1) // "alice joined"
+
+	// A payload that doesn't decode is refused rather than read as a
+	// plain leave.
+	sendEnvelope(t, conn, "leave", "forget")
+	if got := readError(t, conn); got != "invalid leave payload" {
+		t.Errorf("unexpected error %q", got)
+	}
+	if hub.ClientCount("room1") != 1 || sessions.Get(sp.SessionID) == nil {
+		t.Error("expected alice to still be in the room")
+	}
+}
+
+func TestHandlerOversizedFrame(t *testing.T) {
+	ts, hub, _ := newHandlerTestServer(t, nil)
+	defer ts.Close()
+
+	conn := dialAndJoin(t, ts.URL, "room1", "alice")
+	defer conn.Close(websocket.StatusNormalClosure, "")
+	waitForClients(t, hub, "room1", 1)
+	drainSystemMessages(t, conn, 1) // "alice joined"
+
+	// A frame at the limit is read normally and ignored as invalid JSON.
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := conn.Write(ctx, websocket.MessageText, make([]byte, maxFrameSize)); err != nil {
+		t.Fatalf("write error: %v", err)
+	}
+	if err := conn.Write(ctx, websocket.MessageText, make([]byte, maxFrameSize+1)); err != nil {
+		t.Fatalf("write error: %v", err)
+	}
+
+	if msg := readError(t, conn); msg != "message too large" {
+		t.Errorf("expected 'message too large', got %q", msg)
+	}
+	_, _, err := conn.Read(ctx)
+	if status := websocket.CloseStatus(err); status != websocket.StatusMessageTooBig {
+		t.Errorf("expected close status %v, got %v (%v)", websocket.StatusMessageTooBig, status, err)
+	}
+	waitForClients(t, hub, "room1", 0)
+}
+
 func TestHandlerJoinUsernameTooLong(t *testing.T) {
 	ts, _, _ := newHandlerTestServer(t, nil)
 	defer ts.Close()
@@ -1629,6 +2345,63 @@ func TestHandlerHistoryFetch(t *testing.T) {
 	}
 }
 
+func TestHandlerHistoryFetchCursor(t *testing.T) {
+	ts, hub, _ := newHandlerTestServer(t, nil)
+	defer ts.Close()
+
+	for i := 0; i < 80; i++ {
+		hub.messages.Append(&message.Message{
+			ID:        fmt.Sprintf("msg-%d", i),
+			RoomID:    "room1",
+			Content:   fmt.Sprintf("message %d", i),
+			Type:      message.TypeChat,
+			Seq:       int64(i + 1),
+			CreatedAt: time.Now(),
+		})
+	}
+
+	conn := dialAndJoin(t, ts.URL, "room1", "alice")
+	defer conn.Close(websocket.StatusNormalClosure, "")
+	waitForClients(t, hub, "room1", 1)
+	drainSystemMessages(t, conn, 1) // "alice joined"
+
+	readBatch := func() HistoryBatchPayload {
+		t.Helper()
+		env, _ := readMessage(t, conn)
+		if env.Type != "history_batch" {
+			t.Fatalf("expected history_batch, got %s", env.Type)
+		}
+		var p HistoryBatchPayload
+		json.Unmarshal(env.Payload, &p)
+		return p
+	}
+
+	// The first page is fetched by ID and hands back a cursor.
+	sendEnvelope(t, conn, "history_fetch", HistoryFetchPayload{BeforeID: "msg-30", Limit: 20})
+	first := readBatch()
+	if len(first.Messages) != 20 || first.Messages[0].ID != "msg-10" {
+		t.Fatalf("unexpected first batch: %d messages", len(first.Messages))
+	}
+	if !first.HasMore || first.NextCursor == "" {
+		t.Fatalf("expected has_more with a next_cursor, got %+v", first.HasMore)
+	}
+
+	// The cursor continues from where the first page ended.
+	sendEnvelope(t, conn, "history_fetch", HistoryFetchPayload{Cursor: first.NextCursor, Limit: 20})
+	second := readBatch()
+	if len(second.Messages) != 10 || second.Messages[0].ID != "msg-0" || second.Messages[9].ID != "msg-9" {
+		t.Fatalf("expected msg-0 to msg-9, got %d messages", len(second.Messages))
+	}
+	if second.HasMore || second.NextCursor != "" {
+		t.Errorf("expected the last page without a cursor, got has_more=%v cursor=%q", second.HasMore, second.NextCursor)
+	}
+
+	sendEnvelope(t, conn, "history_fetch", HistoryFetchPayload{Cursor: "bogus", Limit: 20})
+	if msg := readError(t, conn); msg != errInvalidCursor.Error() {
+		t.Errorf("expected %q, got %q", errInvalidCursor.Error(), msg)
+	}
+}
+
 func TestHandlerHistoryFetchNoMore(t *testing.T) {
 	hub := NewHub(nil)
 	sessions := NewSessionStore(30 * time.Second)
@@ -1830,6 +2603,9 @@ func TestHandlerChatRateLimited(t *testing.T) {
 	if !strings.Contains(errPayload.Message, "rate limit") {
 		t.Errorf("expected rate limit error, got %q", errPayload.Message)
 	}
+	if errPayload.Code != ErrorCodeRateLimited {
+		t.Errorf("expected code %q, got %q", ErrorCodeRateLimited, errPayload.Code)
+	}
 }
 
 func TestHandlerChatRateLimitPerUser(t *testing.T) {
@@ -2084,6 +2860,70 @@ func TestHandlerKick(t *testing.T) {
 	}
 }
 
+func TestHandlerKickByUsername(t *testing.T) {
+	ts, hub, _ := newHandlerTestServer(t, nil)
+	defer ts.Close()
+
+	conn1 := dialAndJoin(t, ts.URL, "room1", "alice")
+	defer conn1.Close(websocket.StatusNormalClosure, "")
+	waitForClients(t, hub, "room1", 1)
+	drainSystemMessages(t, conn1, 1) // "alice joined"
+
+	conn2 := dialAndJoin(t, ts.URL, "room1", "bob")
+	defer conn2.Close(websocket.StatusNormalClosure, "")
+	waitForClients(t, hub, "room1", 2)
+	drainSystemMessages(t, conn1, 1) // "bob joined"
+
+	// Unknown names are rejected.
+	sendEnvelope(t, conn1, "kick", KickPayload{Username: "carol"})
+	if msg := readError(t, conn1); msg != "user not found in room" {
+		t.Errorf("expected 'user not found in room', got %q", msg)
+	}
+
+	// Names match regardless of case.
+	sendEnvelope(t, conn1, "kick", KickPayload{Username: "BOB"})
+	_, msg := readMessage(t, conn1)
+	if msg.Action != message.ActionKick || msg.Username != "bob" {
+		t.Errorf("expected bob to be kicked, got %q (%s)", msg.Content, msg.Action)
+	}
+	waitForClients(t, hub, "room1", 1)
+}
+
+func TestHandlerMuteByAmbiguousUsername(t *testing.T) {
+	ts, hub, _ := newHandlerTestServer(t, nil)
+	defer ts.Close()
+
+	conn1 := dialAndJoin(t, ts.URL, "room1", "alice")
+	defer conn1.Close(websocket.StatusNormalClosure, "")
+	waitForClients(t, hub, "room1", 1)
+	drainSystemMessages(t, conn1, 1) // "alice joined"
+
+	conn2, sp2 := dialJoinAndReadSession(t, ts.URL, "room1", "bob", "")
+	defer conn2.Close(websocket.StatusNormalClosure, "")
+	conn3, sp3 := dialJoinAndReadSession(t, ts.URL, "room1", "carol", "")
+	defer conn3.Close(websocket.StatusNormalClosure, "")
+	waitForClients(t, hub, "room1", 3)
+	drainSystemMessages(t, conn1, 2) // "bob joined", "carol joined"
+
+	// Unique usernames are enforced at join, so force a clash directly.
+	carol := hub.FindClient("room1", sp3.UserID)
+	hub.mu.Lock()
+	carol.username = "Bob"
+	hub.mu.Unlock()
+
+	sendEnvelope(t, conn1, "mute", MutePayload{Username: "bob"})
+	msg := readError(t, conn1)
+	if !strings.Contains(msg, "matches multiple users") {
+		t.Fatalf("expected ambiguity error, got %q", msg)
+	}
+	if !strings.Contains(msg, sp2.UserID) || !strings.Contains(msg, sp3.UserID) {
+		t.Errorf("expected both candidates listed, got %q", msg)
+	}
+	if hub.IsMuted("room1", sp2.UserID) || hub.IsMuted("room1", sp3.UserID) {
+		t.Error("expected nobody to be muted")
+	}
+}
+
 func TestHandlerKickNonHostDenied(t *testing.T) {
 	ts, hub, _ := newHandlerTestServer(t, nil)
 	defer ts.Close()
@@ -2194,6 +3034,7 @@ func TestHandlerMute(t *testing.T) {
 	conn2, sp2 := dialJoinAndReadSession(t, ts.URL, "room1", "bob", "")
 	defer conn2.Close(websocket.StatusNormalClosure, "")
 	drainSystemMessages(t, conn2, 1) // history
+	readJoined(t, conn2)
 	waitForClients(t, hub, "room1", 2)
 	drainSystemMessages(t, conn1, 1) // "bob joined"
 	drainSystemMessages(t, conn2, 1) // "bob joined"
@@ -2231,6 +3072,11 @@ func TestHandlerMute(t *testing.T) {
 	if envErr.Type != "error" {
 		t.Errorf("expected error for muted user, got %q", envErr.Type)
 	}
+	var errPayload ErrorPayload
+	json.Unmarshal(envErr.Payload, &errPayload)
+	if errPayload.Code != ErrorCodeMuted {
+		t.Errorf("expected code %q, got %q", ErrorCodeMuted, errPayload.Code)
+	}
 
 	// Alice unmutes Bob.
 	sendEnvelope(t, conn1, "mute", MutePayload{UserID: sp2.UserID})
@@ -2265,6 +3111,7 @@ func TestHandlerKickSelfDenied(t *testing.T) {
 	conn1, sp1 := dialJoinAndReadSession(t, ts.URL, "room1", "alice", "")
 	defer conn1.Close(websocket.StatusNormalClosure, "")
 	drainSystemMessages(t, conn1, 1) // history
+	readJoined(t, conn1)
 	waitForClients(t, hub, "room1", 1)
 	drainSystemMessages(t, conn1, 1) // "alice joined"
 
@@ -2325,12 +3172,14 @@ func TestHandlerHostResumedKeepsHostStatus(t *testing.T) {
 	// Alice joins first (host), then bob joins.
 	conn1, sp1 := dialJoinAndReadSession(t, ts.URL, "room1", "alice", "")
 	drainSystemMessages(t, conn1, 1) // history
+	readJoined(t, conn1)
 	waitForClients(t, hub, "room1", 1)
 	drainSystemMessages(t, conn1, 1) // "alice joined"
 
 	conn2, sp2 := dialJoinAndReadSession(t, ts.URL, "room1", "bob", "")
 	defer conn2.Close(websocket.StatusNormalClosure, "")
 	drainSystemMessages(t, conn2, 1) // history
+	readJoined(t, conn2)
 	waitForClients(t, hub, "room1", 2)
 	drainSystemMessages(t, conn1, 1) // "bob joined"
 	drainSystemMessages(t, conn2, 1) // "bob joined"
@@ -2350,11 +3199,11 @@ func TestHandlerHostResumedKeepsHostStatus(t *testing.T) {
 	// Alice (resumed) should still be able to kick Bob.
 	sendEnvelope(t, conn3, "kick", KickPayload{UserID: sp2.UserID})
 
-	// Read backfill and rejoin messages first, then the kick message.
+	// Read backfill, joined and rejoin messages first, then the kick message.
 	// The backfill may contain the "alice left" message.
 	for {
 		env, msg := readMessage(t, conn3)
-		if env.Type == "backfill" {
+		if env.Type == "backfill" || env.Type == "joined" {
 			continue
 		}
 		if env.Type == "system" && msg.Action == message.ActionRejoin {
@@ -2431,6 +3280,8 @@ func TestTypingIndicatorNotPersisted(t *testing.T) {
 	if err := conn1.Write(ctx, websocket.MessageText, chatEnv); err != nil {
 		t.Fatalf("write chat error: %v", err)
 	}
+	// Bob first sees alice's typing indicator cleared.
+	drainSystemMessages(t, conn2, 1)
 
 	// Both receive the chat message.
 	for _, conn := range []*websocket.Conn{conn1, conn2} {
@@ -2499,44 +3350,133 @@ func TestTypingIndicatorRoomIsolation(t *testing.T) {
 	}
 }
 
-func newHandlerTestServerWithUserSessions(t *testing.T) (*httptest.Server, *Hub, *user.SessionStore) {
-	t.Helper()
-	hub := NewHub(nil)
-	sessions := NewSessionStore(30 * time.Second)
-	messages := message.NewStore(200)
-	hub.SetMessageStore(messages)
-	hub.SetSessionStore(sessions)
-	userSessions := user.NewSessionStore()
-	handler := NewHandler(hub, nil, sessions, messages)
-	handler.SetUserSessions(userSessions, "chatsphere_session")
-	return httptest.NewServer(handler), hub, userSessions
-}
+func TestTypingIndicatorStoppedByChat(t *testing.T) {
+	ts, hub, _ := newHandlerTestServer(t, nil)
+	defer ts.Close()
 
-func dialWSWithCookie(t *testing.T, url, cookieName, cookieValue string) *websocket.Conn {
-	t.Helper()
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-	wsURL := "ws" + strings.TrimPrefix(url, "http")
-	conn, _, err := websocket.Dial(ctx, wsURL, &websocket.DialOptions{
-		HTTPHeader: http.Header{
-			"Cookie": {fmt.Sprintf("%s=%s", cookieName, cookieValue)},
-		},
-	})
-	if err != nil {
-		t.Fatalf("dial error: %v", err)
-	}
-	return conn
-}
+	conn1 := dialAndJoin(t, ts.URL, "room1", "alice")
+	defer conn1.Close(websocket.StatusNormalClosure, "")
+	conn2 := dialAndJoin(t, ts.URL, "room1", "bob")
+	defer conn2.Close(websocket.StatusNormalClosure, "")
 
-func dialJoinAndReadSessionWithCookie(t *testing.T, url, roomID, username, cookieName, cookieValue string) (*websocket.Conn, SessionPayload) {
-	t.Helper()
-	conn := dialWSWithCookie(t, url, cookieName, cookieValue)
+	waitForClients(t, hub, "room1", 2)
+	drainSystemMessages(t, conn1, 2)
+	drainSystemMessages(t, conn2, 1)
 
-	payload, _ := json.Marshal(JoinPayload{RoomID: roomID, Username: username})
-	env, _ := json.Marshal(Envelope{Type: "join", Payload: payload})
+	sendEnvelope(t, conn1, "typing", struct{}{})
+	if env, _ := readMessage(t, conn2); env.Type != string(message.TypeTyping) {
+		t.Fatalf("expected type 'typing', got %q", env.Type)
+	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
+	// The chat clears the indicator before the message itself arrives.
+	sendEnvelope(t, conn1, "chat", ChatPayload{Content: "hello"})
+	env, msg := readMessage(t, conn2)
+	if env.Type != string(message.TypeTypingStop) {
+		t.Fatalf("expected type 'typing_stop', got %q", env.Type)
+	}
+	if msg.UserID == "" || msg.Username != "alice" {
+		t.Errorf("expected typing_stop for alice, got %q (%q)", msg.Username, msg.UserID)
+	}
+	if env, _ := readMessage(t, conn2); env.Type != string(message.TypeChat) {
+		t.Fatalf("expected type 'chat', got %q", env.Type)
+	}
+	// The sender never sees its own typing_stop.
+	if env, _ := readMessage(t, conn1); env.Type != string(message.TypeChat) {
+		t.Fatalf("expected sender to get only the chat, got %q", env.Type)
+	}
+
+	// A chat with no indicator showing sends no stop.
+	sendEnvelope(t, conn1, "chat", ChatPayload{Content: "again"})
+	if env, _ := readMessage(t, conn2); env.Type != string(message.TypeChat) {
+		t.Fatalf("expected type 'chat' without a stop, got %q", env.Type)
+	}
+}
+
+func TestTypingIndicatorThrottled(t *testing.T) {
+	ts, hub, _ := newHandlerTestServer(t, nil)
+	defer ts.Close()
+
+	conn1 := dialAndJoin(t, ts.URL, "room1", "alice")
+	defer conn1.Close(websocket.StatusNormalClosure, "")
+	conn2 := dialAndJoin(t, ts.URL, "room1", "bob")
+	defer conn2.Close(websocket.StatusNormalClosure, "")
+
+	waitForClients(t, hub, "room1", 2)
+	drainSystemMessages(t, conn1, 2)
+	drainSystemMessages(t, conn2, 1)
+
+	// Alice hammers typing, then sends a chat message. Everything she sent
+	// is processed in order, so by the time bob sees the chat message he
+	// has seen every typing indicator that was relayed.
+	for i := 0; i < 20; i++ {
+		sendEnvelope(t, conn1, "typing", struct{}{})
+	}
+	sendEnvelope(t, conn1, "chat", ChatPayload{Content: "hello"})
+
+	typing := 0
+	for {
+		env, _ := readMessage(t, conn2)
+		if env.Type == string(message.TypeChat) {
+			break
+		}
+		if env.Type == string(message.TypeTyping) {
+			typing++
+		}
+	}
+	if typing < 1 || typing > 2 {
+		t.Fatalf("expected 1-2 typing indicators for 20 sends, got %d", typing)
+	}
+
+	// Once the interval has passed, a new typing signal goes through.
+	time.Sleep(typingInterval + 100*time.Millisecond)
+	sendEnvelope(t, conn1, "typing", struct{}{})
+	env, msg := readMessage(t, conn2)
+	if env.Type != string(message.TypeTyping) {
+		t.Fatalf("expected type 'typing', got %q", env.Type)
+	}
+	if msg.Username != "alice" {
+		t.Errorf("expected username 'alice', got %q", msg.Username)
+	}
+}
+
+func newHandlerTestServerWithUserSessions(t *testing.T) (*httptest.Server, *Hub, *user.SessionStore) {
+	t.Helper()
+	hub := NewHub(nil)
+	sessions := NewSessionStore(30 * time.Second)
+	messages := message.NewStore(200)
+	hub.SetMessageStore(messages)
+	hub.SetSessionStore(sessions)
+	userSessions := user.NewSessionStore()
+	handler := NewHandler(hub, nil, sessions, messages)
+	handler.SetUserSessions(userSessions, "chatsphere_session")
+	return httptest.NewServer(handler), hub, userSessions
+}
+
+func dialWSWithCookie(t *testing.T, url, cookieName, cookieValue string) *websocket.Conn {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	wsURL := "ws" + strings.TrimPrefix(url, "http")
+	conn, _, err := websocket.Dial(ctx, wsURL, &websocket.DialOptions{
+		HTTPHeader: http.Header{
+			"Cookie": {fmt.Sprintf("%s=%s", cookieName, cookieValue)},
+		},
+	})
+	if err != nil {
+		t.Fatalf("dial error: %v", err)
+	}
+	return conn
+}
+
+func dialJoinAndReadSessionWithCookie(t *testing.T, url, roomID, username, cookieName, cookieValue string) (*websocket.Conn, SessionPayload) {
+	t.Helper()
+	conn := dialWSWithCookie(t, url, cookieName, cookieValue)
+
+	payload, _ := json.Marshal(JoinPayload{RoomID: roomID, Username: username})
+	env, _ := json.Marshal(Envelope{Type: "join", Payload: payload})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
 	if err := conn.Write(ctx, websocket.MessageText, env); err != nil {
 		t.Fatalf("write join error: %v", err)
 	}
@@ -2594,6 +3534,57 @@ func TestHandlerUserSessionCookiePersistsAcrossRooms(t *testing.T) {
 	}
 }
 
+func TestHubBroadcastToUser(t *testing.T) {
+	ts, hub, userSessions := newHandlerTestServerWithUserSessions(t)
+	defer ts.Close()
+
+	anonSess := userSessions.Create()
+	var conns []*websocket.Conn
+	for _, roomID := range []string{"room1", "room2"} {
+		conn, _ := dialJoinAndReadSessionWithCookie(t, ts.URL, roomID, "alice", "chatsphere_session", anonSess.Token)
+		defer conn.Close(websocket.StatusNormalClosure, "")
+		readMessage(t, conn) // history
+		readJoined(t, conn)
+		waitForClients(t, hub, roomID, 1)
+		drainSystemMessages(t, conn, 1) // "alice joined"
+		conns = append(conns, conn)
+	}
+	other := dialAndJoin(t, ts.URL, "room1", "bob")
+	defer other.Close(websocket.StatusNormalClosure, "")
+	waitForClients(t, hub, "room1", 2)
+	drainSystemMessages(t, conns[0], 1) // "bob joined"
+
+	var seen []string
+	hub.ForEachClientOf(anonSess.UserID, func(c *Client) { seen = append(seen, c.roomID) })
+	slices.Sort(seen)
+	if !slices.Equal(seen, []string{"room1", "room2"}) {
+		t.Errorf("expected alice's clients in room1 and room2, got %v", seen)
+	}
+
+	n := hub.BroadcastToUser(anonSess.UserID, &message.Message{
+		Content: "you have been muted everywhere",
+		Type:    message.TypeSystem,
+		Action:  message.ActionMute,
+	})
+	if n != 2 {
+		t.Errorf("expected the message queued for 2 connections, got %d", n)
+	}
+	for i, conn := range conns {
+		_, msg := readMessage(t, conn)
+		if msg.Content != "you have been muted everywhere" {
+			t.Errorf("connection %d: expected the user message, got %q", i, msg.Content)
+		}
+		if want := fmt.Sprintf("room%d", i+1); msg.RoomID != want {
+			t.Errorf("connection %d: expected room_id %q, got %q", i, want, msg.RoomID)
+		}
+	}
+	if msgs := hub.messages.Recent("room1", 10); slices.ContainsFunc(msgs, func(m *message.Message) bool {
+		return m.Action == message.ActionMute
+	}) {
+		t.Error("expected the user message not to be stored")
+	}
+}
+
 func TestHandlerWithoutCookieGetsRandomID(t *testing.T) {
 	ts, _, _ := newHandlerTestServerWithUserSessions(t)
 	defer ts.Close()
@@ -2630,6 +3621,59 @@ func TestHandlerInvalidCookieGetsRandomID(t *testing.T) {
 	}
 }
 
+func TestHandlerUserSessionCookieKeepsReadPosition(t *testing.T) {
+	ts, hub, userSessions := newHandlerTestServerWithUserSessions(t)
+	defer ts.Close()
+
+	bob := dialAndJoin(t, ts.URL, "room1", "bob")
+	defer bob.Close(websocket.StatusNormalClosure, "")
+	waitForClients(t, hub, "room1", 1)
+	drainSystemMessages(t, bob, 1) // "bob joined"
+
+	anonSess := userSessions.Create()
+	alice, _ := dialJoinAndReadSessionWithCookie(t, ts.URL, "room1", "alice", "chatsphere_session", anonSess.Token)
+	drainSystemMessages(t, alice, 1) // history
+	readJoined(t, alice)
+	waitForClients(t, hub, "room1", 2)
+	drainSystemMessages(t, alice, 1) // "alice joined"
+	drainSystemMessages(t, bob, 1)
+
+	var last message.Message
+	for i := 0; i < 10; i++ {
+		sendEnvelope(t, bob, "chat", ChatPayload{Content: fmt.Sprintf("msg %d", i)})
+		readMessage(t, bob)
+		_, last = readMessage(t, alice)
+	}
+	sendEnvelope(t, alice, "mark_read", MarkReadPayload{Seq: last.Seq})
+	alice.Close(websocket.StatusNormalClosure, "")
+	waitForClients(t, hub, "room1", 1)
+	drainSystemMessages(t, bob, 1) // "alice left"
+
+	// Carol sends the new messages; bob has used up his chat rate limit.
+	carol := dialAndJoin(t, ts.URL, "room1", "carol")
+	defer carol.Close(websocket.StatusNormalClosure, "")
+	waitForClients(t, hub, "room1", 2)
+	drainSystemMessages(t, carol, 1) // "carol joined"
+	for i := 0; i < 5; i++ {
+		sendEnvelope(t, carol, "chat", ChatPayload{Content: fmt.Sprintf("later %d", i)})
+		if env, _ := readMessage(t, carol); env.Type != string(message.TypeChat) {
+			t.Fatalf("expected 'chat', got %q", env.Type)
+		}
+	}
+
+	// Rejoining with the same cookie but no ws session starts a new
+	// session that still knows where alice stopped reading.
+	alice2, sp := dialJoinAndReadSessionWithCookie(t, ts.URL, "room1", "alice", "chatsphere_session", anonSess.Token)
+	defer alice2.Close(websocket.StatusNormalClosure, "")
+	if sp.Resumed {
+		t.Fatal("expected a new session")
+	}
+	drainSystemMessages(t, alice2, 1) // history
+	if p := readJoined(t, alice2); p.Unread != 5 {
+		t.Errorf("expected 5 unread after rejoining, got %d", p.Unread)
+	}
+}
+
 func TestHandlerSetUsername(t *testing.T) {
 	ts, hub, sessions := newHandlerTestServer(t, nil)
 	defer ts.Close()
@@ -2641,6 +3685,7 @@ func TestHandlerSetUsername(t *testing.T) {
 	readCtx, readCancel := context.WithTimeout(context.Background(), 5*time.Second)
 	conn1.Read(readCtx) // drain history envelope
 	readCancel()
+	readJoined(t, conn1)
 
 	conn2 := dialAndJoin(t, ts.URL, "room1", "bob")
 	defer conn2.Close(websocket.StatusNormalClosure, "")
@@ -2874,6 +3919,7 @@ func TestHandlerBanNonHostDenied(t *testing.T) {
 	conn2, sp1 := dialJoinAndReadSession(t, ts.URL, "room1", "bob", "")
 	defer conn2.Close(websocket.StatusNormalClosure, "")
 	drainSystemMessages(t, conn2, 1) // history
+	readJoined(t, conn2)
 	waitForClients(t, hub, "room1", 2)
 	drainSystemMessages(t, conn1, 1) // "bob joined"
 	drainSystemMessages(t, conn2, 1) // "bob joined"
@@ -2895,6 +3941,7 @@ func TestHandlerBanSelfDenied(t *testing.T) {
 	conn1, sp1 := dialJoinAndReadSession(t, ts.URL, "room1", "alice", "")
 	defer conn1.Close(websocket.StatusNormalClosure, "")
 	drainSystemMessages(t, conn1, 1) // history
+	readJoined(t, conn1)
 	waitForClients(t, hub, "room1", 1)
 	drainSystemMessages(t, conn1, 1) // "alice joined"
 
@@ -2958,6 +4005,42 @@ func TestHandlerBanBlocksRejoinByIP(t *testing.T) {
 	}
 }
 
+func TestHandlerBanCIDR(t *testing.T) {
+	ts, hub, _ := newHandlerTestServer(t, nil)
+	defer ts.Close()
+
+	conn1 := dialAndJoin(t, ts.URL, "room1", "alice")
+	defer conn1.Close(websocket.StatusNormalClosure, "")
+	waitForClients(t, hub, "room1", 1)
+	drainSystemMessages(t, conn1, 1) // "alice joined"
+
+	sendEnvelope(t, conn1, "ban", BanPayload{CIDR: "10.0.0.0/8"})
+	if msg := readError(t, conn1); !strings.Contains(msg, "too broad") {
+		t.Errorf("expected too broad error, got %q", msg)
+	}
+
+	// The test client connects from 127.0.0.1.
+	sendEnvelope(t, conn1, "ban", BanPayload{CIDR: "127.0.0.0/24"})
+	if msg := readError(t, conn1); msg != "you cannot ban a range that includes your own address" {
+		t.Errorf("expected own-address error, got %q", msg)
+	}
+	if hub.IsBannedIP("room1", "127.0.0.1") {
+		t.Fatal("expected rejected range not to be banned")
+	}
+
+	sendEnvelope(t, conn1, "ban", BanPayload{CIDR: "192.0.2.0/24"})
+	_, msg := readMessage(t, conn1)
+	if msg.Action != message.ActionBan {
+		t.Errorf("expected ban system message, got %q (%s)", msg.Content, msg.Action)
+	}
+	if !hub.IsBannedIP("room1", "192.0.2.44") {
+		t.Error("expected IP inside the range to be banned")
+	}
+	if hub.IsBannedIP("room1", "192.0.3.44") {
+		t.Error("expected IP outside the range to be allowed")
+	}
+}
+
 func TestHandlerBanBlocksRejoinByCookie(t *testing.T) {
 	ts, hub, userSessions := newHandlerTestServerWithUserSessions(t)
 	defer ts.Close()
@@ -3098,6 +4181,7 @@ func TestHandlerTimedMute(t *testing.T) {
 	conn2, sp2 := dialJoinAndReadSession(t, ts.URL, "room1", "bob", "")
 	defer conn2.Close(websocket.StatusNormalClosure, "")
 	drainSystemMessages(t, conn2, 1) // history
+	readJoined(t, conn2)
 	waitForClients(t, hub, "room1", 2)
 	drainSystemMessages(t, conn1, 1) // "bob joined"
 	drainSystemMessages(t, conn2, 1) // "bob joined"
@@ -3158,6 +4242,7 @@ func TestHandlerTimedMuteExpires(t *testing.T) {
 	conn2, sp2 := dialJoinAndReadSession(t, ts.URL, "room1", "bob", "")
 	defer conn2.Close(websocket.StatusNormalClosure, "")
 	drainSystemMessages(t, conn2, 1) // history
+	readJoined(t, conn2)
 	waitForClients(t, hub, "room1", 2)
 	drainSystemMessages(t, conn1, 1) // "bob joined"
 	drainSystemMessages(t, conn2, 1) // "bob joined"
@@ -3191,6 +4276,7 @@ func TestHandlerMuteNegativeDuration(t *testing.T) {
 	conn1, sp := dialJoinAndReadSession(t, ts.URL, "room1", "alice", "")
 	defer conn1.Close(websocket.StatusNormalClosure, "")
 	drainSystemMessages(t, conn1, 1) // history
+	readJoined(t, conn1)
 	waitForClients(t, hub, "room1", 1)
 	drainSystemMessages(t, conn1, 1) // "alice joined"
 
@@ -3198,6 +4284,7 @@ func TestHandlerMuteNegativeDuration(t *testing.T) {
 	conn2, sp2 := dialJoinAndReadSession(t, ts.URL, "room1", "bob", "")
 	defer conn2.Close(websocket.StatusNormalClosure, "")
 	drainSystemMessages(t, conn2, 1) // history
+	readJoined(t, conn2)
 	waitForClients(t, hub, "room1", 2)
 	drainSystemMessages(t, conn1, 1) // "bob joined"
 	drainSystemMessages(t, conn2, 1) // "bob joined"
@@ -3237,3 +4324,2738 @@ func TestFormatDuration(t *testing.T) {
 		})
 	}
 }
+
+func TestHandlerStatusUpdatesPresence(t *testing.T) {
+	ts, hub, sessions := newHandlerTestServer(t, nil)
+	defer ts.Close()
+
+	conn1, sp1 := dialJoinAndReadSession(t, ts.URL, "room1", "alice", "")
+	drainSystemMessages(t, conn1, 1) // history
+	readJoined(t, conn1)
+	waitForClients(t, hub, "room1", 1)
+	drainSystemMessages(t, conn1, 1) // "alice joined"
+
+	conn2 := dialAndJoin(t, ts.URL, "room1", "bob")
+	defer conn2.Close(websocket.StatusNormalClosure, "")
+	waitForClients(t, hub, "room1", 2)
+	drainSystemMessages(t, conn1, 1) // "bob joined"
+	drainSystemMessages(t, conn2, 1) // "bob joined"
+
+	sendEnvelope(t, conn1, "status", StatusPayload{Message: "  in a meeting  "})
+
+	// Both clients receive an updated presence roster; no chat message is stored.
+	for _, conn := range []*websocket.Conn{conn1, conn2} {
+		env, _ := readMessage(t, conn)
+		if env.Type != "presence" {
+			t.Fatalf("expected type 'presence', got %q", env.Type)
+		}
+		var p PresencePayload
+		json.Unmarshal(env.Payload, &p)
+		found := false
+		for _, u := range p.Users {
+			if u.UserID == sp1.UserID {
+				found = true
+				if u.Status != "in a meeting" {
+					t.Errorf("expected trimmed status 'in a meeting', got %q", u.Status)
+				}
+			}
+		}
+		if !found {
+			t.Fatal("expected alice in presence roster")
+		}
+	}
+	if sess := sessions.Get(sp1.SessionID); sess.Status != "in a meeting" {
+		t.Errorf("expected session status 'in a meeting', got %q", sess.Status)
+	}
+
+	// Status survives session resumption.
+	conn1.Close(websocket.StatusNormalClosure, "")
+	waitForClients(t, hub, "room1", 1)
+	drainSystemMessages(t, conn2, 1) // "alice left"
+
+	conn3, sp3 := dialJoinAndReadSession(t, ts.URL, "room1", "", sp1.SessionID)
+	defer conn3.Close(websocket.StatusNormalClosure, "")
+	if !sp3.Resumed {
+		t.Fatal("expected session to resume")
+	}
+	waitForClients(t, hub, "room1", 2)
+	for _, u := range hub.RoomUsers("room1") {
+		if u.UserID == sp1.UserID && u.Status != "in a meeting" {
+			t.Errorf("expected status restored on resume, got %q", u.Status)
+		}
+	}
+}
+
+func TestHandlerStatusValidation(t *testing.T) {
+	ts, hub, _ := newHandlerTestServer(t, nil)
+	defer ts.Close()
+
+	conn := dialAndJoin(t, ts.URL, "room1", "alice")
+	defer conn.Close(websocket.StatusNormalClosure, "")
+	waitForClients(t, hub, "room1", 1)
+	drainSystemMessages(t, conn, 1) // "alice joined"
+
+	for _, status := range []string{
+		strings.Repeat("é", maxStatusLength+1),
+		"away\x07now",
+	} {
+		sendEnvelope(t, conn, "status", StatusPayload{Message: status})
+		env, _ := readMessage(t, conn)
+		if env.Type != "error" {
+			t.Errorf("expected 'error' for status %q, got %q", status, env.Type)
+		}
+	}
+
+	// A status at the rune limit is accepted even if it exceeds 80 bytes.
+	sendEnvelope(t, conn, "status", StatusPayload{Message: strings.Repeat("é", maxStatusLength)})
+	env, _ := readMessage(t, conn)
+	if env.Type != "presence" {
+		t.Errorf("expected 'presence' for status at limit, got %q", env.Type)
+	}
+	if got := hub.RoomUsers("room1")[0].Status; got != strings.Repeat("é", maxStatusLength) {
+		t.Errorf("unexpected status %q", got)
+	}
+}
+
+func TestUserColorDeterministic(t *testing.T) {
+	a := userColor("user-a")
+	b := userColor("user-b")
+	if a == "" || b == "" {
+		t.Fatal("expected non-empty colors")
+	}
+	if a == b {
+		t.Errorf("expected distinct colors for user-a and user-b, both got %q", a)
+	}
+	for i := 0; i < 10; i++ {
+		if got := userColor("user-a"); got != a {
+			t.Fatalf("expected stable color %q, got %q", a, got)
+		}
+	}
+}
+
+func TestHandlerColorStableAcrossSessions(t *testing.T) {
+	ts, hub, _ := newHandlerTestServer(t, nil)
+	defer ts.Close()
+
+	conn1, sp1 := dialJoinAndReadSession(t, ts.URL, "room1", "alice", "")
+	drainSystemMessages(t, conn1, 1) // history
+	readJoined(t, conn1)
+	waitForClients(t, hub, "room1", 1)
+	if sp1.Color != userColor(sp1.UserID) {
+		t.Errorf("expected session color %q, got %q", userColor(sp1.UserID), sp1.Color)
+	}
+
+	_, joinMsg := readMessage(t, conn1)
+	if joinMsg.Color != sp1.Color {
+		t.Errorf("expected join message color %q, got %q", sp1.Color, joinMsg.Color)
+	}
+
+	sendEnvelope(t, conn1, "chat", ChatPayload{Content: "hi"})
+	_, chatMsg := readMessage(t, conn1)
+	if chatMsg.Color != sp1.Color {
+		t.Errorf("expected chat message color %q, got %q", sp1.Color, chatMsg.Color)
+	}
+
+	conn1.Close(websocket.StatusNormalClosure, "")
+	waitForClients(t, hub, "room1", 0)
+
+	conn2, sp2 := dialJoinAndReadSession(t, ts.URL, "room1", "", sp1.SessionID)
+	defer conn2.Close(websocket.StatusNormalClosure, "")
+	if !sp2.Resumed {
+		t.Fatal("expected session to resume")
+	}
+	if sp2.Color != sp1.Color {
+		t.Errorf("expected color %q preserved across sessions, got %q", sp1.Color, sp2.Color)
+	}
+}
+
+func TestHandlerUniqueUsernamesJoinCollision(t *testing.T) {
+	ts, hub, _ := newHandlerTestServer(t, nil)
+	defer ts.Close()
+	hub.RequireUniqueUsernames("room1")
+
+	conn1, sp1 := dialJoinAndReadSession(t, ts.URL, "room1", "alice", "")
+	drainSystemMessages(t, conn1, 1) // history
+	waitForClients(t, hub, "room1", 1)
+	if sp1.Username != "alice" {
+		t.Fatalf("expected 'alice', got %q", sp1.Username)
+	}
+
+	conn2, sp2 := dialJoinAndReadSession(t, ts.URL, "room1", "Alice", "")
+	defer conn2.Close(websocket.StatusNormalClosure, "")
+	drainSystemMessages(t, conn2, 1) // history
+	waitForClients(t, hub, "room1", 2)
+	if sp2.Username != "Alice (2)" {
+		t.Errorf("expected 'Alice (2)' for colliding join, got %q", sp2.Username)
+	}
+
+	// Once alice leaves, the name is free again.
+	conn1.Close(websocket.StatusNormalClosure, "")
+	waitForClients(t, hub, "room1", 1)
+
+	conn3, sp3 := dialJoinAndReadSession(t, ts.URL, "room1", "alice", "")
+	defer conn3.Close(websocket.StatusNormalClosure, "")
+	if sp3.Username != "alice" {
+		t.Errorf("expected freed name 'alice' to be reusable, got %q", sp3.Username)
+	}
+}
+
+func TestHandlerUniqueUsernamesConcurrentJoins(t *testing.T) {
+	ts, hub, _ := newHandlerTestServer(t, nil)
+	defer ts.Close()
+	hub.RequireUniqueUsernames("room1")
+
+	const n = 10
+	wsURL := "ws" + strings.TrimPrefix(ts.URL, "http")
+	join, _ := json.Marshal(JoinPayload{RoomID: "room1", Username: "alice"})
+	env, _ := json.Marshal(Envelope{Type: "join", Payload: join})
+	conns := make(chan *websocket.Conn, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			conn, _, err := websocket.Dial(ctx, wsURL, nil)
+			if err != nil {
+				t.Errorf("dial error: %v", err)
+				return
+			}
+			conns <- conn
+			if err := conn.Write(ctx, websocket.MessageText, env); err != nil {
+				t.Errorf("write join error: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	close(conns)
+	for conn := range conns {
+		defer conn.Close(websocket.StatusNormalClosure, "")
+	}
+	waitForClients(t, hub, "room1", n)
+
+	seen := make(map[string]bool)
+	for _, u := range hub.RoomUsers("room1") {
+		name := strings.ToLower(u.Username)
+		if seen[name] {
+			t.Errorf("expected unique names, %q is used twice", u.Username)
+		}
+		seen[name] = true
+	}
+	if len(seen) != n {
+		t.Errorf("expected %d users, got %d", n, len(seen))
+	}
+}
+
+func TestHandlerUniqueUsernamesRenameCollision(t *testing.T) {
+	ts, hub, _ := newHandlerTestServer(t, nil)
+	defer ts.Close()
+	hub.RequireUniqueUsernames("room1")
+
+	conn1 := dialAndJoin(t, ts.URL, "room1", "alice")
+	defer conn1.Close(websocket.StatusNormalClosure, "")
+	waitForClients(t, hub, "room1", 1)
+	conn2 := dialAndJoin(t, ts.URL, "room1", "bob")
+	defer conn2.Close(websocket.StatusNormalClosure, "")
+	waitForClients(t, hub, "room1", 2)
+	drainSystemMessages(t, conn1, 2) // "alice joined" + "bob joined"
+	drainSystemMessages(t, conn2, 1) // "bob joined"
+
+	sendEnvelope(t, conn2, "set_username", SetUsernamePayload{Username: "alice"})
+	_, msg := readMessage(t, conn2)
+	if msg.Action != message.ActionSetUsername {
+		t.Fatalf("expected set_username action, got %q", msg.Action)
+	}
+	if msg.Username != "alice (2)" {
+		t.Errorf("expected assigned name 'alice (2)', got %q", msg.Username)
+	}
+	if msg.Content != "bob is now known as alice (2)" {
+		t.Errorf("unexpected content: %q", msg.Content)
+	}
+}
+
+func TestHandlerDuplicateUsernamesAllowedByDefault(t *testing.T) {
+	ts, hub, _ := newHandlerTestServer(t, nil)
+	defer ts.Close()
+
+	// The host's own name is protected; see TestHandlerHostNameProtected.
+	host := dialAndJoin(t, ts.URL, "room1", "carol")
+	defer host.Close(websocket.StatusNormalClosure, "")
+	conn1 := dialAndJoin(t, ts.URL, "room1", "alice")
+	defer conn1.Close(websocket.StatusNormalClosure, "")
+	waitForClients(t, hub, "room1", 2)
+
+	conn2, sp2 := dialJoinAndReadSession(t, ts.URL, "room1", "alice", "")
+	defer conn2.Close(websocket.StatusNormalClosure, "")
+	if sp2.Username != "alice" {
+		t.Errorf("expected duplicate 'alice' without enforcement, got %q", sp2.Username)
+	}
+}
+
+func TestHandlerHostNameProtected(t *testing.T) {
+	ts, hub, _ := newHandlerTestServer(t, nil)
+	defer ts.Close()
+
+	host := dialAndJoin(t, ts.URL, "room1", "alice")
+	defer host.Close(websocket.StatusNormalClosure, "")
+	waitForClients(t, hub, "room1", 1)
+	conn2 := dialAndJoin(t, ts.URL, "room1", "bob")
+	defer conn2.Close(websocket.StatusNormalClosure, "")
+	waitForClients(t, hub, "room1", 2)
+	drainSystemMessages(t, conn2, 1) // "bob joined"
+
+	// A guest cannot rename to the host's name, in any case.
+	sendEnvelope(t, conn2, "set_username", SetUsernamePayload{Username: "ALICE"})
+	env, _ := readMessage(t, conn2)
+	var ep ErrorPayload
+	json.Unmarshal(env.Payload, &ep)
+	if env.Type != "error" || ep.Code != ErrorCodeUsernameReserved {
+		t.Fatalf("expected username_reserved error, got %q %q", env.Type, ep.Code)
+	}
+
+	// Nor join under it.
+	conn3 := dialWS(t, ts.URL)
+	defer conn3.Close(websocket.StatusNormalClosure, "")
+	sendEnvelope(t, conn3, "join", JoinPayload{RoomID: "room1", Username: "Alice"})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, _, err := conn3.Read(ctx)
+	if websocket.CloseStatus(err) != websocket.StatusPolicyViolation {
+		t.Fatalf("expected join to be refused, got %v", err)
+	}
+	if hub.ClientCount("room1") != 2 {
+		t.Errorf("expected 2 clients, got %d", hub.ClientCount("room1"))
+	}
+}
+
+func TestHandlerReservedUsernames(t *testing.T) {
+	ts, hub, _ := newHandlerTestServer(t, nil)
+	defer ts.Close()
+
+	// Joining with a reserved name falls back to an anonymous name.
+	conn1, sp1 := dialJoinAndReadSession(t, ts.URL, "room1", "System", "")
+	defer conn1.Close(websocket.StatusNormalClosure, "")
+	drainSystemMessages(t, conn1, 1) // history
+	readJoined(t, conn1)
+	waitForClients(t, hub, "room1", 1)
+	drainSystemMessages(t, conn1, 1) // join
+	if !strings.HasPrefix(sp1.Username, "anon-") {
+		t.Errorf("expected anon fallback for reserved join name, got %q", sp1.Username)
+	}
+
+	// Renaming to a reserved name or an anon- lookalike is rejected.
+	for _, name := range []string{"ADMIN", "Moderator", "Anon-123456"} {
+		sendEnvelope(t, conn1, "set_username", SetUsernamePayload{Username: name})
+		env, _ := readMessage(t, conn1)
+		if env.Type != "error" {
+			t.Errorf("expected 'error' renaming to %q, got %q", name, env.Type)
+		}
+	}
+}
+
+func TestHandlerReadOnly(t *testing.T) {
+	ts, hub, _ := newHandlerTestServer(t, nil)
+	defer ts.Close()
+
+	conn1 := dialAndJoin(t, ts.URL, "room1", "alice")
+	defer conn1.Close(websocket.StatusNormalClosure, "")
+	waitForClients(t, hub, "room1", 1)
+	drainSystemMessages(t, conn1, 1) // "alice joined"
+	conn2 := dialAndJoin(t, ts.URL, "room1", "bob")
+	defer conn2.Close(websocket.StatusNormalClosure, "")
+	waitForClients(t, hub, "room1", 2)
+	drainSystemMessages(t, conn1, 1) // "bob joined"
+	drainSystemMessages(t, conn2, 1)
+
+	// Only the host may switch it on.
+	sendEnvelope(t, conn2, "set_read_only", ReadOnlyPayload{Enabled: true})
+	if got := readError(t, conn2); got != "only the room host can change who may post" {
+		t.Errorf("unexpected error %q", got)
+	}
+
+	sendEnvelope(t, conn1, "set_read_only", ReadOnlyPayload{Enabled: true})
+	for _, conn := range []*websocket.Conn{conn1, conn2} {
+		env, msg := readMessage(t, conn)
+		if env.Type != "system" || msg.Action != message.ActionReadOnly {
+			t.Errorf("expected read_only system message, got %q %q", env.Type, msg.Action)
+		}
+	}
+
+	// A guest's chat is refused...
+	sendEnvelope(t, conn2, "chat", ChatPayload{Content: "can I ask something?"})
+	env, _ := readMessage(t, conn2)
+	var ep ErrorPayload
+	json.Unmarshal(env.Payload, &ep)
+	if env.Type != "error" || ep.Code != ErrorCodeReadOnly {
+		t.Fatalf("expected read_only error, got %q %q", env.Type, ep.Code)
+	}
+
+	// ...while the host's goes through.
+	sendEnvelope(t, conn1, "chat", ChatPayload{Content: "welcome to the AMA"})
+	env, msg := readMessage(t, conn2)
+	if env.Type != "chat" || msg.Content != "welcome to the AMA" {
+		t.Errorf("expected host chat, got %q %q", env.Type, msg.Content)
+	}
+
+	// Late joiners learn the room is read-only.
+	conn3, _ := dialJoinAndReadSession(t, ts.URL, "room1", "carol", "")
+	defer conn3.Close(websocket.StatusNormalClosure, "")
+	drainSystemMessages(t, conn3, 1) // history
+	if p := readJoined(t, conn3); !p.ReadOnly {
+		t.Error("expected read_only in joined payload")
+	}
+	waitForClients(t, hub, "room1", 3)
+	drainSystemMessages(t, conn2, 1) // "carol joined"
+
+	// Turning it off lets everyone post again.
+	sendEnvelope(t, conn1, "set_read_only", ReadOnlyPayload{Enabled: false})
+	drainSystemMessages(t, conn2, 1)
+	sendEnvelope(t, conn2, "chat", ChatPayload{Content: "thanks!"})
+	if env, msg := readMessage(t, conn2); env.Type != "chat" || msg.Content != "thanks!" {
+		t.Errorf("expected own chat echoed, got %q %q", env.Type, msg.Content)
+	}
+}
+
+func TestHandlerSetTopic(t *testing.T) {
+	hub := NewHub(nil)
+	sessions := NewSessionStore(30 * time.Second)
+	messages := message.NewStore(200)
+	hub.SetMessageStore(messages)
+	hub.SetSessionStore(sessions)
+	handler := NewHandler(hub, nil, sessions, messages)
+	var mu sync.Mutex
+	topics := make(map[string]string)
+	handler.SetRoomTopic(func(roomID string) string {
+		mu.Lock()
+		defer mu.Unlock()
+		return topics[roomID]
+	}, func(roomID, topic string) {
+		mu.Lock()
+		defer mu.Unlock()
+		topics[roomID] = topic
+	})
+	ts := httptest.NewServer(handler)
+	defer ts.Close()
+
+	conn1 := dialAndJoin(t, ts.URL, "room1", "alice")
+	defer conn1.Close(websocket.StatusNormalClosure, "")
+	waitForClients(t, hub, "room1", 1)
+	drainSystemMessages(t, conn1, 1) // "alice joined"
+	conn2 := dialAndJoin(t, ts.URL, "room1", "bob")
+	defer conn2.Close(websocket.StatusNormalClosure, "")
+	waitForClients(t, hub, "room1", 2)
+	drainSystemMessages(t, conn1, 1) // "bob joined"
+	drainSystemMessages(t, conn2, 1)
+
+	// The host sets the topic and everyone is told.
+	sendEnvelope(t, conn1, "set_topic", TopicPayload{Topic: "  Standup at 10  "})
+	for _, conn := range []*websocket.Conn{conn1, conn2} {
+		env, msg := readMessage(t, conn)
+		if env.Type != "system" || msg.Action != message.ActionTopic || msg.Content != "Standup at 10" {
+			t.Errorf("expected topic system message, got %q %q %q", env.Type, msg.Action, msg.Content)
+		}
+	}
+
+	// Anyone joining now sees it.
+	conn3, _ := dialJoinAndReadSession(t, ts.URL, "room1", "carol", "")
+	defer conn3.Close(websocket.StatusNormalClosure, "")
+	drainSystemMessages(t, conn3, 1) // history
+	if p := readJoined(t, conn3); p.Topic != "Standup at 10" {
+		t.Errorf("expected topic in joined payload, got %q", p.Topic)
+	}
+	waitForClients(t, hub, "room1", 3)
+	drainSystemMessages(t, conn1, 1) // "carol joined"
+	drainSystemMessages(t, conn2, 1)
+	drainSystemMessages(t, conn3, 1)
+
+	// Only the host may change it.
+	sendEnvelope(t, conn2, "set_topic", TopicPayload{Topic: "bob's topic"})
+	env, _ := readMessage(t, conn2)
+	var ep ErrorPayload
+	json.Unmarshal(env.Payload, &ep)
+	if env.Type != "error" || ep.Code != ErrorCodeNotHost {
+		t.Errorf("expected not_host error, got %q %+v", env.Type, ep)
+	}
+
+	sendEnvelope(t, conn1, "set_topic", TopicPayload{Topic: strings.Repeat("é", maxTopicLength+1)})
+	env, _ = readMessage(t, conn1)
+	json.Unmarshal(env.Payload, &ep)
+	if env.Type != "error" || ep.Code != ErrorCodeTooLong {
+		t.Errorf("expected too_long error, got %q %+v", env.Type, ep)
+	}
+
+	// An empty topic clears it.
+	sendEnvelope(t, conn1, "set_topic", TopicPayload{})
+	for _, conn := range []*websocket.Conn{conn1, conn2, conn3} {
+		env, msg := readMessage(t, conn)
+		if env.Type != "system" || msg.Action != message.ActionTopic || msg.Content != "" {
+			t.Errorf("expected cleared topic system message, got %q %q %q", env.Type, msg.Action, msg.Content)
+		}
+	}
+	mu.Lock()
+	got := topics["room1"]
+	mu.Unlock()
+	if got != "" {
+		t.Errorf("expected topic to be cleared, got %q", got)
+	}
+}
+
+func TestHandlerSetReservedUsernames(t *testing.T) {
+	hub := NewHub(nil)
+	sessions := NewSessionStore(30 * time.Second)
+	messages := message.NewStore(200)
+	hub.SetMessageStore(messages)
+	hub.SetSessionStore(sessions)
+	handler := NewHandler(hub, nil, sessions, messages)
+	handler.SetReservedUsernames([]string{"Helper"})
+	ts := httptest.NewServer(handler)
+	defer ts.Close()
+
+	conn := dialAndJoin(t, ts.URL, "room1", "alice")
+	defer conn.Close(websocket.StatusNormalClosure, "")
+	waitForClients(t, hub, "room1", 1)
+	drainSystemMessages(t, conn, 1) // join
+
+	sendEnvelope(t, conn, "set_username", SetUsernamePayload{Username: "hElPeR"})
+	env, _ := readMessage(t, conn)
+	if env.Type != "error" {
+		t.Errorf("expected 'error' for custom reserved name, got %q", env.Type)
+	}
+
+	// Default names are no longer reserved once the list is replaced.
+	sendEnvelope(t, conn, "set_username", SetUsernamePayload{Username: "admin"})
+	env, msg := readMessage(t, conn)
+	if env.Type != "system" || msg.Username != "admin" {
+		t.Errorf("expected rename to 'admin' to succeed, got %q %q", env.Type, msg.Username)
+	}
+}
+
+func TestHandlerAnonNamer(t *testing.T) {
+	hub := NewHub(nil)
+	sessions := NewSessionStore(30 * time.Second)
+	messages := message.NewStore(200)
+	hub.SetMessageStore(messages)
+	hub.SetSessionStore(sessions)
+	handler := NewHandler(hub, nil, sessions, messages)
+	ts := httptest.NewServer(handler)
+	defer ts.Close()
+
+	tests := []struct {
+		name  string
+		namer func(userID string) string
+		want  func(userID string) string
+	}{
+		{
+			name:  "custom",
+			namer: func(userID string) string { return "Guest-" + userID[:4] },
+			want:  func(userID string) string { return "Guest-" + userID[:4] },
+		},
+		{
+			name:  "reserved falls back",
+			namer: func(string) string { return "Admin" },
+			want:  func(userID string) string { return "anon-" + userID[:6] },
+		},
+		{
+			name:  "too long falls back",
+			namer: func(string) string { return strings.Repeat("x", maxUsernameLength+1) },
+			want:  func(userID string) string { return "anon-" + userID[:6] },
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler.SetAnonNamer(tt.namer)
+			conn, sp := dialJoinAndReadSession(t, ts.URL, "room1", "", "")
+			defer conn.Close(websocket.StatusNormalClosure, "")
+			if want := tt.want(sp.UserID); sp.Username != want {
+				t.Errorf("expected username %q, got %q", want, sp.Username)
+			}
+		})
+	}
+}
+
+func TestHandlerSetUsernameRateLimited(t *testing.T) {
+	hub := NewHub(nil)
+	sessions := NewSessionStore(30 * time.Second)
+	messages := message.NewStore(200)
+	hub.SetMessageStore(messages)
+	hub.SetSessionStore(sessions)
+	handler := NewHandler(hub, nil, sessions, messages)
+	handler.SetRenameLimiter(ratelimit.NewIPLimiter(3, 200*time.Millisecond))
+	ts := httptest.NewServer(handler)
+	defer ts.Close()
+
+	conn := dialAndJoin(t, ts.URL, "room1", "alice")
+	defer conn.Close(websocket.StatusNormalClosure, "")
+	waitForClients(t, hub, "room1", 1)
+	drainSystemMessages(t, conn, 1) // join
+
+	for i := 1; i <= 3; i++ {
+		sendEnvelope(t, conn, "set_username", SetUsernamePayload{Username: fmt.Sprintf("alice%d", i)})
+		env, _ := readMessage(t, conn)
+		if env.Type != "system" {
+			t.Fatalf("rename %d: expected 'system', got %q", i, env.Type)
+		}
+	}
+
+	// The 4th rename within the window is rejected.
+	sendEnvelope(t, conn, "set_username", SetUsernamePayload{Username: "alice4"})
+	env, _ := readMessage(t, conn)
+	if env.Type != "error" {
+		t.Fatalf("expected 'error' for 4th rename, got %q", env.Type)
+	}
+	var ep ErrorPayload
+	json.Unmarshal(env.Payload, &ep)
+	if !strings.Contains(ep.Message, "try again later") {
+		t.Errorf("expected cooldown info in error, got %q", ep.Message)
+	}
+	if !strings.Contains(ep.Message, "max 3 changes") {
+		t.Errorf("expected the configured limit in error, got %q", ep.Message)
+	}
+
+	// Chat is unaffected by the rename limiter.
+	sendEnvelope(t, conn, "chat", ChatPayload{Content: "still here"})
+	if env, _ := readMessage(t, conn); env.Type != "chat" {
+		t.Errorf("expected chat to succeed, got %q", env.Type)
+	}
+
+	time.Sleep(250 * time.Millisecond)
+
+	sendEnvelope(t, conn, "set_username", SetUsernamePayload{Username: "alice4"})
+	env, msg := readMessage(t, conn)
+	if env.Type != "system" || msg.Username != "alice4" {
+		t.Errorf("expected rename allowed after window, got %q %q", env.Type, msg.Username)
+	}
+}
+
+func TestHandlerRenameBroadcastLimit(t *testing.T) {
+	hub := NewHub(nil)
+	sessions := NewSessionStore(30 * time.Second)
+	messages := message.NewStore(200)
+	hub.SetMessageStore(messages)
+	hub.SetSessionStore(sessions)
+	handler := NewHandler(hub, nil, sessions, messages)
+	handler.SetRenameBroadcastLimit(1, time.Minute)
+	ts := httptest.NewServer(handler)
+	defer ts.Close()
+
+	alice := dialAndJoin(t, ts.URL, "room1", "alice")
+	defer alice.Close(websocket.StatusNormalClosure, "")
+	waitForClients(t, hub, "room1", 1)
+	drainSystemMessages(t, alice, 1) // "alice joined"
+	bob := dialAndJoin(t, ts.URL, "room1", "bob")
+	defer bob.Close(websocket.StatusNormalClosure, "")
+	waitForClients(t, hub, "room1", 2)
+	drainSystemMessages(t, alice, 1) // "bob joined"
+	drainSystemMessages(t, bob, 1)
+
+	// Under the limit a rename is announced.
+	sendEnvelope(t, alice, "set_username", SetUsernamePayload{Username: "alicia"})
+	if env, msg := readMessage(t, bob); env.Type != "system" || msg.Content != "alice is now known as alicia" {
+		t.Fatalf("expected the rename to be announced, got %q %q", env.Type, msg.Content)
+	}
+	drainSystemMessages(t, alice, 1)
+
+	// Over it the rename only shows in presence.
+	sendEnvelope(t, bob, "set_username", SetUsernamePayload{Username: "robert"})
+	env, _ := readMessage(t, alice)
+	if env.Type != "presence" {
+		t.Fatalf("expected a presence update, got %q", env.Type)
+	}
+	var p PresencePayload
+	if err := json.Unmarshal(env.Payload, &p); err != nil {
+		t.Fatalf("unmarshal presence: %v", err)
+	}
+	var names []string
+	for _, u := range p.Users {
+		names = append(names, u.Username)
+	}
+	if !slices.Contains(names, "robert") {
+		t.Errorf("expected robert in presence, got %v", names)
+	}
+
+	var renames int
+	for _, m := range messages.Recent("room1", 200) {
+		if m.Action == message.ActionSetUsername {
+			renames++
+		}
+	}
+	if renames != 1 {
+		t.Errorf("expected one stored rename message, got %d", renames)
+	}
+
+	// A rename on resume counts against the same cap.
+	carol, sp := dialJoinAndReadSession(t, ts.URL, "room1", "carol", "")
+	waitForClients(t, hub, "room1", 3)
+	carol.Close(websocket.StatusNormalClosure, "")
+	waitForClients(t, hub, "room1", 2)
+	carol, _ = dialJoinAndReadSession(t, ts.URL, "room1", "caroline", sp.SessionID)
+	defer carol.Close(websocket.StatusNormalClosure, "")
+	readBackfill(t, carol)
+	readJoined(t, carol)
+	if env, _ := readMessage(t, carol); env.Type != "presence" {
+		t.Fatalf("expected a presence update for the resume rename, got %q", env.Type)
+	}
+	for _, m := range messages.Recent("room1", 200) {
+		if m.Action == message.ActionSetUsername && m.Username == "caroline" {
+			t.Errorf("expected no rename message past the cap, got %q", m.Content)
+		}
+	}
+}
+
+func TestHandlerChatClientMsgIDDedupe(t *testing.T) {
+	ts, hub, _ := newHandlerTestServer(t, nil)
+	defer ts.Close()
+
+	conn1 := dialAndJoin(t, ts.URL, "room1", "alice")
+	defer conn1.Close(websocket.StatusNormalClosure, "")
+	waitForClients(t, hub, "room1", 1)
+	conn2 := dialAndJoin(t, ts.URL, "room1", "bob")
+	defer conn2.Close(websocket.StatusNormalClosure, "")
+	waitForClients(t, hub, "room1", 2)
+	drainSystemMessages(t, conn1, 2) // "alice joined" + "bob joined"
+	drainSystemMessages(t, conn2, 1) // "bob joined"
+
+	sendEnvelope(t, conn1, "chat", ChatPayload{Content: "hello", ClientMsgID: "c-1"})
+	sendEnvelope(t, conn1, "chat", ChatPayload{Content: "hello", ClientMsgID: "c-1"})
+
+	// The sender sees the same server message twice, each followed by an ack.
+	_, first := readMessage(t, conn1)
+	ack1, _ := readMessage(t, conn1)
+	_, second := readMessage(t, conn1)
+	ack2, _ := readMessage(t, conn1)
+	if first.ID == "" || first.ID != second.ID {
+		t.Errorf("expected resend to echo server message %q, got %q", first.ID, second.ID)
+	}
+	for _, env := range []Envelope{ack1, ack2} {
+		var ack AckPayload
+		json.Unmarshal(env.Payload, &ack)
+		if env.Type != "ack" || ack.MessageID != first.ID {
+			t.Errorf("expected ack for %q, got %q %+v", first.ID, env.Type, ack)
+		}
+	}
+
+	// Bob receives it once; the next message he sees is the follow-up.
+	sendEnvelope(t, conn1, "chat", ChatPayload{Content: "next"})
+	_, msg := readMessage(t, conn2)
+	if msg.ID != first.ID {
+		t.Errorf("expected bob to receive %q, got %q", first.ID, msg.ID)
+	}
+	_, msg = readMessage(t, conn2)
+	if msg.Content != "next" {
+		t.Errorf("expected no duplicate broadcast, got %q", msg.Content)
+	}
+
+	if n := hub.messages.Count("room1"); n != 4 { // 2 joins + 2 chats
+		t.Errorf("expected 4 stored messages, got %d", n)
+	}
+}
+
+func TestHandlerSessionTracksLastSeq(t *testing.T) {
+	ts, hub, sessions := newHandlerTestServer(t, nil)
+	defer ts.Close()
+
+	conn, sp := dialJoinAndReadSession(t, ts.URL, "room1", "alice", "")
+	defer conn.Close(websocket.StatusNormalClosure, "")
+	drainSystemMessages(t, conn, 1) // history
+	readJoined(t, conn)
+	waitForClients(t, hub, "room1", 1)
+
+	_, join := readMessage(t, conn)
+	sendEnvelope(t, conn, "chat", ChatPayload{Content: "one"})
+	_, chat := readMessage(t, conn)
+	if join.Seq != 1 || chat.Seq != 2 {
+		t.Errorf("expected seqs 1 and 2, got %d and %d", join.Seq, chat.Seq)
+	}
+	// The session pointer is advanced right after the send is queued.
+	deadline := time.Now().Add(2 * time.Second)
+	for sessions.Get(sp.SessionID).LastSeq != chat.Seq && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if sess := sessions.Get(sp.SessionID); sess.LastSeq != chat.Seq {
+		t.Errorf("expected session LastSeq %d, got %d", chat.Seq, sess.LastSeq)
+	}
+}
+
+func TestHandlerChatAck(t *testing.T) {
+	ts, hub, _ := newHandlerTestServer(t, nil)
+	defer ts.Close()
+
+	conn := dialAndJoin(t, ts.URL, "room1", "alice")
+	defer conn.Close(websocket.StatusNormalClosure, "")
+	waitForClients(t, hub, "room1", 1)
+	drainSystemMessages(t, conn, 1) // join
+
+	sendEnvelope(t, conn, "chat", ChatPayload{Content: "hello", ClientMsgID: "pending-1"})
+	_, msg := readMessage(t, conn)
+	env, _ := readMessage(t, conn)
+	if env.Type != "ack" {
+		t.Fatalf("expected 'ack' after broadcast, got %q", env.Type)
+	}
+	var ack AckPayload
+	json.Unmarshal(env.Payload, &ack)
+	if ack.ClientMsgID != "pending-1" || ack.MessageID != msg.ID || ack.Seq != msg.Seq {
+		t.Errorf("ack %+v does not match message id=%q seq=%d", ack, msg.ID, msg.Seq)
+	}
+
+	// Without a client message ID no ack is sent.
+	sendEnvelope(t, conn, "chat", ChatPayload{Content: "plain"})
+	sendEnvelope(t, conn, "chat", ChatPayload{Content: "marker"})
+	readMessage(t, conn)
+	if env, msg := readMessage(t, conn); env.Type != "chat" || msg.Content != "marker" {
+		t.Errorf("expected no ack without client_msg_id, got %q %q", env.Type, msg.Content)
+	}
+}
+
+func TestHandlerChatErrorEchoesClientMsgID(t *testing.T) {
+	ts, hub, _ := newHandlerTestServer(t, nil)
+	defer ts.Close()
+
+	conn := dialAndJoin(t, ts.URL, "room1", "alice")
+	defer conn.Close(websocket.StatusNormalClosure, "")
+	waitForClients(t, hub, "room1", 1)
+	drainSystemMessages(t, conn, 1) // join
+
+	sendEnvelope(t, conn, "chat", ChatPayload{Content: strings.Repeat("x", maxMessageLength+1), ClientMsgID: "too-long"})
+	env, _ := readMessage(t, conn)
+	var ep ErrorPayload
+	json.Unmarshal(env.Payload, &ep)
+	if env.Type != "error" || ep.ClientMsgID != "too-long" {
+		t.Errorf("expected error echoing 'too-long', got %q %+v", env.Type, ep)
+	}
+
+	hub.Mute("room1", hub.RoomUsers("room1")[0].UserID, 0)
+	sendEnvelope(t, conn, "chat", ChatPayload{Content: "hi", ClientMsgID: "muted"})
+	env, _ = readMessage(t, conn)
+	json.Unmarshal(env.Payload, &ep)
+	if env.Type != "error" || ep.ClientMsgID != "muted" {
+		t.Errorf("expected error echoing 'muted', got %q %+v", env.Type, ep)
+	}
+}
+
+func TestHandlerSearch(t *testing.T) {
+	hub := NewHub(nil)
+	sessions := NewSessionStore(30 * time.Second)
+	messages := message.NewStore(200)
+	hub.SetMessageStore(messages)
+	hub.SetSessionStore(sessions)
+	handler := NewHandler(hub, nil, sessions, messages)
+	handler.SetSearchLimiter(ratelimit.NewIPLimiter(2, time.Minute))
+	ts := httptest.NewServer(handler)
+	defer ts.Close()
+
+	conn := dialAndJoin(t, ts.URL, "room1", "alice")
+	defer conn.Close(websocket.StatusNormalClosure, "")
+	waitForClients(t, hub, "room1", 1)
+	drainSystemMessages(t, conn, 1) // join
+
+	for _, content := range []string{"see http://link.example", "nothing here", "another LINK"} {
+		sendEnvelope(t, conn, "chat", ChatPayload{Content: content})
+		readMessage(t, conn)
+	}
+
+	sendEnvelope(t, conn, "search", SearchPayload{Query: "link"})
+	env, _ := readMessage(t, conn)
+	if env.Type != "search_result" {
+		t.Fatalf("expected 'search_result', got %q", env.Type)
+	}
+	var res SearchResultPayload
+	json.Unmarshal(env.Payload, &res)
+	if len(res.Messages) != 2 {
+		t.Fatalf("expected 2 results, got %d", len(res.Messages))
+	}
+	if res.Messages[0].Content != "another LINK" {
+		t.Errorf("expected most recent match first, got %q", res.Messages[0].Content)
+	}
+
+	// System messages ("alice joined") only match when requested.
+	sendEnvelope(t, conn, "search", SearchPayload{Query: "joined", IncludeSystem: true})
+	env, _ = readMessage(t, conn)
+	json.Unmarshal(env.Payload, &res)
+	if len(res.Messages) != 1 || res.Messages[0].Type != message.TypeSystem {
+		t.Errorf("expected the join system message, got %+v", res.Messages)
+	}
+
+	// The third search within the window is rate limited.
+	sendEnvelope(t, conn, "search", SearchPayload{Query: "joined"})
+	if env, _ := readMessage(t, conn); env.Type != "error" {
+		t.Errorf("expected rate limit 'error', got %q", env.Type)
+	}
+}
+
+func TestHandlerContentFilter(t *testing.T) {
+	hub := NewHub(nil)
+	sessions := NewSessionStore(30 * time.Second)
+	messages := message.NewStore(200)
+	hub.SetMessageStore(messages)
+	hub.SetSessionStore(sessions)
+	handler := NewHandler(hub, nil, sessions, messages)
+	handler.SetContentFilter(func(content string) (string, bool) {
+		if strings.Contains(content, "forbidden") {
+			return "", true
+		}
+		return strings.ReplaceAll(content, "darn", "****"), false
+	})
+	ts := httptest.NewServer(handler)
+	defer ts.Close()
+
+	conn := dialAndJoin(t, ts.URL, "room1", "alice")
+	defer conn.Close(websocket.StatusNormalClosure, "")
+	waitForClients(t, hub, "room1", 1)
+	drainSystemMessages(t, conn, 1) // join
+
+	// Blocked.
+	sendEnvelope(t, conn, "chat", ChatPayload{Content: "this is forbidden"})
+	if env, _ := readMessage(t, conn); env.Type != "error" {
+		t.Errorf("expected 'error' for blocked content, got %q", env.Type)
+	}
+
+	// Masked.
+	sendEnvelope(t, conn, "chat", ChatPayload{Content: "  oh darn it  "})
+	if _, msg := readMessage(t, conn); msg.Content != "oh **** it" {
+		t.Errorf("expected masked content, got %q", msg.Content)
+	}
+
+	// Passthrough.
+	sendEnvelope(t, conn, "chat", ChatPayload{Content: "all good"})
+	if _, msg := readMessage(t, conn); msg.Content != "all good" {
+		t.Errorf("expected passthrough content, got %q", msg.Content)
+	}
+
+	if n := messages.Count("room1"); n != 3 { // join + 2 chats
+		t.Errorf("expected blocked message not to be stored, got %d messages", n)
+	}
+}
+
+// knockAndReadPending dials, sends a knock for roomID, and returns the
+// connection along with the request ID from the knock_pending reply.
+func knockAndReadPending(t *testing.T, url, roomID, username string) (*websocket.Conn, string) {
+	t.Helper()
+	conn := dialWS(t, url)
+	sendEnvelope(t, conn, "knock", JoinPayload{RoomID: roomID, Username: username})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, data, err := conn.Read(ctx)
+	if err != nil {
+		t.Fatalf("read knock_pending error: %v", err)
+	}
+	var env Envelope
+	json.Unmarshal(data, &env)
+	if env.Type != "knock_pending" {
+		t.Fatalf("expected knock_pending, got %s", env.Type)
+	}
+	var p KnockPendingPayload
+	json.Unmarshal(env.Payload, &p)
+	return conn, p.RequestID
+}
+
+// readKnock reads the next envelope on the host connection and expects a knock.
+func readKnock(t *testing.T, conn *websocket.Conn) KnockPayload {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, data, err := conn.Read(ctx)
+	if err != nil {
+		t.Fatalf("read knock error: %v", err)
+	}
+	var env Envelope
+	json.Unmarshal(data, &env)
+	if env.Type != "knock" {
+		t.Fatalf("expected knock, got %s", env.Type)
+	}
+	var p KnockPayload
+	json.Unmarshal(env.Payload, &p)
+	return p
+}
+
+func TestHandlerKnockAdmit(t *testing.T) {
+	ts, hub, _ := newHandlerTestServer(t, nil)
+	defer ts.Close()
+	hub.SetKnockRequired("room1", true)
+
+	host := dialAndJoin(t, ts.URL, "room1", "alice")
+	defer host.Close(websocket.StatusNormalClosure, "")
+	waitForClients(t, hub, "room1", 1)
+	drainSystemMessages(t, host, 1)
+
+	guest, requestID := knockAndReadPending(t, ts.URL, "room1", "bob")
+	defer guest.Close(websocket.StatusNormalClosure, "")
+
+	knock := readKnock(t, host)
+	if knock.RequestID != requestID {
+		t.Errorf("expected request ID %q, got %q", requestID, knock.RequestID)
+	}
+	if knock.Username != "bob" {
+		t.Errorf("expected username bob, got %q", knock.Username)
+	}
+
+	sendEnvelope(t, host, "admit", KnockResponsePayload{RequestID: requestID})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, data, err := guest.Read(ctx)
+	if err != nil {
+		t.Fatalf("read session error: %v", err)
+	}
+	var env Envelope
+	json.Unmarshal(data, &env)
+	if env.Type != "session" {
+		t.Fatalf("expected session after admit, got %s", env.Type)
+	}
+	waitForClients(t, hub, "room1", 2)
+	if n := hub.PendingKnocks(); n != 0 {
+		t.Errorf("expected no pending knocks, got %d", n)
+	}
+}
+
+func TestHandlerKnockDeny(t *testing.T) {
+	ts, hub, _ := newHandlerTestServer(t, nil)
+	defer ts.Close()
+	hub.SetKnockRequired("room1", true)
+
+	host := dialAndJoin(t, ts.URL, "room1", "alice")
+	defer host.Close(websocket.StatusNormalClosure, "")
+	waitForClients(t, hub, "room1", 1)
+	drainSystemMessages(t, host, 1)
+
+	guest, requestID := knockAndReadPending(t, ts.URL, "room1", "bob")
+	defer guest.Close(websocket.StatusNormalClosure, "")
+	readKnock(t, host)
+
+	sendEnvelope(t, host, "deny", KnockResponsePayload{RequestID: requestID})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, _, err := guest.Read(ctx)
+	if err == nil {
+		t.Fatal("expected connection to be closed after deny")
+	}
+	if status := websocket.CloseStatus(err); status != websocket.StatusPolicyViolation {
+		t.Errorf("expected policy violation close, got %v", err)
+	}
+	if n := hub.ClientCount("room1"); n != 1 {
+		t.Errorf("expected only the host in the room, got %d", n)
+	}
+}
+
+func TestHandlerKnockTimeout(t *testing.T) {
+	hub := NewHub(nil)
+	sessions := NewSessionStore(30 * time.Second)
+	messages := message.NewStore(200)
+	hub.SetMessageStore(messages)
+	hub.SetSessionStore(sessions)
+	handler := NewHandler(hub, nil, sessions, messages)
+	handler.SetKnockTimeout(100 * time.Millisecond)
+	ts := httptest.NewServer(handler)
+	defer ts.Close()
+	hub.SetKnockRequired("room1", true)
+
+	host := dialAndJoin(t, ts.URL, "room1", "alice")
+	defer host.Close(websocket.StatusNormalClosure, "")
+	waitForClients(t, hub, "room1", 1)
+	drainSystemMessages(t, host, 1)
+
+	guest, _ := knockAndReadPending(t, ts.URL, "room1", "bob")
+	defer guest.Close(websocket.StatusNormalClosure, "")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, _, err := guest.Read(ctx); err == nil {
+		t.Fatal("expected connection to be closed after knock timeout")
+	}
+	if n := hub.PendingKnocks(); n != 0 {
+		t.Errorf("expected timed-out knock to be removed, got %d pending", n)
+	}
+}
+
+func TestHandlerKnockRequiredRejectsJoin(t *testing.T) {
+	ts, hub, _ := newHandlerTestServer(t, nil)
+	defer ts.Close()
+	hub.SetKnockRequired("room1", true)
+
+	host := dialAndJoin(t, ts.URL, "room1", "alice")
+	defer host.Close(websocket.StatusNormalClosure, "")
+	waitForClients(t, hub, "room1", 1)
+	drainSystemMessages(t, host, 1)
+
+	conn := dialWS(t, ts.URL)
+	defer conn.Close(websocket.StatusNormalClosure, "")
+	sendEnvelope(t, conn, "join", JoinPayload{RoomID: "room1", Username: "bob"})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if _, _, err := conn.Read(ctx); err == nil {
+		t.Fatal("expected plain join to be rejected in a knock-only room")
+	}
+}
+
+func TestHandlerSetKnock(t *testing.T) {
+	ts, hub, _ := newHandlerTestServer(t, nil)
+	defer ts.Close()
+
+	host := dialAndJoin(t, ts.URL, "room1", "alice")
+	defer host.Close(websocket.StatusNormalClosure, "")
+	waitForClients(t, hub, "room1", 1)
+	drainSystemMessages(t, host, 1) // "alice joined"
+	guest := dialAndJoin(t, ts.URL, "room1", "bob")
+	defer guest.Close(websocket.StatusNormalClosure, "")
+	waitForClients(t, hub, "room1", 2)
+	drainSystemMessages(t, host, 1) // "bob joined"
+	drainSystemMessages(t, guest, 1)
+
+	sendEnvelope(t, guest, "set_knock", SetKnockPayload{Enabled: true})
+	if got := readError(t, guest); got != "only the room host can change who may join" {
+		t.Errorf("unexpected error %q", got)
+	}
+
+	sendEnvelope(t, host, "set_knock", SetKnockPayload{Enabled: true})
+	if _, msg := readMessage(t, guest); msg.Action != message.ActionKnock {
+		t.Fatalf("expected the change to be announced, got %+v", msg)
+	}
+	drainSystemMessages(t, host, 1)
+	if !hub.KnockRequired("room1") {
+		t.Fatal("expected the room to require knocking")
+	}
+
+	// A knock goes through the same name checks as a join.
+	for _, name := range []string{"ALICE", strings.Repeat("x", maxUsernameLength+1)} {
+		conn := dialWS(t, ts.URL)
+		sendEnvelope(t, conn, "knock", JoinPayload{RoomID: "room1", Username: name})
+		if stillOpen(conn) {
+			t.Errorf("expected a knock as %q to be refused", name)
+		}
+	}
+	if n := hub.PendingKnocks(); n != 0 {
+		t.Errorf("expected no knocks relayed, got %d", n)
+	}
+
+	conn, _ := knockAndReadPending(t, ts.URL, "room1", "admin")
+	defer conn.Close(websocket.StatusNormalClosure, "")
+	if knock := readKnock(t, host); !strings.HasPrefix(knock.Username, anonPrefix) {
+		t.Errorf("expected a reserved name to knock as anonymous, got %q", knock.Username)
+	}
+}
+
+func TestHandlerRoomEventHook(t *testing.T) {
+	ts, hub, _ := newHandlerTestServer(t, nil)
+	defer ts.Close()
+
+	events := make(chan RoomEvent, 16)
+	hub.SetRoomEventHook(func(roomID string, e RoomEvent) {
+		if roomID == "room1" {
+			events <- e
+		}
+	})
+	next := func() RoomEvent {
+		t.Helper()
+		select {
+		case e := <-events:
+			return e
+		case <-time.After(2 * time.Second):
+			t.Fatal("timed out waiting for room event")
+			return RoomEvent{}
+		}
+	}
+	expect := func(typ EventType, userID, username string) {
+		t.Helper()
+		e := next()
+		if e.Type != typ || e.UserID != userID || e.Username != username {
+			t.Errorf("expected %s for %s/%s, got %+v", typ, userID, username, e)
+		}
+		if e.Time.IsZero() {
+			t.Error("expected event time to be set")
+		}
+	}
+
+	conn1, sp1 := dialJoinAndReadSession(t, ts.URL, "room1", "alice", "")
+	defer conn1.Close(websocket.StatusNormalClosure, "")
+	drainSystemMessages(t, conn1, 1) // history
+	waitForClients(t, hub, "room1", 1)
+	expect(EventJoin, sp1.UserID, "alice")
+
+	conn2, sp2 := dialJoinAndReadSession(t, ts.URL, "room1", "bob", "")
+	defer conn2.Close(websocket.StatusNormalClosure, "")
+	waitForClients(t, hub, "room1", 2)
+	expect(EventJoin, sp2.UserID, "bob")
+
+	sendEnvelope(t, conn1, "kick", KickPayload{UserID: sp2.UserID})
+	waitForClients(t, hub, "room1", 1)
+	expect(EventKick, sp2.UserID, "bob")
+
+	conn3, sp3 := dialJoinAndReadSession(t, ts.URL, "room1", "carol", "")
+	defer conn3.Close(websocket.StatusNormalClosure, "")
+	waitForClients(t, hub, "room1", 2)
+	expect(EventJoin, sp3.UserID, "carol")
+
+	// Closing the room reports everyone it removed.
+	hub.DisconnectRoom("room1")
+	left := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		if e := next(); e.Type == EventLeave {
+			left[e.UserID] = true
+		}
+	}
+	if !left[sp1.UserID] || !left[sp3.UserID] {
+		t.Errorf("expected leave events for alice and carol, got %v", left)
+	}
+	select {
+	case e := <-events:
+		t.Errorf("unexpected extra event %+v", e)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestHandlerKickEmitsEvent(t *testing.T) {
+	ts, hub, _ := newHandlerTestServer(t, nil)
+	defer ts.Close()
+
+	var mu sync.Mutex
+	var events []Event
+	hub.SetEventSink(func(e Event) {
+		mu.Lock()
+		events = append(events, e)
+		mu.Unlock()
+	})
+
+	conn1, sp1 := dialJoinAndReadSession(t, ts.URL, "room1", "alice", "")
+	defer conn1.Close(websocket.StatusNormalClosure, "")
+	drainSystemMessages(t, conn1, 1) // history
+	waitForClients(t, hub, "room1", 1)
+	drainSystemMessages(t, conn1, 1) // "alice joined"
+
+	conn2, sp2 := dialJoinAndReadSession(t, ts.URL, "room1", "bob", "")
+	defer conn2.Close(websocket.StatusNormalClosure, "")
+	drainSystemMessages(t, conn2, 1) // history
+	waitForClients(t, hub, "room1", 2)
+	drainSystemMessages(t, conn1, 1) // "bob joined"
+
+	sendEnvelope(t, conn1, "kick", KickPayload{UserID: sp2.UserID})
+	readMessage(t, conn1) // "bob was kicked"
+	waitForClients(t, hub, "room1", 1)
+
+	mu.Lock()
+	defer mu.Unlock()
+	var kicks []Event
+	for _, e := range events {
+		if e.Type == EventKick {
+			kicks = append(kicks, e)
+		}
+	}
+	if len(kicks) != 1 {
+		t.Fatalf("expected exactly 1 kick event, got %d", len(kicks))
+	}
+	e := kicks[0]
+	if e.RoomID != "room1" {
+		t.Errorf("expected room_id room1, got %q", e.RoomID)
+	}
+	if e.UserID != sp2.UserID || e.Username != "bob" {
+		t.Errorf("expected subject bob (%s), got %q (%s)", sp2.UserID, e.Username, e.UserID)
+	}
+	if e.ActorID != sp1.UserID {
+		t.Errorf("expected actor %s, got %q", sp1.UserID, e.ActorID)
+	}
+	if e.Time.IsZero() {
+		t.Error("expected event time to be set")
+	}
+}
+
+func TestSafeCloseReason(t *testing.T) {
+	if got := safeCloseReason("short"); got != "short" {
+		t.Errorf("expected short reason unchanged, got %q", got)
+	}
+	if got := safeCloseReason(strings.Repeat("a", 200)); len(got) != maxCloseReasonBytes {
+		t.Errorf("expected %d bytes, got %d", maxCloseReasonBytes, len(got))
+	}
+	// "é" is 2 bytes, so byte 123 falls mid-rune and must be dropped.
+	got := safeCloseReason(strings.Repeat("é", 100))
+	if !utf8.ValidString(got) {
+		t.Errorf("expected valid UTF-8, got %q", got)
+	}
+	if len(got) != 122 {
+		t.Errorf("expected 122 bytes, got %d", len(got))
+	}
+}
+
+func TestHandlerLongCloseReason(t *testing.T) {
+	reason := strings.Repeat("x", 200)
+	ts, _, _ := newHandlerTestServer(t, func(roomID string) string {
+		return reason
+	})
+	defer ts.Close()
+
+	conn := dialWS(t, ts.URL)
+	defer conn.Close(websocket.StatusNormalClosure, "")
+	sendEnvelope(t, conn, "join", JoinPayload{RoomID: "room1", Username: "alice"})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	_, _, err := conn.Read(ctx)
+	var ce websocket.CloseError
+	if !errors.As(err, &ce) {
+		t.Fatalf("expected a close frame, got %v", err)
+	}
+	if ce.Code != websocket.StatusPolicyViolation {
+		t.Errorf("expected policy violation, got %v", ce.Code)
+	}
+	if ce.Reason != reason[:maxCloseReasonBytes] {
+		t.Errorf("expected reason truncated to %d bytes, got %d", maxCloseReasonBytes, len(ce.Reason))
+	}
+}
+
+// readBackfill reads the next envelope and expects a backfill.
+func readBackfill(t *testing.T, conn *websocket.Conn) BackfillPayload {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, data, err := conn.Read(ctx)
+	if err != nil {
+		t.Fatalf("read backfill error: %v", err)
+	}
+	var env Envelope
+	json.Unmarshal(data, &env)
+	if env.Type != "backfill" {
+		t.Fatalf("expected backfill, got %s", env.Type)
+	}
+	var p BackfillPayload
+	json.Unmarshal(env.Payload, &p)
+	return p
+}
+
+func TestHandlerBackfillGapThreshold(t *testing.T) {
+	hub := NewHub(nil)
+	sessions := NewSessionStore(30 * time.Second)
+	messages := message.NewStore(2000)
+	hub.SetMessageStore(messages)
+	hub.SetSessionStore(sessions)
+	handler := NewHandler(hub, nil, sessions, messages)
+	handler.SetBackfillLimit(1500)
+	handler.SetBackfillGap(500, 50)
+	ts := httptest.NewServer(handler)
+	defer ts.Close()
+
+	// missWhileAway disconnects conn, broadcasts n messages and resumes.
+	missWhileAway := func(conn *websocket.Conn, sessionID string, n int) (*websocket.Conn, BackfillPayload) {
+		t.Helper()
+		conn.Close(websocket.StatusNormalClosure, "")
+		waitForClients(t, hub, "room1", 0)
+		for i := 0; i < n; i++ {
+			hub.Broadcast("room1", &message.Message{
+				ID:      fmt.Sprintf("m%d-%d", n, i),
+				RoomID:  "room1",
+				Content: fmt.Sprintf("missed-%d", i),
+				Type:    message.TypeChat,
+			})
+		}
+		conn, sp := dialJoinAndReadSession(t, ts.URL, "room1", "", sessionID)
+		if !sp.Resumed {
+			t.Fatal("expected session to be resumed")
+		}
+		conn.SetReadLimit(1 << 20) // the full replay is well over the default
+		return conn, readBackfill(t, conn)
+	}
+
+	conn, sp := dialJoinAndReadSession(t, ts.URL, "room1", "alice", "")
+	drainSystemMessages(t, conn, 3) // history, joined, "alice joined"
+
+	// A long absence gets only the newest few, flagged as a gap.
+	conn, bf := missWhileAway(conn, sp.SessionID, 1000)
+	if !bf.HasGap {
+		t.Error("expected has_gap after 1000 missed messages")
+	}
+	if len(bf.Messages) != 50 {
+		t.Fatalf("expected 50 messages, got %d", len(bf.Messages))
+	}
+	if last := bf.Messages[49].Content; last != "missed-999" {
+		t.Errorf("expected newest message last, got %q", last)
+	}
+	drainSystemMessages(t, conn, 2) // joined, "alice rejoined"
+
+	// Below the threshold the whole run is replayed.
+	conn, bf = missWhileAway(conn, sp.SessionID, 300)
+	defer conn.Close(websocket.StatusNormalClosure, "")
+	if bf.HasGap {
+		t.Error("expected no gap after 300 missed messages")
+	}
+	if len(bf.Messages) < 300 {
+		t.Errorf("expected at least 300 messages, got %d", len(bf.Messages))
+	}
+}
+
+func TestHandlerBackfillBoundaryOnOwnLeave(t *testing.T) {
+	ts, hub, sessions := newHandlerTestServer(t, nil)
+	defer ts.Close()
+
+	conn1, sp1 := dialJoinAndReadSession(t, ts.URL, "room1", "alice", "")
+	drainSystemMessages(t, conn1, 1) // history
+	readJoined(t, conn1)
+	waitForClients(t, hub, "room1", 1)
+	drainSystemMessages(t, conn1, 1) // "alice joined"
+
+	conn2 := dialAndJoin(t, ts.URL, "room1", "bob")
+	defer conn2.Close(websocket.StatusNormalClosure, "")
+	waitForClients(t, hub, "room1", 2)
+	drainSystemMessages(t, conn1, 1) // "bob joined"
+	drainSystemMessages(t, conn2, 1) // "bob joined"
+
+	// The last message alice receives before leaving.
+	sendEnvelope(t, conn2, "chat", ChatPayload{Content: "before"})
+	_, last := readMessage(t, conn1)
+	readMessage(t, conn2)
+	deadline := time.Now().Add(2 * time.Second)
+	for sessions.Get(sp1.SessionID).LastSeq != last.Seq && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	conn1.Close(websocket.StatusNormalClosure, "")
+	waitForClients(t, hub, "room1", 1)
+	_, left := readMessage(t, conn2)
+	if left.Action != message.ActionLeave {
+		t.Fatalf("expected leave message, got action %q", left.Action)
+	}
+
+	// Alice's own leave message must not advance her session pointer.
+	if sess := sessions.Get(sp1.SessionID); sess.LastMessageID != last.ID || sess.LastSeq != last.Seq {
+		t.Errorf("expected session pointer at %q (seq %d), got %q (seq %d)", last.ID, last.Seq, sess.LastMessageID, sess.LastSeq)
+	}
+
+	// Resuming backfills everything after the last delivered message.
+	conn3, _ := dialJoinAndReadSession(t, ts.URL, "room1", "", sp1.SessionID)
+	defer conn3.Close(websocket.StatusNormalClosure, "")
+	backfill := readBackfill(t, conn3)
+	readJoined(t, conn3)
+	if backfill.HasGap {
+		t.Error("expected no gap")
+	}
+	if len(backfill.Messages) != 1 || backfill.Messages[0].ID != left.ID {
+		t.Errorf("expected backfill to start at alice's leave message, got %+v", backfill.Messages)
+	}
+}
+
+func TestHandlerChatRateLimitPerRoom(t *testing.T) {
+	hub := NewHub(nil)
+	sessions := NewSessionStore(30 * time.Second)
+	messages := message.NewStore(200)
+	hub.SetMessageStore(messages)
+	hub.SetSessionStore(sessions)
+	handler := NewHandler(hub, nil, sessions, messages)
+	handler.SetChatLimiter(ratelimit.NewIPLimiter(4, 10*time.Second))
+	slow := ratelimit.NewIPLimiter(1, time.Minute)
+	handler.SetRoomChatLimiter(func(roomID string) *ratelimit.IPLimiter {
+		if roomID == "support" {
+			return slow
+		}
+		return nil
+	})
+	ts := httptest.NewServer(handler)
+	defer ts.Close()
+
+	// sendChats sends n chats and returns the number accepted and the last
+	// error message.
+	sendChats := func(conn *websocket.Conn, n int) (int, string) {
+		accepted, lastErr := 0, ""
+		for i := 0; i < n; i++ {
+			sendEnvelope(t, conn, "chat", ChatPayload{Content: fmt.Sprintf("msg-%d", i)})
+			env, _ := readMessage(t, conn)
+			switch env.Type {
+			case "chat":
+				accepted++
+			case "error":
+				var p ErrorPayload
+				json.Unmarshal(env.Payload, &p)
+				lastErr = p.Message
+			}
+		}
+		return accepted, lastErr
+	}
+
+	support := dialAndJoin(t, ts.URL, "support", "alice")
+	defer support.Close(websocket.StatusNormalClosure, "")
+	waitForClients(t, hub, "support", 1)
+	drainSystemMessages(t, support, 1) // "alice joined"
+
+	lobby := dialAndJoin(t, ts.URL, "lobby", "bob")
+	defer lobby.Close(websocket.StatusNormalClosure, "")
+	waitForClients(t, hub, "lobby", 1)
+	drainSystemMessages(t, lobby, 1) // "bob joined"
+
+	if n, msg := sendChats(support, 3); n != 1 || msg != "rate limit exceeded: max 1 messages per 1 minute" {
+		t.Errorf("support: expected 1 accepted with room limit error, got %d, %q", n, msg)
+	}
+	if n, msg := sendChats(lobby, 5); n != 4 || msg != "rate limit exceeded: max 4 messages per 10 seconds" {
+		t.Errorf("lobby: expected 4 accepted with global limit error, got %d, %q", n, msg)
+	}
+}
+
+// testPNG is the 8-byte PNG signature followed by padding, enough for
+// content sniffing to report image/png.
+var testPNG = append([]byte("\x89PNG\r\n\x1a\n"), make([]byte, 40)...)
+
+func sendBinary(t *testing.T, conn *websocket.Conn, data []byte) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := conn.Write(ctx, websocket.MessageBinary, data); err != nil {
+		t.Fatalf("write binary error: %v", err)
+	}
+}
+
+// readError reads the next envelope and expects an error, returning its message.
+func readError(t *testing.T, conn *websocket.Conn) string {
+	t.Helper()
+	env, _ := readMessage(t, conn)
+	if env.Type != "error" {
+		t.Fatalf("expected error, got %s", env.Type)
+	}
+	var p ErrorPayload
+	json.Unmarshal(env.Payload, &p)
+	return p.Message
+}
+
+func TestHandlerAttachmentUpload(t *testing.T) {
+	ts, hub, _ := newHandlerTestServer(t, nil)
+	defer ts.Close()
+
+	conn1 := dialAndJoin(t, ts.URL, "room1", "alice")
+	defer conn1.Close(websocket.StatusNormalClosure, "")
+	waitForClients(t, hub, "room1", 1)
+	drainSystemMessages(t, conn1, 1) // "alice joined"
+
+	conn2 := dialAndJoin(t, ts.URL, "room1", "bob")
+	defer conn2.Close(websocket.StatusNormalClosure, "")
+	waitForClients(t, hub, "room1", 2)
+	drainSystemMessages(t, conn1, 1) // "bob joined"
+	drainSystemMessages(t, conn2, 1) // "bob joined"
+
+	sendEnvelope(t, conn1, "attach_begin", AttachBeginPayload{Name: "cat.png", MIME: "image/png", Size: len(testPNG)})
+	// Send the bytes in two chunks.
+	sendBinary(t, conn1, testPNG[:20])
+	sendBinary(t, conn1, testPNG[20:])
+
+	env, msg := readMessage(t, conn2)
+	if env.Type != string(message.TypeAttachment) {
+		t.Fatalf("expected attachment envelope, got %s", env.Type)
+	}
+	if msg.Attachment == nil {
+		t.Fatal("expected attachment metadata")
+	}
+	a := msg.Attachment
+	if a.ID == "" || a.Name != "cat.png" || a.MIME != "image/png" || a.Size != len(testPNG) {
+		t.Errorf("unexpected attachment metadata: %+v", a)
+	}
+	if msg.Username != "alice" {
+		t.Errorf("expected sender alice, got %q", msg.Username)
+	}
+
+	data, mime, ok := hub.Attachment(a.ID)
+	if !ok || mime != "image/png" || !bytes.Equal(data, testPNG) {
+		t.Errorf("expected stored attachment bytes, got ok=%v mime=%q len=%d", ok, mime, len(data))
+	}
+}
+
+func TestHandlerAttachmentRejected(t *testing.T) {
+	ts, hub, _ := newHandlerTestServer(t, nil)
+	defer ts.Close()
+
+	conn := dialAndJoin(t, ts.URL, "room1", "alice")
+	defer conn.Close(websocket.StatusNormalClosure, "")
+	waitForClients(t, hub, "room1", 1)
+	drainSystemMessages(t, conn, 1) // "alice joined"
+
+	// Binary frame with no preceding attach_begin.
+	sendBinary(t, conn, testPNG)
+	if msg := readError(t, conn); msg != "binary frame without attach_begin" {
+		t.Errorf("unexpected error: %q", msg)
+	}
+
+	// Announced size over the cap.
+	sendEnvelope(t, conn, "attach_begin", AttachBeginPayload{MIME: "image/png", Size: maxAttachmentSize + 1})
+	if msg := readError(t, conn); !strings.Contains(msg, "512 KiB") {
+		t.Errorf("unexpected error: %q", msg)
+	}
+
+	// Unsupported type.
+	sendEnvelope(t, conn, "attach_begin", AttachBeginPayload{MIME: "text/html", Size: 10})
+	if msg := readError(t, conn); msg != "unsupported attachment type" {
+		t.Errorf("unexpected error: %q", msg)
+	}
+
+	// More bytes than announced.
+	sendEnvelope(t, conn, "attach_begin", AttachBeginPayload{MIME: "image/png", Size: 10})
+	sendBinary(t, conn, testPNG)
+	if msg := readError(t, conn); msg != "attachment exceeds announced size" {
+		t.Errorf("unexpected error: %q", msg)
+	}
+
+	// The failed upload is discarded, so further binary frames are orphaned.
+	sendBinary(t, conn, testPNG[:5])
+	if msg := readError(t, conn); msg != "binary frame without attach_begin" {
+		t.Errorf("unexpected error: %q", msg)
+	}
+
+	// Content that doesn't match the declared type.
+	fake := []byte("<html>not an image</html>")
+	sendEnvelope(t, conn, "attach_begin", AttachBeginPayload{MIME: "image/png", Size: len(fake)})
+	sendBinary(t, conn, fake)
+	if msg := readError(t, conn); msg != "attachment content does not match its type" {
+		t.Errorf("unexpected error: %q", msg)
+	}
+}
+
+func TestHandlerLinkPreview(t *testing.T) {
+	page := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(50 * time.Millisecond) // a slow page must not delay the chat
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte(`<meta property="og:title" content="Example Page"><meta property="og:description" content="Hello">`))
+	}))
+	defer page.Close()
+
+	hub := NewHub(nil)
+	sessions := NewSessionStore(30 * time.Second)
+	messages := message.NewStore(200)
+	hub.SetMessageStore(messages)
+	hub.SetSessionStore(sessions)
+	handler := NewHandler(hub, nil, sessions, messages)
+	u := NewUnfurler(nil, nil)
+	u.allowPrivate = true
+	handler.SetUnfurler(u)
+	ts := httptest.NewServer(handler)
+	defer ts.Close()
+
+	conn := dialAndJoin(t, ts.URL, "room1", "alice")
+	defer conn.Close(websocket.StatusNormalClosure, "")
+	waitForClients(t, hub, "room1", 1)
+	drainSystemMessages(t, conn, 1) // "alice joined"
+
+	link := page.URL + "/article"
+	sendEnvelope(t, conn, "chat", ChatPayload{Content: "look at " + link})
+
+	env, chat := readMessage(t, conn)
+	if env.Type != "chat" {
+		t.Fatalf("expected the chat first, got %s", env.Type)
+	}
+
+	env, _ = readMessage(t, conn)
+	if env.Type != string(message.TypeLinkPreview) {
+		t.Fatalf("expected link_preview, got %s", env.Type)
+	}
+	var p LinkPreviewPayload
+	json.Unmarshal(env.Payload, &p)
+	if p.MessageID != chat.ID {
+		t.Errorf("expected preview for message %s, got %s", chat.ID, p.MessageID)
+	}
+	if p.URL != link || p.Title != "Example Page" || p.Description != "Hello" {
+		t.Errorf("unexpected preview: %+v", p)
+	}
+}
+
+func TestHandlerMessageFormat(t *testing.T) {
+	var hits atomic.Int32
+	page := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte(`<meta property="og:title" content="Example Page">`))
+	}))
+	defer page.Close()
+
+	hub := NewHub(nil)
+	sessions := NewSessionStore(30 * time.Second)
+	messages := message.NewStore(200)
+	hub.SetMessageStore(messages)
+	hub.SetSessionStore(sessions)
+	handler := NewHandler(hub, nil, sessions, messages)
+	u := NewUnfurler(nil, nil)
+	u.allowPrivate = true
+	handler.SetUnfurler(u)
+	ts := httptest.NewServer(handler)
+	defer ts.Close()
+
+	conn := dialAndJoin(t, ts.URL, "room1", "alice")
+	defer conn.Close(websocket.StatusNormalClosure, "")
+	waitForClients(t, hub, "room1", 1)
+	drainSystemMessages(t, conn, 1) // "alice joined"
+
+	sendEnvelope(t, conn, "chat", ChatPayload{Content: "hi", Format: "bold"})
+	env, _ := readMessage(t, conn)
+	var ep ErrorPayload
+	json.Unmarshal(env.Payload, &ep)
+	if env.Type != "error" || ep.Code != ErrorCodeInvalidPayload {
+		t.Fatalf("expected invalid_payload error for unknown format, got %q %q", env.Type, ep.Code)
+	}
+
+	// A link inside a code block is not unfurled; the same link in plain
+	// text is.
+	link := page.URL + "/article"
+	sendEnvelope(t, conn, "chat", ChatPayload{Content: "curl " + link, Format: message.FormatCode})
+	env, code := readMessage(t, conn)
+	if env.Type != "chat" || code.Format != message.FormatCode {
+		t.Fatalf("expected code chat, got %q %q", env.Type, code.Format)
+	}
+	sendEnvelope(t, conn, "chat", ChatPayload{Content: "see " + link})
+	_, plain := readMessage(t, conn)
+	env, _ = readMessage(t, conn)
+	var p LinkPreviewPayload
+	json.Unmarshal(env.Payload, &p)
+	if env.Type != string(message.TypeLinkPreview) || p.MessageID != plain.ID {
+		t.Fatalf("expected preview for the plain message, got %s for %s", env.Type, p.MessageID)
+	}
+	if n := hits.Load(); n != 1 {
+		t.Errorf("expected the page fetched once, got %d", n)
+	}
+
+	// The format is kept for history.
+	recent := messages.Recent("room1", 2)
+	if recent[0].ID != code.ID || recent[0].Format != message.FormatCode {
+		t.Errorf("expected stored code message, got %+v", recent[0])
+	}
+}
+
+func TestHandlerEditReflectedInBackfill(t *testing.T) {
+	ts, hub, _ := newHandlerTestServer(t, nil)
+	defer ts.Close()
+
+	alice := dialAndJoin(t, ts.URL, "room1", "alice")
+	defer alice.Close(websocket.StatusNormalClosure, "")
+	waitForClients(t, hub, "room1", 1)
+	drainSystemMessages(t, alice, 1) // "alice joined"
+
+	bob, bobSession := dialJoinAndReadSession(t, ts.URL, "room1", "bob", "")
+	drainSystemMessages(t, bob, 2) // history, "bob joined"
+	drainSystemMessages(t, alice, 1)
+
+	// Bob drops; Alice posts a message and edits it while he is away.
+	bob.Close(websocket.StatusNormalClosure, "")
+	waitForClients(t, hub, "room1", 1)
+	drainSystemMessages(t, alice, 1) // "bob left"
+
+	sendEnvelope(t, alice, "chat", ChatPayload{Content: "helo"})
+	_, original := readMessage(t, alice)
+
+	sendEnvelope(t, alice, "edit", EditPayload{MessageID: original.ID, Content: "hello"})
+	env, edited := readMessage(t, alice)
+	if env.Type != "edit" {
+		t.Fatalf("expected edit envelope, got %s", env.Type)
+	}
+	if edited.ID != original.ID || edited.Content != "hello" || edited.EditedAt == nil {
+		t.Fatalf("unexpected edited message: %+v", edited)
+	}
+	if edited.Seq != original.Seq {
+		t.Errorf("expected edit to keep seq %d, got %d", original.Seq, edited.Seq)
+	}
+
+	bob2, sp := dialJoinAndReadSession(t, ts.URL, "room1", "", bobSession.SessionID)
+	defer bob2.Close(websocket.StatusNormalClosure, "")
+	if !sp.Resumed {
+		t.Fatal("expected session to be resumed")
+	}
+
+	bf := readBackfill(t, bob2)
+	if len(bf.Messages) != 2 {
+		t.Fatalf("expected 2 backfill messages, got %d", len(bf.Messages))
+	}
+	m := bf.Messages[1]
+	if m.ID != original.ID || m.Content != "hello" {
+		t.Errorf("expected edited content in backfill, got %q", m.Content)
+	}
+	if m.EditedAt == nil {
+		t.Error("expected edited_at to be set in backfill")
+	}
+}
+
+func TestHandlerEditRejected(t *testing.T) {
+	ts, hub, _ := newHandlerTestServer(t, nil)
+	defer ts.Close()
+
+	alice := dialAndJoin(t, ts.URL, "room1", "alice")
+	defer alice.Close(websocket.StatusNormalClosure, "")
+	waitForClients(t, hub, "room1", 1)
+	drainSystemMessages(t, alice, 1)
+
+	bob := dialAndJoin(t, ts.URL, "room1", "bob")
+	defer bob.Close(websocket.StatusNormalClosure, "")
+	waitForClients(t, hub, "room1", 2)
+	drainSystemMessages(t, bob, 1)
+	drainSystemMessages(t, alice, 1)
+
+	sendEnvelope(t, alice, "chat", ChatPayload{Content: "mine"})
+	_, msg := readMessage(t, alice)
+	readMessage(t, bob)
+
+	sendEnvelope(t, bob, "edit", EditPayload{MessageID: msg.ID, Content: "hijacked"})
+	if got := readError(t, bob); got != "message not found or not editable" {
+		t.Errorf("unexpected error: %q", got)
+	}
+
+	sendEnvelope(t, alice, "edit", EditPayload{MessageID: msg.ID, Content: "   "})
+	if got := readError(t, alice); got != "message content is required" {
+		t.Errorf("unexpected error: %q", got)
+	}
+}
+
+func TestHandlerJoinedServerTime(t *testing.T) {
+	hub := NewHub(nil)
+	hub.SetClockOffset(time.Hour)
+	sessions := NewSessionStore(30 * time.Second)
+	messages := message.NewStore(200)
+	hub.SetMessageStore(messages)
+	hub.SetSessionStore(sessions)
+	ts := httptest.NewServer(NewHandler(hub, nil, sessions, messages))
+	defer ts.Close()
+
+	alice, _ := dialJoinAndReadSession(t, ts.URL, "room1", "alice", "")
+	defer alice.Close(websocket.StatusNormalClosure, "")
+	drainSystemMessages(t, alice, 1) // history
+	p := readJoined(t, alice)
+
+	want := time.Now().Add(time.Hour)
+	if skew := time.Duration(want.UnixMilli()-p.ServerTime) * time.Millisecond; skew < 0 || skew > 5*time.Second {
+		t.Errorf("expected server_time near %d, got %d", want.UnixMilli(), p.ServerTime)
+	}
+
+	// Messages the server stamps use the same shifted clock.
+	_, msg := readMessage(t, alice) // "alice joined"
+	if msg.CreatedAt.Before(want.Add(-5 * time.Second)) {
+		t.Errorf("expected join message stamped with the offset clock, got %v", msg.CreatedAt)
+	}
+}
+
+func TestHandlerSubprotocol(t *testing.T) {
+	ts, _, _ := newHandlerTestServer(t, nil)
+	defer ts.Close()
+	wsURL := "ws" + strings.TrimPrefix(ts.URL, "http")
+
+	t.Run("unknown", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		conn, resp, err := websocket.Dial(ctx, wsURL, &websocket.DialOptions{
+			Subprotocols: []string{"chatsphere.v2"},
+		})
+		if err == nil {
+			conn.Close(websocket.StatusNormalClosure, "")
+			t.Fatal("expected dial with unknown subprotocol to fail")
+		}
+		if resp == nil || resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("expected 400, got %v", resp)
+		}
+	})
+
+	t.Run("v1", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		conn, _, err := websocket.Dial(ctx, wsURL, &websocket.DialOptions{
+			Subprotocols: []string{"chatsphere.v2", Subprotocol},
+		})
+		if err != nil {
+			t.Fatalf("dial error: %v", err)
+		}
+		defer conn.Close(websocket.StatusNormalClosure, "")
+		if conn.Subprotocol() != Subprotocol {
+			t.Errorf("expected negotiated subprotocol %q, got %q", Subprotocol, conn.Subprotocol())
+		}
+
+		sendEnvelope(t, conn, "join", JoinPayload{RoomID: "room1", Username: "alice"})
+		readMessage(t, conn) // session
+		readMessage(t, conn) // history
+		if p := readJoined(t, conn); p.Protocol != Subprotocol {
+			t.Errorf("expected joined protocol %q, got %q", Subprotocol, p.Protocol)
+		}
+	})
+}
+
+func TestHandlerIdentityResolver(t *testing.T) {
+	hub := NewHub(nil)
+	sessions := NewSessionStore(30 * time.Second)
+	messages := message.NewStore(200)
+	hub.SetMessageStore(messages)
+	hub.SetSessionStore(sessions)
+	handler := NewHandler(hub, nil, sessions, messages)
+	handler.SetIdentityResolver(func(r *http.Request) (string, string, bool) {
+		if r.Header.Get("Authorization") != "Bearer dana-token" {
+			return "", "", false
+		}
+		return "user-42", "Dana", true
+	})
+	ts := httptest.NewServer(handler)
+	defer ts.Close()
+	wsURL := "ws" + strings.TrimPrefix(ts.URL, "http")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	dana, _, err := websocket.Dial(ctx, wsURL, &websocket.DialOptions{
+		HTTPHeader: http.Header{"Authorization": {"Bearer dana-token"}},
+	})
+	if err != nil {
+		t.Fatalf("dial error: %v", err)
+	}
+	defer dana.Close(websocket.StatusNormalClosure, "")
+
+	// The verified identity wins over whatever the join asks for.
+	sendEnvelope(t, dana, "join", JoinPayload{RoomID: "room1", Username: "mallory"})
+	env, _ := readMessage(t, dana)
+	var sp SessionPayload
+	json.Unmarshal(env.Payload, &sp)
+	if env.Type != "session" || sp.UserID != "user-42" || sp.Username != "Dana" {
+		t.Fatalf("expected session for user-42/Dana, got %s %+v", env.Type, sp)
+	}
+	drainSystemMessages(t, dana, 3) // history, joined, "Dana joined"
+
+	sendEnvelope(t, dana, "set_username", SetUsernamePayload{Username: "mallory"})
+	if got := readError(t, dana); got != "your username comes from your account" {
+		t.Errorf("unexpected error %q", got)
+	}
+
+	// Without a token the anonymous path is unchanged.
+	anon, sp2 := dialJoinAndReadSession(t, ts.URL, "room1", "mallory", "")
+	defer anon.Close(websocket.StatusNormalClosure, "")
+	if sp2.UserID == "user-42" || sp2.Username != "mallory" {
+		t.Errorf("expected anonymous mallory, got %+v", sp2)
+	}
+}
+
+func TestHandlerNilSessionStore(t *testing.T) {
+	hub := NewHub(nil)
+	messages := message.NewStore(200)
+	hub.SetMessageStore(messages)
+	ts := httptest.NewServer(NewHandler(hub, nil, nil, messages))
+	defer ts.Close()
+
+	alice, sp := dialJoinAndReadSession(t, ts.URL, "room1", "alice", "")
+	defer alice.Close(websocket.StatusNormalClosure, "")
+	if sp.Resumed {
+		t.Error("expected a fresh session")
+	}
+	drainSystemMessages(t, alice, 2) // history, joined
+	waitForClients(t, hub, "room1", 1)
+	drainSystemMessages(t, alice, 1) // "alice joined"
+
+	sendEnvelope(t, alice, "chat", ChatPayload{Content: "hello"})
+	if env, msg := readMessage(t, alice); env.Type != "chat" || msg.Content != "hello" {
+		t.Fatalf("expected chat echo, got %q %q", env.Type, msg.Content)
+	}
+	sendEnvelope(t, alice, "set_username", SetUsernamePayload{Username: "alicia"})
+	sendEnvelope(t, alice, "mark_read", MarkReadPayload{Seq: 1})
+
+	// Asking to resume just gets a new session.
+	bob, sp2 := dialJoinAndReadSession(t, ts.URL, "room1", "bob", sp.SessionID)
+	defer bob.Close(websocket.StatusNormalClosure, "")
+	if sp2.Resumed {
+		t.Error("expected resume to be refused without a session store")
+	}
+	waitForClients(t, hub, "room1", 2)
+
+	alice.Close(websocket.StatusNormalClosure, "")
+	waitForClients(t, hub, "room1", 1)
+}
+
+func TestHandlerCapabilities(t *testing.T) {
+	for _, enabled := range []bool{true, false} {
+		t.Run(fmt.Sprintf("enabled=%v", enabled), func(t *testing.T) {
+			hub := NewHub(nil)
+			sessions := NewSessionStore(30 * time.Second)
+			messages := message.NewStore(200)
+			hub.SetMessageStore(messages)
+			hub.SetSessionStore(sessions)
+			handler := NewHandler(hub, nil, sessions, messages)
+			handler.SetEditingEnabled(enabled)
+			handler.SetAttachmentsEnabled(enabled)
+			ts := httptest.NewServer(handler)
+			defer ts.Close()
+
+			alice, _ := dialJoinAndReadSession(t, ts.URL, "room1", "alice", "")
+			defer alice.Close(websocket.StatusNormalClosure, "")
+			drainSystemMessages(t, alice, 1) // history
+			caps := readJoined(t, alice).Capabilities
+			if caps.EditingEnabled != enabled || caps.AttachmentsEnabled != enabled {
+				t.Errorf("expected editing and attachments enabled=%v, got %+v", enabled, caps)
+			}
+			if caps.MaxMessageLength != maxMessageLength || caps.HistoryLimit != historyLimit {
+				t.Errorf("unexpected limits: %+v", caps)
+			}
+			if caps != handler.Capabilities() {
+				t.Errorf("joined capabilities %+v differ from handler's %+v", caps, handler.Capabilities())
+			}
+			if enabled {
+				return
+			}
+
+			waitForClients(t, hub, "room1", 1)
+			drainSystemMessages(t, alice, 1) // "alice joined"
+			sendEnvelope(t, alice, "edit", EditPayload{MessageID: "m1", Content: "hello"})
+			if got := readError(t, alice); got != "editing is not enabled" {
+				t.Errorf("unexpected edit error: %q", got)
+			}
+			sendEnvelope(t, alice, "attach_begin", AttachBeginPayload{Name: "a.png", MIME: "image/png", Size: 10})
+			if got := readError(t, alice); got != "attachments are not enabled" {
+				t.Errorf("unexpected attach error: %q", got)
+			}
+		})
+	}
+}
+
+func TestHandlerResumeAfterRoomClosed(t *testing.T) {
+	ts, hub, sessions := newHandlerTestServer(t, nil)
+	defer ts.Close()
+
+	alice, sp := dialJoinAndReadSession(t, ts.URL, "room1", "alice", "")
+	waitForClients(t, hub, "room1", 1)
+	alice.Close(websocket.StatusNormalClosure, "")
+	waitForClients(t, hub, "room1", 0)
+
+	// The room is reaped while alice's session is waiting to be resumed.
+	hub.DisconnectRoom("room1")
+	if sess := sessions.Get(sp.SessionID); sess == nil || !sess.RoomClosed {
+		t.Fatalf("expected the session marked room-closed, got %+v", sess)
+	}
+
+	conn := dialWS(t, ts.URL)
+	defer conn.Close(websocket.StatusNormalClosure, "")
+	sendEnvelope(t, conn, "join", JoinPayload{RoomID: "room1", SessionID: sp.SessionID})
+
+	env, _ := readMessage(t, conn)
+	if env.Type != "error" {
+		t.Fatalf("expected error, got %s", env.Type)
+	}
+	var p ErrorPayload
+	json.Unmarshal(env.Payload, &p)
+	if p.Code != ErrorCodeRoomClosed || p.Message != "this room no longer exists" {
+		t.Errorf("expected room_closed error, got %+v", p)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, _, err := conn.Read(ctx)
+	var ce websocket.CloseError
+	if !errors.As(err, &ce) || ce.Reason != "this room no longer exists" {
+		t.Fatalf("expected close with 'this room no longer exists', got %v", err)
+	}
+	if hub.ClientCount("room1") != 0 {
+		t.Error("no client should have joined the closed room")
+	}
+}
+
+func TestHandlerEphemeralRoom(t *testing.T) {
+	ts, hub, _ := newHandlerTestServer(t, nil)
+	defer ts.Close()
+	hub.SetEphemeralLookup(func(roomID string) bool { return roomID == "secret" })
+
+	alice := dialAndJoin(t, ts.URL, "secret", "alice")
+	defer alice.Close(websocket.StatusNormalClosure, "")
+	waitForClients(t, hub, "secret", 1)
+	drainSystemMessages(t, alice, 1) // "alice joined"
+
+	bob, bobSP := dialJoinAndReadSession(t, ts.URL, "secret", "bob", "")
+	drainSystemMessages(t, bob, 1) // history
+	readJoined(t, bob)
+	waitForClients(t, hub, "secret", 2)
+	drainSystemMessages(t, alice, 1) // "bob joined"
+	drainSystemMessages(t, bob, 1)
+
+	// Chat is delivered live as usual.
+	sendEnvelope(t, alice, "chat", ChatPayload{Content: "off the record"})
+	readMessage(t, alice)
+	if _, msg := readMessage(t, bob); msg.Content != "off the record" {
+		t.Fatalf("expected the chat live, got %q", msg.Content)
+	}
+
+	// A later joiner gets an empty history.
+	carol, _ := dialJoinAndReadSession(t, ts.URL, "secret", "carol", "")
+	defer carol.Close(websocket.StatusNormalClosure, "")
+	env, _ := readMessage(t, carol)
+	if env.Type != "history" {
+		t.Fatalf("expected history, got %s", env.Type)
+	}
+	var history []message.Message
+	json.Unmarshal(env.Payload, &history)
+	if len(history) != 0 {
+		t.Errorf("expected no history in an ephemeral room, got %d messages", len(history))
+	}
+	readJoined(t, carol)
+	drainSystemMessages(t, alice, 1) // "carol joined"
+
+	// A resuming session gets no backfill either: joined follows session.
+	bob.Close(websocket.StatusNormalClosure, "")
+	waitForClients(t, hub, "secret", 2)
+	sendEnvelope(t, alice, "chat", ChatPayload{Content: "while bob was away"})
+	readMessage(t, alice)
+	bob2, sp := dialJoinAndReadSession(t, ts.URL, "secret", "", bobSP.SessionID)
+	defer bob2.Close(websocket.StatusNormalClosure, "")
+	if !sp.Resumed {
+		t.Fatal("expected bob's session to resume")
+	}
+	readJoined(t, bob2)
+
+	// An ordinary room still keeps its history.
+	dave := dialAndJoin(t, ts.URL, "open", "dave")
+	defer dave.Close(websocket.StatusNormalClosure, "")
+	waitForClients(t, hub, "open", 1)
+	drainSystemMessages(t, dave, 1)
+	erin, _ := dialJoinAndReadSession(t, ts.URL, "open", "erin", "")
+	defer erin.Close(websocket.StatusNormalClosure, "")
+	env, _ = readMessage(t, erin)
+	json.Unmarshal(env.Payload, &history)
+	if env.Type != "history" || len(history) == 0 {
+		t.Errorf("expected history in an ordinary room, got %s with %d messages", env.Type, len(history))
+	}
+}
+
+func TestHandlerJoinRefusedWhileModerationUnavailable(t *testing.T) {
+	ts, hub, _ := newHandlerTestServer(t, nil)
+	defer ts.Close()
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer client.Close()
+	hub.SetModerationStore(NewRedisModerationStore(client))
+	mr.SetError("LOADING Redis is loading the dataset in memory")
+
+	conn := dialWS(t, ts.URL)
+	defer conn.Close(websocket.StatusNormalClosure, "")
+	sendEnvelope(t, conn, "join", JoinPayload{RoomID: "room1", Username: "alice"})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, _, err := conn.Read(ctx)
+	var ce websocket.CloseError
+	if !errors.As(err, &ce) || ce.Code != websocket.StatusTryAgainLater {
+		t.Fatalf("expected close with StatusTryAgainLater, got %v", err)
+	}
+	if n := hub.ClientCount("room1"); n != 0 {
+		t.Errorf("expected refused client to stay out of the room, got %d clients", n)
+	}
+}
+
+func TestHandlerServerAtCapacity(t *testing.T) {
+	ts, hub, _ := newHandlerTestServer(t, nil)
+	defer ts.Close()
+	hub.ConnMgr().maxConns = 1
+
+	alice := dialAndJoin(t, ts.URL, "room1", "alice")
+	defer alice.Close(websocket.StatusNormalClosure, "")
+	waitForClients(t, hub, "room1", 1)
+	drainSystemMessages(t, alice, 1) // "alice joined"
+
+	bob, _ := dialJoinAndReadSession(t, ts.URL, "room1", "bob", "")
+	defer bob.Close(websocket.StatusNormalClosure, "")
+	drainSystemMessages(t, bob, 1) // history
+
+	if got := readError(t, bob); got != "server at capacity, retry shortly" {
+		t.Fatalf("unexpected error: %q", got)
+	}
+	env, _ := readMessage(t, bob)
+	if env.Type != string(message.TypeReconnect) {
+		t.Fatalf("expected reconnect hint, got %s", env.Type)
+	}
+	var hint ReconnectPayload
+	json.Unmarshal(env.Payload, &hint)
+	if hint.AfterMs < int(reconnectBaseDelay.Milliseconds()) {
+		t.Errorf("expected a reconnect delay of at least %v, got %dms", reconnectBaseDelay, hint.AfterMs)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, _, err := bob.Read(ctx)
+	var ce websocket.CloseError
+	if !errors.As(err, &ce) || ce.Code != websocket.StatusTryAgainLater {
+		t.Fatalf("expected close with StatusTryAgainLater, got %v", err)
+	}
+
+	if n := hub.ClientCount("room1"); n != 1 {
+		t.Errorf("expected rejected client to stay out of the room, got %d clients", n)
+	}
+	if got := hub.ConnMgr().Stats().Rejected; got != 1 {
+		t.Errorf("expected 1 rejected connection, got %d", got)
+	}
+
+	// Alice never hears about the rejected join.
+	sendEnvelope(t, alice, "chat", ChatPayload{Content: "still here"})
+	if _, m := readMessage(t, alice); m.Content != "still here" {
+		t.Errorf("expected alice's own chat next, got %+v", m)
+	}
+}
+
+func TestHandlerIdleTimeoutLeaveMessage(t *testing.T) {
+	ts, hub, _ := newHandlerTestServer(t, nil)
+	defer ts.Close()
+
+	alice := dialAndJoin(t, ts.URL, "room1", "alice")
+	defer alice.Close(websocket.StatusNormalClosure, "")
+	waitForClients(t, hub, "room1", 1)
+	drainSystemMessages(t, alice, 1)
+
+	bob := dialAndJoin(t, ts.URL, "room1", "bob")
+	defer bob.Close(websocket.StatusNormalClosure, "")
+	waitForClients(t, hub, "room1", 2)
+	drainSystemMessages(t, alice, 1) // "bob joined"
+
+	carol := dialAndJoin(t, ts.URL, "room1", "carol")
+	waitForClients(t, hub, "room1", 3)
+	drainSystemMessages(t, alice, 1) // "carol joined"
+
+	// Carol leaves on her own.
+	carol.Close(websocket.StatusNormalClosure, "")
+	env, m := readMessage(t, alice)
+	if env.Type != "system" || m.Action != message.ActionLeave || m.Content != "carol left the room" {
+		t.Fatalf("expected carol's leave message, got %+v", m)
+	}
+
+	// Bob goes idle and is reaped.
+	cm := hub.ConnMgr()
+	cm.mu.Lock()
+	cm.idleTTL = time.Minute
+	for c, entry := range cm.clients {
+		if c.username == "bob" {
+			entry.lastActive = time.Now().Add(-2 * time.Minute)
+		}
+	}
+	cm.mu.Unlock()
+	cm.reapIdle()
+
+	env, m = readMessage(t, alice)
+	if env.Type != "system" || m.Action != message.ActionTimeout || m.Content != "bob timed out" {
+		t.Fatalf("expected bob's timeout message, got %+v", m)
+	}
+	if n := hub.ClientCount("room1"); n != 1 {
+		t.Errorf("expected only alice to remain, got %d clients", n)
+	}
+}
+
+func TestHandlerPing(t *testing.T) {
+	ts, hub, _ := newHandlerTestServer(t, nil)
+	defer ts.Close()
+
+	conn := dialAndJoin(t, ts.URL, "room1", "alice")
+	defer conn.Close(websocket.StatusNormalClosure, "")
+	waitForClients(t, hub, "room1", 1)
+	drainSystemMessages(t, conn, 1) // "alice joined"
+
+	clientTime := time.Now().UnixMilli()
+	sent := time.Now()
+	sendEnvelope(t, conn, "ping", PingPayload{ClientTime: clientTime})
+	env, _ := readMessage(t, conn)
+	if env.Type != "pong" {
+		t.Fatalf("expected pong, got %q", env.Type)
+	}
+	if rtt := time.Since(sent); rtt > time.Second {
+		t.Errorf("expected a prompt pong, took %v", rtt)
+	}
+	var p PongPayload
+	json.Unmarshal(env.Payload, &p)
+	if p.ClientTime != clientTime {
+		t.Errorf("expected client_time %d echoed, got %d", clientTime, p.ClientTime)
+	}
+	if p.ServerTime < clientTime {
+		t.Errorf("expected server_time at or after client_time, got %d < %d", p.ServerTime, clientTime)
+	}
+
+	// A bare ping is answered too.
+	sendEnvelope(t, conn, "ping", nil)
+	if env, _ := readMessage(t, conn); env.Type != "pong" {
+		t.Errorf("expected pong for a ping without payload, got %q", env.Type)
+	}
+}
+
+func TestHandlerPresenceFetch(t *testing.T) {
+	ts, hub, _ := newHandlerTestServer(t, nil)
+	defer ts.Close()
+
+	alice, aliceSP := dialJoinAndReadSession(t, ts.URL, "room1", "alice", "")
+	defer alice.Close(websocket.StatusNormalClosure, "")
+	drainSystemMessages(t, alice, 1) // history
+	waitForClients(t, hub, "room1", 1)
+	drainSystemMessages(t, alice, 1) // "alice joined"
+
+	bob := dialAndJoin(t, ts.URL, "room1", "bob")
+	defer bob.Close(websocket.StatusNormalClosure, "")
+	waitForClients(t, hub, "room1", 2)
+	drainSystemMessages(t, bob, 1) // "bob joined"
+
+	sendEnvelope(t, bob, "presence_fetch", struct{}{})
+	env, _ := readMessage(t, bob)
+	if env.Type != "presence" {
+		t.Fatalf("expected presence, got %s", env.Type)
+	}
+	var p PresencePayload
+	json.Unmarshal(env.Payload, &p)
+	if len(p.Users) != 2 {
+		t.Fatalf("expected 2 users, got %d", len(p.Users))
+	}
+	for _, u := range p.Users {
+		if u.Host != (u.UserID == aliceSP.UserID) {
+			t.Errorf("unexpected host flag for %s: %v", u.Username, u.Host)
+		}
+	}
+
+	for i := 0; i < 4; i++ {
+		sendEnvelope(t, bob, "presence_fetch", struct{}{})
+		if env, _ := readMessage(t, bob); env.Type != "presence" {
+			t.Fatalf("fetch %d: expected presence, got %s", i+2, env.Type)
+		}
+	}
+	sendEnvelope(t, bob, "presence_fetch", struct{}{})
+	if got := readError(t, bob); !strings.Contains(got, "rate limit exceeded") {
+		t.Errorf("expected rate limit error, got %q", got)
+	}
+}
+
+func TestHandlerRoomFloodEngagesSlowMode(t *testing.T) {
+	ts, hub, _ := newHandlerTestServer(t, nil)
+	defer ts.Close()
+	hub.SetFloodGuard(3, time.Minute)
+
+	alice := dialAndJoin(t, ts.URL, "room1", "alice")
+	defer alice.Close(websocket.StatusNormalClosure, "")
+	waitForClients(t, hub, "room1", 1)
+	bob := dialAndJoin(t, ts.URL, "room1", "bob")
+	defer bob.Close(websocket.StatusNormalClosure, "")
+	waitForClients(t, hub, "room1", 2)
+	carol := dialAndJoin(t, ts.URL, "room1", "carol")
+	defer carol.Close(websocket.StatusNormalClosure, "")
+	waitForClients(t, hub, "room1", 3)
+	drainSystemMessages(t, alice, 3)
+	drainSystemMessages(t, bob, 2)
+	drainSystemMessages(t, carol, 1)
+	conns := []*websocket.Conn{alice, bob, carol}
+
+	// Each user sends one message, well under the per-user limit.
+	for _, sender := range conns {
+		sendEnvelope(t, sender, "chat", ChatPayload{Content: "hi"})
+		for _, c := range conns {
+			if env, _ := readMessage(t, c); env.Type != "chat" {
+				t.Fatalf("expected chat, got %s", env.Type)
+			}
+		}
+	}
+
+	// Together they hit the room cap: the next message trips slow mode.
+	sendEnvelope(t, alice, "chat", ChatPayload{Content: "one too many"})
+	var gotNotice, gotError bool
+	for i := 0; i < 2; i++ {
+		env, m := readMessage(t, alice)
+		switch {
+		case env.Type == "system" && m.Action == message.ActionSlowMode:
+			gotNotice = true
+		case env.Type == "error":
+			gotError = true
+		default:
+			t.Fatalf("unexpected %s envelope: %+v", env.Type, m)
+		}
+	}
+	if !gotNotice || !gotError {
+		t.Fatalf("expected slow mode notice and error, got notice=%v error=%v", gotNotice, gotError)
+	}
+	for _, c := range []*websocket.Conn{bob, carol} {
+		if _, m := readMessage(t, c); m.Action != message.ActionSlowMode {
+			t.Fatalf("expected slow mode notice, got %+v", m)
+		}
+	}
+
+	// In slow mode bob gets one message through, then is held back.
+	sendEnvelope(t, bob, "chat", ChatPayload{Content: "slowly"})
+	for _, c := range conns {
+		if _, m := readMessage(t, c); m.Content != "slowly" {
+			t.Fatalf("expected bob's message, got %+v", m)
+		}
+	}
+	sendEnvelope(t, bob, "chat", ChatPayload{Content: "again"})
+	if got := readError(t, bob); !strings.Contains(got, "slow mode is on") {
+		t.Errorf("expected slow mode error, got %q", got)
+	}
+}
+
+func TestHandlerShutdownSendsStaggeredReconnectHints(t *testing.T) {
+	ts, hub, _ := newHandlerTestServer(t, nil)
+	defer ts.Close()
+
+	names := []string{"alice", "bob", "carol"}
+	conns := make([]*websocket.Conn, len(names))
+	for i, name := range names {
+		conns[i] = dialAndJoin(t, ts.URL, "room1", name)
+		defer conns[i].Close(websocket.StatusNormalClosure, "")
+		waitForClients(t, hub, "room1", i+1)
+	}
+	for i, c := range conns {
+		drainSystemMessages(t, c, len(conns)-i) // own and later joins
+	}
+
+	// Keep reading on every client so each close handshake completes.
+	hints := make(chan ReconnectPayload, len(conns))
+	for _, c := range conns {
+		go func(c *websocket.Conn) {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			for {
+				_, data, err := c.Read(ctx)
+				if err != nil {
+					return
+				}
+				var env Envelope
+				json.Unmarshal(data, &env)
+				if env.Type == string(message.TypeReconnect) {
+					var p ReconnectPayload
+					json.Unmarshal(env.Payload, &p)
+					hints <- p
+				}
+			}
+		}(c)
+	}
+
+	hub.ConnMgr().Shutdown()
+
+	var delays []int
+	for range conns {
+		select {
+		case p := <-hints:
+			if p.JitterMs <= 0 {
+				t.Errorf("expected positive jitter, got %d", p.JitterMs)
+			}
+			delays = append(delays, p.AfterMs)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected %d reconnect hints, got %d", len(conns), len(delays))
+		}
+	}
+	sort.Ints(delays)
+	if delays[0] < int(reconnectBaseDelay.Milliseconds()) {
+		t.Errorf("expected delays of at least %v, got %v", reconnectBaseDelay, delays)
+	}
+	for i := 1; i < len(delays); i++ {
+		if delays[i] <= delays[i-1] {
+			t.Errorf("expected distinct increasing delays, got %v", delays)
+		}
+	}
+}
+
+func TestHandlerLeaveGetsNoReconnectHint(t *testing.T) {
+	ts, hub, _ := newHandlerTestServer(t, nil)
+	defer ts.Close()
+
+	conn := dialAndJoin(t, ts.URL, "room1", "alice")
+	defer conn.Close(websocket.StatusNormalClosure, "")
+	waitForClients(t, hub, "room1", 1)
+	drainSystemMessages(t, conn, 1)
+
+	sendEnvelope(t, conn, "leave", struct{}{})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for {
+		_, data, err := conn.Read(ctx)
+		if err != nil {
+			if websocket.CloseStatus(err) != websocket.StatusNormalClosure {
+				t.Errorf("expected normal closure, got %v", err)
+			}
+			return
+		}
+		var env Envelope
+		json.Unmarshal(data, &env)
+		if env.Type == string(message.TypeReconnect) {
+			t.Fatal("expected no reconnect hint on a voluntary leave")
+		}
+	}
+}
+
+func TestHandlerHistoryRange(t *testing.T) {
+	ts, hub, _ := newHandlerTestServer(t, nil)
+	defer ts.Close()
+
+	base := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < 4; i++ {
+		hub.messages.Append(&message.Message{
+			ID:        fmt.Sprintf("old-%d", i),
+			RoomID:    "room1",
+			Content:   fmt.Sprintf("msg %d", i),
+			Type:      message.TypeChat,
+			CreatedAt: base.Add(time.Duration(i) * time.Hour),
+		})
+	}
+
+	conn := dialAndJoin(t, ts.URL, "room1", "alice")
+	defer conn.Close(websocket.StatusNormalClosure, "")
+	waitForClients(t, hub, "room1", 1)
+	drainSystemMessages(t, conn, 1)
+
+	readRange := func() HistoryBatchPayload {
+		t.Helper()
+		env, _ := readMessage(t, conn)
+		if env.Type != "history_range" {
+			t.Fatalf("expected history_range, got %s", env.Type)
+		}
+		var p HistoryBatchPayload
+		json.Unmarshal(env.Payload, &p)
+		return p
+	}
+
+	sendEnvelope(t, conn, "history_range", HistoryRangePayload{
+		SinceTime: base.Add(time.Hour),
+		UntilTime: base.Add(4 * time.Hour),
+		Limit:     2,
+	})
+	p := readRange()
+	if len(p.Messages) != 2 || p.Messages[0].ID != "old-1" || p.Messages[1].ID != "old-2" {
+		t.Fatalf("unexpected range batch: %+v", p.Messages)
+	}
+	if !p.HasMore {
+		t.Error("expected has_more with old-3 still in range")
+	}
+
+	// Nothing in range: an empty batch, not an error.
+	sendEnvelope(t, conn, "history_range", HistoryRangePayload{
+		SinceTime: base.Add(-2 * time.Hour),
+		UntilTime: base.Add(-time.Hour),
+	})
+	if p := readRange(); len(p.Messages) != 0 || p.HasMore {
+		t.Errorf("expected empty batch, got %+v", p)
+	}
+
+	sendEnvelope(t, conn, "history_range", HistoryRangePayload{
+		SinceTime: base.Add(time.Hour),
+		UntilTime: base,
+	})
+	if got := readError(t, conn); got != "since_time must not be after until_time" {
+		t.Errorf("unexpected error: %q", got)
+	}
+}
+
+func TestHandlerJoinedEndsHandshake(t *testing.T) {
+	hub := NewHub(nil)
+	sessions := NewSessionStore(30 * time.Second)
+	messages := message.NewStore(200)
+	hub.SetMessageStore(messages)
+	hub.SetSessionStore(sessions)
+	handler := NewHandler(hub, nil, sessions, messages)
+	handler.SetRoomCapacity(func(roomID string) int { return 8 })
+	ts := httptest.NewServer(handler)
+	defer ts.Close()
+
+	// New join: session, history, then joined.
+	alice, aliceSP := dialJoinAndReadSession(t, ts.URL, "room1", "alice", "")
+	if env, _ := readMessage(t, alice); env.Type != "history" {
+		t.Fatalf("expected history, got %s", env.Type)
+	}
+	joined := readJoined(t, alice)
+	if joined.RoomID != "room1" || joined.Capacity != 8 || !joined.IsHost {
+		t.Errorf("unexpected joined payload for host: %+v", joined)
+	}
+	if _, m := readMessage(t, alice); m.Action != message.ActionJoin {
+		t.Errorf("expected the join broadcast after joined, got %+v", m)
+	}
+
+	bob := dialAndJoin(t, ts.URL, "room1", "bob")
+	defer bob.Close(websocket.StatusNormalClosure, "")
+	waitForClients(t, hub, "room1", 2)
+	drainSystemMessages(t, alice, 1) // "bob joined"
+
+	// Resumption: session, backfill, then joined.
+	alice.Close(websocket.StatusNormalClosure, "")
+	waitForClients(t, hub, "room1", 1)
+	sendEnvelope(t, bob, "chat", ChatPayload{Content: "while you were out"})
+
+	alice2, sp := dialJoinAndReadSession(t, ts.URL, "room1", "", aliceSP.SessionID)
+	defer alice2.Close(websocket.StatusNormalClosure, "")
+	if !sp.Resumed {
+		t.Fatal("expected session to resume")
+	}
+	readBackfill(t, alice2)
+	joined = readJoined(t, alice2)
+	if !joined.IsHost || joined.Capacity != 8 {
+		t.Errorf("unexpected joined payload on resume: %+v", joined)
+	}
+	if _, m := readMessage(t, alice2); m.Action != message.ActionRejoin {
+		t.Errorf("expected the rejoin broadcast after joined, got %+v", m)
+	}
+}
+
+func TestHandlerKickGuests(t *testing.T) {
+	ts, hub, userSessions := newHandlerTestServerWithUserSessions(t)
+	defer ts.Close()
+
+	host := dialAndJoin(t, ts.URL, "room1", "alice")
+	defer host.Close(websocket.StatusNormalClosure, "")
+	waitForClients(t, hub, "room1", 1)
+
+	named := dialAndJoin(t, ts.URL, "room1", "bob")
+	defer named.Close(websocket.StatusNormalClosure, "")
+
+	// A cookie-backed user without a chosen name keeps their place.
+	sess := userSessions.Create()
+	cookie, _ := dialJoinAndReadSessionWithCookie(t, ts.URL, "room1", "", "chatsphere_session", sess.Token)
+	defer cookie.Close(websocket.StatusNormalClosure, "")
+
+	guest1 := dialAndJoin(t, ts.URL, "room1", "")
+	defer guest1.Close(websocket.StatusNormalClosure, "")
+	guest2 := dialAndJoin(t, ts.URL, "room1", "")
+	defer guest2.Close(websocket.StatusNormalClosure, "")
+	waitForClients(t, hub, "room1", 5)
+
+	sendEnvelope(t, host, "kick_guests", nil)
+	waitForClients(t, hub, "room1", 3)
+
+	// The host sees one summary line covering both guests.
+	for {
+		env, msg := readMessage(t, host)
+		if env.Type != "system" || !strings.Contains(msg.Content, "removed") {
+			continue
+		}
+		if msg.Action != message.ActionKick {
+			t.Errorf("expected action 'kick', got %q", msg.Action)
+		}
+		if msg.Content != "2 guests were removed from the room" {
+			t.Errorf("unexpected summary %q", msg.Content)
+		}
+		break
+	}
+
+	if guests := hub.guestsInRoom("room1"); len(guests) != 0 {
+		t.Errorf("expected no guests left, got %d", len(guests))
+	}
+}
+
+func TestHandlerKickGuestsNonHostDenied(t *testing.T) {
+	ts, hub, _ := newHandlerTestServer(t, nil)
+	defer ts.Close()
+
+	host := dialAndJoin(t, ts.URL, "room1", "alice")
+	defer host.Close(websocket.StatusNormalClosure, "")
+	waitForClients(t, hub, "room1", 1)
+
+	bob := dialAndJoin(t, ts.URL, "room1", "bob")
+	defer bob.Close(websocket.StatusNormalClosure, "")
+	guest := dialAndJoin(t, ts.URL, "room1", "")
+	defer guest.Close(websocket.StatusNormalClosure, "")
+	waitForClients(t, hub, "room1", 3)
+
+	sendEnvelope(t, bob, "kick_guests", nil)
+	for {
+		env, _ := readMessage(t, bob)
+		if env.Type != "error" {
+			continue
+		}
+		var p ErrorPayload
+		json.Unmarshal(env.Payload, &p)
+		if p.Message != "only the room host can kick users" {
+			t.Errorf("unexpected error %q", p.Message)
+		}
+		break
+	}
+	if n := hub.ClientCount("room1"); n != 3 {
+		t.Errorf("expected 3 clients, got %d", n)
+	}
+}
+
+func TestHandlerRoomMessageCap(t *testing.T) {
+	hub := NewHub(nil)
+	sessions := NewSessionStore(30 * time.Second)
+	messages := message.NewStore(200)
+	hub.SetMessageStore(messages)
+	hub.SetSessionStore(sessions)
+	handler := NewHandler(hub, nil, sessions, messages)
+	ts := httptest.NewServer(handler)
+	defer ts.Close()
+
+	// join lets alice watch bob chat in roomID. The two join notices take
+	// the first two slots of the room's history.
+	join := func(roomID string) (alice, bob *websocket.Conn) {
+		alice = dialAndJoin(t, ts.URL, roomID, "alice")
+		waitForClients(t, hub, roomID, 1)
+		drainSystemMessages(t, alice, 1) // "alice joined"
+		bob = dialAndJoin(t, ts.URL, roomID, "bob")
+		waitForClients(t, hub, roomID, 2)
+		drainSystemMessages(t, alice, 1) // "bob joined"
+		drainSystemMessages(t, bob, 1)
+		return alice, bob
+	}
+	// chat has bob post content and returns the message alice receives.
+	chat := func(alice, bob *websocket.Conn, content string) message.Message {
+		t.Helper()
+		sendEnvelope(t, bob, "chat", ChatPayload{Content: content})
+		env, msg := readMessage(t, alice)
+		if env.Type != "chat" || msg.Content != content {
+			t.Fatalf("expected chat %q, got %s %q", content, env.Type, msg.Content)
+		}
+		drainSystemMessages(t, bob, 1) // bob's own copy
+		return msg
+	}
+
+	messages.SetRoomLimit("reject", 4, message.OverflowRejectNew)
+	alice, bob := join("reject")
+	defer alice.Close(websocket.StatusNormalClosure, "")
+	defer bob.Close(websocket.StatusNormalClosure, "")
+
+	first := chat(alice, bob, "one")
+	chat(alice, bob, "two")
+	sendEnvelope(t, bob, "chat", ChatPayload{Content: "three"})
+	if got := readError(t, bob); got != historyFullError {
+		t.Fatalf("expected history full error, got %q", got)
+	}
+	// System messages still go out in a full room, they just aren't kept.
+	sendEnvelope(t, alice, "set_knock", SetKnockPayload{Enabled: true})
+	for _, conn := range []*websocket.Conn{alice, bob} {
+		if _, msg := readMessage(t, conn); msg.Action != message.ActionKnock {
+			t.Fatalf("expected the knock notice in a full room, got %q", msg.Content)
+		}
+	}
+	if n := messages.Count("reject"); n != 4 {
+		t.Fatalf("expected the knock notice not to be stored, got %d messages", n)
+	}
+
+	// Only the host may delete, and doing so frees a slot.
+	sendEnvelope(t, bob, "delete", DeletePayload{MessageID: first.ID})
+	if got := readError(t, bob); got != "only the room host can delete messages" {
+		t.Fatalf("expected not host error, got %q", got)
+	}
+	sendEnvelope(t, alice, "delete", DeletePayload{MessageID: first.ID})
+	for _, conn := range []*websocket.Conn{alice, bob} {
+		env, _ := readMessage(t, conn)
+		var p DeletePayload
+		json.Unmarshal(env.Payload, &p)
+		if env.Type != "delete" || p.MessageID != first.ID {
+			t.Fatalf("expected delete of %s, got %s %s", first.ID, env.Type, p.MessageID)
+		}
+	}
+	// Alice never saw "three": the next thing she reads is "four".
+	chat(alice, bob, "four")
+	if n := messages.Count("reject"); n != 4 {
+		t.Errorf("expected the room to be full again with 4 messages, got %d", n)
+	}
+
+	messages.SetRoomLimit("drop", 4, message.OverflowDropOldest)
+	alice2, bob2 := join("drop")
+	defer alice2.Close(websocket.StatusNormalClosure, "")
+	defer bob2.Close(websocket.StatusNormalClosure, "")
+	for i := 0; i < 5; i++ {
+		chat(alice2, bob2, fmt.Sprintf("message %d", i))
+	}
+	recent := messages.Recent("drop", 10)
+	if len(recent) != 4 || recent[0].Content != "message 1" {
+		t.Errorf("expected the newest 4 messages from message 1, got %d starting %q", len(recent), recent[0].Content)
+	}
+}
+
+func TestHandlerUnknownType(t *testing.T) {
+	for _, strict := range []bool{false, true} {
+		t.Run(fmt.Sprintf("strict=%v", strict), func(t *testing.T) {
+			hub := NewHub(nil)
+			sessions := NewSessionStore(30 * time.Second)
+			hub.SetSessionStore(sessions)
+			handler := NewHandler(hub, nil, sessions, nil)
+			handler.SetStrictProtocol(strict)
+			ts := httptest.NewServer(handler)
+			defer ts.Close()
+
+			conn := dialAndJoin(t, ts.URL, "room1", "alice")
+			defer conn.Close(websocket.StatusNormalClosure, "")
+			waitForClients(t, hub, "room1", 1)
+			drainSystemMessages(t, conn, 1) // "alice joined"
+
+			sendEnvelope(t, conn, "frobnicate", struct{}{})
+			if strict {
+				if got := readError(t, conn); got != `unknown message type "frobnicate"` {
+					t.Errorf("unexpected error %q", got)
+				}
+			}
+			// In lenient mode the ping's pong is the next thing to arrive.
+			sendEnvelope(t, conn, "ping", PingPayload{})
+			if env, _ := readMessage(t, conn); env.Type != "pong" {
+				t.Errorf("expected pong, got %s", env.Type)
+			}
+		})
+	}
+}
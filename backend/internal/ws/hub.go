@@ -3,30 +3,68 @@ package ws
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"log"
+	"net"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
 	"github.com/christopherjohns/chatsphere/internal/message"
+	"github.com/christopherjohns/chatsphere/internal/ratelimit"
 	"nhooyr.io/websocket"
 )
 
 // kickDuration is how long a kicked user is blocked from rejoining.
 const kickDuration = 15 * time.Minute
 
+// typingInterval is the minimum gap between typing indicators relayed for
+// one user. Clients send one per keystroke burst; repeats inside the
+// interval are dropped since peers are already showing the indicator.
+const typingInterval = time.Second
+
+// roomSweepInterval is how often StartRoomSweep looks for room entries
+// that outlived their last client.
+const roomSweepInterval = 5 * time.Minute
+
+// readOnlyBufferSize is the number of envelopes queued per read-only
+// subscriber; see AddReadOnly.
+const readOnlyBufferSize = sendBufferSize
+
+// Range bans broader than these prefix lengths are refused, so a host
+// cannot lock most of the internet out of a room by mistake.
+const (
+	minIPv4BanPrefix = 16
+	minIPv6BanPrefix = 48
+)
+
 // Client represents a connected WebSocket user.
 type Client struct {
-	conn      *websocket.Conn
-	send      chan []byte
-	userID    string
-	username  string
-	roomID    string
-	sessionID string
-	ip        string
-	resumed   bool
-	hub       *Hub
-	isCreator bool
-	kicked    bool // set when the user is kicked/banned to suppress "left" message
+	conn       *websocket.Conn
+	send       chan []byte
+	userID     string
+	username   string
+	roomID     string
+	status     string // free-text status message shown in presence
+	color      string // avatar color derived from userID
+	sessionID  string
+	sessionGen uint64 // this connection's claim on the session; see SessionStore.Resume
+	ip         string
+	resumed    bool
+	persistent bool // userID comes from a user session cookie
+	hub        *Hub
+	isCreator  bool
+	joined     bool           // join handshake finished; roomID and userID are set
+	newHost    bool           // became host during this join; undone if the join fails
+	prevName   string         // name a resume replaced, announced once the join succeeds
+	kicked     bool           // set when the user is kicked/banned to suppress "left" message
+	timedOut   atomic.Bool    // set by the idle reaper so the leave message says why
+	left       bool           // sent an explicit leave, so it is announced without a grace period
+	upload     *pendingUpload // attachment being received, owned by the read loop
+	verified   string         // display name vouched for by the IdentityResolver, if any
+	typing     bool           // a typing indicator was relayed and not yet stopped, owned by the read loop
 }
 
 // Hub manages WebSocket clients grouped by room.
@@ -34,29 +72,69 @@ type Hub struct {
 	mu          sync.RWMutex
 	rooms       map[string]map[*Client]struct{}
 	hosts       map[string]string               // roomID → host userID
-	banned      map[string]map[string]struct{}   // roomID → set of banned userIDs
-	bannedIPs   map[string]map[string]struct{}   // roomID → set of banned IPs
-	muted       map[string]map[string]time.Time  // roomID → userID → mute-expires-at (zero = permanent)
-	kicked      map[string]map[string]time.Time  // roomID → userID → rejoin-allowed-at
+	banned      map[string]map[string]struct{}  // roomID → set of banned userIDs
+	bannedIPs   map[string]map[string]struct{}  // roomID → set of banned IPs
+	bannedCIDRs map[string][]*net.IPNet         // roomID → banned IP ranges
+	muted       map[string]map[string]time.Time // roomID → userID → mute-expires-at (zero = permanent)
+	kicked      map[string]map[string]time.Time // roomID → userID → rejoin-allowed-at
+	uniqueNames map[string]bool                 // roomID → usernames must be unique
+	knockRooms  map[string]bool                 // roomID → joining requires host admission
+	admitted    map[string]map[string]struct{}  // roomID → set of admitted userIDs
+	knocks      map[string]*pendingKnock        // requestID → pending join request
+	seqMu       sync.Mutex
+	seqs        map[string]int64 // roomID → last assigned sequence number
 	conns       *ConnManager
+	attachments *attachmentStore
+	flood       *floodGuard
+	typing      *ratelimit.IPLimiter // keyed by roomID/userID
+	moderation  ModerationStore
 	messages    message.MessageStore
 	sessions    *SessionStore
 	onJoin      func(roomID string, delta int)
 	onBroadcast func(roomID string)
+	eventSink   func(Event)
+	readers     map[string]map[chan []byte]struct{} // roomID → read-only subscribers
+	ephemeral   func(roomID string) bool
+	clockOffset time.Duration
+	stamps      map[string]time.Time           // roomID → last broadcast CreatedAt, guarded by seqMu
+	readOnly    map[string]bool                // roomID → only the host and moderators may post
+	roomEvents  chan queuedRoomEvent           // feeds the room event hook, if set
+	blocklists  map[string]*roomBlocklist      // roomID → words the host has blocked
+	mods        map[string]map[string]struct{} // roomID → user IDs the host made moderators
 }
 
 // NewHub creates a new Hub. The onJoin callback is called with +1/-1
-// when a client joins or leaves a room.
-func NewHub(onJoin func(roomID string, delta int)) *Hub {
+// when a client joins or leaves a room. opts configure the hub's
+// ConnManager.
+func NewHub(onJoin func(roomID string, delta int), opts ...ConnManagerOption) *Hub {
+	return NewHubWithConnManager(onJoin, NewConnManager(opts...))
+}
+
+// NewHubWithConnManager creates a Hub that tracks its connections with cm,
+// for callers that build and tune the ConnManager themselves.
+func NewHubWithConnManager(onJoin func(roomID string, delta int), cm *ConnManager) *Hub {
 	return &Hub{
-		rooms:     make(map[string]map[*Client]struct{}),
-		hosts:     make(map[string]string),
-		banned:    make(map[string]map[string]struct{}),
-		bannedIPs: make(map[string]map[string]struct{}),
-		muted:     make(map[string]map[string]time.Time),
-		kicked:    make(map[string]map[string]time.Time),
-		conns:  NewConnManager(),
-		onJoin: onJoin,
+		rooms:       make(map[string]map[*Client]struct{}),
+		readers:     make(map[string]map[chan []byte]struct{}),
+		hosts:       make(map[string]string),
+		banned:      make(map[string]map[string]struct{}),
+		bannedIPs:   make(map[string]map[string]struct{}),
+		bannedCIDRs: make(map[string][]*net.IPNet),
+		muted:       make(map[string]map[string]time.Time),
+		kicked:      make(map[string]map[string]time.Time),
+		uniqueNames: make(map[string]bool),
+		knockRooms:  make(map[string]bool),
+		admitted:    make(map[string]map[string]struct{}),
+		knocks:      make(map[string]*pendingKnock),
+		seqs:        make(map[string]int64),
+		stamps:      make(map[string]time.Time),
+		readOnly:    make(map[string]bool),
+		blocklists:  make(map[string]*roomBlocklist),
+		mods:        make(map[string]map[string]struct{}),
+		conns:       cm,
+		attachments: newAttachmentStore(attachmentTTL),
+		typing:      ratelimit.NewIPLimiter(1, typingInterval),
+		onJoin:      onJoin,
 	}
 }
 
@@ -70,6 +148,58 @@ func (h *Hub) SetSessionStore(sessions *SessionStore) {
 	h.sessions = sessions
 }
 
+// SetClockOffset shifts every timestamp the hub hands out by d, for hosts
+// whose system clock is known to be off. Call it before serving.
+func (h *Hub) SetClockOffset(d time.Duration) {
+	h.clockOffset = d
+}
+
+// Now is the clock for every timestamp the server sends to clients:
+// message CreatedAt, edits, event times and the server_time fields. It
+// keeps time.Now's monotonic reading, so comparisons within a process are
+// immune to wall-clock steps.
+func (h *Hub) Now() time.Time {
+	return time.Now().Add(h.clockOffset)
+}
+
+// SetEphemeralLookup installs a lookup for rooms that keep no history.
+// Broadcasts in a room for which fn returns true are delivered live but
+// never stored, so there is nothing to send as history or backfill.
+func (h *Hub) SetEphemeralLookup(fn func(roomID string) bool) {
+	h.ephemeral = fn
+}
+
+// SetReadOnly turns spectator mode on or off for a room. While it is on,
+// only the host and moderators may post; everyone else can still read,
+// type and set a status.
+func (h *Hub) SetReadOnly(roomID string, enabled bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if enabled {
+		h.readOnly[roomID] = true
+	} else {
+		delete(h.readOnly, roomID)
+	}
+}
+
+// ReadOnly reports whether the room is in spectator mode.
+func (h *Hub) ReadOnly(roomID string) bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.readOnly[roomID]
+}
+
+// IsEphemeral reports whether roomID keeps no history.
+func (h *Hub) IsEphemeral(roomID string) bool {
+	return h.ephemeral != nil && h.ephemeral(roomID)
+}
+
+// HistoryFull reports whether the room has reached a reject-new message
+// cap, so nothing more may be broadcast until a message is deleted.
+func (h *Hub) HistoryFull(roomID string) bool {
+	return h.messages != nil && !h.IsEphemeral(roomID) && h.messages.Full(roomID)
+}
+
 // SetOnBroadcast sets a callback invoked after each broadcast for a room.
 func (h *Hub) SetOnBroadcast(fn func(roomID string)) {
 	h.onBroadcast = fn
@@ -89,6 +219,7 @@ type Envelope struct {
 // JoinPayload is sent by the client to join a room.
 type JoinPayload struct {
 	RoomID    string `json:"room_id"`
+	Code      string `json:"code,omitempty"` // private room code, used when room_id is empty
 	Username  string `json:"username"`
 	SessionID string `json:"session_id,omitempty"`
 }
@@ -98,46 +229,188 @@ type SessionPayload struct {
 	SessionID string `json:"session_id"`
 	UserID    string `json:"user_id"`
 	Username  string `json:"username"`
+	Color     string `json:"color"`
 	Resumed   bool   `json:"resumed"`
 	IsCreator bool   `json:"is_creator"`
+	IsHost    bool   `json:"is_host"`
+	IsMod     bool   `json:"is_mod"`
+}
+
+// JoinedPayload is the last envelope of the join handshake, sent after
+// history or backfill. It carries the room's current settings and the
+// client's name and role in it. In a room that requires unique names the
+// name can differ from the session envelope's if a concurrent join took
+// that one first.
+type JoinedPayload struct {
+	RoomID          string       `json:"room_id"`
+	Username        string       `json:"username"`
+	Capacity        int          `json:"capacity,omitempty"`
+	SlowModeSeconds int          `json:"slow_mode_seconds,omitempty"`
+	KnockRequired   bool         `json:"knock_required,omitempty"`
+	IsHost          bool         `json:"is_host"`
+	IsMod           bool         `json:"is_mod"`
+	Muted           bool         `json:"muted,omitempty"`
+	Unread          int          `json:"unread"`
+	Topic           string       `json:"topic,omitempty"`
+	Capabilities    Capabilities `json:"capabilities"`
+	// ServerTime is the server's clock in Unix milliseconds when the join
+	// completed, so clients can measure their own clock skew.
+	ServerTime int64 `json:"server_time"`
+	// Protocol is the envelope schema version in effect for this
+	// connection. Clients that negotiated a subprotocol get the same value
+	// back; those that offered none are spoken to in it anyway.
+	Protocol string `json:"protocol"`
+	// ReadOnly is set when only the host and moderators may post; see
+	// SetReadOnly.
+	ReadOnly bool `json:"read_only,omitempty"`
+}
+
+// Capabilities describes the features and limits this server supports, so
+// one client can adapt to servers that lack some of them.
+type Capabilities struct {
+	MaxMessageLength   int  `json:"max_message_length"`
+	HistoryLimit       int  `json:"history_limit"`
+	ReactionsEnabled   bool `json:"reactions_enabled"`
+	EditingEnabled     bool `json:"editing_enabled"`
+	AttachmentsEnabled bool `json:"attachments_enabled"`
 }
 
 // ChatPayload is sent by the client to post a message.
+// ClientMsgID is an optional idempotency key; resends with the same key
+// are not broadcast again.
 type ChatPayload struct {
-	Content string `json:"content"`
+	Content     string           `json:"content"`
+	Format      message.Format   `json:"format,omitempty"`
+	Audience    message.Audience `json:"audience,omitempty"`
+	ClientMsgID string           `json:"client_msg_id,omitempty"`
+}
+
+// EditPayload is sent by the client to change the content of one of its
+// own chat messages.
+type EditPayload struct {
+	MessageID string `json:"message_id"`
+	Content   string `json:"content"`
+}
+
+// DeletePayload is sent by the host to remove a message from the room's
+// history, and relayed to the room as the delete envelope.
+type DeletePayload struct {
+	MessageID string `json:"message_id"`
 }
 
 // HistoryFetchPayload is sent by the client to request older messages.
+// Cursor takes precedence over BeforeID, which is kept for older clients.
 type HistoryFetchPayload struct {
+	Cursor   string `json:"cursor,omitempty"`
 	BeforeID string `json:"before_id"`
 	Limit    int    `json:"limit"`
 }
 
+// HistoryRangePayload is sent by the client to request messages created
+// within [SinceTime, UntilTime). A zero time leaves that end open.
+type HistoryRangePayload struct {
+	SinceTime time.Time `json:"since_time"`
+	UntilTime time.Time `json:"until_time"`
+	Limit     int       `json:"limit"`
+}
+
 // HistoryBatchPayload is sent by the server with a batch of older messages.
+// NextCursor, set when HasMore is true, fetches the batch before this one.
 type HistoryBatchPayload struct {
+	Messages   []*message.Message `json:"messages"`
+	HasMore    bool               `json:"has_more"`
+	NextCursor string             `json:"next_cursor,omitempty"`
+}
+
+// SearchPayload is sent by the client to search the room's stored messages.
+// System messages are excluded unless IncludeSystem is set.
+type SearchPayload struct {
+	Query         string `json:"query"`
+	Limit         int    `json:"limit"`
+	IncludeSystem bool   `json:"include_system,omitempty"`
+}
+
+// SearchResultPayload is sent by the server with matching messages, most
+// recent first.
+type SearchResultPayload struct {
+	Query    string             `json:"query"`
 	Messages []*message.Message `json:"messages"`
-	HasMore  bool               `json:"has_more"`
 }
 
+// ErrorCode classifies an error so clients can react to it without
+// matching on the display message.
+type ErrorCode string
+
+const (
+	ErrorCodeInvalidPayload   ErrorCode = "invalid_payload"
+	ErrorCodeRateLimited      ErrorCode = "rate_limited"
+	ErrorCodeSlowMode         ErrorCode = "slow_mode"
+	ErrorCodeMuted            ErrorCode = "muted"
+	ErrorCodeContentRequired  ErrorCode = "content_required"
+	ErrorCodeTooLong          ErrorCode = "too_long"
+	ErrorCodeBlocked          ErrorCode = "blocked"
+	ErrorCodeNotHost          ErrorCode = "not_host"
+	ErrorCodeNotFound         ErrorCode = "not_found"
+	ErrorCodeAmbiguousUser    ErrorCode = "ambiguous_user"
+	ErrorCodeInvalidTarget    ErrorCode = "invalid_target"
+	ErrorCodeUsernameReserved ErrorCode = "username_reserved"
+	ErrorCodeAtCapacity       ErrorCode = "at_capacity"
+	ErrorCodeUnsupported      ErrorCode = "unsupported"
+	ErrorCodeNotJoined        ErrorCode = "not_joined"
+	ErrorCodeRoomClosed       ErrorCode = "room_closed"
+	ErrorCodeReadOnly         ErrorCode = "read_only"
+	ErrorCodeHistoryFull      ErrorCode = "history_full"
+	ErrorCodeUnknownType      ErrorCode = "unknown_type"
+)
+
 // ErrorPayload is sent by the server when a client message is rejected.
+// Code is stable for clients to branch on; Message is for display.
+// ClientMsgID echoes the rejected chat's idempotency key, if any.
 type ErrorPayload struct {
-	Message string `json:"message"`
+	Code        ErrorCode `json:"code"`
+	Message     string    `json:"message"`
+	ClientMsgID string    `json:"client_msg_id,omitempty"`
+}
+
+// AckPayload is sent to the author of a chat that carried a ClientMsgID,
+// mapping it to the authoritative server message.
+type AckPayload struct {
+	ClientMsgID string `json:"client_msg_id"`
+	MessageID   string `json:"message_id"`
+	Seq         int64  `json:"seq"`
+}
+
+// MarkReadPayload is sent by the client to record the sequence number of
+// the last message the user has seen.
+type MarkReadPayload struct {
+	Seq int64 `json:"seq"`
+}
+
+// LeavePayload is sent by the client to leave the room. By default the
+// session stays resumable; Forget deletes it so the user fully exits.
+type LeavePayload struct {
+	Forget bool `json:"forget,omitempty"`
 }
 
 // KickPayload is sent by a room creator to kick a user.
 type KickPayload struct {
-	UserID string `json:"user_id"`
+	UserID   string `json:"user_id"`
+	Username string `json:"username,omitempty"` // used when UserID is empty
 }
 
-// BanPayload is sent by a room creator to ban a user.
+// BanPayload is sent by a room creator to ban a user. CIDR, if set, also
+// bans an IP range; it may be sent without a user.
 type BanPayload struct {
-	UserID string `json:"user_id"`
+	UserID   string `json:"user_id"`
+	Username string `json:"username,omitempty"` // used when UserID is empty
+	CIDR     string `json:"cidr,omitempty"`
 }
 
 // MutePayload is sent by a room creator to mute/unmute a user.
 // Duration is in seconds; 0 means permanent (until manually unmuted).
 type MutePayload struct {
 	UserID   string `json:"user_id"`
+	Username string `json:"username,omitempty"` // used when UserID is empty
 	Duration int    `json:"duration,omitempty"` // seconds
 }
 
@@ -152,6 +425,22 @@ type SetUsernamePayload struct {
 	Username string `json:"username"`
 }
 
+// StatusPayload is sent by the client to set or clear their status message.
+type StatusPayload struct {
+	Message string `json:"message"`
+}
+
+// TopicPayload is sent by the host to set the room topic. An empty topic
+// clears it.
+type TopicPayload struct {
+	Topic string `json:"topic"`
+}
+
+// ReadOnlyPayload is sent by the host to turn spectator mode on or off.
+type ReadOnlyPayload struct {
+	Enabled bool `json:"enabled"`
+}
+
 // TypingPayload is broadcast by the server to indicate a user is typing.
 type TypingPayload struct {
 	UserID   string `json:"user_id"`
@@ -162,6 +451,25 @@ type TypingPayload struct {
 type RoomUser struct {
 	UserID   string `json:"user_id"`
 	Username string `json:"username"`
+	Color    string `json:"color,omitempty"`
+	Status   string `json:"status,omitempty"`
+	Host     bool   `json:"host,omitempty"`
+	Mod      bool   `json:"mod,omitempty"`
+}
+
+// PingPayload is sent by the client to measure latency or keep the
+// connection alive where proxies drop WebSocket control frames.
+// ClientTime is the client's clock in Unix milliseconds.
+type PingPayload struct {
+	ClientTime int64 `json:"client_time"`
+}
+
+// PongPayload answers a ping, echoing its ClientTime so the client can
+// compute the round trip. ServerTime is the server's clock in Unix
+// milliseconds.
+type PongPayload struct {
+	ClientTime int64 `json:"client_time"`
+	ServerTime int64 `json:"server_time"`
 }
 
 // PresencePayload is broadcast when a user joins or leaves a room.
@@ -172,15 +480,87 @@ type PresencePayload struct {
 // maxMessageLength is the maximum allowed length for a chat message.
 const maxMessageLength = 2000
 
+// maxFrameSize is the largest WebSocket message a client may send. It fits
+// a chat of maxMessageLength bytes even if every byte is JSON-escaped as
+// \uXXXX, plus the envelope around it.
+const maxFrameSize = 16 << 10
+
 // maxUsernameLength is the maximum allowed length for a username.
 const maxUsernameLength = 30
 
+// maxStatusLength is the maximum allowed length (in runes) for a status message.
+const maxStatusLength = 80
+
+// maxTopicLength is the maximum allowed length (in runes) for a room topic.
+const maxTopicLength = 200
+
+// claimHost makes userID the host of a room that has none, and reports
+// whether userID is the host. claimed is true if this call made it so.
+// Joins claim the host before the session envelope is sent, so the
+// envelope can say whether the joiner is the host.
+func (h *Hub) claimHost(roomID, userID string) (isHost, claimed bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	host, ok := h.hosts[roomID]
+	if !ok {
+		h.hosts[roomID] = userID
+		return true, true
+	}
+	return host == userID, false
+}
+
+// releaseHost gives up a host claim made by a join that then failed, so
+// the next user to join can become host instead.
+func (h *Hub) releaseHost(roomID, userID string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.hosts[roomID] != userID {
+		return
+	}
+	for c := range h.rooms[roomID] {
+		if c.userID == userID {
+			return
+		}
+	}
+	delete(h.hosts, roomID)
+}
+
 // addClient registers a client in its room and starts its write pump.
-// Returns a context that is cancelled when the client is removed.
-func (h *Hub) addClient(c *Client) context.Context {
-	ctx := h.conns.Add(c)
+// Returns a context that is cancelled when the client is removed. If the
+// ConnManager refuses the client it is not added to the room, the
+// connection is left open and the error says why.
+func (h *Hub) addClient(c *Client) (context.Context, error) {
+	ctx, err := h.conns.register(c)
+	if err != nil {
+		return ctx, err
+	}
 
 	h.mu.Lock()
+	// When a session is taken over, the newest claim wins: an older
+	// connection still in the room is evicted, and a newcomer whose claim
+	// was already superseded is refused.
+	var evicted *Client
+	for other := range h.rooms[c.roomID] {
+		if c.sessionID == "" || other.sessionID != c.sessionID {
+			continue
+		}
+		if other.sessionGen > c.sessionGen {
+			h.mu.Unlock()
+			h.conns.Remove(c)
+			return nil, errSessionInUse
+		}
+		other.kicked = true
+		delete(h.rooms[c.roomID], other)
+		evicted = other
+		break
+	}
+	var evictedEvent RoomEvent
+	if evicted != nil {
+		evictedEvent = h.roomEvent(EventLeave, evicted)
+	}
+	// Unique names are settled under the lock that inserts the client, so
+	// two concurrent joins can't both take the same one.
+	c.username = h.uniqueUsernameLocked(c.roomID, c.username, c)
 	if h.rooms[c.roomID] == nil {
 		h.rooms[c.roomID] = make(map[*Client]struct{})
 	}
@@ -192,12 +572,29 @@ func (h *Hub) addClient(c *Client) context.Context {
 	} else if h.hosts[c.roomID] == c.userID {
 		c.isCreator = true
 	}
+	joinEvent := h.roomEvent(EventJoin, c)
 	h.mu.Unlock()
 
+	if evicted != nil {
+		// Marked kicked, the evicted connection's handler says nothing as
+		// it goes, so its leave is reported here.
+		h.sendRoomEvent(c.roomID, evictedEvent)
+		h.emit(Event{Type: EventLeave, RoomID: c.roomID, UserID: evicted.userID, Username: evictedEvent.Username})
+	}
+	h.sendRoomEvent(c.roomID, joinEvent)
+	if evicted != nil {
+		// The evicted connection's handler unregisters it once the close
+		// handshake ends its read loop. Removing it here first would cancel
+		// its context and drop the connection before the close frame is sent.
+		go closeWithError(evicted.conn, "session resumed from another connection")
+		if h.onJoin != nil {
+			h.onJoin(c.roomID, -1)
+		}
+	}
 	if h.onJoin != nil {
 		h.onJoin(c.roomID, 1)
 	}
-	return ctx
+	return ctx, nil
 }
 
 // removeClient unregisters a client from its room and stops its write pump.
@@ -206,11 +603,13 @@ func (h *Hub) removeClient(c *Client) {
 	h.conns.Remove(c)
 
 	removed := false
+	var event RoomEvent
 	h.mu.Lock()
 	if clients, ok := h.rooms[c.roomID]; ok {
 		if _, exists := clients[c]; exists {
 			delete(clients, c)
 			removed = true
+			event = h.roomEvent(EventLeave, c)
 			if len(clients) == 0 {
 				delete(h.rooms, c.roomID)
 			}
@@ -218,29 +617,82 @@ func (h *Hub) removeClient(c *Client) {
 	}
 	h.mu.Unlock()
 
+	if removed {
+		h.sendRoomEvent(c.roomID, event)
+	}
 	if removed && h.onJoin != nil {
 		h.onJoin(c.roomID, -1)
 	}
 }
 
 // Broadcast sends a message to all clients in a room and persists it
-// to the message store for backfill on reconnect.
-func (h *Hub) Broadcast(roomID string, msg *message.Message) {
-	if h.messages != nil {
+// to the message store for backfill on reconnect. The hub is the only
+// authority on when a message happened: it stamps the room's next sequence
+// number and CreatedAt, overwriting any the caller set, and fills in an ID
+// if the message has none. It reports false if the room refused the
+// message, which happens to anything but system messages once a
+// reject-new room is full.
+func (h *Hub) Broadcast(roomID string, msg *message.Message) bool {
+	_, _, ok := h.broadcast(roomID, nil, msg)
+	return ok
+}
+
+// BroadcastWithStats is Broadcast, reporting how many clients in the room
+// the message was queued for and how many it was dropped for, usually
+// because their send buffer was full. Read-only subscribers are not
+// counted. A room that refuses the message reports 0, 0.
+func (h *Hub) BroadcastWithStats(roomID string, msg *message.Message) (delivered, dropped int) {
+	delivered, dropped, _ = h.broadcast(roomID, nil, msg)
+	return delivered, dropped
+}
+
+// BroadcastFrom is like Broadcast but skips sender: the message is not
+// delivered to them and their session's last-delivered pointer does not
+// advance. Use it for messages generated on a client's own disconnect
+// path, which that client never renders, so a later resume backfills
+// everything after the last message it actually received.
+func (h *Hub) BroadcastFrom(roomID string, sender *Client, msg *message.Message) {
+	h.broadcast(roomID, sender, msg)
+}
+
+func (h *Hub) broadcast(roomID string, sender *Client, msg *message.Message) (delivered, dropped int, ok bool) {
+	if msg.ID == "" {
+		msg.ID = generateClientID()
+	}
+	// Stamp, assign the sequence number and append under the same lock so
+	// the store's order always matches sequence order, and so does time.
+	h.seqMu.Lock()
+	// A message the store would refuse is not delivered either, so live
+	// clients never see what a later join's history lacks. System messages
+	// are still delivered so a full room keeps reporting joins and leaves.
+	if msg.Type != message.TypeSystem && h.HistoryFull(roomID) {
+		h.seqMu.Unlock()
+		return 0, 0, false
+	}
+	msg.Seq = h.nextSeq(roomID)
+	msg.CreatedAt = h.Now()
+	// The wall clock can still step backwards; never let CreatedAt follow
+	// it within a room. Equal times are left to seq to order.
+	if last := h.stamps[roomID]; msg.CreatedAt.Before(last) {
+		msg.CreatedAt = last
+	}
+	h.stamps[roomID] = msg.CreatedAt
+	if h.messages != nil && !h.IsEphemeral(roomID) {
 		h.messages.Append(msg)
 	}
+	h.seqMu.Unlock()
 
 	data, err := json.Marshal(msg)
 	if err != nil {
 		log.Printf("ws: failed to marshal message: %v", err)
-		return
+		return 0, 0, true
 	}
 
 	env := Envelope{Type: string(msg.Type), Payload: data}
 	envData, err := json.Marshal(env)
 	if err != nil {
 		log.Printf("ws: failed to marshal envelope: %v", err)
-		return
+		return 0, 0, true
 	}
 
 	h.mu.RLock()
@@ -248,19 +700,65 @@ func (h *Hub) Broadcast(roomID string, msg *message.Message) {
 	// Copy the set so we can release the lock before sending.
 	targets := make([]*Client, 0, len(clients))
 	for c := range clients {
-		targets = append(targets, c)
+		if c != sender && h.canSeeLocked(c, msg) {
+			targets = append(targets, c)
+		}
 	}
 	h.mu.RUnlock()
 
 	for _, c := range targets {
-		if h.conns.Send(c, envData) && h.sessions != nil {
-			h.sessions.SetLastMessageID(c.sessionID, msg.ID)
+		if !h.conns.Send(c, envData) {
+			dropped++
+			continue
 		}
+		delivered++
+		if h.sessions != nil {
+			h.sessions.SetLastDelivered(c.sessionID, msg.ID, msg.Seq)
+		}
+	}
+	if msg.Audience != message.AudienceMods {
+		h.sendToReaders(roomID, envData)
 	}
 
 	if h.onBroadcast != nil {
 		h.onBroadcast(roomID)
 	}
+	return delivered, dropped, true
+}
+
+// nextSeq returns the next sequence number for a room. Must be called with
+// seqMu held.
+func (h *Hub) nextSeq(roomID string) int64 {
+	last := h.lastSeqLocked(roomID) + 1
+	h.seqs[roomID] = last
+	return last
+}
+
+// lastSeqLocked returns the room's most recent sequence number. The counter
+// is seeded from the most recent stored message so numbering continues
+// after a restart when a persistent store is used. Must be called with
+// seqMu held.
+func (h *Hub) lastSeqLocked(roomID string) int64 {
+	if last, ok := h.seqs[roomID]; ok {
+		return last
+	}
+	if h.messages == nil {
+		return 0
+	}
+	recent := h.messages.Recent(roomID, 1)
+	if len(recent) == 0 {
+		return 0
+	}
+	h.seqs[roomID] = recent[0].Seq
+	return recent[0].Seq
+}
+
+// LastSeq returns the most recently assigned sequence number for a room,
+// including one stored before a restart, or 0 if the room has none.
+func (h *Hub) LastSeq(roomID string) int64 {
+	h.seqMu.Lock()
+	defer h.seqMu.Unlock()
+	return h.lastSeqLocked(roomID)
 }
 
 // BroadcastEphemeral sends a message to all clients in a room except the
@@ -293,19 +791,135 @@ func (h *Hub) BroadcastEphemeral(roomID string, sender *Client, msg *message.Mes
 	for _, c := range targets {
 		h.conns.Send(c, envData)
 	}
+	h.sendToReaders(roomID, envData)
+}
+
+// BroadcastTyping relays a typing indicator from client to the rest of its
+// room, at most once per typingInterval. Signals inside the interval are
+// dropped so a client repeating them cannot fan out a send per peer each time.
+func (h *Hub) BroadcastTyping(client *Client) {
+	if !h.typing.Allow(client.roomID + "/" + client.userID) {
+		return
+	}
+	client.typing = true
+	h.BroadcastEphemeral(client.roomID, client, &message.Message{
+		RoomID:   client.roomID,
+		UserID:   client.userID,
+		Username: client.username,
+		Type:     message.TypeTyping,
+	})
+}
+
+// StopTyping tells the rest of client's room to drop its typing indicator
+// now rather than waiting for it to expire. It does nothing if no indicator
+// has been relayed since the last stop.
+func (h *Hub) StopTyping(client *Client) {
+	if !client.typing {
+		return
+	}
+	client.typing = false
+	h.BroadcastEphemeral(client.roomID, client, &message.Message{
+		RoomID:   client.roomID,
+		UserID:   client.userID,
+		Username: client.username,
+		Type:     message.TypeTypingStop,
+	})
+}
+
+// Announce sends a system message to every room that currently has
+// connected clients. Each room receives its own copy with RoomID, ID and
+// CreatedAt filled in. If persist is true the copy is stored via Broadcast so it
+// appears in history; otherwise it is delivered live only. Returns the
+// number of rooms reached.
+func (h *Hub) Announce(msg *message.Message, persist bool) int {
+	h.mu.RLock()
+	roomIDs := make([]string, 0, len(h.rooms))
+	for roomID, clients := range h.rooms {
+		if len(clients) > 0 {
+			roomIDs = append(roomIDs, roomID)
+		}
+	}
+	h.mu.RUnlock()
+
+	for _, roomID := range roomIDs {
+		m := *msg
+		m.RoomID = roomID
+		if persist {
+			h.Broadcast(roomID, &m)
+		} else {
+			m.ID = generateClientID()
+			m.CreatedAt = h.Now()
+			h.BroadcastEphemeral(roomID, nil, &m)
+		}
+	}
+	return len(roomIDs)
+}
+
+// sendToRoom queues raw envelope data to every client in a room without
+// persisting it.
+func (h *Hub) sendToRoom(roomID string, data []byte) {
+	h.mu.RLock()
+	targets := make([]*Client, 0, len(h.rooms[roomID]))
+	for c := range h.rooms[roomID] {
+		targets = append(targets, c)
+	}
+	h.mu.RUnlock()
+
+	for _, c := range targets {
+		h.conns.Send(c, data)
+	}
+}
+
+// AddReadOnly subscribes to a room's broadcasts without joining it: the
+// subscriber gets every envelope Broadcast or BroadcastEphemeral sends to
+// the room but is not a member, so it doesn't appear in presence or
+// counts and can't post. Envelopes are dropped if the subscriber falls
+// readOnlyBufferSize behind. The channel is closed by the returned remove
+// func or when the room is disconnected.
+func (h *Hub) AddReadOnly(roomID string) (<-chan []byte, func()) {
+	ch := make(chan []byte, readOnlyBufferSize)
+	h.mu.Lock()
+	if h.readers[roomID] == nil {
+		h.readers[roomID] = make(map[chan []byte]struct{})
+	}
+	h.readers[roomID][ch] = struct{}{}
+	h.mu.Unlock()
+
+	remove := func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		if _, ok := h.readers[roomID][ch]; !ok {
+			return
+		}
+		delete(h.readers[roomID], ch)
+		if len(h.readers[roomID]) == 0 {
+			delete(h.readers, roomID)
+		}
+		close(ch)
+	}
+	return ch, remove
+}
+
+// sendToReaders queues data to a room's read-only subscribers. Sends
+// happen under the read lock so they never race with a close.
+func (h *Hub) sendToReaders(roomID string, data []byte) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for ch := range h.readers[roomID] {
+		select {
+		case ch <- data:
+		default:
+			h.conns.droppedMessages.Add(1)
+		}
+	}
 }
 
 // BroadcastPresence sends the current user list to all clients in a room.
 func (h *Hub) BroadcastPresence(roomID string) {
 	h.mu.RLock()
-	clients := h.rooms[roomID]
-	users := make([]RoomUser, 0, len(clients))
-	targets := make([]*Client, 0, len(clients))
-	for c := range clients {
-		users = append(users, RoomUser{
-			UserID:   c.userID,
-			Username: c.username,
-		})
+	users := h.roomUsersLocked(roomID)
+	targets := make([]*Client, 0, len(h.rooms[roomID]))
+	for c := range h.rooms[roomID] {
 		targets = append(targets, c)
 	}
 	h.mu.RUnlock()
@@ -334,37 +948,185 @@ func (h *Hub) DisconnectRoom(roomID string) {
 	h.mu.Lock()
 	clients := h.rooms[roomID]
 	targets := make([]*Client, 0, len(clients))
+	events := make([]RoomEvent, 0, len(clients))
 	for c := range clients {
 		targets = append(targets, c)
+		events = append(events, h.roomEvent(EventLeave, c))
 	}
 	delete(h.rooms, roomID)
 	delete(h.hosts, roomID)
 	delete(h.banned, roomID)
 	delete(h.bannedIPs, roomID)
+	delete(h.bannedCIDRs, roomID)
 	delete(h.muted, roomID)
 	delete(h.kicked, roomID)
+	delete(h.uniqueNames, roomID)
+	delete(h.knockRooms, roomID)
+	delete(h.readOnly, roomID)
+	delete(h.blocklists, roomID)
+	delete(h.mods, roomID)
+	delete(h.admitted, roomID)
+	for ch := range h.readers[roomID] {
+		close(ch)
+	}
+	delete(h.readers, roomID)
 	h.mu.Unlock()
 
+	h.seqMu.Lock()
+	delete(h.seqs, roomID)
+	delete(h.stamps, roomID)
+	h.seqMu.Unlock()
+	if h.sessions != nil {
+		h.sessions.CloseRoom(roomID)
+	}
+	h.attachments.deleteRoom(roomID)
+	if h.flood != nil {
+		h.flood.deleteRoom(roomID)
+	}
+	if h.moderation != nil {
+		h.moderation.DeleteRoom(roomID)
+	}
+
 	for _, c := range targets {
 		h.conns.Remove(c)
 	}
+	for _, e := range events {
+		h.sendRoomEvent(roomID, e)
+	}
 }
 
-// RoomUsers returns the list of online users in a room.
+// RoomUsers returns a snapshot of the online users in a room.
 func (h *Hub) RoomUsers(roomID string) []RoomUser {
 	h.mu.RLock()
 	defer h.mu.RUnlock()
+	return h.roomUsersLocked(roomID)
+}
+
+// roomUsersLocked snapshots the room's users into a fresh slice of values,
+// so callers never hold references to live client state. Must be called
+// with h.mu held.
+func (h *Hub) roomUsersLocked(roomID string) []RoomUser {
 	clients := h.rooms[roomID]
+	host := h.hosts[roomID]
 	users := make([]RoomUser, 0, len(clients))
 	for c := range clients {
+		_, isMod := h.mods[roomID][c.userID]
 		users = append(users, RoomUser{
 			UserID:   c.userID,
 			Username: c.username,
+			Color:    c.color,
+			Status:   c.status,
+			Host:     c.userID == host,
+			Mod:      isMod,
 		})
 	}
 	return users
 }
 
+// SetStatus updates a client's status message under the hub lock so
+// concurrent presence snapshots observe a consistent value.
+func (h *Hub) SetStatus(c *Client, status string) {
+	h.mu.Lock()
+	c.status = status
+	h.mu.Unlock()
+}
+
+// SetUsername updates a client's username under the hub lock, like SetStatus.
+func (h *Hub) SetUsername(c *Client, username string) {
+	h.mu.Lock()
+	c.username = username
+	h.mu.Unlock()
+}
+
+// RequireUniqueUsernames enables unique-username enforcement for a room.
+// Joins and renames that collide with a connected user's name are
+// auto-suffixed ("alice (2)").
+func (h *Hub) RequireUniqueUsernames(roomID string) {
+	h.mu.Lock()
+	h.uniqueNames[roomID] = true
+	h.mu.Unlock()
+}
+
+// uniqueUsername returns name unchanged unless the room requires unique
+// usernames and another client (other than self) already uses it, in which
+// case the lowest free numeric suffix is appended. Comparison is
+// case-insensitive.
+func (h *Hub) uniqueUsername(roomID, name string, self *Client) string {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.uniqueUsernameLocked(roomID, name, self)
+}
+
+// uniqueUsernameLocked is uniqueUsername for callers already holding h.mu.
+func (h *Hub) uniqueUsernameLocked(roomID, name string, self *Client) string {
+	if !h.uniqueNames[roomID] {
+		return name
+	}
+
+	taken := func(candidate string) bool {
+		for c := range h.rooms[roomID] {
+			if c != self && strings.EqualFold(c.username, candidate) {
+				return true
+			}
+		}
+		return false
+	}
+	if !taken(name) {
+		return name
+	}
+	for n := 2; ; n++ {
+		suffix := fmt.Sprintf(" (%d)", n)
+		base := name
+		if len(base)+len(suffix) > maxUsernameLength {
+			base = base[:maxUsernameLength-len(suffix)]
+			// Don't leave half a multi-byte character at the cut.
+			for !utf8.ValidString(base) {
+				base = base[:len(base)-1]
+			}
+		}
+		if candidate := base + suffix; !taken(candidate) {
+			return candidate
+		}
+	}
+}
+
+// impersonatesStaff reports whether name matches, case-insensitively, the
+// name the room's host or one of its moderators is using, for anyone but
+// that user. Rooms that require unique usernames already give a lookalike
+// a numeric suffix, so this only matters where duplicate names are
+// otherwise allowed.
+func (h *Hub) impersonatesStaff(roomID, name, userID string) bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if h.uniqueNames[roomID] {
+		return false
+	}
+	host := h.hosts[roomID]
+	for c := range h.rooms[roomID] {
+		if c.userID == userID || !strings.EqualFold(c.username, name) {
+			continue
+		}
+		if _, isMod := h.mods[roomID][c.userID]; c.userID == host || isMod {
+			return true
+		}
+	}
+	return false
+}
+
+// IsAtCapacity reports whether a room already holds capacity clients.
+// A capacity of zero or less means the room is unlimited.
+func (h *Hub) IsAtCapacity(roomID string, capacity int) bool {
+	return capacity > 0 && h.ClientCount(roomID) >= capacity
+}
+
+// IsHost reports whether userID is the room's host.
+func (h *Hub) IsHost(roomID, userID string) bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	host, ok := h.hosts[roomID]
+	return ok && host == userID
+}
+
 // ClientCount returns the number of connected clients in a room.
 func (h *Hub) ClientCount(roomID string) int {
 	h.mu.RLock()
@@ -372,6 +1134,42 @@ func (h *Hub) ClientCount(roomID string) int {
 	return len(h.rooms[roomID])
 }
 
+// RoomCount returns the number of rooms the hub is tracking clients for.
+func (h *Hub) RoomCount() int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return len(h.rooms)
+}
+
+// StartRoomSweep begins a background goroutine that runs sweepRooms every
+// roomSweepInterval. Rooms are dropped as their last client leaves, so the
+// sweep only guards against a bug in that path leaking map entries.
+func (h *Hub) StartRoomSweep() {
+	go func() {
+		ticker := time.NewTicker(roomSweepInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			h.sweepRooms()
+		}
+	}()
+}
+
+// sweepRooms deletes room entries that have no clients left, logging each
+// one since it should never find any. It returns the number removed.
+func (h *Hub) sweepRooms() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	swept := 0
+	for roomID, clients := range h.rooms {
+		if len(clients) == 0 {
+			log.Printf("ws: sweeping empty room entry %s left behind", roomID)
+			delete(h.rooms, roomID)
+			swept++
+		}
+	}
+	return swept
+}
+
 // FindClient returns the client with the given userID in the room, or nil.
 func (h *Hub) FindClient(roomID, userID string) *Client {
 	h.mu.RLock()
@@ -384,8 +1182,17 @@ func (h *Hub) FindClient(roomID, userID string) *Client {
 	return nil
 }
 
-// IsBanned returns true if the user is banned from the room.
+// IsBanned returns true if the user is banned from the room. If the
+// moderation store can't be reached the user is treated as banned.
 func (h *Hub) IsBanned(roomID, userID string) bool {
+	if h.moderation != nil {
+		banned, err := h.moderation.IsBanned(roomID, userID)
+		if err != nil {
+			log.Printf("ws: ban check in room %s failed, treating as banned: %v", roomID, err)
+			return true
+		}
+		return banned
+	}
 	h.mu.RLock()
 	defer h.mu.RUnlock()
 	_, ok := h.banned[roomID][userID]
@@ -395,6 +1202,10 @@ func (h *Hub) IsBanned(roomID, userID string) bool {
 // Ban adds a user to the room's ban list. If ip is non-empty, the IP
 // address is also banned so the user cannot rejoin from the same network.
 func (h *Hub) Ban(roomID, userID, ip string) {
+	if h.moderation != nil {
+		h.moderation.Ban(roomID, userID, ip)
+		return
+	}
 	h.mu.Lock()
 	if h.banned[roomID] == nil {
 		h.banned[roomID] = make(map[string]struct{})
@@ -409,15 +1220,133 @@ func (h *Hub) Ban(roomID, userID, ip string) {
 	h.mu.Unlock()
 }
 
-// IsBannedIP returns true if the IP address is banned from the room.
+// parseBanCIDR parses cidr and rejects ranges broader than /16 for IPv4
+// or /48 for IPv6.
+func parseBanCIDR(cidr string) (*net.IPNet, error) {
+	_, ipnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid CIDR %q", cidr)
+	}
+	ones, bits := ipnet.Mask.Size()
+	if bits == 32 && ones < minIPv4BanPrefix {
+		return nil, fmt.Errorf("CIDR %s is too broad: IPv4 ranges must be /%d or narrower", cidr, minIPv4BanPrefix)
+	}
+	if bits == 128 && ones < minIPv6BanPrefix {
+		return nil, fmt.Errorf("CIDR %s is too broad: IPv6 ranges must be /%d or narrower", cidr, minIPv6BanPrefix)
+	}
+	return ipnet, nil
+}
+
+// BanCIDR bans every IP address in the range from the room. It returns an
+// error if cidr is malformed or too broad.
+func (h *Hub) BanCIDR(roomID, cidr string) error {
+	ipnet, err := parseBanCIDR(cidr)
+	if err != nil {
+		return err
+	}
+	h.banCIDR(roomID, ipnet)
+	return nil
+}
+
+// banCIDR bans a range that parseBanCIDR already accepted.
+func (h *Hub) banCIDR(roomID string, ipnet *net.IPNet) {
+	if h.moderation != nil {
+		h.moderation.BanCIDR(roomID, ipnet.String())
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, n := range h.bannedCIDRs[roomID] {
+		if n.String() == ipnet.String() {
+			return
+		}
+	}
+	h.bannedCIDRs[roomID] = append(h.bannedCIDRs[roomID], ipnet)
+}
+
+// IsBannedIP returns true if the IP address, or a range containing it, is
+// banned from the room. If the moderation store can't be reached the
+// address is treated as banned.
 func (h *Hub) IsBannedIP(roomID, ip string) bool {
 	if ip == "" {
 		return false
 	}
+	if h.moderation != nil {
+		banned, err := h.moderation.IsBannedIP(roomID, ip)
+		if err != nil {
+			log.Printf("ws: IP ban check in room %s failed, treating as banned: %v", roomID, err)
+			return true
+		}
+		return banned
+	}
 	h.mu.RLock()
 	defer h.mu.RUnlock()
-	_, ok := h.bannedIPs[roomID][ip]
-	return ok
+	if _, ok := h.bannedIPs[roomID][ip]; ok {
+		return true
+	}
+	return inCIDRs(ip, h.bannedCIDRs[roomID])
+}
+
+// banStatus reports whether userID, or ip if non-empty, is banned from the
+// room. Unlike IsBanned and IsBannedIP it hands back a moderation store
+// error instead of reading it as a ban, so a join can be refused with a
+// retryable error rather than a ban message.
+func (h *Hub) banStatus(roomID, userID, ip string) (bool, error) {
+	if h.moderation == nil {
+		return h.IsBanned(roomID, userID) || h.IsBannedIP(roomID, ip), nil
+	}
+	if banned, err := h.moderation.IsBanned(roomID, userID); err != nil || banned {
+		return banned, err
+	}
+	if ip == "" {
+		return false, nil
+	}
+	return h.moderation.IsBannedIP(roomID, ip)
+}
+
+// inCIDRs reports whether ip falls inside any of the ranges. IPv6
+// addresses may be bracketed as they appear in a remote address.
+func inCIDRs(ip string, cidrs []*net.IPNet) bool {
+	if len(cidrs) == 0 {
+		return false
+	}
+	parsed := net.ParseIP(strings.Trim(ip, "[]"))
+	if parsed == nil {
+		return false
+	}
+	for _, n := range cidrs {
+		if n.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientsInCIDR returns the room's clients connected from inside ipnet.
+func (h *Hub) clientsInCIDR(roomID string, ipnet *net.IPNet) []*Client {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	var matches []*Client
+	for c := range h.rooms[roomID] {
+		if inCIDRs(c.ip, []*net.IPNet{ipnet}) {
+			matches = append(matches, c)
+		}
+	}
+	return matches
+}
+
+// guestsInRoom returns the clients in a room that have neither picked a
+// name nor a cookie-backed identity. The host is never a guest.
+func (h *Hub) guestsInRoom(roomID string) []*Client {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	var guests []*Client
+	for c := range h.rooms[roomID] {
+		if !c.persistent && !c.isCreator && strings.HasPrefix(c.username, anonPrefix) {
+			guests = append(guests, c)
+		}
+	}
+	return guests
 }
 
 // IsKicked returns true if the user is temporarily blocked from rejoining the room.
@@ -442,8 +1371,16 @@ func (h *Hub) Kick(roomID, userID string) {
 }
 
 // IsMuted returns true if the user is currently muted in the room.
-// Expired timed mutes are cleaned up automatically.
+// Expired timed mutes are cleaned up automatically. If the moderation
+// store can't be reached it falls back to the mutes applied on this hub.
 func (h *Hub) IsMuted(roomID, userID string) bool {
+	if h.moderation != nil {
+		muted, err := h.moderation.IsMuted(roomID, userID)
+		if err == nil {
+			return muted
+		}
+		log.Printf("ws: mute check in room %s failed, using local state: %v", roomID, err)
+	}
 	h.mu.Lock()
 	defer h.mu.Unlock()
 	expiresAt, ok := h.muted[roomID][userID]
@@ -462,6 +1399,16 @@ func (h *Hub) IsMuted(roomID, userID string) bool {
 // permanent (until manually unmuted). Returns true if the user is muted
 // after the call.
 func (h *Hub) Mute(roomID, userID string, duration time.Duration) bool {
+	if h.moderation != nil {
+		muted := !h.IsMuted(roomID, userID)
+		if muted {
+			h.moderation.Mute(roomID, userID, duration)
+		} else {
+			h.moderation.Unmute(roomID, userID)
+		}
+		h.setLocalMute(roomID, userID, muted, duration)
+		return muted
+	}
 	h.mu.Lock()
 	defer h.mu.Unlock()
 	if h.muted[roomID] == nil {
@@ -479,22 +1426,124 @@ func (h *Hub) Mute(roomID, userID string, duration time.Duration) bool {
 	return true
 }
 
-// KickClient forcefully disconnects a client from its room.
-// It removes the client from the room map first to prevent
-// subsequent broadcasts from sending to a closed channel.
-func (h *Hub) KickClient(c *Client) {
+// setLocalMute records or clears a mute in the hub's own map. With a
+// moderation store the map is only read when the store can't be reached.
+func (h *Hub) setLocalMute(roomID, userID string, muted bool, duration time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !muted {
+		delete(h.muted[roomID], userID)
+		return
+	}
+	if h.muted[roomID] == nil {
+		h.muted[roomID] = make(map[string]time.Time)
+	}
+	var expiresAt time.Time
+	if duration > 0 {
+		expiresAt = time.Now().Add(duration)
+	}
+	h.muted[roomID][userID] = expiresAt
+}
+
+// DisconnectUser closes every connection belonging to userID, in any room,
+// and drops their resumable sessions so none of them can be picked up
+// again. The room hears each one leave as usual. It returns the number of
+// connections closed.
+func (h *Hub) DisconnectUser(userID, reason string) int {
+	n := 0
+	h.ForEachClientOf(userID, func(c *Client) {
+		if h.sessions != nil && c.sessionID != "" {
+			h.sessions.Delete(c.sessionID)
+		}
+		h.removeClient(c)
+		go c.conn.Close(websocket.StatusNormalClosure, safeCloseReason(reason))
+		n++
+	})
+	return n
+}
+
+// ForEachClientOf calls fn for every connection userID holds, in any room.
+// fn runs after the hub's lock is released, so it may call back into the
+// hub.
+func (h *Hub) ForEachClientOf(userID string, fn func(*Client)) {
+	h.mu.RLock()
+	var targets []*Client
+	for _, clients := range h.rooms {
+		for c := range clients {
+			if c.userID == userID {
+				targets = append(targets, c)
+			}
+		}
+	}
+	h.mu.RUnlock()
+
+	for _, c := range targets {
+		fn(c)
+	}
+}
+
+// BroadcastToUser sends msg live to every connection userID holds, for
+// account-level notices that are not part of any room's conversation.
+// Each connection gets a copy with its own RoomID; all copies share one ID
+// and CreatedAt. Nothing is stored. Returns the number of connections the
+// message was queued for.
+func (h *Hub) BroadcastToUser(userID string, msg *message.Message) int {
+	if msg.ID == "" {
+		msg.ID = generateClientID()
+	}
+	msg.CreatedAt = h.Now()
+	n := 0
+	h.ForEachClientOf(userID, func(c *Client) {
+		m := *msg
+		m.RoomID = c.roomID
+		data, err := json.Marshal(m)
+		if err != nil {
+			log.Printf("ws: failed to marshal user message: %v", err)
+			return
+		}
+		env, err := json.Marshal(Envelope{Type: string(m.Type), Payload: data})
+		if err != nil {
+			log.Printf("ws: failed to marshal user envelope: %v", err)
+			return
+		}
+		if h.conns.Send(c, env) {
+			n++
+		}
+	})
+	return n
+}
+
+// KickClient forcefully disconnects a client from its room and closes the
+// connection with reason. It removes the client from the room map first to
+// prevent subsequent broadcasts from sending to a closed channel.
+func (h *Hub) KickClient(c *Client, reason string) {
 	c.kicked = true
+	typ := EventKick
+	if h.IsBanned(c.roomID, c.userID) || h.IsBannedIP(c.roomID, c.ip) {
+		typ = EventBan
+	}
 
+	removed := false
+	var event RoomEvent
 	h.mu.Lock()
 	if clients, ok := h.rooms[c.roomID]; ok {
+		if _, exists := clients[c]; exists {
+			removed = true
+			event = h.roomEvent(typ, c)
+		}
 		delete(clients, c)
 		if len(clients) == 0 {
 			delete(h.rooms, c.roomID)
 		}
 	}
 	h.mu.Unlock()
+	if removed {
+		h.sendRoomEvent(c.roomID, event)
+	}
 
 	h.conns.Remove(c)
+	// Close waits for the peer's close frame, so don't block the caller.
+	go closeWithError(c.conn, reason)
 
 	if h.onJoin != nil {
 		h.onJoin(c.roomID, -1)
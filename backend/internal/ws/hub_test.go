@@ -3,12 +3,14 @@ package ws
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"strings"
 	"sync/atomic"
 	"testing"
 	"time"
+	"unicode/utf8"
 
 	"github.com/christopherjohns/chatsphere/internal/message"
 	"nhooyr.io/websocket"
@@ -472,6 +474,40 @@ func TestHubDisconnectRoomClearsKicked(t *testing.T) {
 	}
 }
 
+func TestHubBanCIDR(t *testing.T) {
+	hub := NewHub(nil)
+
+	if err := hub.BanCIDR("room1", "10.0.0.0/24"); err != nil {
+		t.Fatalf("BanCIDR error: %v", err)
+	}
+	if !hub.IsBannedIP("room1", "10.0.0.7") {
+		t.Error("expected IP inside the banned /24 to be banned")
+	}
+	if hub.IsBannedIP("room1", "10.0.1.7") {
+		t.Error("expected IP outside the banned /24 to be allowed")
+	}
+	if hub.IsBannedIP("room2", "10.0.0.7") {
+		t.Error("expected range ban to be scoped to the room")
+	}
+
+	for _, cidr := range []string{"10.0.0.7", "not-a-cidr", "10.0.0.0/8", "2001:db8::/32"} {
+		if err := hub.BanCIDR("room1", cidr); err == nil {
+			t.Errorf("expected %q to be rejected", cidr)
+		}
+	}
+	if err := hub.BanCIDR("room1", "2001:db8::/64"); err != nil {
+		t.Errorf("expected IPv6 /64 to be accepted, got %v", err)
+	}
+	if !hub.IsBannedIP("room1", "[2001:db8::1]") {
+		t.Error("expected bracketed IPv6 address inside the range to be banned")
+	}
+
+	hub.DisconnectRoom("room1")
+	if hub.IsBannedIP("room1", "10.0.0.7") {
+		t.Error("expected range bans to be cleared with the room")
+	}
+}
+
 func TestHubMuteAndIsMuted(t *testing.T) {
 	hub := NewHub(nil)
 
@@ -537,3 +573,456 @@ func TestHubDisconnectRoomClearsMuted(t *testing.T) {
 		t.Error("expected muted map to be cleared after DisconnectRoom")
 	}
 }
+
+func TestHubBroadcastSequenceNumbers(t *testing.T) {
+	hub := NewHub(nil)
+	store := message.NewStore(100)
+	hub.SetMessageStore(store)
+
+	for i := 0; i < 5; i++ {
+		hub.Broadcast("room1", &message.Message{ID: fmt.Sprintf("a%d", i), RoomID: "room1", Type: message.TypeChat})
+		if i < 3 {
+			hub.Broadcast("room2", &message.Message{ID: fmt.Sprintf("b%d", i), RoomID: "room2", Type: message.TypeChat})
+		}
+	}
+
+	for roomID, want := range map[string]int{"room1": 5, "room2": 3} {
+		msgs := store.Recent(roomID, 100)
+		if len(msgs) != want {
+			t.Fatalf("%s: expected %d messages, got %d", roomID, want, len(msgs))
+		}
+		for i, m := range msgs {
+			if m.Seq != int64(i+1) {
+				t.Errorf("%s: message %d expected seq %d, got %d", roomID, i, i+1, m.Seq)
+			}
+		}
+		if hub.LastSeq(roomID) != int64(want) {
+			t.Errorf("%s: expected LastSeq %d, got %d", roomID, want, hub.LastSeq(roomID))
+		}
+	}
+}
+
+func TestHubSequenceContinuesFromStore(t *testing.T) {
+	store := message.NewStore(100)
+	store.Append(&message.Message{ID: "old", RoomID: "room1", Seq: 41})
+
+	// A fresh hub (e.g. after restart) continues numbering from the store.
+	hub := NewHub(nil)
+	hub.SetMessageStore(store)
+	msg := &message.Message{ID: "new", RoomID: "room1", Type: message.TypeChat}
+	hub.Broadcast("room1", msg)
+	if msg.Seq != 42 {
+		t.Errorf("expected seq 42, got %d", msg.Seq)
+	}
+}
+
+func TestHubLastSeqFromStore(t *testing.T) {
+	store := message.NewStore(100)
+	store.Append(&message.Message{ID: "old", RoomID: "room1", Seq: 41, Type: message.TypeChat})
+
+	// A fresh hub reports the stored seq before anything is broadcast, so
+	// the first joiner after a restart doesn't see old chat as unread.
+	hub := NewHub(nil)
+	sessions := NewSessionStore(30 * time.Second)
+	hub.SetMessageStore(store)
+	hub.SetSessionStore(sessions)
+	if got := hub.LastSeq("room1"); got != 41 {
+		t.Errorf("expected last seq 41, got %d", got)
+	}
+	if got := hub.LastSeq("empty"); got != 0 {
+		t.Errorf("expected last seq 0 for a room with no messages, got %d", got)
+	}
+
+	ts := httptest.NewServer(NewHandler(hub, nil, sessions, store))
+	defer ts.Close()
+	conn, _ := dialJoinAndReadSession(t, ts.URL, "room1", "alice", "")
+	defer conn.Close(websocket.StatusNormalClosure, "")
+	readMessage(t, conn) // history
+	if p := readJoined(t, conn); p.Unread != 0 {
+		t.Errorf("expected nothing unread for the first joiner, got %d", p.Unread)
+	}
+}
+
+func TestHubBroadcastStampsMessages(t *testing.T) {
+	hub := NewHub(nil)
+	store := message.NewStore(100)
+	hub.SetMessageStore(store)
+
+	// Callers' own timestamps are ignored, however far off they are.
+	before := hub.Now()
+	hub.Broadcast("room1", &message.Message{RoomID: "room1", Type: message.TypeChat, CreatedAt: before.Add(time.Hour)})
+	hub.Broadcast("room1", &message.Message{RoomID: "room1", Type: message.TypeChat, CreatedAt: before.Add(-time.Hour)})
+	hub.Broadcast("room1", &message.Message{RoomID: "room1", Type: message.TypeChat})
+	after := hub.Now()
+
+	msgs := store.Recent("room1", 100)
+	if len(msgs) != 3 {
+		t.Fatalf("expected 3 messages, got %d", len(msgs))
+	}
+	ids := map[string]bool{}
+	for i, m := range msgs {
+		if m.ID == "" || ids[m.ID] {
+			t.Errorf("message %d: expected a fresh ID, got %q", i, m.ID)
+		}
+		ids[m.ID] = true
+		if m.CreatedAt.Before(before) || m.CreatedAt.After(after) {
+			t.Errorf("message %d: CreatedAt %v not stamped at broadcast", i, m.CreatedAt)
+		}
+		if i == 0 {
+			continue
+		}
+		if m.Seq <= msgs[i-1].Seq {
+			t.Errorf("seq not strictly increasing: %d then %d", msgs[i-1].Seq, m.Seq)
+		}
+		if m.CreatedAt.Before(msgs[i-1].CreatedAt) {
+			t.Errorf("message %d created before message %d", i, i-1)
+		}
+	}
+}
+
+func TestHubRoomCountAfterLeave(t *testing.T) {
+	hub := NewHub(nil)
+	ts1 := newTestServer(t, hub, "room1")
+	defer ts1.Close()
+	ts2 := newTestServer(t, hub, "room2")
+	defer ts2.Close()
+
+	conn1 := dialWS(t, ts1.URL)
+	conn2 := dialWS(t, ts2.URL)
+	waitForClients(t, hub, "room1", 1)
+	waitForClients(t, hub, "room2", 1)
+	if n := hub.RoomCount(); n != 2 {
+		t.Fatalf("expected 2 rooms, got %d", n)
+	}
+
+	conn1.Close(websocket.StatusNormalClosure, "")
+	conn2.Close(websocket.StatusNormalClosure, "")
+	deadline := time.Now().Add(2 * time.Second)
+	for hub.RoomCount() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected 0 rooms after everyone left, got %d", hub.RoomCount())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Leaving already cleaned up, so the sweep has nothing to do.
+	if n := hub.sweepRooms(); n != 0 {
+		t.Errorf("expected the sweep to find nothing, removed %d", n)
+	}
+
+	// An entry left behind with no clients is swept.
+	hub.mu.Lock()
+	hub.rooms["leaked"] = make(map[*Client]struct{})
+	hub.mu.Unlock()
+	if n := hub.sweepRooms(); n != 1 {
+		t.Errorf("expected the sweep to remove 1 leaked entry, removed %d", n)
+	}
+	if n := hub.RoomCount(); n != 0 {
+		t.Errorf("expected 0 rooms after the sweep, got %d", n)
+	}
+}
+
+func TestHubAnnounceReachesAllRooms(t *testing.T) {
+	hub := NewHub(nil)
+	hub.SetMessageStore(message.NewStore(100))
+
+	ts1 := newTestServer(t, hub, "room1")
+	defer ts1.Close()
+	ts2 := newTestServer(t, hub, "room2")
+	defer ts2.Close()
+
+	conn1 := dialWS(t, ts1.URL)
+	defer conn1.Close(websocket.StatusNormalClosure, "")
+	conn2 := dialWS(t, ts2.URL)
+	defer conn2.Close(websocket.StatusNormalClosure, "")
+
+	deadline := time.Now().Add(2 * time.Second)
+	for (hub.ClientCount("room1") == 0 || hub.ClientCount("room2") == 0) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	n := hub.Announce(&message.Message{
+		Content: "maintenance in 10 minutes",
+		Type:    message.TypeSystem,
+		Action:  message.ActionAnnouncement,
+	}, false)
+	if n != 2 {
+		t.Errorf("expected announcement to reach 2 rooms, got %d", n)
+	}
+
+	for roomID, conn := range map[string]*websocket.Conn{"room1": conn1, "room2": conn2} {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		_, data, err := conn.Read(ctx)
+		cancel()
+		if err != nil {
+			t.Fatalf("%s: read error: %v", roomID, err)
+		}
+		var env Envelope
+		json.Unmarshal(data, &env)
+		var msg message.Message
+		json.Unmarshal(env.Payload, &msg)
+		if msg.Action != message.ActionAnnouncement || msg.RoomID != roomID {
+			t.Errorf("%s: unexpected announcement %+v", roomID, msg)
+		}
+	}
+
+	// Non-persistent announcements are not stored.
+	if hub.messages.Count("room1") != 0 {
+		t.Errorf("expected announcement not to be persisted")
+	}
+
+	// Empty rooms are skipped without error.
+	conn2.Close(websocket.StatusNormalClosure, "")
+	deadline = time.Now().Add(2 * time.Second)
+	for hub.ClientCount("room2") != 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := hub.Announce(&message.Message{Content: "again", Type: message.TypeSystem}, true); n != 1 {
+		t.Errorf("expected announcement to reach 1 room, got %d", n)
+	}
+	if hub.messages.Count("room1") != 1 {
+		t.Errorf("expected persistent announcement to be stored")
+	}
+}
+
+// Run with -race: renames must not race with RoomUsers snapshots.
+func TestHubRoomUsersConcurrentRename(t *testing.T) {
+	hub := NewHub(nil)
+	c := &Client{userID: "u1", username: "alice", roomID: "room1", hub: hub}
+	hub.rooms["room1"] = map[*Client]struct{}{c: {}}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 1000; i++ {
+			hub.SetUsername(c, fmt.Sprintf("alice-%d", i))
+		}
+	}()
+
+	for i := 0; i < 1000; i++ {
+		users := hub.RoomUsers("room1")
+		if len(users) != 1 {
+			t.Fatalf("expected 1 user, got %d", len(users))
+		}
+		// Mutating the snapshot must not affect the live client.
+		users[0].Username = "mallory"
+	}
+	<-done
+
+	if got := hub.RoomUsers("room1")[0].Username; got != "alice-999" {
+		t.Errorf("expected final username alice-999, got %q", got)
+	}
+}
+
+// Run with -race: a broadcast that snapshotted its targets before a kick
+// must not panic sending to the kicked client's closed channel.
+func TestHubKickDuringBroadcast(t *testing.T) {
+	hub := NewHub(nil)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			t.Errorf("accept error: %v", err)
+			return
+		}
+		client := &Client{
+			conn:   conn,
+			userID: r.URL.Query().Get("user_id"),
+			roomID: "room1",
+			hub:    hub,
+		}
+		hub.addClient(client)
+		defer hub.removeClient(client)
+		for {
+			if _, _, err := conn.Read(r.Context()); err != nil {
+				return
+			}
+		}
+	}))
+	defer ts.Close()
+
+	const n = 20
+	for i := 0; i < n; i++ {
+		conn := dialWS(t, fmt.Sprintf("%s?user_id=u%d", ts.URL, i))
+		defer conn.Close(websocket.StatusNormalClosure, "")
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for hub.ClientCount("room1") < n && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if hub.ClientCount("room1") != n {
+		t.Fatalf("expected %d clients, got %d", n, hub.ClientCount("room1"))
+	}
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			hub.Broadcast("room1", &message.Message{ID: fmt.Sprintf("m%d", i), RoomID: "room1", Type: message.TypeChat})
+		}
+	}()
+
+	for i := 0; i < n; i++ {
+		if c := hub.FindClient("room1", fmt.Sprintf("u%d", i)); c != nil {
+			hub.KickClient(c, "kicked")
+		}
+	}
+	close(stop)
+	<-done
+
+	if got := hub.ClientCount("room1"); got != 0 {
+		t.Errorf("expected all clients kicked, got %d", got)
+	}
+}
+
+func TestNewHubWithConnManagerEnforcesMaxConns(t *testing.T) {
+	cm := NewConnManager(WithMaxConns(2))
+	hub := NewHubWithConnManager(nil, cm)
+	if hub.ConnMgr() != cm {
+		t.Fatal("expected hub to use the injected ConnManager")
+	}
+	sessions := NewSessionStore(30 * time.Second)
+	ts := httptest.NewServer(NewHandler(hub, nil, sessions, nil))
+	defer ts.Close()
+
+	for i, name := range []string{"alice", "bob"} {
+		conn := dialAndJoin(t, ts.URL, "room1", name)
+		defer conn.Close(websocket.StatusNormalClosure, "")
+		waitForClients(t, hub, "room1", i+1)
+	}
+
+	carol, _ := dialJoinAndReadSession(t, ts.URL, "room1", "carol", "")
+	defer carol.Close(websocket.StatusNormalClosure, "")
+	drainSystemMessages(t, carol, 1) // history
+	if got := readError(t, carol); got != "server at capacity, retry shortly" {
+		t.Fatalf("expected third client to be rejected, got %q", got)
+	}
+	if n := cm.Count(); n != 2 {
+		t.Errorf("expected 2 managed connections, got %d", n)
+	}
+	if got := cm.Stats().Rejected; got != 1 {
+		t.Errorf("expected 1 rejection, got %d", got)
+	}
+}
+
+func TestHubAddReadOnly(t *testing.T) {
+	hub := NewHub(nil)
+
+	ch, remove := hub.AddReadOnly("room1")
+	if n := hub.ClientCount("room1"); n != 0 {
+		t.Errorf("read-only subscriber should not count as a client, got %d", n)
+	}
+
+	hub.Broadcast("room1", &message.Message{ID: "m1", RoomID: "room1", Content: "hi", Type: message.TypeChat})
+	hub.Broadcast("room2", &message.Message{ID: "m2", RoomID: "room2", Content: "elsewhere", Type: message.TypeChat})
+
+	select {
+	case data := <-ch:
+		var env Envelope
+		if err := json.Unmarshal(data, &env); err != nil {
+			t.Fatalf("unmarshal error: %v", err)
+		}
+		var msg message.Message
+		json.Unmarshal(env.Payload, &msg)
+		if env.Type != "chat" || msg.ID != "m1" {
+			t.Errorf("expected chat m1, got %s %s", env.Type, msg.ID)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the broadcast on the read-only channel")
+	}
+	select {
+	case data := <-ch:
+		t.Fatalf("unexpected envelope from another room: %s", data)
+	default:
+	}
+
+	remove()
+	if _, ok := <-ch; ok {
+		t.Error("expected channel closed after remove")
+	}
+	remove() // idempotent
+
+	// Expiring the room closes its subscribers too.
+	ch2, remove2 := hub.AddReadOnly("room1")
+	defer remove2()
+	hub.DisconnectRoom("room1")
+	if _, ok := <-ch2; ok {
+		t.Error("expected channel closed when the room is disconnected")
+	}
+}
+
+func TestHubBroadcastWithStats(t *testing.T) {
+	hub := NewHub(nil)
+
+	// The clients need no connection: nothing drains their send buffers.
+	now := time.Now()
+	clients := make([]*Client, 3)
+	hub.rooms["room1"] = make(map[*Client]struct{})
+	for i := range clients {
+		c := &Client{userID: fmt.Sprintf("user-%d", i), roomID: "room1"}
+		c.send = make(chan []byte, sendBufferSize)
+		_, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		hub.conns.mu.Lock()
+		hub.conns.clients[c] = &connEntry{cancel: cancel, connectedAt: now, lastActive: now}
+		hub.conns.mu.Unlock()
+		hub.rooms["room1"][c] = struct{}{}
+		clients[i] = c
+	}
+	for i := 0; i < sendBufferSize; i++ {
+		clients[0].send <- []byte("backlog")
+	}
+
+	delivered, dropped := hub.BroadcastWithStats("room1", &message.Message{
+		RoomID: "room1", Content: "hello", Type: message.TypeChat,
+	})
+	if delivered != 2 || dropped != 1 {
+		t.Errorf("expected 2 delivered and 1 dropped, got %d and %d", delivered, dropped)
+	}
+	if delivered, dropped := hub.BroadcastWithStats("empty", &message.Message{
+		RoomID: "empty", Content: "hello", Type: message.TypeChat,
+	}); delivered != 0 || dropped != 0 {
+		t.Errorf("expected nothing for an empty room, got %d and %d", delivered, dropped)
+	}
+}
+
+func TestHubUniqueUsernameTruncatesOnRune(t *testing.T) {
+	hub := NewHub(nil)
+	hub.RequireUniqueUsernames("room1")
+	name := "a" + strings.Repeat("é", 14) // 29 bytes
+	hub.rooms["room1"] = map[*Client]struct{}{
+		{userID: "user-1", roomID: "room1", username: name}: {},
+	}
+
+	got := hub.uniqueUsername("room1", name, nil)
+	if !utf8.ValidString(got) {
+		t.Fatalf("expected valid UTF-8, got %q", got)
+	}
+	if want := "a" + strings.Repeat("é", 12) + " (2)"; got != want {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+}
+
+func TestHubBroadcastRefusedWhenFull(t *testing.T) {
+	hub := NewHub(nil)
+	store := message.NewStore(200)
+	store.SetRoomLimit("room1", 1, message.OverflowRejectNew)
+	hub.SetMessageStore(store)
+
+	if !hub.Broadcast("room1", &message.Message{RoomID: "room1", Content: "one", Type: message.TypeChat}) {
+		t.Fatal("expected the first message to be accepted")
+	}
+	refused := &message.Message{RoomID: "room1", Content: "two", Type: message.TypeChat}
+	if hub.Broadcast("room1", refused) || refused.Seq != 0 {
+		t.Errorf("expected a full room to refuse chat, got seq %d", refused.Seq)
+	}
+	if !hub.Broadcast("room1", &message.Message{RoomID: "room1", Content: "bob joined", Type: message.TypeSystem}) {
+		t.Error("expected a full room to still accept system messages")
+	}
+}
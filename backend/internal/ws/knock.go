@@ -0,0 +1,258 @@
+package ws
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/christopherjohns/chatsphere/internal/message"
+	"nhooyr.io/websocket"
+)
+
+// defaultKnockTimeout is how long a knock waits for the host to respond.
+const defaultKnockTimeout = 60 * time.Second
+
+// KnockPayload is sent by the server to the host when a user asks to join
+// a knock-only room.
+type KnockPayload struct {
+	RequestID string `json:"request_id"`
+	UserID    string `json:"user_id"`
+	Username  string `json:"username"`
+}
+
+// KnockPendingPayload is sent to the requester while the host decides.
+type KnockPendingPayload struct {
+	RequestID string `json:"request_id"`
+}
+
+// KnockResponsePayload is sent by the host to admit or deny a knock.
+type KnockResponsePayload struct {
+	RequestID string `json:"request_id"`
+}
+
+// SetKnockPayload is sent by the host to turn knock-to-join on or off.
+type SetKnockPayload struct {
+	Enabled bool `json:"enabled"`
+}
+
+// pendingKnock is a join request waiting for the host's decision.
+type pendingKnock struct {
+	roomID   string
+	userID   string
+	decision chan bool
+}
+
+// SetKnockRequired enables or disables knock-to-join for a room. When
+// enabled, users other than the host must knock and be admitted.
+func (h *Hub) SetKnockRequired(roomID string, required bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if required {
+		h.knockRooms[roomID] = true
+	} else {
+		delete(h.knockRooms, roomID)
+	}
+}
+
+// KnockRequired reports whether the room is knock-to-join.
+func (h *Hub) KnockRequired(roomID string) bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.knockRooms[roomID]
+}
+
+// NeedsKnock reports whether the user must knock before joining the room.
+// The host, previously admitted users, and the first user into a room with
+// no host yet (who becomes the host) may enter directly.
+func (h *Hub) NeedsKnock(roomID, userID string) bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if !h.knockRooms[roomID] {
+		return false
+	}
+	if host, ok := h.hosts[roomID]; !ok || host == userID {
+		return false
+	}
+	_, ok := h.admitted[roomID][userID]
+	return !ok
+}
+
+// Knock registers a pending join request and relays it to the room host.
+// It returns the request ID and a channel that receives the host's
+// decision. ok is false if no host is connected to answer.
+func (h *Hub) Knock(roomID, userID, username string) (requestID string, decision <-chan bool, ok bool) {
+	h.mu.RLock()
+	hostID, hasHost := h.hosts[roomID]
+	h.mu.RUnlock()
+	if !hasHost {
+		return "", nil, false
+	}
+
+	requestID = generateClientID()
+	data, err := json.Marshal(KnockPayload{RequestID: requestID, UserID: userID, Username: username})
+	if err != nil {
+		return "", nil, false
+	}
+	env, err := json.Marshal(Envelope{Type: "knock", Payload: data})
+	if err != nil {
+		return "", nil, false
+	}
+
+	ch := make(chan bool, 1)
+	h.mu.Lock()
+	h.knocks[requestID] = &pendingKnock{roomID: roomID, userID: userID, decision: ch}
+	h.mu.Unlock()
+
+	if !h.SendToUser(roomID, hostID, env) {
+		h.cancelKnock(requestID)
+		return "", nil, false
+	}
+	return requestID, ch, true
+}
+
+// ResolveKnock delivers the host's decision for a pending knock in the room.
+// Admitted users are remembered so they can reconnect without knocking.
+// Returns false if no such request is pending.
+func (h *Hub) ResolveKnock(roomID, requestID string, admit bool) bool {
+	h.mu.Lock()
+	k, ok := h.knocks[requestID]
+	if !ok || k.roomID != roomID {
+		h.mu.Unlock()
+		return false
+	}
+	delete(h.knocks, requestID)
+	if admit {
+		if h.admitted[roomID] == nil {
+			h.admitted[roomID] = make(map[string]struct{})
+		}
+		h.admitted[roomID][k.userID] = struct{}{}
+	}
+	h.mu.Unlock()
+
+	k.decision <- admit
+	return true
+}
+
+// cancelKnock drops a pending knock (e.g. on timeout).
+func (h *Hub) cancelKnock(requestID string) {
+	h.mu.Lock()
+	delete(h.knocks, requestID)
+	h.mu.Unlock()
+}
+
+// PendingKnocks returns the number of unanswered knocks.
+func (h *Hub) PendingKnocks() int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return len(h.knocks)
+}
+
+// SendToUser queues raw envelope data to every connection the user holds
+// in the room. Returns false if the user is not connected there.
+func (h *Hub) SendToUser(roomID, userID string, data []byte) bool {
+	h.mu.RLock()
+	var targets []*Client
+	for c := range h.rooms[roomID] {
+		if c.userID == userID {
+			targets = append(targets, c)
+		}
+	}
+	h.mu.RUnlock()
+
+	sent := false
+	for _, c := range targets {
+		if h.conns.Send(c, data) {
+			sent = true
+		}
+	}
+	return sent
+}
+
+// awaitKnock relays a knock to the host and blocks until the host admits
+// or denies the client, or the knock times out. On denial or timeout the
+// connection is closed with a reason and false is returned.
+func (h *Handler) awaitKnock(ctx context.Context, client *Client, roomID, username string) bool {
+	requestID, decision, ok := h.hub.Knock(roomID, client.userID, username)
+	if !ok {
+		closeWithError(client.conn, "no host is available to admit you")
+		return false
+	}
+
+	data, _ := json.Marshal(KnockPendingPayload{RequestID: requestID})
+	env, _ := json.Marshal(Envelope{Type: "knock_pending", Payload: data})
+	writeCtx, cancel := context.WithTimeout(ctx, writeTimeout)
+	err := client.conn.Write(writeCtx, websocket.MessageText, env)
+	cancel()
+	if err != nil {
+		log.Printf("ws: failed to write knock_pending: %v", err)
+		h.hub.cancelKnock(requestID)
+		return false
+	}
+
+	timer := time.NewTimer(h.knockTimeout)
+	defer timer.Stop()
+	select {
+	case admit := <-decision:
+		if !admit {
+			closeWithError(client.conn, "the host denied your request to join")
+			return false
+		}
+		return true
+	case <-timer.C:
+		h.hub.cancelKnock(requestID)
+		closeWithError(client.conn, "your request to join timed out")
+		return false
+	case <-ctx.Done():
+		h.hub.cancelKnock(requestID)
+		return false
+	}
+}
+
+// handleKnockResponse lets the host admit or deny a pending knock.
+func (h *Handler) handleKnockResponse(ctx context.Context, client *Client, payload json.RawMessage, admit bool) {
+	if !client.isCreator {
+		h.sendError(ctx, client, ErrorCodeNotHost, "only the room host can answer join requests")
+		return
+	}
+	var p KnockResponsePayload
+	if err := json.Unmarshal(payload, &p); err != nil || p.RequestID == "" {
+		h.sendError(ctx, client, ErrorCodeInvalidPayload, "invalid knock response payload")
+		return
+	}
+	if !h.hub.ResolveKnock(client.roomID, p.RequestID, admit) {
+		h.sendError(ctx, client, ErrorCodeNotFound, "join request not found or already answered")
+	}
+}
+
+// handleSetKnock lets the host turn knock-to-join on or off and tells the
+// room. Users already admitted stay admitted.
+func (h *Handler) handleSetKnock(ctx context.Context, client *Client, payload json.RawMessage) {
+	if !client.isCreator {
+		h.sendError(ctx, client, ErrorCodeNotHost, "only the room host can change who may join")
+		return
+	}
+	var p SetKnockPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		h.sendError(ctx, client, ErrorCodeInvalidPayload, "invalid set_knock payload")
+		return
+	}
+	if h.hub.KnockRequired(client.roomID) == p.Enabled {
+		return
+	}
+
+	h.hub.SetKnockRequired(client.roomID, p.Enabled)
+	content := "Anyone with the link can join again"
+	if p.Enabled {
+		content = "Joining now needs the host's approval"
+	}
+	h.hub.Broadcast(client.roomID, &message.Message{
+		RoomID:   client.roomID,
+		UserID:   client.userID,
+		Username: client.username,
+		Color:    client.color,
+		Content:  content,
+		Type:     message.TypeSystem,
+		Action:   message.ActionKnock,
+	})
+}
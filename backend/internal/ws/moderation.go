@@ -0,0 +1,190 @@
+package ws
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// ModerationStore holds room bans and mutes outside the hub so every
+// replica behind a load balancer enforces the same moderation state.
+//
+// The lookups return an error when the store can't be reached, and the hub
+// never reads that as "not banned": ban checks fail closed, so a join is
+// refused with a retryable close until the store is back, and mute checks
+// fall back to the mutes this replica has applied itself.
+type ModerationStore interface {
+	Ban(roomID, userID, ip string)
+	IsBanned(roomID, userID string) (bool, error)
+	// BanCIDR bans an IP range, given in canonical CIDR notation.
+	BanCIDR(roomID, cidr string)
+	// IsBannedIP reports whether ip is banned directly or by range.
+	IsBannedIP(roomID, ip string) (bool, error)
+	// Mute mutes a user; a zero duration mutes until Unmute is called.
+	Mute(roomID, userID string, duration time.Duration)
+	Unmute(roomID, userID string)
+	IsMuted(roomID, userID string) (bool, error)
+	DeleteRoom(roomID string)
+}
+
+// SetModerationStore makes the hub read and write bans and mutes through
+// store instead of its in-memory maps.
+func (h *Hub) SetModerationStore(store ModerationStore) {
+	h.moderation = store
+}
+
+// RedisModerationStore keeps bans in a Redis set per room and each mute in
+// its own key, so timed mutes expire through the key's TTL.
+type RedisModerationStore struct {
+	client redis.Cmdable
+}
+
+// NewRedisModerationStore creates a ModerationStore backed by Redis.
+func NewRedisModerationStore(client redis.Cmdable) *RedisModerationStore {
+	return &RedisModerationStore{client: client}
+}
+
+func bannedKey(roomID string) string {
+	return "room:" + roomID + ":banned"
+}
+
+func bannedIPsKey(roomID string) string {
+	return "room:" + roomID + ":banned_ips"
+}
+
+func bannedCIDRsKey(roomID string) string {
+	return "room:" + roomID + ":banned_cidrs"
+}
+
+func mutedKey(roomID, userID string) string {
+	return "room:" + roomID + ":muted:" + userID
+}
+
+// mutedPattern matches every mute key in a room.
+func mutedPattern(roomID string) string {
+	return "room:" + roomID + ":muted:*"
+}
+
+// Ban adds userID, and ip if non-empty, to the room's ban sets.
+func (s *RedisModerationStore) Ban(roomID, userID, ip string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	pipe := s.client.Pipeline()
+	pipe.SAdd(ctx, bannedKey(roomID), userID)
+	if ip != "" {
+		pipe.SAdd(ctx, bannedIPsKey(roomID), ip)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Printf("redis: failed to ban user: %v", err)
+	}
+}
+
+// IsBanned reports whether userID is in the room's ban set.
+func (s *RedisModerationStore) IsBanned(roomID, userID string) (bool, error) {
+	return s.isMember(bannedKey(roomID), userID)
+}
+
+// BanCIDR adds cidr to the room's range ban set.
+func (s *RedisModerationStore) BanCIDR(roomID, cidr string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	if err := s.client.SAdd(ctx, bannedCIDRsKey(roomID), cidr).Err(); err != nil {
+		log.Printf("redis: failed to ban range: %v", err)
+	}
+}
+
+// IsBannedIP reports whether ip is in the room's IP ban set or inside one
+// of its banned ranges.
+func (s *RedisModerationStore) IsBannedIP(roomID, ip string) (bool, error) {
+	if ip == "" {
+		return false, nil
+	}
+	if banned, err := s.isMember(bannedIPsKey(roomID), ip); err != nil || banned {
+		return banned, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	members, err := s.client.SMembers(ctx, bannedCIDRsKey(roomID)).Result()
+	if err != nil {
+		return false, fmt.Errorf("redis: read banned ranges: %w", err)
+	}
+	cidrs := make([]*net.IPNet, 0, len(members))
+	for _, m := range members {
+		if _, ipnet, err := net.ParseCIDR(m); err == nil {
+			cidrs = append(cidrs, ipnet)
+		}
+	}
+	return inCIDRs(ip, cidrs), nil
+}
+
+func (s *RedisModerationStore) isMember(key, member string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	ok, err := s.client.SIsMember(ctx, key, member).Result()
+	if err != nil {
+		return false, fmt.Errorf("redis: check %s: %w", key, err)
+	}
+	return ok, nil
+}
+
+// Mute sets the user's mute key, expiring after duration if positive.
+func (s *RedisModerationStore) Mute(roomID, userID string, duration time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	if duration < 0 {
+		duration = 0
+	}
+	if err := s.client.Set(ctx, mutedKey(roomID, userID), "1", duration).Err(); err != nil {
+		log.Printf("redis: failed to mute user: %v", err)
+	}
+}
+
+// Unmute removes the user's mute key.
+func (s *RedisModerationStore) Unmute(roomID, userID string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	if err := s.client.Del(ctx, mutedKey(roomID, userID)).Err(); err != nil {
+		log.Printf("redis: failed to unmute user: %v", err)
+	}
+}
+
+// IsMuted reports whether the user's mute key exists.
+func (s *RedisModerationStore) IsMuted(roomID, userID string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	n, err := s.client.Exists(ctx, mutedKey(roomID, userID)).Result()
+	if err != nil {
+		return false, fmt.Errorf("redis: check mute: %w", err)
+	}
+	return n > 0, nil
+}
+
+// DeleteRoom removes every ban and mute for a room.
+func (s *RedisModerationStore) DeleteRoom(roomID string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	keys := []string{bannedKey(roomID), bannedIPsKey(roomID), bannedCIDRsKey(roomID)}
+	iter := s.client.Scan(ctx, 0, mutedPattern(roomID), 100).Iterator()
+	for iter.Next(ctx) {
+		keys = append(keys, iter.Val())
+	}
+	if err := iter.Err(); err != nil {
+		log.Printf("redis: failed to scan room mutes: %v", err)
+	}
+	if err := s.client.Del(ctx, keys...).Err(); err != nil {
+		log.Printf("redis: failed to delete room moderation state: %v", err)
+	}
+}
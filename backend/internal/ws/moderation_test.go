@@ -0,0 +1,115 @@
+package ws
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+// newSharedHubs returns two hubs backed by the same Redis, standing in for
+// two replicas of the server.
+func newSharedHubs(t *testing.T) (*Hub, *Hub, *miniredis.Miniredis) {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	hubs := make([]*Hub, 2)
+	for i := range hubs {
+		client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+		t.Cleanup(func() { client.Close() })
+		hubs[i] = NewHub(nil)
+		hubs[i].SetModerationStore(NewRedisModerationStore(client))
+	}
+	return hubs[0], hubs[1], mr
+}
+
+func TestModerationStoreSharesBans(t *testing.T) {
+	a, b, _ := newSharedHubs(t)
+
+	a.Ban("room1", "user1", "203.0.113.7")
+	if !b.IsBanned("room1", "user1") {
+		t.Error("expected ban set on one hub to be seen by the other")
+	}
+	if !b.IsBannedIP("room1", "203.0.113.7") {
+		t.Error("expected IP ban to be shared")
+	}
+	if b.IsBanned("room2", "user1") || b.IsBannedIP("room1", "") {
+		t.Error("expected bans to be scoped to the room")
+	}
+
+	a.DisconnectRoom("room1")
+	if b.IsBanned("room1", "user1") || b.IsBannedIP("room1", "203.0.113.7") {
+		t.Error("expected bans to be cleared with the room")
+	}
+}
+
+func TestModerationStoreSharesCIDRBans(t *testing.T) {
+	a, b, _ := newSharedHubs(t)
+
+	if err := a.BanCIDR("room1", "198.51.100.0/24"); err != nil {
+		t.Fatalf("BanCIDR error: %v", err)
+	}
+	if !b.IsBannedIP("room1", "198.51.100.9") {
+		t.Error("expected range ban to be shared")
+	}
+	if b.IsBannedIP("room1", "198.51.101.9") {
+		t.Error("expected IP outside the range to be allowed")
+	}
+
+	a.DisconnectRoom("room1")
+	if b.IsBannedIP("room1", "198.51.100.9") {
+		t.Error("expected range bans to be cleared with the room")
+	}
+}
+
+func TestModerationStoreSharesMutes(t *testing.T) {
+	a, b, mr := newSharedHubs(t)
+
+	if !a.Mute("room1", "user1", 0) {
+		t.Fatal("expected user to be muted")
+	}
+	if !b.IsMuted("room1", "user1") {
+		t.Error("expected mute to be shared")
+	}
+	// Toggling on the other replica unmutes.
+	if b.Mute("room1", "user1", 0) {
+		t.Fatal("expected second mute to toggle off")
+	}
+	if a.IsMuted("room1", "user1") {
+		t.Error("expected unmute to be shared")
+	}
+
+	a.Mute("room1", "user2", 30*time.Second)
+	if ttl := mr.TTL(mutedKey("room1", "user2")); ttl != 30*time.Second {
+		t.Errorf("expected mute key TTL of 30s, got %v", ttl)
+	}
+	mr.FastForward(31 * time.Second)
+	if b.IsMuted("room1", "user2") {
+		t.Error("expected timed mute to expire")
+	}
+}
+
+func TestModerationStoreUnavailable(t *testing.T) {
+	a, _, mr := newSharedHubs(t)
+
+	a.Mute("room1", "user1", 0)
+	mr.SetError("LOADING Redis is loading the dataset in memory")
+
+	if !a.IsBanned("room1", "user2") || !a.IsBannedIP("room1", "203.0.113.7") {
+		t.Error("expected ban checks to fail closed while the store is down")
+	}
+	if _, err := a.banStatus("room1", "user2", "203.0.113.7"); err == nil {
+		t.Error("expected banStatus to report the store error")
+	}
+	if !a.IsMuted("room1", "user1") {
+		t.Error("expected a mute applied on this hub to hold while the store is down")
+	}
+	if a.IsMuted("room1", "user2") {
+		t.Error("expected an unknown user not to be muted while the store is down")
+	}
+
+	mr.SetError("")
+	if banned, err := a.banStatus("room1", "user2", "203.0.113.7"); err != nil || banned {
+		t.Errorf("expected no ban once the store is back, got %v, %v", banned, err)
+	}
+}
@@ -0,0 +1,186 @@
+package ws
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"log"
+	"slices"
+
+	"github.com/christopherjohns/chatsphere/internal/message"
+	"nhooyr.io/websocket"
+)
+
+// Role is a user's standing in a room, as reported by "who".
+type Role string
+
+const (
+	RoleHost  Role = "host"
+	RoleMod   Role = "mod"
+	RoleGuest Role = "guest"
+)
+
+// SetModPayload is sent by the host to make a user a moderator or to take
+// the role away.
+type SetModPayload struct {
+	UserID string `json:"user_id"`
+	Mod    bool   `json:"mod"`
+}
+
+// WhoUser is one entry of a "who" response.
+type WhoUser struct {
+	UserID   string `json:"user_id"`
+	Username string `json:"username"`
+	Role     Role   `json:"role"`
+}
+
+// WhoPayload is sent in reply to "who": everyone in the room, the host
+// first, then moderators, then guests, each by username.
+type WhoPayload struct {
+	Users []WhoUser `json:"users"`
+}
+
+// SetMod makes userID a moderator of the room, or takes the role away.
+func (h *Hub) SetMod(roomID, userID string, mod bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !mod {
+		delete(h.mods[roomID], userID)
+		return
+	}
+	if h.mods[roomID] == nil {
+		h.mods[roomID] = make(map[string]struct{})
+	}
+	h.mods[roomID][userID] = struct{}{}
+}
+
+// IsMod reports whether the host made userID a moderator of the room.
+func (h *Hub) IsMod(roomID, userID string) bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	_, ok := h.mods[roomID][userID]
+	return ok
+}
+
+// canSeeLocked reports whether c may see msg: messages for moderators
+// reach only the host and the room's moderators. Must be called with h.mu
+// held.
+func (h *Hub) canSeeLocked(c *Client, msg *message.Message) bool {
+	if msg.Audience != message.AudienceMods || c.isCreator {
+		return true
+	}
+	_, ok := h.mods[c.roomID][c.userID]
+	return ok
+}
+
+// visibleTo returns the messages of msgs that c may see.
+func (h *Hub) visibleTo(c *Client, msgs []*message.Message) []*message.Message {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	visible := make([]*message.Message, 0, len(msgs))
+	for _, m := range msgs {
+		if h.canSeeLocked(c, m) {
+			visible = append(visible, m)
+		}
+	}
+	return visible
+}
+
+// sendToAudience is sendToRoom for an envelope about msg, skipping
+// clients that may not see it.
+func (h *Hub) sendToAudience(roomID string, msg *message.Message, data []byte) {
+	h.mu.RLock()
+	targets := make([]*Client, 0, len(h.rooms[roomID]))
+	for c := range h.rooms[roomID] {
+		if h.canSeeLocked(c, msg) {
+			targets = append(targets, c)
+		}
+	}
+	h.mu.RUnlock()
+
+	for _, c := range targets {
+		h.conns.Send(c, data)
+	}
+}
+
+// Who returns the room's roster with each user's role.
+func (h *Hub) Who(roomID string) []WhoUser {
+	h.mu.RLock()
+	host := h.hosts[roomID]
+	users := make([]WhoUser, 0, len(h.rooms[roomID]))
+	for c := range h.rooms[roomID] {
+		role := RoleGuest
+		if c.userID == host {
+			role = RoleHost
+		} else if _, ok := h.mods[roomID][c.userID]; ok {
+			role = RoleMod
+		}
+		users = append(users, WhoUser{UserID: c.userID, Username: c.username, Role: role})
+	}
+	h.mu.RUnlock()
+
+	rank := map[Role]int{RoleHost: 0, RoleMod: 1, RoleGuest: 2}
+	slices.SortFunc(users, func(a, b WhoUser) int {
+		return cmp.Or(cmp.Compare(rank[a.Role], rank[b.Role]), cmp.Compare(a.Username, b.Username))
+	})
+	return users
+}
+
+// handleWho sends the client the room's roster. Any member may ask.
+func (h *Handler) handleWho(ctx context.Context, client *Client) {
+	data, err := json.Marshal(WhoPayload{Users: h.hub.Who(client.roomID)})
+	if err != nil {
+		log.Printf("ws: failed to marshal who payload: %v", err)
+		return
+	}
+	env, err := json.Marshal(Envelope{Type: "who", Payload: data})
+	if err != nil {
+		log.Printf("ws: failed to marshal who envelope: %v", err)
+		return
+	}
+	writeCtx, cancel := context.WithTimeout(ctx, writeTimeout)
+	defer cancel()
+	if err := client.conn.Write(writeCtx, websocket.MessageText, env); err != nil {
+		log.Printf("ws: failed to write who: %v", err)
+	}
+}
+
+// handleSetMod lets the host make a user in the room a moderator, or take
+// the role away, and tells the room.
+func (h *Handler) handleSetMod(ctx context.Context, client *Client, payload json.RawMessage) {
+	if !client.isCreator {
+		h.sendError(ctx, client, ErrorCodeNotHost, "only the room host can choose moderators")
+		return
+	}
+	var p SetModPayload
+	if err := json.Unmarshal(payload, &p); err != nil || p.UserID == "" {
+		h.sendError(ctx, client, ErrorCodeInvalidPayload, "invalid set_mod payload")
+		return
+	}
+	if p.UserID == client.userID {
+		h.sendError(ctx, client, ErrorCodeInvalidTarget, "the host cannot also be a moderator")
+		return
+	}
+	target := h.hub.FindClient(client.roomID, p.UserID)
+	if target == nil {
+		h.sendError(ctx, client, ErrorCodeNotFound, "user not found in room")
+		return
+	}
+	if h.hub.IsMod(client.roomID, p.UserID) == p.Mod {
+		return
+	}
+
+	h.hub.SetMod(client.roomID, p.UserID, p.Mod)
+	content := target.username + " is now a moderator"
+	if !p.Mod {
+		content = target.username + " is no longer a moderator"
+	}
+	h.hub.Broadcast(client.roomID, &message.Message{
+		RoomID:   client.roomID,
+		UserID:   target.userID,
+		Username: target.username,
+		Content:  content,
+		Type:     message.TypeSystem,
+		Action:   message.ActionMod,
+	})
+}
@@ -0,0 +1,219 @@
+package ws
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/christopherjohns/chatsphere/internal/message"
+	"nhooyr.io/websocket"
+)
+
+func TestHandlerWho(t *testing.T) {
+	ts, hub, _ := newHandlerTestServer(t, nil)
+	defer ts.Close()
+
+	alice := dialAndJoin(t, ts.URL, "room1", "alice")
+	defer alice.Close(websocket.StatusNormalClosure, "")
+	waitForClients(t, hub, "room1", 1)
+	drainSystemMessages(t, alice, 1) // "alice joined"
+	bob := dialAndJoin(t, ts.URL, "room1", "bob")
+	defer bob.Close(websocket.StatusNormalClosure, "")
+	waitForClients(t, hub, "room1", 2)
+	drainSystemMessages(t, alice, 1) // "bob joined"
+	drainSystemMessages(t, bob, 1)
+	carol := dialAndJoin(t, ts.URL, "room1", "carol")
+	defer carol.Close(websocket.StatusNormalClosure, "")
+	waitForClients(t, hub, "room1", 3)
+	drainSystemMessages(t, alice, 1) // "carol joined"
+	drainSystemMessages(t, bob, 1)
+	drainSystemMessages(t, carol, 1)
+
+	var carolID string
+	for _, u := range hub.RoomUsers("room1") {
+		if u.Username == "carol" {
+			carolID = u.UserID
+		}
+	}
+
+	// Only the host may promote.
+	sendEnvelope(t, bob, "set_mod", SetModPayload{UserID: carolID, Mod: true})
+	if got := readError(t, bob); got != "only the room host can choose moderators" {
+		t.Errorf("unexpected error %q", got)
+	}
+
+	sendEnvelope(t, alice, "set_mod", SetModPayload{UserID: carolID, Mod: true})
+	if _, msg := readMessage(t, bob); msg.Content != "carol is now a moderator" {
+		t.Fatalf("expected the promotion to be announced, got %q", msg.Content)
+	}
+
+	sendEnvelope(t, bob, "who", struct{}{})
+	env, _ := readMessage(t, bob)
+	if env.Type != "who" {
+		t.Fatalf("expected who, got %s", env.Type)
+	}
+	var who WhoPayload
+	if err := json.Unmarshal(env.Payload, &who); err != nil {
+		t.Fatalf("unmarshal who: %v", err)
+	}
+	want := []WhoUser{
+		{Username: "alice", Role: RoleHost},
+		{Username: "carol", Role: RoleMod},
+		{Username: "bob", Role: RoleGuest},
+	}
+	if len(who.Users) != len(want) {
+		t.Fatalf("expected %d users, got %+v", len(want), who.Users)
+	}
+	for i, w := range want {
+		if got := who.Users[i]; got.Username != w.Username || got.Role != w.Role {
+			t.Errorf("user %d: expected %s as %s, got %s as %s", i, w.Username, w.Role, got.Username, got.Role)
+		}
+	}
+}
+
+func TestHandlerModAudience(t *testing.T) {
+	ts, hub, _ := newHandlerTestServer(t, nil)
+	defer ts.Close()
+
+	alice := dialAndJoin(t, ts.URL, "room1", "alice")
+	defer alice.Close(websocket.StatusNormalClosure, "")
+	waitForClients(t, hub, "room1", 1)
+	drainSystemMessages(t, alice, 1) // "alice joined"
+	bob, sp := dialJoinAndReadSession(t, ts.URL, "room1", "bob", "")
+	readMessage(t, bob) // history
+	readJoined(t, bob)
+	waitForClients(t, hub, "room1", 2)
+	drainSystemMessages(t, alice, 1) // "bob joined"
+	drainSystemMessages(t, bob, 1)
+	carol := dialAndJoin(t, ts.URL, "room1", "carol")
+	defer carol.Close(websocket.StatusNormalClosure, "")
+	waitForClients(t, hub, "room1", 3)
+	drainSystemMessages(t, alice, 1) // "carol joined"
+	drainSystemMessages(t, bob, 1)
+	drainSystemMessages(t, carol, 1)
+
+	var carolID string
+	for _, u := range hub.RoomUsers("room1") {
+		if u.Username == "carol" {
+			carolID = u.UserID
+		}
+	}
+	sendEnvelope(t, alice, "set_mod", SetModPayload{UserID: carolID, Mod: true})
+	drainSystemMessages(t, alice, 1) // "carol is now a moderator"
+	drainSystemMessages(t, bob, 1)
+	drainSystemMessages(t, carol, 1)
+
+	// Guests can't post to moderators.
+	sendEnvelope(t, bob, "chat", ChatPayload{Content: "let me in", Audience: message.AudienceMods})
+	if got := readError(t, bob); got != "only the host and moderators can post to moderators" {
+		t.Errorf("unexpected error %q", got)
+	}
+
+	sendEnvelope(t, carol, "chat", ChatPayload{Content: "keep an eye on bob", Audience: message.AudienceMods})
+	if _, msg := readMessage(t, alice); msg.Content != "keep an eye on bob" || msg.Audience != message.AudienceMods {
+		t.Fatalf("expected the host to get the moderators' message, got %+v", msg)
+	}
+	drainSystemMessages(t, carol, 1)
+
+	// Bob's next message is the host's, so he never got carol's.
+	sendEnvelope(t, alice, "chat", ChatPayload{Content: "hi all"})
+	if _, msg := readMessage(t, bob); msg.Content != "hi all" {
+		t.Fatalf("expected the guest to skip the moderators' message, got %q", msg.Content)
+	}
+	drainSystemMessages(t, alice, 1)
+	drainSystemMessages(t, carol, 1)
+
+	bob.Close(websocket.StatusNormalClosure, "")
+	waitForClients(t, hub, "room1", 2)
+	drainSystemMessages(t, alice, 1) // "bob left"
+	drainSystemMessages(t, carol, 1)
+	sendEnvelope(t, carol, "chat", ChatPayload{Content: "he's gone", Audience: message.AudienceMods})
+	drainSystemMessages(t, alice, 1)
+	drainSystemMessages(t, carol, 1)
+
+	// Nor does he find it in his backfill when he comes back.
+	bob, _ = dialJoinAndReadSession(t, ts.URL, "room1", "bob", sp.SessionID)
+	defer bob.Close(websocket.StatusNormalClosure, "")
+	backfill := readBackfill(t, bob)
+	if len(backfill.Messages) == 0 {
+		t.Fatal("expected a backfill")
+	}
+	for _, m := range backfill.Messages {
+		if m.Audience == message.AudienceMods {
+			t.Errorf("expected no moderators' messages in the guest's backfill, got %q", m.Content)
+		}
+	}
+	// Nor are they counted as unread: only the host's "hi all" is.
+	if p := readJoined(t, bob); p.Unread != 1 {
+		t.Errorf("expected 1 unread for the guest, got %d", p.Unread)
+	}
+}
+
+func TestHandlerModPrivileges(t *testing.T) {
+	ts, hub, _ := newHandlerTestServer(t, nil)
+	defer ts.Close()
+
+	alice := dialAndJoin(t, ts.URL, "room1", "alice")
+	defer alice.Close(websocket.StatusNormalClosure, "")
+	waitForClients(t, hub, "room1", 1)
+	drainSystemMessages(t, alice, 1) // "alice joined"
+	bob := dialAndJoin(t, ts.URL, "room1", "bob")
+	defer bob.Close(websocket.StatusNormalClosure, "")
+	waitForClients(t, hub, "room1", 2)
+	drainSystemMessages(t, alice, 1) // "bob joined"
+	drainSystemMessages(t, bob, 1)
+	carol, sp := dialJoinAndReadSession(t, ts.URL, "room1", "carol", "")
+	readMessage(t, carol) // history
+	if p := readJoined(t, carol); p.IsMod {
+		t.Error("expected a new guest not to be a moderator")
+	}
+	waitForClients(t, hub, "room1", 3)
+	drainSystemMessages(t, alice, 1) // "carol joined"
+	drainSystemMessages(t, bob, 1)
+	drainSystemMessages(t, carol, 1)
+
+	sendEnvelope(t, alice, "set_mod", SetModPayload{UserID: sp.UserID, Mod: true})
+	drainSystemMessages(t, alice, 1) // "carol is now a moderator"
+	drainSystemMessages(t, bob, 1)
+	drainSystemMessages(t, carol, 1)
+
+	for _, u := range hub.RoomUsers("room1") {
+		if u.Mod != (u.UserID == sp.UserID) {
+			t.Errorf("unexpected mod flag for %s: %v", u.Username, u.Mod)
+		}
+	}
+
+	// Guests can't take a moderator's name.
+	sendEnvelope(t, bob, "set_username", SetUsernamePayload{Username: "Carol"})
+	if got := readError(t, bob); got != hostNameError {
+		t.Errorf("expected %q, got %q", hostNameError, got)
+	}
+
+	// In a read-only room moderators may still post, guests may not.
+	sendEnvelope(t, alice, "set_read_only", ReadOnlyPayload{Enabled: true})
+	drainSystemMessages(t, alice, 1)
+	drainSystemMessages(t, bob, 1)
+	drainSystemMessages(t, carol, 1)
+	sendEnvelope(t, bob, "chat", ChatPayload{Content: "hello?"})
+	if got := readError(t, bob); got != readOnlyError {
+		t.Errorf("expected %q, got %q", readOnlyError, got)
+	}
+	sendEnvelope(t, carol, "chat", ChatPayload{Content: "questions after the talk"})
+	if _, msg := readMessage(t, bob); msg.Content != "questions after the talk" {
+		t.Fatalf("expected the moderator's chat, got %q", msg.Content)
+	}
+	drainSystemMessages(t, alice, 1)
+	drainSystemMessages(t, carol, 1)
+
+	// A moderator who reconnects is told so.
+	carol.Close(websocket.StatusNormalClosure, "")
+	waitForClients(t, hub, "room1", 2)
+	carol, sp2 := dialJoinAndReadSession(t, ts.URL, "room1", "carol", sp.SessionID)
+	defer carol.Close(websocket.StatusNormalClosure, "")
+	if !sp2.IsMod {
+		t.Error("expected is_mod in the resumed session payload")
+	}
+	readBackfill(t, carol)
+	if p := readJoined(t, carol); !p.IsMod {
+		t.Error("expected is_mod in the joined payload")
+	}
+}
@@ -3,10 +3,15 @@ package ws
 import (
 	"crypto/rand"
 	"encoding/hex"
+	"errors"
 	"sync"
 	"time"
 )
 
+// errSessionInUse is returned when a join names a session that another
+// connection still holds.
+var errSessionInUse = errors.New("session is already connected")
+
 // Session holds the state needed to resume a WebSocket connection.
 type Session struct {
 	ID        string
@@ -15,13 +20,34 @@ type Session struct {
 	RoomID    string
 	CreatedAt time.Time
 
+	// Status is the user's free-text status message, restored on resume.
+	Status string
+
 	// LastMessageID is the ID of the last message delivered to this session.
 	// Used to determine which messages to backfill on reconnect.
 	LastMessageID string
 
+	// LastSeq is the room sequence number of the last message delivered to
+	// this session. Unlike LastMessageID it remains meaningful after the
+	// message has been evicted from the store.
+	LastSeq int64
+
+	// LastReadSeq is the highest sequence number the user has marked as
+	// read. Chat messages after it count as unread.
+	LastReadSeq int64
+
+	// RoomClosed is set when the session's room is reaped. The session can
+	// no longer be resumed; it is kept until the TTL so a resume attempt
+	// can be told why.
+	RoomClosed bool
+
 	// disconnectedAt is set when the client disconnects. A zero value
 	// means the client is currently connected.
 	disconnectedAt time.Time
+
+	// gen is bumped each time a connection claims the session, so a
+	// connection that has been superseded cannot mark it disconnected.
+	gen uint64
 }
 
 // connected returns true if the session has an active connection.
@@ -55,6 +81,7 @@ func (ss *SessionStore) Create(userID, username, roomID string) *Session {
 		Username:  username,
 		RoomID:    roomID,
 		CreatedAt: time.Now(),
+		gen:       1,
 	}
 	ss.mu.Lock()
 	ss.sessions[id] = s
@@ -62,39 +89,80 @@ func (ss *SessionStore) Create(userID, username, roomID string) *Session {
 	return s
 }
 
-// Get returns the session with the given ID, or nil if not found or expired.
+// Get returns a copy of the session with the given ID, or nil if not found
+// or expired. A copy keeps readers safe from concurrent updates made by the
+// connection that holds the session.
 func (ss *SessionStore) Get(id string) *Session {
 	ss.mu.Lock()
 	defer ss.mu.Unlock()
-	return ss.sessions[id]
+	s, ok := ss.sessions[id]
+	if !ok {
+		return nil
+	}
+	cp := *s
+	return &cp
 }
 
-// MarkDisconnected records the time the client disconnected. The session
-// remains available for resumption until the TTL expires.
-func (ss *SessionStore) MarkDisconnected(id string) {
+// Release marks the session disconnected if gen still owns it; it stays
+// available for resumption until the TTL expires. A connection that was
+// taken over by a newer one leaves the session alone.
+func (ss *SessionStore) Release(id string, gen uint64) {
 	ss.mu.Lock()
 	defer ss.mu.Unlock()
-	if s, ok := ss.sessions[id]; ok {
+	if s, ok := ss.sessions[id]; ok && s.gen == gen {
 		s.disconnectedAt = time.Now()
 	}
 }
 
-// MarkConnected clears the disconnected timestamp, indicating the session
-// has been resumed.
-func (ss *SessionStore) MarkConnected(id string) {
+// Connected reports whether the session exists and has a live connection.
+func (ss *SessionStore) Connected(id string) bool {
 	ss.mu.Lock()
 	defer ss.mu.Unlock()
-	if s, ok := ss.sessions[id]; ok {
-		s.disconnectedAt = time.Time{}
+	s, ok := ss.sessions[id]
+	return ok && s.connected()
+}
+
+// Resume claims the session for a new connection in roomID and marks it
+// connected. The check and the claim happen under one lock, so of two
+// concurrent resumes of a disconnected session only one succeeds; the
+// other gets errSessionInUse. With takeover set, a connected session is
+// claimed anyway and its older connection loses ownership. It returns a
+// copy of the session and the generation identifying this claim, or a nil
+// session if there is no such session in roomID.
+func (ss *SessionStore) Resume(id, roomID string, takeover bool) (*Session, uint64, error) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	s, ok := ss.sessions[id]
+	if !ok || s.RoomID != roomID || s.RoomClosed {
+		return nil, 0, nil
+	}
+	if s.connected() && !takeover {
+		return nil, 0, errSessionInUse
 	}
+	s.disconnectedAt = time.Time{}
+	s.gen++
+	cp := *s
+	return &cp, s.gen, nil
 }
 
-// SetLastMessageID records the ID of the last message delivered to this session.
-func (ss *SessionStore) SetLastMessageID(id, messageID string) {
+// SetLastDelivered records the ID and sequence number of the last message
+// delivered to this session.
+func (ss *SessionStore) SetLastDelivered(id, messageID string, seq int64) {
 	ss.mu.Lock()
 	defer ss.mu.Unlock()
 	if s, ok := ss.sessions[id]; ok {
 		s.LastMessageID = messageID
+		s.LastSeq = seq
+	}
+}
+
+// SetLastRead records seq as the user's read position. The position only
+// moves forward.
+func (ss *SessionStore) SetLastRead(id string, seq int64) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if s, ok := ss.sessions[id]; ok && seq > s.LastReadSeq {
+		s.LastReadSeq = seq
 	}
 }
 
@@ -107,6 +175,27 @@ func (ss *SessionStore) SetUsername(id, username string) {
 	}
 }
 
+// SetStatus updates the status message for a session.
+func (ss *SessionStore) SetStatus(id, status string) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if s, ok := ss.sessions[id]; ok {
+		s.Status = status
+	}
+}
+
+// CloseRoom marks every session in roomID as belonging to a closed room,
+// so none of them can be resumed.
+func (ss *SessionStore) CloseRoom(roomID string) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	for _, s := range ss.sessions {
+		if s.RoomID == roomID {
+			s.RoomClosed = true
+		}
+	}
+}
+
 // Delete removes a session immediately.
 func (ss *SessionStore) Delete(id string) {
 	ss.mu.Lock()
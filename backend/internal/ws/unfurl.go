@@ -0,0 +1,376 @@
+package ws
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unicode/utf8"
+
+	"github.com/christopherjohns/chatsphere/internal/message"
+)
+
+const (
+	// unfurlTimeout bounds the whole fetch of a linked page.
+	unfurlTimeout = 5 * time.Second
+
+	// unfurlMaxBytes caps how much of a linked page is read.
+	unfurlMaxBytes = 256 << 10
+
+	// unfurlCacheSize is the number of URLs whose previews are cached.
+	unfurlCacheSize = 512
+)
+
+// LinkPreviewPayload is broadcast after a chat message containing a URL,
+// once the linked page's metadata has been fetched.
+type LinkPreviewPayload struct {
+	MessageID   string `json:"message_id"`
+	URL         string `json:"url"`
+	Title       string `json:"title"`
+	Description string `json:"description,omitempty"`
+	Image       string `json:"image,omitempty"`
+}
+
+// linkPreview is the cached metadata for a URL.
+type linkPreview struct {
+	Title       string
+	Description string
+	Image       string
+}
+
+// Unfurler fetches OpenGraph/title metadata for links posted in chat.
+// Hosts may be restricted with an allowlist and denylist, and connections
+// to private, loopback, link-local and other non-public addresses are
+// always refused to prevent SSRF against internal services.
+type Unfurler struct {
+	client *http.Client
+	allow  map[string]bool
+	deny   map[string]bool
+
+	mu       sync.Mutex
+	cache    map[string]*linkPreview // nil value = fetched, no preview
+	order    []string                // insertion order for eviction
+	inflight map[string]*unfurlCall  // fetches in progress, by URL
+
+	allowPrivate bool // for tests against local servers
+}
+
+// unfurlCall is a fetch in progress. Later callers for the same URL wait
+// on done and share its result rather than fetching again.
+type unfurlCall struct {
+	done chan struct{}
+	p    *linkPreview
+}
+
+// NewUnfurler creates an Unfurler. If allow is non-empty only those hosts
+// (and their subdomains) are fetched; hosts in deny never are.
+func NewUnfurler(allow, deny []string) *Unfurler {
+	u := &Unfurler{
+		allow:    hostSet(allow),
+		deny:     hostSet(deny),
+		cache:    make(map[string]*linkPreview),
+		inflight: make(map[string]*unfurlCall),
+	}
+	dialer := &net.Dialer{
+		Timeout: unfurlTimeout,
+		// Check the resolved address at connect time so DNS rebinding
+		// can't point an allowed name at an internal address.
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			ip := net.ParseIP(host)
+			if ip == nil || (!u.allowPrivate && !isPublicIP(ip)) {
+				return fmt.Errorf("unfurl: refusing to connect to %s", host)
+			}
+			return nil
+		},
+	}
+	u.client = &http.Client{
+		Timeout:   unfurlTimeout,
+		Transport: &http.Transport{DialContext: dialer.DialContext, Proxy: nil},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 3 {
+				return errors.New("unfurl: too many redirects")
+			}
+			if !u.hostAllowed(req.URL.Hostname()) {
+				return errors.New("unfurl: redirect to disallowed host")
+			}
+			return nil
+		},
+	}
+	return u
+}
+
+func hostSet(hosts []string) map[string]bool {
+	set := make(map[string]bool, len(hosts))
+	for _, h := range hosts {
+		set[strings.ToLower(strings.TrimSpace(h))] = true
+	}
+	return set
+}
+
+// matchHost reports whether host or one of its parent domains is in set.
+func matchHost(set map[string]bool, host string) bool {
+	for {
+		if set[host] {
+			return true
+		}
+		i := strings.IndexByte(host, '.')
+		if i < 0 {
+			return false
+		}
+		host = host[i+1:]
+	}
+}
+
+func (u *Unfurler) hostAllowed(host string) bool {
+	host = strings.ToLower(host)
+	if host == "" || matchHost(u.deny, host) {
+		return false
+	}
+	return len(u.allow) == 0 || matchHost(u.allow, host)
+}
+
+// nonPublicPrefixes are the address ranges link previews never connect
+// to: private, shared, loopback, link-local, documentation, benchmarking,
+// multicast and reserved space, and the IPv6 translation ranges that can
+// reach IPv4 addresses behind them.
+var nonPublicPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("10.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("127.0.0.0/8"),
+	netip.MustParsePrefix("169.254.0.0/16"),
+	netip.MustParsePrefix("172.16.0.0/12"),
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("192.0.2.0/24"),
+	netip.MustParsePrefix("192.168.0.0/16"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("198.51.100.0/24"),
+	netip.MustParsePrefix("203.0.113.0/24"),
+	netip.MustParsePrefix("224.0.0.0/4"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+	netip.MustParsePrefix("::/128"),
+	netip.MustParsePrefix("::1/128"),
+	netip.MustParsePrefix("64:ff9b::/96"),
+	netip.MustParsePrefix("64:ff9b:1::/48"),
+	netip.MustParsePrefix("100::/64"),
+	netip.MustParsePrefix("2001:db8::/32"),
+	netip.MustParsePrefix("2002::/16"),
+	netip.MustParsePrefix("fc00::/7"),
+	netip.MustParsePrefix("fe80::/10"),
+	netip.MustParsePrefix("ff00::/8"),
+}
+
+// isPublicIP reports whether ip is a globally routable address. IPv4
+// addresses mapped into IPv6 are checked as IPv4.
+func isPublicIP(ip net.IP) bool {
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, p := range nonPublicPrefixes {
+		if p.Contains(addr) {
+			return false
+		}
+	}
+	return true
+}
+
+// urlPattern matches http(s) links in chat text.
+var urlPattern = regexp.MustCompile(`https?://[^\s<>"']+`)
+
+// firstURL returns the first http(s) URL in s, or "" if there is none.
+func firstURL(s string) string {
+	return strings.TrimRight(urlPattern.FindString(s), ".,;:!?)]}")
+}
+
+// Preview returns metadata for rawURL, fetching it on a cache miss. ok is
+// false if the URL is disallowed, unreachable, or has no title. Concurrent
+// calls for the same URL share a single fetch.
+func (u *Unfurler) Preview(ctx context.Context, rawURL string) (*linkPreview, bool) {
+	u.mu.Lock()
+	if p, cached := u.cache[rawURL]; cached {
+		u.mu.Unlock()
+		return p, p != nil
+	}
+	if call, ok := u.inflight[rawURL]; ok {
+		u.mu.Unlock()
+		select {
+		case <-call.done:
+			return call.p, call.p != nil
+		case <-ctx.Done():
+			return nil, false
+		}
+	}
+	call := &unfurlCall{done: make(chan struct{})}
+	u.inflight[rawURL] = call
+	u.mu.Unlock()
+
+	p, err := u.fetch(ctx, rawURL)
+	if err != nil {
+		log.Printf("ws: unfurl %s: %v", rawURL, err)
+	}
+
+	u.mu.Lock()
+	if _, ok := u.cache[rawURL]; !ok {
+		if len(u.order) >= unfurlCacheSize {
+			delete(u.cache, u.order[0])
+			u.order = u.order[1:]
+		}
+		u.cache[rawURL] = p
+		u.order = append(u.order, rawURL)
+	}
+	delete(u.inflight, rawURL)
+	u.mu.Unlock()
+	call.p = p
+	close(call.done)
+	return p, p != nil
+}
+
+func (u *Unfurler) fetch(ctx context.Context, rawURL string) (*linkPreview, error) {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if parsed.Scheme != "http" && parsed.Scheme != "https" {
+		return nil, errors.New("unsupported scheme")
+	}
+	if !u.hostAllowed(parsed.Hostname()) {
+		return nil, errors.New("host not allowed")
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", "ChatSphere-LinkPreview/1.0")
+	req.Header.Set("Accept", "text/html")
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/html") {
+		return nil, fmt.Errorf("not an HTML page: %q", ct)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, unfurlMaxBytes))
+	if err != nil {
+		return nil, err
+	}
+	p := parsePreview(string(body))
+	if p.Title == "" {
+		return nil, nil
+	}
+	return p, nil
+}
+
+var (
+	metaTagPattern  = regexp.MustCompile(`(?is)<meta\s[^>]*>`)
+	metaAttrPattern = regexp.MustCompile(`(?is)(property|name|content)\s*=\s*(?:"([^"]*)"|'([^']*)')`)
+	titlePattern    = regexp.MustCompile(`(?is)<title[^>]*>(.*?)</title>`)
+)
+
+// parsePreview extracts OpenGraph metadata from an HTML document, falling
+// back to <title> and the description meta tag.
+func parsePreview(doc string) *linkPreview {
+	meta := make(map[string]string)
+	for _, tag := range metaTagPattern.FindAllString(doc, -1) {
+		var key, content string
+		for _, m := range metaAttrPattern.FindAllStringSubmatch(tag, -1) {
+			val := m[2] + m[3]
+			if strings.EqualFold(m[1], "content") {
+				content = val
+			} else {
+				key = strings.ToLower(val)
+			}
+		}
+		if key != "" && content != "" {
+			if _, dup := meta[key]; !dup {
+				meta[key] = html.UnescapeString(strings.TrimSpace(content))
+			}
+		}
+	}
+
+	p := &linkPreview{
+		Title:       meta["og:title"],
+		Description: meta["og:description"],
+	}
+	if img := meta["og:image"]; strings.HasPrefix(img, "https://") || strings.HasPrefix(img, "http://") {
+		p.Image = img
+	}
+	if p.Title == "" {
+		if m := titlePattern.FindStringSubmatch(doc); m != nil {
+			p.Title = html.UnescapeString(strings.TrimSpace(m[1]))
+		}
+	}
+	if p.Description == "" {
+		p.Description = meta["description"]
+	}
+	p.Title = truncateRunes(p.Title, 200)
+	p.Description = truncateRunes(p.Description, 500)
+	return p
+}
+
+// truncateRunes shortens s to at most n runes.
+func truncateRunes(s string, n int) string {
+	if utf8.RuneCountInString(s) <= n {
+		return s
+	}
+	return string([]rune(s)[:n])
+}
+
+// SetUnfurler enables link previews for chat messages. A nil Unfurler (the
+// default) disables them.
+func (h *Handler) SetUnfurler(u *Unfurler) {
+	h.unfurler = u
+}
+
+// sendLinkPreview fetches a preview for rawURL and broadcasts it to the
+// room as a follow-up to the message that contained the link. It runs in
+// its own goroutine so the original broadcast is never delayed.
+func (h *Handler) sendLinkPreview(roomID, messageID, rawURL string) {
+	ctx, cancel := context.WithTimeout(context.Background(), unfurlTimeout)
+	defer cancel()
+	p, ok := h.unfurler.Preview(ctx, rawURL)
+	if !ok {
+		return
+	}
+
+	data, err := json.Marshal(LinkPreviewPayload{
+		MessageID:   messageID,
+		URL:         rawURL,
+		Title:       p.Title,
+		Description: p.Description,
+		Image:       p.Image,
+	})
+	if err != nil {
+		log.Printf("ws: failed to marshal link preview: %v", err)
+		return
+	}
+	env, err := json.Marshal(Envelope{Type: string(message.TypeLinkPreview), Payload: data})
+	if err != nil {
+		log.Printf("ws: failed to marshal link preview envelope: %v", err)
+		return
+	}
+	h.hub.sendToRoom(roomID, env)
+}
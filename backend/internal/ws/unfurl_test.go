@@ -0,0 +1,168 @@
+package ws
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestFirstURL(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"no links here", ""},
+		{"see https://example.com/a?b=c.", "https://example.com/a?b=c"},
+		{"(http://example.com/x)", "http://example.com/x"},
+		{"ftp://example.com", ""},
+		{"two: https://a.example https://b.example", "https://a.example"},
+	}
+	for _, tt := range tests {
+		if got := firstURL(tt.in); got != tt.want {
+			t.Errorf("firstURL(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestParsePreview(t *testing.T) {
+	doc := `<html><head>
+		<title>Fallback Title</title>
+		<meta content="OG &amp; Title" property="og:title">
+		<meta property='og:description' content='A description'>
+		<meta property="og:image" content="javascript:alert(1)">
+	</head></html>`
+	p := parsePreview(doc)
+	if p.Title != "OG & Title" {
+		t.Errorf("expected og:title with entities decoded, got %q", p.Title)
+	}
+	if p.Description != "A description" {
+		t.Errorf("expected og:description, got %q", p.Description)
+	}
+	if p.Image != "" {
+		t.Errorf("expected non-http image to be dropped, got %q", p.Image)
+	}
+
+	p = parsePreview(`<title> Plain </title><meta name="description" content="Desc">`)
+	if p.Title != "Plain" || p.Description != "Desc" {
+		t.Errorf("expected title/description fallbacks, got %+v", p)
+	}
+}
+
+func TestUnfurlerHostRules(t *testing.T) {
+	u := NewUnfurler([]string{"example.com"}, []string{"bad.example.com"})
+	tests := []struct {
+		host string
+		want bool
+	}{
+		{"example.com", true},
+		{"www.example.com", true},
+		{"bad.example.com", false},
+		{"x.bad.example.com", false},
+		{"other.org", false},
+	}
+	for _, tt := range tests {
+		if got := u.hostAllowed(tt.host); got != tt.want {
+			t.Errorf("hostAllowed(%q) = %v, want %v", tt.host, got, tt.want)
+		}
+	}
+
+	for _, ip := range []string{
+		"127.0.0.1", "10.1.2.3", "192.168.0.1", "169.254.169.254", "::1", "0.0.0.0",
+		"0.1.2.3", "100.64.0.1", "192.0.0.8", "198.18.0.1", "64:ff9b::a00:1",
+		"::ffff:10.0.0.1", "fd00::1",
+	} {
+		if isPublicIP(net.ParseIP(ip)) {
+			t.Errorf("expected %s to be treated as internal", ip)
+		}
+	}
+	if !isPublicIP(net.ParseIP("93.184.216.34")) {
+		t.Error("expected public address to be allowed")
+	}
+}
+
+func TestUnfurlerRefusesLoopback(t *testing.T) {
+	var hits atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte("<title>secret</title>"))
+	}))
+	defer ts.Close()
+
+	u := NewUnfurler(nil, nil)
+	if _, ok := u.Preview(context.Background(), ts.URL); ok {
+		t.Error("expected preview of a loopback address to be refused")
+	}
+	if hits.Load() != 0 {
+		t.Error("expected no request to reach the loopback server")
+	}
+}
+
+func TestUnfurlerCachesPreviews(t *testing.T) {
+	var hits atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write([]byte("<title>Cached</title>"))
+	}))
+	defer ts.Close()
+
+	u := NewUnfurler(nil, nil)
+	u.allowPrivate = true
+	for i := 0; i < 3; i++ {
+		p, ok := u.Preview(context.Background(), ts.URL)
+		if !ok || p.Title != "Cached" {
+			t.Fatalf("expected preview, got %+v, %v", p, ok)
+		}
+	}
+	if n := hits.Load(); n != 1 {
+		t.Errorf("expected 1 fetch with caching, got %d", n)
+	}
+}
+
+func TestUnfurlerSharesInFlightFetch(t *testing.T) {
+	var hits atomic.Int32
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		<-release
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte("<title>Shared</title>"))
+	}))
+	defer ts.Close()
+
+	u := NewUnfurler(nil, nil)
+	u.allowPrivate = true
+	const n = 5
+	var wg sync.WaitGroup
+	results := make(chan bool, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p, ok := u.Preview(context.Background(), ts.URL)
+			results <- ok && p.Title == "Shared"
+		}()
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for hits.Load() == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	close(results)
+
+	for ok := range results {
+		if !ok {
+			t.Error("expected every caller to get the preview")
+		}
+	}
+	if n := hits.Load(); n != 1 {
+		t.Errorf("expected 1 fetch for concurrent previews, got %d", n)
+	}
+}
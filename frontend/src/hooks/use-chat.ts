@@ -73,24 +73,31 @@ export function useChat({ roomID, username }: UseChatOptions) {
     setTypingUsers(new Map());
   }, [roomID, username]);
 
+  const clearTyping = useCallback((userId: string) => {
+    setTypingUsers((prev) => {
+      if (!prev.has(userId)) return prev;
+      const next = new Map(prev);
+      next.delete(userId);
+      return next;
+    });
+    const timer = typingTimersRef.current.get(userId);
+    if (timer) {
+      clearTimeout(timer);
+      typingTimersRef.current.delete(userId);
+    }
+  }, []);
+
   const handleMessage = useCallback((envelope: Envelope) => {
     if (envelope.type === "message" || envelope.type === "chat") {
       const msg = envelope.payload as ChatMessage;
       setMessages((prev) => [...prev, msg]);
       // Clear typing indicator when user sends a message.
-      if (msg.user_id) {
-        setTypingUsers((prev) => {
-          if (!prev.has(msg.user_id!)) return prev;
-          const next = new Map(prev);
-          next.delete(msg.user_id!);
-          return next;
-        });
-        const timer = typingTimersRef.current.get(msg.user_id);
-        if (timer) {
-          clearTimeout(timer);
-          typingTimersRef.current.delete(msg.user_id);
-        }
-      }
+      if (msg.user_id) clearTyping(msg.user_id);
+      return;
+    }
+    if (envelope.type === "typing_stop") {
+      const payload = envelope.payload as TypingPayload;
+      clearTyping(payload.user_id);
       return;
     }
     if (envelope.type === "system") {
@@ -156,7 +163,7 @@ export function useChat({ roomID, username }: UseChatOptions) {
       typingTimersRef.current.set(payload.user_id, timer);
       return;
     }
-  }, []);
+  }, [clearTyping]);
 
   const handleHistoryBatch = useCallback(
     (batch: BackfillMessage[], more: boolean) => {
@@ -9,6 +9,7 @@ class MockWebSocket {
   static CLOSED = 3;
 
   url: string;
+  protocols: string[];
   readyState = MockWebSocket.OPEN;
   onopen: ((ev: Event) => void) | null = null;
   onclose: ((ev: CloseEvent) => void) | null = null;
@@ -18,8 +19,9 @@ class MockWebSocket {
   sent: string[] = [];
   closeCalled = false;
 
-  constructor(url: string) {
+  constructor(url: string, protocols: string[] = []) {
     this.url = url;
+    this.protocols = protocols;
     MockWebSocket.instances.push(this);
   }
 
@@ -87,6 +89,7 @@ describe("ReconnectingWS", () => {
 
     const sock = lastSocket();
     expect(sock.url).toBe("ws://localhost/ws");
+    expect(sock.protocols).toEqual(["chatsphere.v1"]);
 
     sock.simulateOpen();
     expect(sock.sent).toHaveLength(1);
@@ -404,6 +407,44 @@ describe("ReconnectingWS", () => {
     ws.disconnect();
   });
 
+  it("splits a batch envelope into individual onMessage calls", () => {
+    const onMessage = vi.fn();
+    const ws = new ReconnectingWS({
+      url: "ws://localhost/ws",
+      roomID: "room1",
+      onMessage,
+    });
+
+    ws.connect();
+    lastSocket().simulateOpen();
+    lastSocket().simulateMessage(sessionEnvelope());
+
+    lastSocket().simulateMessage({
+      type: "batch",
+      payload: [
+        { type: "chat", payload: { id: "msg-1", content: "one" } },
+        { type: "chat", payload: { id: "msg-2", content: "two" } },
+        { type: "typing", payload: { user_id: "user-1", username: "bob" } },
+      ],
+    });
+
+    expect(onMessage).toHaveBeenCalledTimes(3);
+    expect(onMessage).toHaveBeenNthCalledWith(1, {
+      type: "chat",
+      payload: { id: "msg-1", content: "one" },
+    });
+    expect(onMessage).toHaveBeenNthCalledWith(2, {
+      type: "chat",
+      payload: { id: "msg-2", content: "two" },
+    });
+    expect(onMessage).toHaveBeenNthCalledWith(3, {
+      type: "typing",
+      payload: { user_id: "user-1", username: "bob" },
+    });
+
+    ws.disconnect();
+  });
+
   it("does not call onMessage for empty backfill", () => {
     const onMessage = vi.fn();
     const ws = new ReconnectingWS({
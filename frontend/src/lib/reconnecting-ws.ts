@@ -15,6 +15,7 @@ export interface SessionPayload {
   username: string;
   resumed: boolean;
   is_creator: boolean;
+  is_host: boolean;
 }
 
 export interface BackfillMessage {
@@ -60,6 +61,10 @@ const DEFAULT_MAX_RETRIES = 10;
 const DEFAULT_BASE_DELAY = 500;
 const DEFAULT_MAX_DELAY = 30_000;
 
+// Envelope schema version, offered as the WebSocket subprotocol. Must match
+// the server's ws.Subprotocol.
+const SUBPROTOCOL = "chatsphere.v1";
+
 // Max number of message IDs to track for deduplication.
 const SEEN_IDS_LIMIT = 500;
 
@@ -138,7 +143,7 @@ export class ReconnectingWS {
   private openSocket(): void {
     if (this.disposed) return;
 
-    const ws = new WebSocket(this.opts.url);
+    const ws = new WebSocket(this.opts.url, [SUBPROTOCOL]);
     this.ws = ws;
 
     ws.onopen = () => {
@@ -159,53 +164,7 @@ export class ReconnectingWS {
         return;
       }
 
-      if (envelope.type === "session") {
-        const session = envelope.payload as SessionPayload;
-        this.sessionID = session.session_id;
-        this.retryCount = 0;
-        this.setState("connected");
-        this.opts.onSession?.(session);
-        return;
-      }
-
-      if (envelope.type === "history") {
-        const messages = envelope.payload as BackfillMessage[];
-        for (const msg of messages) {
-          if (this.seenIDs.has(msg.id)) continue;
-          this.trackMessageID(msg.id);
-          this.opts.onMessage?.({ type: msg.type, payload: msg });
-        }
-        return;
-      }
-
-      if (envelope.type === "history_batch") {
-        const batch = envelope.payload as HistoryBatchPayload;
-        for (const msg of batch.messages) {
-          this.trackMessageID(msg.id);
-        }
-        this.opts.onHistoryBatch?.(batch.messages, batch.has_more);
-        return;
-      }
-
-      if (envelope.type === "backfill") {
-        const backfill = envelope.payload as BackfillPayload;
-        if (backfill.has_gap) {
-          this.opts.onBackfillGap?.();
-        }
-        for (const msg of backfill.messages) {
-          if (this.seenIDs.has(msg.id)) continue;
-          this.trackMessageID(msg.id);
-          this.opts.onMessage?.({ type: msg.type, payload: msg });
-        }
-        return;
-      }
-
-      // Track IDs for regular messages too.
-      const msgPayload = envelope.payload as { id?: string };
-      if (msgPayload?.id) {
-        this.trackMessageID(msgPayload.id);
-      }
-      this.opts.onMessage?.(envelope);
+      this.handleEnvelope(envelope);
     };
 
     ws.onclose = (event: CloseEvent) => {
@@ -226,6 +185,64 @@ export class ReconnectingWS {
     };
   }
 
+  private handleEnvelope(envelope: Envelope): void {
+    // The server may coalesce queued envelopes into one batch frame.
+    if (envelope.type === "batch") {
+      for (const inner of envelope.payload as Envelope[]) {
+        this.handleEnvelope(inner);
+      }
+      return;
+    }
+
+    if (envelope.type === "session") {
+      const session = envelope.payload as SessionPayload;
+      this.sessionID = session.session_id;
+      this.retryCount = 0;
+      this.setState("connected");
+      this.opts.onSession?.(session);
+      return;
+    }
+
+    if (envelope.type === "history") {
+      const messages = envelope.payload as BackfillMessage[];
+      for (const msg of messages) {
+        if (this.seenIDs.has(msg.id)) continue;
+        this.trackMessageID(msg.id);
+        this.opts.onMessage?.({ type: msg.type, payload: msg });
+      }
+      return;
+    }
+
+    if (envelope.type === "history_batch") {
+      const batch = envelope.payload as HistoryBatchPayload;
+      for (const msg of batch.messages) {
+        this.trackMessageID(msg.id);
+      }
+      this.opts.onHistoryBatch?.(batch.messages, batch.has_more);
+      return;
+    }
+
+    if (envelope.type === "backfill") {
+      const backfill = envelope.payload as BackfillPayload;
+      if (backfill.has_gap) {
+        this.opts.onBackfillGap?.();
+      }
+      for (const msg of backfill.messages) {
+        if (this.seenIDs.has(msg.id)) continue;
+        this.trackMessageID(msg.id);
+        this.opts.onMessage?.({ type: msg.type, payload: msg });
+      }
+      return;
+    }
+
+    // Track IDs for regular messages too.
+    const msgPayload = envelope.payload as { id?: string };
+    if (msgPayload?.id) {
+      this.trackMessageID(msgPayload.id);
+    }
+    this.opts.onMessage?.(envelope);
+  }
+
   private sendJoin(): void {
     const payload: Record<string, string> = { room_id: this.opts.roomID };
     if (this.opts.username) {